@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/mail"
+	"strings"
+)
+
+// errInvalidResetToken is returned for unknown, used and expired reset tokens alike.
+var errInvalidResetToken = errors.New("invalid or expired reset token")
+
+// forgotPassword emails a password reset link to the posted address, if it
+// belongs to an account. The response is the same either way, so that the
+// endpoint can't be used to find out who is signed up.
+func (app *application) forgotPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if _, err := mail.ParseAddress(payload.Email); err != nil {
+		app.errorJSON(w, errors.New("a valid email address is required"), http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), payload.Email)
+	if err == nil {
+		if err := app.Accounts.SendPasswordReset(r.Context(), user); err != nil {
+			app.Logger.ErrorContext(r.Context(), "sending password reset", "user_id", user.ID, "error", err)
+		}
+	}
+
+	_ = app.writeJSON(w, http.StatusAccepted, map[string]string{
+		"message": "if that address belongs to an account, a reset link has been sent to it",
+	})
+}
+
+// resetPassword spends a password reset token and sets the new password. Every
+// refresh token the user holds stops working.
+func (app *application) resetPassword(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if len(payload.Password) < data.MinPasswordLength {
+		app.errorJSON(w, fmt.Errorf("password must be at least %d characters long", data.MinPasswordLength), http.StatusBadRequest)
+		return
+	}
+
+	token, err := app.DB.UseToken(r.Context(), data.ScopePasswordReset, payload.Token)
+	if err != nil {
+		app.errorJSON(w, errInvalidResetToken, http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.ResetPassword(r.Context(), token.UserID, payload.Password)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// errEmailNotVerified is returned when a user with the right password hasn't
+// confirmed their email address yet.
+var errEmailNotVerified = errors.New("email address not verified")
+
+// registration is the JSON payload used to sign up.
+type registration struct {
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name"`
+	Email     string `json:"email"`
+	Password  string `json:"password"`
+}
+
+// validateRegistration checks a registration, including that the email address isn't taken.
+func (app *application) validateRegistration(ctx context.Context, reg registration) error {
+	if strings.TrimSpace(reg.FirstName) == "" || strings.TrimSpace(reg.LastName) == "" {
+		return errors.New("first_name and last_name are required")
+	}
+
+	if addr, err := mail.ParseAddress(reg.Email); err != nil || addr.Address != reg.Email {
+		return errors.New("a valid email address is required")
+	}
+
+	if len(reg.Password) < data.MinPasswordLength {
+		return fmt.Errorf("password must be at least %d characters long", data.MinPasswordLength)
+	}
+
+	if _, err := app.DB.GetUserByEmail(ctx, reg.Email); err == nil {
+		return errors.New("an account with this email address already exists")
+	}
+
+	return nil
+}
+
+// register creates an unverified account, and emails a link to verify its
+// address. The account can't authenticate until the link is followed.
+func (app *application) register(w http.ResponseWriter, r *http.Request) {
+	var reg registration
+
+	err := app.readJSON(w, r, &reg)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.validateRegistration(r.Context(), reg); err != nil {
+		app.errorJSON(w, err, http.StatusUnprocessableEntity)
+		return
+	}
+
+	user := data.User{
+		FirstName: reg.FirstName,
+		LastName:  reg.LastName,
+		Email:     reg.Email,
+		Password:  reg.Password,
+	}
+
+	user.ID, err = app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Accounts.SendEmailVerification(r.Context(), &user); err != nil {
+		app.Logger.ErrorContext(r.Context(), "sending email verification", "user_id", user.ID, "error", err)
+	}
+
+	_ = app.writeJSON(w, http.StatusCreated, user)
+}
+
+// verifyEmail spends an email verification token, for clients that handle the
+// link from the email themselves.
+func (app *application) verifyEmail(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Token string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	token, err := app.DB.UseToken(r.Context(), data.ScopeEmailVerification, payload.Token)
+	if err != nil {
+		app.errorJSON(w, errors.New("invalid or expired verification token"), http.StatusBadRequest)
+		return
+	}
+
+	err = app.DB.VerifyEmail(r.Context(), token.UserID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// resetLink matches the token of a password reset link in a sent email
+var resetLink = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// lastResetToken returns the token of the last password reset link mailed, if any
+func lastResetToken() string {
+	matches := resetLink.FindAllStringSubmatch(testMail.String(), -1)
+	if len(matches) == 0 {
+		return ""
+	}
+
+	return matches[len(matches)-1][1]
+}
+
+func Test_app_forgotPassword(t *testing.T) {
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+		expectMail         bool
+	}{
+		{"known account", `{"email":"admin@example.com"}`, http.StatusAccepted, true},
+		{"unknown account", `{"email":"nobody@example.com"}`, http.StatusAccepted, false},
+		{"invalid email", `{"email":"nobody"}`, http.StatusBadRequest, false},
+		{"not json", `I'm not JSON`, http.StatusBadRequest, false},
+	}
+
+	for _, e := range tests {
+		testMail.Reset()
+
+		req, _ := http.NewRequest("POST", "/forgot-password", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.forgotPassword).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if sent := lastResetToken() != ""; sent != e.expectMail {
+			t.Errorf("%s: expected mail sent to be %v, got %v", e.name, e.expectMail, sent)
+		}
+	}
+}
+
+func Test_app_resetPassword(t *testing.T) {
+	testMail.Reset()
+
+	req, _ := http.NewRequest("POST", "/forgot-password", strings.NewReader(`{"email":"admin@example.com"}`))
+	http.HandlerFunc(app.forgotPassword).ServeHTTP(httptest.NewRecorder(), req)
+
+	token := lastResetToken()
+	if token == "" {
+		t.Fatal("expected a password reset link to be mailed")
+	}
+
+	// a second request replaces the first link
+	req, _ = http.NewRequest("POST", "/forgot-password", strings.NewReader(`{"email":"admin@example.com"}`))
+	http.HandlerFunc(app.forgotPassword).ServeHTTP(httptest.NewRecorder(), req)
+
+	oldToken, token := token, lastResetToken()
+
+	// the reset must also log the user out everywhere
+	tokens, err := app.generateTokenPair(context.Background(), &data.User{ID: 1, Email: "admin@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"password too short", `{"token":"` + token + `","password":"short"}`, http.StatusBadRequest},
+		{"replaced token", `{"token":"` + oldToken + `","password":"new password"}`, http.StatusBadRequest},
+		{"unknown token", `{"token":"not-a-token","password":"new password"}`, http.StatusBadRequest},
+		{"valid", `{"token":"` + token + `","password":"new password"}`, http.StatusNoContent},
+		{"token already used", `{"token":"` + token + `","password":"new password"}`, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/reset-password", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.resetPassword).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+
+	claims, err := app.parseRefreshToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := app.rotateRefreshToken(context.Background(), claims); err == nil {
+		t.Error("expected the refresh token to be revoked by the password reset")
+	}
+}
+
+// verifyLink matches the token of an email verification link in a sent email
+var verifyLink = regexp.MustCompile(`/verify-email\?token=([A-Za-z0-9_-]+)`)
+
+func Test_app_register(t *testing.T) {
+	var tests = []struct {
+		name               string
+		requestBody        string
+		expectedStatusCode int
+	}{
+		{"valid", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","password":"long enough"}`, http.StatusCreated},
+		{"missing name", `{"first_name":"","last_name":"Doe","email":"jane@example.com","password":"long enough"}`, http.StatusUnprocessableEntity},
+		{"invalid email", `{"first_name":"Jane","last_name":"Doe","email":"Jane <jane@example.com>","password":"long enough"}`, http.StatusUnprocessableEntity},
+		{"email taken", `{"first_name":"Jane","last_name":"Doe","email":"admin@example.com","password":"long enough"}`, http.StatusUnprocessableEntity},
+		{"password too short", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","password":"short"}`, http.StatusUnprocessableEntity},
+		{"unknown field", `{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","password":"long enough","is_admin":1}`, http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		testMail.Reset()
+
+		req, _ := http.NewRequest("POST", "/register", strings.NewReader(e.requestBody))
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.register).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d: %s", e.name, e.expectedStatusCode, rr.Code, rr.Body.String())
+		}
+
+		sent := verifyLink.MatchString(testMail.String())
+		if sent != (rr.Code == http.StatusCreated) {
+			t.Errorf("%s: expected a verification mail only on success, sent is %v", e.name, sent)
+		}
+
+		if rr.Code == http.StatusCreated && strings.Contains(rr.Body.String(), "email_verified_at") {
+			t.Errorf("%s: expected a new account to be unverified, got %s", e.name, rr.Body.String())
+		}
+	}
+}
+
+func Test_app_verifyEmail(t *testing.T) {
+	testMail.Reset()
+
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(`{"first_name":"Jane","last_name":"Doe","email":"jane@example.com","password":"long enough"}`))
+	http.HandlerFunc(app.register).ServeHTTP(httptest.NewRecorder(), req)
+
+	matches := verifyLink.FindStringSubmatch(testMail.String())
+	if matches == nil {
+		t.Fatal("expected a verification link to be mailed")
+	}
+
+	var tests = []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"valid", matches[1], http.StatusNoContent},
+		{"already used", matches[1], http.StatusBadRequest},
+		{"unknown", "not-a-token", http.StatusBadRequest},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/verify-email", strings.NewReader(`{"token":"`+e.token+`"}`))
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.verifyEmail).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+	}
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"errors"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -31,37 +34,67 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// turn away locked out accounts and addresses before looking at the password
+	if !app.checkLockout(w, r, creds.Username) {
+		return
+	}
+
 	// look up the user by email address
-	user, err := app.DB.GetUserByEmail(creds.Username)
+	user, err := app.DB.GetUserByEmail(r.Context(), creds.Username)
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.loginFailed(w, r, creds.Username, errors.New("unauthorized"))
 		return
 	}
 
 	// check password
 	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(creds.Password))
 	if err != nil {
-		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		app.loginFailed(w, r, creds.Username, errors.New("unauthorized"))
+		return
+	}
+
+	// the password is right, so it's safe to say what else is wrong
+	if !user.EmailVerified() {
+		app.errorJSON(w, errEmailNotVerified, http.StatusForbidden)
+		return
+	}
+
+	// with two-factor authentication on, the password only earns a token that
+	// verifyMFA exchanges for a token pair, together with a code
+	if user.TOTPEnabled {
+		mfaToken, err := app.issueMFAToken(user)
+		if err != nil {
+			app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+			return
+		}
+
+		_ = app.writeJSON(w, http.StatusAccepted, MFAChallenge{MFARequired: true, MFAToken: mfaToken})
 		return
 	}
 
 	// generate tokens
-	tokenPairs, err := app.generateTokenPair(user)
+	tokenPairs, err := app.generateTokenPair(r.Context(), user)
 	if err != nil {
 		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
 		return
 	}
 
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+	app.Metrics.AuthAttempt(metrics.AuthSuccess)
+	app.Metrics.TokenIssued(metrics.TokenLogin)
+
 	http.SetCookie(w, &http.Cookie{
 		Name:     "refresh_token",
 		Path:     "/",
 		Value:    tokenPairs.RefreshToken,
 		Expires:  time.Now().Add(refreshTokenExpiry),
 		MaxAge:   int(refreshTokenExpiry.Seconds()),
-		Domain:   "localhost",
+		Domain:   app.CookieDomain,
 		SameSite: http.SameSiteStrictMode,
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   app.CookieSecure,
 	})
 
 	// send token to user
@@ -70,7 +103,7 @@ func (app *application) authenticate(w http.ResponseWriter, r *http.Request) {
 
 // refresh is the handler called to request a new token pair, when
 // the jwt token has expired. We expect the refresh token to come
-// from a POST request. We validate it, look up the user in the db,
+// from a POST request. We validate it, spend it, look up the user in the db,
 // and if everything is good we send back a new token pair
 // as JSON. We also set an http only, secure cookie with the refresh
 // token stored inside.
@@ -82,12 +115,8 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 	}
 
 	refreshToken := r.Form.Get("refresh_token")
-	claims := &Claims{}
-
-	_, err = jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (interface{}, error) {
-		return []byte(app.JWTSecret), nil
-	})
 
+	claims, err := app.parseRefreshToken(refreshToken)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
@@ -98,22 +127,9 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// get the user id from the claims
-	userID, err := strconv.Atoi(claims.Subject)
-	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
-		return
-	}
-
-	user, err := app.DB.GetUser(userID)
-	if err != nil {
-		app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
-		return
-	}
-
-	tokenPairs, err := app.generateTokenPair(user)
+	tokenPairs, err := app.rotateRefreshToken(r.Context(), claims)
 	if err != nil {
-		app.errorJSON(w, err, http.StatusBadRequest)
+		app.errorJSON(w, err, refreshErrorStatus(err))
 		return
 	}
 
@@ -123,48 +139,30 @@ func (app *application) refresh(w http.ResponseWriter, r *http.Request) {
 		Value:    tokenPairs.RefreshToken,
 		Expires:  time.Now().Add(refreshTokenExpiry),
 		MaxAge:   int(refreshTokenExpiry.Seconds()),
-		Domain:   "localhost",
+		Domain:   app.CookieDomain,
 		SameSite: http.SameSiteStrictMode,
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   app.CookieSecure,
 	})
 
 	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
 }
 
 // refreshUsingCookie is the handler called to request a new token pair, when
+// the refresh token is kept in an http only cookie rather than by the client.
 func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Request) {
 
 	for _, cookie := range r.Cookies() {
 		if cookie.Name == "refresh_token" {
-			claims := &Claims{}
-			refreshToken := cookie.Value
-
-			_, err := jwt.ParseWithClaims(refreshToken, claims, func(token *jwt.Token) (interface{}, error) {
-				return []byte(app.JWTSecret), nil
-			})
-
-			if err != nil {
-				app.errorJSON(w, err, http.StatusBadRequest)
-				return
-			}
-
-			// get the user id from the claims
-			userID, err := strconv.Atoi(claims.Subject)
+			claims, err := app.parseRefreshToken(cookie.Value)
 			if err != nil {
 				app.errorJSON(w, err, http.StatusBadRequest)
 				return
 			}
 
-			user, err := app.DB.GetUser(userID)
+			tokenPairs, err := app.rotateRefreshToken(r.Context(), claims)
 			if err != nil {
-				app.errorJSON(w, errors.New("unknown user"), http.StatusBadRequest)
-				return
-			}
-
-			tokenPairs, err := app.generateTokenPair(user)
-			if err != nil {
-				app.errorJSON(w, err, http.StatusBadRequest)
+				app.errorJSON(w, err, refreshErrorStatus(err))
 				return
 			}
 
@@ -174,10 +172,10 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 				Value:    tokenPairs.RefreshToken,
 				Expires:  time.Now().Add(refreshTokenExpiry),
 				MaxAge:   int(refreshTokenExpiry.Seconds()),
-				Domain:   "localhost",
+				Domain:   app.CookieDomain,
 				SameSite: http.SameSiteStrictMode,
 				HttpOnly: true,
-				Secure:   true,
+				Secure:   app.CookieSecure,
 			})
 
 			_ = app.writeJSON(w, http.StatusOK, tokenPairs)
@@ -190,18 +188,101 @@ func (app *application) refreshUsingCookie(w http.ResponseWriter, r *http.Reques
 
 }
 
-// allUsers returns a list of all users as JSON
+// refreshErrorStatus picks the status code for an error returned by rotateRefreshToken.
+func refreshErrorStatus(err error) int {
+	if errors.Is(err, errRefreshTokenRevoked) || errors.Is(err, errRefreshTokenUnknown) {
+		return http.StatusUnauthorized
+	}
+
+	return http.StatusBadRequest
+}
+
+// allUsers returns one page of users as JSON, along with the total number of
+// matching users and the cursor for the next page. See parseUserQuery for the
+// supported query string parameters.
 func (app *application) allUsers(w http.ResponseWriter, r *http.Request) {
-	users, err := app.DB.AllUsers()
+	q, err := parseUserQuery(r.URL.Query())
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
-	_ = app.writeJSON(w, http.StatusOK, users)
+	page, err := app.DB.ListUsers(r.Context(), q)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, page)
+}
+
+// parseUserQuery builds a data.UserQuery from the query string of a user
+// listing request. It understands limit, offset, cursor, email, name, is_admin,
+// created_after, created_before and sort, where sort is a field name that may
+// be prefixed with "-" to sort in descending order.
+func parseUserQuery(v url.Values) (data.UserQuery, error) {
+	var q data.UserQuery
+	var err error
+
+	if s := v.Get("limit"); s != "" {
+		if q.Limit, err = strconv.Atoi(s); err != nil {
+			return q, errors.New("limit must be a number")
+		}
+	}
+
+	if s := v.Get("offset"); s != "" {
+		if q.Offset, err = strconv.Atoi(s); err != nil {
+			return q, errors.New("offset must be a number")
+		}
+	}
+
+	q.Cursor = v.Get("cursor")
+	q.Email = v.Get("email")
+	q.Name = v.Get("name")
+
+	if s := v.Get("is_admin"); s != "" {
+		isAdmin, err := strconv.ParseBool(s)
+		if err != nil {
+			return q, errors.New("is_admin must be true or false")
+		}
+		q.IsAdmin = new(int)
+		if isAdmin {
+			*q.IsAdmin = 1
+		}
+	}
+
+	if q.CreatedAfter, err = parseQueryTime(v.Get("created_after")); err != nil {
+		return q, errors.New("created_after must be a date or an RFC 3339 timestamp")
+	}
+
+	if q.CreatedBefore, err = parseQueryTime(v.Get("created_before")); err != nil {
+		return q, errors.New("created_before must be a date or an RFC 3339 timestamp")
+	}
+
+	if s := v.Get("sort"); s != "" {
+		q.SortDesc = strings.HasPrefix(s, "-")
+		q.SortBy = strings.TrimPrefix(s, "-")
+	}
+
+	return q, q.Normalize()
+}
+
+// parseQueryTime parses either a plain date or a full RFC 3339 timestamp. An
+// empty string yields the zero time.
+func parseQueryTime(s string) (time.Time, error) {
+	if s == "" {
+		return time.Time{}, nil
+	}
+
+	if t, err := time.Parse("2006-01-02", s); err == nil {
+		return t, nil
+	}
+
+	return time.Parse(time.RFC3339, s)
 }
 
-// getUser returns one user as JSON
+// getUser returns one user as JSON. Users without the users:read permission may
+// only read their own record.
 func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
 	if err != nil {
@@ -209,7 +290,12 @@ func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	user, err := app.DB.GetUser(userID)
+	if !app.canAccessUser(r, data.PermUsersRead, userID) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
@@ -218,7 +304,10 @@ func (app *application) getUser(w http.ResponseWriter, r *http.Request) {
 	_ = app.writeJSON(w, http.StatusOK, user)
 }
 
-// updateUser updates a user from a JSON payload, and returns just a header
+// updateUser updates a user from a JSON payload, and returns just a header.
+// Users without the users:update permission may only update their own record,
+// and may not change whether they are an admin; a new email address of theirs
+// has to be confirmed before they can log in again.
 func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
 	var user data.User
 	err := app.readJSON(w, r, &user)
@@ -227,15 +316,58 @@ func (app *application) updateUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.UpdateUser(user)
+	if !app.canAccessUser(r, data.PermUsersUpdate, user.ID) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	// admins are trusted with addresses, as when they create users
+	emailChanged := false
+	if claims := claimsFromContext(r.Context()); !claims.HasPermission(data.PermUsersUpdate) {
+		current, err := app.DB.GetUser(r.Context(), user.ID)
+		if err != nil {
+			app.errorJSON(w, err, http.StatusBadRequest)
+			return
+		}
+
+		if user.IsAdmin != current.IsAdmin {
+			app.errorJSON(w, errors.New("forbidden: cannot change admin status"), http.StatusForbidden)
+			return
+		}
+
+		emailChanged = !strings.EqualFold(user.Email, current.Email)
+	}
+
+	err = app.DB.UpdateUser(r.Context(), user)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
 	}
 
+	if emailChanged {
+		if err := app.DB.UnverifyEmail(r.Context(), user.ID); err != nil {
+			app.Logger.ErrorContext(r.Context(), "unverifying email", "user_id", user.ID, "error", err)
+		}
+
+		if err := app.Accounts.SendEmailVerification(r.Context(), &user); err != nil {
+			app.Logger.ErrorContext(r.Context(), "sending email verification", "user_id", user.ID, "error", err)
+		}
+	}
+
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// canAccessUser reports whether the access token in the request either grants
+// permission, or belongs to the user with id userID.
+func (app *application) canAccessUser(r *http.Request, permission string, userID int) bool {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return false
+	}
+
+	return claims.HasPermission(permission) || claims.IsSubject(userID)
+}
+
 // deleteUser deletes one user based on ID in URL, and returns a header
 func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
@@ -244,7 +376,7 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	err = app.DB.DeleteUser(userID)
+	err = app.DB.DeleteUser(r.Context(), userID)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
@@ -253,7 +385,8 @@ func (app *application) deleteUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
-// insertUser inserts a user using a JSON payload, and returns a header
+// insertUser inserts a user using a JSON payload, and returns a header. Users
+// created this way count as having verified their email address.
 func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
 	var user data.User
 	err := app.readJSON(w, r, &user)
@@ -262,7 +395,13 @@ func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	_, err = app.DB.InsertUser(user)
+	// accounts created by an admin don't need to verify their address
+	if user.EmailVerifiedAt == nil {
+		now := time.Now()
+		user.EmailVerifiedAt = &now
+	}
+
+	_, err = app.DB.InsertUser(r.Context(), user)
 	if err != nil {
 		app.errorJSON(w, err, http.StatusBadRequest)
 		return
@@ -271,20 +410,43 @@ func (app *application) insertUser(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteRefreshCookie logs the user out: the refresh token family in the cookie
+// is revoked server-side, so that copies of the token stop working too, and the
+// cookie itself is deleted.
 func (app *application) deleteRefreshCookie(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie("refresh_token"); err == nil {
+		// an expired token still identifies its family, which may hold live tokens
+		claims, err := app.parseRefreshToken(cookie.Value, jwt.WithoutClaimsValidation())
+		if err == nil && claims.FamilyID != "" {
+			if err := app.DB.RevokeRefreshTokenFamily(r.Context(), claims.FamilyID); err != nil {
+				app.errorJSON(w, err, http.StatusInternalServerError)
+				return
+			}
+		}
+	}
+
 	delCookie := http.Cookie{
 		Name:     "refresh_token",
 		Path:     "/",
 		Value:    "",
 		Expires:  time.Unix(0, 0),
 		MaxAge:   -1,
-		Domain:   "localhost",
+		Domain:   app.CookieDomain,
 		SameSite: http.SameSiteStrictMode,
 		HttpOnly: true,
-		Secure:   true,
+		Secure:   app.CookieSecure,
 	}
 
 	http.SetCookie(w, &delCookie)
 
 	w.WriteHeader(http.StatusAccepted)
 }
+
+// jwks publishes the public half of every signing key as a JSON Web Key Set.
+// Clients may cache it for a while, but must refetch it when they see a token
+// with an unknown kid.
+func (app *application) jwks(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Cache-Control", "public, max-age=300")
+
+	_ = app.writeJSON(w, http.StatusOK, app.Keys.JWKS())
+}
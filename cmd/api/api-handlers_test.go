@@ -2,8 +2,13 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/keyring"
 	"github.com/go-chi/chi/v5"
+	"github.com/golang-jwt/jwt/v4"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -25,6 +30,8 @@ func Test_app_authenticate(t *testing.T) {
 		{"empty email", `{"email":""}`, http.StatusUnauthorized},
 		{"empty password", `{"email":"admin@example.com"}`, http.StatusUnauthorized},
 		{"invalid user", `{"email":"admin@someotherdomain.com","password":"secret"}`, http.StatusUnauthorized},
+		{"email not verified", `{"email":"unverified@example.com","password":"secret"}`, http.StatusForbidden},
+		{"email not verified, wrong password", `{"email":"unverified@example.com","password":"wrong"}`, http.StatusUnauthorized},
 	}
 
 	for _, e := range theTests {
@@ -69,7 +76,7 @@ func Test_app_refresh(t *testing.T) {
 			if e.resetRefreshTime {
 				refreshTokenExpiry = time.Second * 1
 			}
-			tokens, _ := app.generateTokenPair(&testUser)
+			tokens, _ := app.generateTokenPair(context.Background(), &testUser)
 			tkn = tokens.RefreshToken
 		} else {
 			tkn = e.token
@@ -174,6 +181,8 @@ func Test_app_userHandlers(t *testing.T) {
 			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
 		}
 
+		req = addClaimsToRequest(req, adminClaims)
+
 		rr := httptest.NewRecorder()
 		handler := http.HandlerFunc(e.handler)
 		handler.ServeHTTP(rr, req)
@@ -194,7 +203,7 @@ func Test_app_refreshUsingCookie(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
 
 	// Create a cookie with the refresh token.
 	testCookie := &http.Cookie{
@@ -280,3 +289,404 @@ func Test_app_deleteRefreshCookie(t *testing.T) {
 	}
 
 }
+
+// Test_app_userHandlersCancelledContext makes sure that the request context
+// reaches the repository, so that a client disconnect stops the query.
+func Test_app_userHandlersCancelledContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", "1")
+	ctx = context.WithValue(ctx, chi.RouteCtxKey, chiCtx)
+
+	req, _ := http.NewRequestWithContext(ctx, "GET", "/", nil)
+	req = addClaimsToRequest(req, adminClaims)
+	rr := httptest.NewRecorder()
+
+	handler := http.HandlerFunc(app.getUser)
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a cancelled request but got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+// Test_app_allUsersPagination tests filtering, sorting and paging of the user listing.
+func Test_app_allUsersPagination(t *testing.T) {
+	var tests = []struct {
+		name           string
+		query          string
+		expectedStatus int
+		expectedIDs    []int
+		expectedTotal  int
+		expectCursor   bool
+	}{
+		{"default sort", "", http.StatusOK, []int{4, 2, 3, 1}, 4, false},
+		{"limit", "?limit=2&sort=id", http.StatusOK, []int{1, 2}, 4, true},
+		{"offset", "?limit=2&offset=2&sort=id", http.StatusOK, []int{3, 4}, 4, false},
+		{"descending", "?sort=-created_at", http.StatusOK, []int{4, 3, 2, 1}, 4, false},
+		{"email filter", "?email=JACK", http.StatusOK, []int{2}, 1, false},
+		{"name filter", "?name=smith&sort=first_name", http.StatusOK, []int{2, 3}, 2, false},
+		{"is_admin filter", "?is_admin=true", http.StatusOK, []int{1}, 1, false},
+		{"created range", "?created_after=2022-09-01&created_before=2023-01-01&sort=id", http.StatusOK, []int{2, 3}, 2, false},
+		{"bad sort field", "?sort=password", http.StatusBadRequest, nil, 0, false},
+		{"bad limit", "?limit=1000", http.StatusBadRequest, nil, 0, false},
+		{"bad is_admin", "?is_admin=maybe", http.StatusBadRequest, nil, 0, false},
+		{"bad date", "?created_after=yesterday", http.StatusBadRequest, nil, 0, false},
+		{"bad cursor", "?cursor=not-a-cursor", http.StatusBadRequest, nil, 0, false},
+		{"cursor and offset", "?cursor=abc&offset=1", http.StatusBadRequest, nil, 0, false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/users"+e.query, nil)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(app.allUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d but got %d", e.name, e.expectedStatus, rr.Code)
+			continue
+		}
+
+		if e.expectedStatus != http.StatusOK {
+			continue
+		}
+
+		var page data.UserPage
+		if err := json.NewDecoder(rr.Body).Decode(&page); err != nil {
+			t.Errorf("%s: could not decode response: %s", e.name, err)
+			continue
+		}
+
+		if page.Total != e.expectedTotal {
+			t.Errorf("%s: expected total %d but got %d", e.name, e.expectedTotal, page.Total)
+		}
+
+		if (page.NextCursor != "") != e.expectCursor {
+			t.Errorf("%s: expected next cursor %v but got %q", e.name, e.expectCursor, page.NextCursor)
+		}
+
+		var ids []int
+		for _, u := range page.Users {
+			ids = append(ids, u.ID)
+		}
+
+		if fmt.Sprint(ids) != fmt.Sprint(e.expectedIDs) {
+			t.Errorf("%s: expected users %v but got %v", e.name, e.expectedIDs, ids)
+		}
+	}
+}
+
+// Test_app_allUsersCursor walks through the whole listing one cursor at a time.
+func Test_app_allUsersCursor(t *testing.T) {
+	var ids []int
+	cursor := ""
+
+	for i := 0; i < 10; i++ {
+		req, _ := http.NewRequest("GET", "/users?limit=3&sort=-id&cursor="+url.QueryEscape(cursor), nil)
+		rr := httptest.NewRecorder()
+
+		handler := http.HandlerFunc(app.allUsers)
+		handler.ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status %d but got %d", http.StatusOK, rr.Code)
+		}
+
+		var page data.UserPage
+		_ = json.NewDecoder(rr.Body).Decode(&page)
+
+		for _, u := range page.Users {
+			ids = append(ids, u.ID)
+		}
+
+		if page.NextCursor == "" {
+			break
+		}
+		cursor = page.NextCursor
+	}
+
+	if fmt.Sprint(ids) != fmt.Sprint([]int{4, 3, 2, 1}) {
+		t.Errorf("expected to see users [4 3 2 1] but got %v", ids)
+	}
+
+	// a cursor is tied to the sort order it was issued for
+	req, _ := http.NewRequest("GET", "/users?limit=3&sort=id&cursor="+url.QueryEscape(cursor), nil)
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.allUsers).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("expected status %d for a cursor with another sort order but got %d", http.StatusBadRequest, rr.Code)
+	}
+}
+
+// Test_app_refreshTokenReuse makes sure a refresh token can only be used once, and
+// that replaying a spent token revokes the whole token family.
+func Test_app_refreshTokenReuse(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
+
+	refreshWithCookie := func(token string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/web/refresh-token", nil)
+		req.AddCookie(&http.Cookie{Name: "refresh_token", Value: token})
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.refreshUsingCookie).ServeHTTP(rr, req)
+		return rr
+	}
+
+	rr := refreshWithCookie(tokens.RefreshToken)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("first use: expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	var rotated TokenPairs
+	_ = json.NewDecoder(rr.Body).Decode(&rotated)
+
+	if rotated.RefreshToken == tokens.RefreshToken {
+		t.Error("expected a new refresh token after rotation")
+	}
+
+	rr = refreshWithCookie(tokens.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("reuse: expected status %d but got %d", http.StatusUnauthorized, rr.Code)
+	}
+
+	// the reuse revoked the family, so the rotated token is dead as well
+	rr = refreshWithCookie(rotated.RefreshToken)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("rotated token after reuse: expected status %d but got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// Test_app_deleteRefreshCookieRevokes makes sure that logging out revokes the
+// refresh token on the server, not just in the browser.
+func Test_app_deleteRefreshCookieRevokes(t *testing.T) {
+	testUser := data.User{
+		ID:        1,
+		FirstName: "Admin",
+		LastName:  "User",
+		Email:     "admin@example.com",
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
+
+	req, _ := http.NewRequest("GET", "/web/logout", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: tokens.RefreshToken})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.deleteRefreshCookie).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d but got %d", http.StatusAccepted, rr.Code)
+	}
+
+	req, _ = http.NewRequest("GET", "/web/refresh-token", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: tokens.RefreshToken})
+	rr = httptest.NewRecorder()
+	http.HandlerFunc(app.refreshUsingCookie).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("expected status %d for a logged out token but got %d", http.StatusUnauthorized, rr.Code)
+	}
+}
+
+// Test_app_resetPasswordRevokes makes sure that resetting a password revokes every
+// refresh token the user holds.
+func Test_app_resetPasswordRevokes(t *testing.T) {
+	testUser := data.User{ID: 1}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
+
+	if err := app.DB.ResetPassword(context.Background(), testUser.ID, "new-password"); err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := app.parseRefreshToken(tokens.RefreshToken)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = app.rotateRefreshToken(context.Background(), claims)
+	if !errors.Is(err, errRefreshTokenRevoked) {
+		t.Errorf("expected errRefreshTokenRevoked but got %v", err)
+	}
+}
+
+// Test_app_jwks makes sure the published key set can verify the tokens we issue.
+func Test_app_jwks(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.jwks).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status %d but got %d", http.StatusOK, rr.Code)
+	}
+
+	var set keyring.JWKSet
+	if err := json.NewDecoder(rr.Body).Decode(&set); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(set.Keys) != 1 || set.Keys[0].KeyID != app.Keys.SigningKeyID() {
+		t.Fatalf("expected the signing key to be published, got %+v", set.Keys)
+	}
+
+	tokens, _ := app.generateTokenPair(context.Background(), &data.User{ID: 1})
+
+	token, _, err := jwt.NewParser().ParseUnverified(tokens.Token, jwt.MapClaims{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if token.Header["kid"] != set.Keys[0].KeyID || token.Header["alg"] != set.Keys[0].Algorithm {
+		t.Errorf("token header %v does not match published key %+v", token.Header, set.Keys[0])
+	}
+}
+
+// Test_app_userHandlersAsPlainUser makes sure a user without permissions can only
+// read and update their own record, and cannot make themselves an admin.
+func Test_app_userHandlersAsPlainUser(t *testing.T) {
+	var tests = []struct {
+		name           string
+		method         string
+		json           string
+		paramID        string
+		handler        http.HandlerFunc
+		expectedStatus int
+	}{
+		{"getUser self", "GET", "", "2", app.getUser, http.StatusOK},
+		{"getUser other", "GET", "", "1", app.getUser, http.StatusForbidden},
+		{
+			"updateUser self",
+			"PATCH",
+			`{"id":2,"first_name":"Jackie","last_name":"Smith","email":"jack@example.com"}`,
+			"",
+			app.updateUser,
+			http.StatusNoContent,
+		},
+		{
+			"updateUser self to admin",
+			"PATCH",
+			`{"id":2,"first_name":"Jack","last_name":"Smith","email":"jack@example.com","is_admin":1}`,
+			"",
+			app.updateUser,
+			http.StatusForbidden,
+		},
+		{
+			"updateUser other",
+			"PATCH",
+			`{"id":1,"first_name":"Administrator","last_name":"User","email":"admin@example.com"}`,
+			"",
+			app.updateUser,
+			http.StatusForbidden,
+		},
+	}
+
+	for _, e := range tests {
+		var req *http.Request
+		if e.json == "" {
+			req, _ = http.NewRequest(e.method, "/", nil)
+		} else {
+			req, _ = http.NewRequest(e.method, "/", strings.NewReader(e.json))
+		}
+
+		if e.paramID != "" {
+			chiCtx := chi.NewRouteContext()
+			chiCtx.URLParams.Add("userID", e.paramID)
+			req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		}
+
+		req = addClaimsToRequest(req, userClaims)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned; expected %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
+
+// Test_app_updateUserEmail makes sure users who change their own email address
+// are sent a link to confirm the new one, and admins aren't.
+func Test_app_updateUserEmail(t *testing.T) {
+	var tests = []struct {
+		name             string
+		json             string
+		claims           *Claims
+		expectedMailedTo string
+	}{
+		{"same address", `{"id":2,"first_name":"Jack","last_name":"Smith","email":"Jack@example.com"}`, userClaims, ""},
+		{"new address", `{"id":2,"first_name":"Jack","last_name":"Smith","email":"jackie@example.com"}`, userClaims, "To: jackie@example.com"},
+		{"changed by an admin", `{"id":2,"first_name":"Jack","last_name":"Smith","email":"jackie@example.com"}`, adminClaims, ""},
+	}
+
+	for _, e := range tests {
+		testMail.Reset()
+
+		req, _ := http.NewRequest("PATCH", "/", strings.NewReader(e.json))
+		req = addClaimsToRequest(req, e.claims)
+		rr := httptest.NewRecorder()
+
+		app.updateUser(rr, req)
+
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("%s: expected status %d, got %d", e.name, http.StatusNoContent, rr.Code)
+		}
+
+		sent := verifyLink.MatchString(testMail.String())
+		if sent != (e.expectedMailedTo != "") || !strings.Contains(testMail.String(), e.expectedMailedTo) {
+			t.Errorf("%s: expected a verification mail to %q, got %q", e.name, e.expectedMailedTo, testMail.String())
+		}
+	}
+}
+
+// Test_app_userRoutesPermissions sends requests through the router, to make sure
+// each route is guarded by the right permission.
+func Test_app_userRoutesPermissions(t *testing.T) {
+	admin, _ := app.generateTokenPair(context.Background(), &data.User{ID: 1, IsAdmin: 1})
+	user, _ := app.generateTokenPair(context.Background(), &data.User{ID: 2})
+
+	var tests = []struct {
+		name           string
+		method         string
+		url            string
+		json           string
+		token          string
+		expectedStatus int
+	}{
+		{"list as admin", "GET", "/users/", "", admin.Token, http.StatusOK},
+		{"list as user", "GET", "/users/", "", user.Token, http.StatusForbidden},
+		{"delete as admin", "DELETE", "/users/2", "", admin.Token, http.StatusNoContent},
+		{"delete as user", "DELETE", "/users/1", "", user.Token, http.StatusForbidden},
+		{"delete self as user", "DELETE", "/users/2", "", user.Token, http.StatusForbidden},
+		{"insert as user", "PUT", "/users/", `{"first_name":"Jack","last_name":"Smith","email":"jack@example.com"}`, user.Token, http.StatusForbidden},
+		{"get self as user", "GET", "/users/2", "", user.Token, http.StatusOK},
+		{"get other as user", "GET", "/users/1", "", user.Token, http.StatusForbidden},
+		{"no token", "GET", "/users/2", "", "", http.StatusUnauthorized},
+	}
+
+	routes := app.routes()
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.url, strings.NewReader(e.json))
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+
+		rr := httptest.NewRecorder()
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: wrong status returned; expected %d but got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
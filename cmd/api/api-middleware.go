@@ -1,30 +1,100 @@
 package main
 
-import "net/http"
-
-func (app *application) enableCORS(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
-		w.Header().Set("Access-Control-Allow-Origin", "http://localhost:8090")
-		if r.Method == "OPTIONS" {
-			w.Header().Set("Access-Control-Allow-Credentials", "true")
-			w.Header().Set("Access-Control-Allow-Methods", "GET,POST,PUT,PATCH,DELETE,OPTIONS")
-			w.Header().Set("Access-Control-Allow-Headers", "Accept, Content-Type, X-CSRF-Token, Authorization")
-			return
-		} else {
-			next.ServeHTTP(w, r)
-		}
+import (
+	"context"
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/cors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// newCORS returns the CORS policy of the API for the browser origins allowed
+// to call it. Credentials are allowed, since the front end keeps the refresh
+// token in a cookie; the routes that need neither a bearer token nor anything
+// but POST say so, so that preflights for anything else fail early.
+func newCORS(origins []string, maxAge time.Duration) *cors.Policy {
+	public := []string{"Accept", "Content-Type", logging.RequestIDHeader}
+	post := []string{"POST"}
+
+	return cors.New(cors.Options{
+		AllowedOrigins:   origins,
+		AllowedMethods:   []string{"GET", "POST", "PUT", "PATCH", "DELETE"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", logging.RequestIDHeader},
+		ExposedHeaders:   []string{logging.RequestIDHeader, "RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy", "Retry-After"},
+		AllowCredentials: true,
+		MaxAge:           maxAge,
+		Routes: []cors.Route{
+			{Prefix: "/web", Methods: []string{"GET", "POST"}, Headers: public},
+			{Prefix: "/.well-known", Methods: []string{"GET"}, Headers: public},
+			{Prefix: "/auth", Methods: post, Headers: public},
+			{Prefix: "/refresh-token", Methods: post, Headers: public},
+			{Prefix: "/forgot-password", Methods: post, Headers: public},
+			{Prefix: "/reset-password", Methods: post, Headers: public},
+			{Prefix: "/register", Methods: post, Headers: public},
+			{Prefix: "/verify-email", Methods: post, Headers: public},
+			{Prefix: "/mfa", Methods: post, Headers: append(public, "Authorization")},
+		},
 	})
 }
 
+// logClientIP records the address of the client, as far as the trusted proxies
+// in front of the API can tell, in the access log line of the request.
+func (app *application) logClientIP(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		logging.SetIP(r.Context(), app.ClientIP.IP(r))
+		next.ServeHTTP(w, r)
+	})
+}
+
+type contextKey string
+
+const contextClaimsKey contextKey = "claims"
+
+// claimsFromContext returns the claims of the verified access token stored by
+// authRequired, or nil if there is none.
+func claimsFromContext(ctx context.Context) *Claims {
+	claims, _ := ctx.Value(contextClaimsKey).(*Claims)
+	return claims
+}
+
+// authRequired makes sure the request carries a valid access token, and stores
+// its claims in the request context.
 func (app *application) authRequired(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request){
-		_, _, err := app.getTokenFromHeaderAndVerify(w, r)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, claims, err := app.getTokenFromHeaderAndVerify(w, r)
 		if err != nil {
 			w.WriteHeader(http.StatusUnauthorized)
 			return
 		}
 
-		next.ServeHTTP(w, r)
-		return
+		if userID, err := strconv.Atoi(claims.Subject); err == nil {
+			logging.SetUserID(r.Context(), userID)
+		}
+
+		ctx := context.WithValue(r.Context(), contextClaimsKey, claims)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-}
\ No newline at end of file
+}
+
+// requirePermission only lets requests through whose access token grants
+// permission. It must run after authRequired.
+func (app *application) requirePermission(permission string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			claims := claimsFromContext(r.Context())
+			if claims == nil {
+				app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+				return
+			}
+
+			if !claims.HasPermission(permission) {
+				app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,39 +1,66 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
 )
 
-func Test_app_enableCORS(t *testing.T) {
-	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+func Test_newCORS(t *testing.T) {
+	routes := app.routes()
 
 	var tests = []struct {
-		name         string
-		method       string
-		expectHeader bool
+		name          string
+		method        string
+		path          string
+		origin        string
+		requestMethod string
+		headers       string
+		expectStatus  int
+		expectOrigin  string
 	}{
-		{"preflight", "OPTIONS", true},
-		{"get", "GET", false},
+		{"preflight", "OPTIONS", "/users/1", "http://localhost:8090", "DELETE", "Authorization", http.StatusNoContent, "http://localhost:8090"},
+		{"preflight other origin", "OPTIONS", "/users/1", "https://evil.example.com", "DELETE", "Authorization", http.StatusForbidden, ""},
+		{"preflight login", "OPTIONS", "/auth", "http://localhost:8090", "POST", "Content-Type, X-Request-ID", http.StatusNoContent, "http://localhost:8090"},
+		{"preflight login with wrong method", "OPTIONS", "/auth", "http://localhost:8090", "DELETE", "", http.StatusForbidden, ""},
+		{"preflight cookie refresh with bearer token", "OPTIONS", "/web/refresh-token", "http://localhost:8090", "GET", "Authorization", http.StatusForbidden, ""},
+		{"get", "GET", "/.well-known/jwks.json", "http://localhost:8090", "", "", http.StatusOK, "http://localhost:8090"},
+		{"get other origin", "GET", "/.well-known/jwks.json", "https://evil.example.com", "", "", http.StatusOK, ""},
 	}
 
 	for _, e := range tests {
-		handlerToTest := app.enableCORS(nextHandler)
-
-		req := httptest.NewRequest(e.method, "http://testing", nil)
+		req := httptest.NewRequest(e.method, e.path, nil)
+		req.Header.Set("Origin", e.origin)
+		if e.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", e.requestMethod)
+			req.Header.Set("Access-Control-Request-Headers", e.headers)
+		}
 		rr := httptest.NewRecorder()
 
-		handlerToTest.ServeHTTP(rr, req)
+		routes.ServeHTTP(rr, req)
 
-		if e.expectHeader && rr.Header().Get("Access-Control-Allow-Credentials") == "" {
-			t.Errorf("%s: expected header, but did not find it", e.name)
+		if rr.Code != e.expectStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectStatus, rr.Code)
 		}
 
-		if !e.expectHeader && rr.Header().Get("Access-Control-Allow-Credentials") != "" {
-			t.Errorf("%s: expected no header, but got one", e.name)
+		if origin := rr.Header().Get("Access-Control-Allow-Origin"); origin != e.expectOrigin {
+			t.Errorf("%s: expected allowed origin %q, got %q", e.name, e.expectOrigin, origin)
+		}
+
+		credentials := rr.Header().Get("Access-Control-Allow-Credentials")
+		if (e.expectOrigin != "") != (credentials == "true") {
+			t.Errorf("%s: expected credentials to be allowed with the origin, got %q", e.name, credentials)
 		}
 	}
 }
@@ -48,7 +75,7 @@ func Test_app_authRequired(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
 
 	var tests = []struct {
 		name             string
@@ -68,7 +95,8 @@ func Test_app_authRequired(t *testing.T) {
 		}
 		rr := httptest.NewRecorder()
 
-		handlerToTest := app.authRequired(nextHandler)
+		var accessLog bytes.Buffer
+		handlerToTest := logging.AccessLog(logging.New(&accessLog, slog.LevelInfo))(app.authRequired(nextHandler))
 		handlerToTest.ServeHTTP(rr, req)
 
 		if e.expectAuthorized && rr.Code == http.StatusUnauthorized {
@@ -78,5 +106,99 @@ func Test_app_authRequired(t *testing.T) {
 		if !e.expectAuthorized && rr.Code != http.StatusUnauthorized {
 			t.Errorf("%s: did not get code 401, and should have", e.name)
 		}
+
+		if loggedUser := strings.Contains(accessLog.String(), `"user_id":1`); loggedUser != e.expectAuthorized {
+			t.Errorf("%s: expected the user in the access log to be %v, got %s", e.name, e.expectAuthorized, accessLog.String())
+		}
+	}
+}
+
+func Test_app_requirePermission(t *testing.T) {
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	// the claims cmd/cli mints
+	cliUser := &data.User{ID: 1, FirstName: "John", LastName: "Doe", IsAdmin: 1}
+	cliRoles := []*data.Role{{Name: data.RoleAdmin, Permissions: data.AllPermissions}}
+	cliToken, err := app.Keys.Sign(jwt.MapClaims(data.AccessClaims(cliUser, cliRoles, "example.com", time.Now().Add(time.Hour))))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the claims cmd/cli minted before roles, which grant nothing
+	legacyToken, err := app.Keys.Sign(jwt.MapClaims{
+		"sub":   "1",
+		"admin": true,
+		"aud":   "example.com",
+		"iss":   "example.com",
+		"exp":   time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	userTokens, err := app.generateTokenPair(context.Background(), &data.User{ID: 2, FirstName: "Jack", LastName: "Smith"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name         string
+		token        string
+		expectedCode int
+	}{
+		{"cli token", cliToken, http.StatusOK},
+		{"admin flag only", legacyToken, http.StatusForbidden},
+		{"plain user", userTokens.Token, http.StatusForbidden},
+		{"no token", "", http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("GET", "/", nil)
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		rr := httptest.NewRecorder()
+
+		handlerToTest := app.authRequired(app.requirePermission(data.PermUsersList)(nextHandler))
+		handlerToTest.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedCode {
+			t.Errorf("%s: expected code %d, got %d", e.name, e.expectedCode, rr.Code)
+		}
+	}
+}
+
+func Test_app_logClientIP(t *testing.T) {
+	resolver := app.ClientIP
+	defer func() { app.ClientIP = resolver }()
+
+	app.ClientIP, _ = clientip.New([]string{"10.0.0.0/8"}, clientip.XForwardedFor)
+
+	var tests = []struct {
+		name         string
+		remoteAddr   string
+		forwardedFor string
+		expectIP     string
+	}{
+		{"direct", "192.0.2.1:1234", "", "192.0.2.1"},
+		{"spoofed header", "192.0.2.1:1234", "198.51.100.7", "192.0.2.1"},
+		{"trusted proxy", "10.0.0.1:1234", "198.51.100.7", "198.51.100.7"},
+	}
+
+	for _, e := range tests {
+		var buf bytes.Buffer
+		handler := logging.AccessLog(logging.New(&buf, slog.LevelInfo))(app.logClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+		req := httptest.NewRequest("GET", "/users", nil)
+		req.RemoteAddr = e.remoteAddr
+		if e.forwardedFor != "" {
+			req.Header.Set("X-Forwarded-For", e.forwardedFor)
+		}
+
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if !strings.Contains(buf.String(), fmt.Sprintf(`"ip":%q`, e.expectIP)) {
+			t.Errorf("%s: expected ip %s in the access log, got %s", e.name, e.expectIP, buf.String())
+		}
 	}
 }
@@ -3,6 +3,9 @@ package main
 import (
 	"net/http"
 
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 )
@@ -11,30 +14,77 @@ func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	// register middleware
+	mux.Use(logging.RequestIDMiddleware)
+	mux.Use(logging.AccessLog(app.Logger))
+	mux.Use(app.logClientIP)
+	mux.Use(app.Metrics.Middleware)
 	mux.Use(middleware.Recoverer)
-	mux.Use(app.enableCORS)
+	mux.Use(app.CORS.Handler)
 
 	mux.Handle("/", http.StripPrefix("/", http.FileServer(http.Dir("./html/"))))
 
+	// Prometheus metrics, and liveness and readiness probes
+	mux.Handle("/metrics", app.Metrics.Handler())
+	mux.Get("/healthz", app.Health.Live)
+	mux.Get("/readyz", app.Health.Ready)
+
+	// public keys, so that other services can verify our tokens
+	mux.Get("/.well-known/jwks.json", app.jwks)
+
+	// rate limits by route group, per client address or, for the routes of
+	// signed in users, per user; they run before authRequired, so that
+	// requests with a bad token count too
+	authLimit := app.rateLimit("auth")
+	refreshLimit := app.rateLimit("refresh")
+	usersLimit := app.rateLimitUser("users")
+
 	mux.Route("/web", func(mux chi.Router) {
-		mux.Post("/auth", app.authenticate)
-		mux.Get("/refresh-token", app.refreshUsingCookie)
+		mux.With(authLimit).Post("/auth", app.authenticate)
+		mux.With(authLimit).Post("/auth/mfa", app.verifyMFA)
+		mux.With(refreshLimit).Get("/refresh-token", app.refreshUsingCookie)
 		mux.Get("/logout", app.deleteRefreshCookie)
 	})
 
 	// authentication routes - auth handler, refresh
-	mux.Post("/auth", app.authenticate)
-	mux.Post("/refresh-token", app.refresh)
+	mux.With(authLimit).Post("/auth", app.authenticate)
+	mux.With(authLimit).Post("/auth/mfa", app.verifyMFA)
+	mux.With(refreshLimit).Post("/refresh-token", app.refresh)
+
+	// password reset, for users who can't log in
+	mux.With(authLimit).Post("/forgot-password", app.forgotPassword)
+	mux.With(authLimit).Post("/reset-password", app.resetPassword)
+
+	// self-service sign up
+	mux.With(authLimit).Post("/register", app.register)
+	mux.With(authLimit).Post("/verify-email", app.verifyEmail)
 
-	// protected routes
+	// two-factor enrollment of the current user
+	mux.Route("/mfa", func(mux chi.Router) {
+		mux.Use(usersLimit)
+		mux.Use(app.authRequired)
+
+		mux.Post("/setup", app.setupMFA)
+		mux.Post("/enable", app.enableMFA)
+		mux.Post("/disable", app.disableMFA)
+	})
+
+	// protected routes; reading and updating a single user is also allowed
+	// for the user themselves, which the handlers check
 	mux.Route("/users", func(mux chi.Router) {
+		mux.Use(usersLimit)
 		mux.Use(app.authRequired)
 
-		mux.Get("/", app.allUsers)
+		mux.With(app.requirePermission(data.PermUsersList)).Get("/", app.allUsers)
 		mux.Get("/{userID}", app.getUser)
-		mux.Delete("/{userID}", app.deleteUser)
-		mux.Put("/", app.insertUser)
+		mux.With(app.requirePermission(data.PermUsersDelete)).Delete("/{userID}", app.deleteUser)
+		mux.With(app.requirePermission(data.PermUsersCreate)).Put("/", app.insertUser)
 		mux.Patch("/", app.updateUser)
+		mux.With(app.requirePermission(data.PermUsersUpdate)).Post("/{userID}/unlock", app.unlockUser)
+
+		// profile picture gallery
+		mux.Get("/{userID}/images", app.listUserImages)
+		mux.Put("/{userID}/images/{imageID}/active", app.activateUserImage)
+		mux.Delete("/{userID}/images/{imageID}", app.deleteUserImage)
 	})
 
 	return mux
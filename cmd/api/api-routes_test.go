@@ -20,6 +20,23 @@ func Test_app_routes(t *testing.T) {
 		{"/users/{userID}", "DELETE"},
 		{"/users/", "PATCH"},
 		{"/users/", "PUT"},
+		{"/.well-known/jwks.json", "GET"},
+		{"/forgot-password", "POST"},
+		{"/reset-password", "POST"},
+		{"/register", "POST"},
+		{"/verify-email", "POST"},
+		{"/auth/mfa", "POST"},
+		{"/web/auth/mfa", "POST"},
+		{"/mfa/setup", "POST"},
+		{"/mfa/enable", "POST"},
+		{"/mfa/disable", "POST"},
+		{"/users/{userID}/unlock", "POST"},
+		{"/users/{userID}/images", "GET"},
+		{"/users/{userID}/images/{imageID}/active", "PUT"},
+		{"/users/{userID}/images/{imageID}", "DELETE"},
+		{"/metrics", "GET"},
+		{"/healthz", "GET"},
+		{"/readyz", "GET"},
 		
 	}
 
@@ -1,10 +1,16 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
@@ -20,16 +26,47 @@ type TokenPairs struct {
 }
 
 type Claims struct {
-	UserName string `json:"name"`
+	UserName    string   `json:"name"`
+	FamilyID    string   `json:"fid,omitempty"`
+	Admin       bool     `json:"admin"`
+	Roles       []string `json:"roles,omitempty"`
+	Permissions []string `json:"perms,omitempty"`
 	jwt.RegisteredClaims
 }
 
+// HasPermission reports whether the token grants permission.
+func (c *Claims) HasPermission(permission string) bool {
+	for _, p := range c.Permissions {
+		if p == permission {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IsSubject reports whether the token was issued to the user with id userID.
+func (c *Claims) IsSubject(userID int) bool {
+	return c.Subject == strconv.Itoa(userID)
+}
+
+var (
+	errRefreshTokenRevoked = errors.New("refresh token has been revoked")
+	errRefreshTokenUnknown = errors.New("unknown refresh token")
+)
+
 func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *http.Request) (string, *Claims, error) {
-	// we expect our authorization header to look like this:
-	// Bearer <token>
 	// add a header
 	w.Header().Add("Vary", "Authorization")
 
+	return app.verifyAuthHeader(r)
+}
+
+// verifyAuthHeader returns the access token of the Authorization header of r,
+// and its claims, once it has checked that we issued it.
+func (app *application) verifyAuthHeader(r *http.Request) (string, *Claims, error) {
+	// we expect our authorization header to look like this:
+	// Bearer <token>
 	// get the authorization header
 	authHeader := r.Header.Get("Authorization")
 
@@ -54,14 +91,9 @@ func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *ht
 	// declare an empty Claims variable
 	claims := &Claims{}
 
-	// parse the token with our claims (we read into claims), using our secret (from the receiver)
-	_, err := jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
-		// validate the signing algorithm
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexepected signing method: %v", token.Header["alg"])
-		}
-		return []byte(app.JWTSecret), nil
-	})
+	// parse the token with our claims (we read into claims), using the key named in its
+	// kid header; the keyring also makes sure the signing algorithm matches that key
+	_, err := jwt.ParseWithClaims(token, claims, app.Keys.Keyfunc)
 
 	// check for an error; note that this catches expired tokens as well.
 	if err != nil {
@@ -80,41 +112,63 @@ func (app *application) getTokenFromHeaderAndVerify(w http.ResponseWriter, r *ht
 	return token, claims, nil
 }
 
-func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
-	// Create the token.
-	token := jwt.New(jwt.SigningMethodHS256)
-
-	// set claims
-	claims := token.Claims.(jwt.MapClaims)
-	claims["name"] = fmt.Sprintf("%s %s", user.FirstName, user.LastName)
-	claims["sub"] = fmt.Sprint(user.ID)
-	claims["aud"] = app.Domain
-	claims["iss"] = app.Domain
-	if user.IsAdmin == 1 {
-		claims["admin"] = true
-	} else {
-		claims["admin"] = false
+// generateTokenPair issues a new access token and a new refresh token for user.
+// The refresh token starts a new token family.
+func (app *application) generateTokenPair(ctx context.Context, user *data.User) (TokenPairs, error) {
+	familyID, err := newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
 	}
 
-	// set the expiry
-	claims["exp"] = time.Now().Add(jwtTokenExpiry).Unix()
+	return app.generateTokenPairInFamily(ctx, user, familyID)
+}
+
+// generateTokenPairInFamily issues a new access token and a new refresh token for
+// user. The refresh token joins the given family, and is recorded in the database
+// so that it can be used exactly once, or revoked.
+func (app *application) generateTokenPairInFamily(ctx context.Context, user *data.User, familyID string) (TokenPairs, error) {
+	// roles and permissions are read when the token is issued, so changes
+	// take effect at the next refresh
+	roles, err := app.DB.GetUserRoles(ctx, user.ID)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	claims := jwt.MapClaims(data.AccessClaims(user, roles, app.Domain, time.Now().Add(jwtTokenExpiry)))
 
 	// create the signed token
-	signedAccessToken, err := token.SignedString([]byte(app.JWTSecret))
+	signedAccessToken, err := app.Keys.Sign(claims)
 	if err != nil {
 		return TokenPairs{}, err
 	}
 
+	// every refresh token gets a unique id, which is what we keep track of
+	refreshTokenID, err := newTokenID()
+	if err != nil {
+		return TokenPairs{}, err
+	}
+	refreshTokenExpires := time.Now().Add(refreshTokenExpiry)
+
 	// create the refresh token
-	refreshToken := jwt.New(jwt.SigningMethodHS256)
-	refreshTokenClaims := refreshToken.Claims.(jwt.MapClaims)
+	refreshTokenClaims := jwt.MapClaims{}
 	refreshTokenClaims["sub"] = fmt.Sprint(user.ID)
+	refreshTokenClaims["jti"] = refreshTokenID
+	refreshTokenClaims["fid"] = familyID
 
 	// set expiry; must be longer than jwt expiry
-	refreshTokenClaims["exp"] = time.Now().Add(refreshTokenExpiry).Unix()
+	refreshTokenClaims["exp"] = refreshTokenExpires.Unix()
 
 	// create signed refresh token
-	signedRefreshToken, err := refreshToken.SignedString([]byte(app.JWTSecret))
+	signedRefreshToken, err := app.Keys.Sign(refreshTokenClaims)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	err = app.DB.InsertRefreshToken(ctx, data.RefreshToken{
+		ID:        refreshTokenID,
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		ExpiresAt: refreshTokenExpires,
+	})
 	if err != nil {
 		return TokenPairs{}, err
 	}
@@ -126,3 +180,59 @@ func (app *application) generateTokenPair(user *data.User) (TokenPairs, error) {
 
 	return tokenPairs, nil
 }
+
+// parseRefreshToken verifies the signature and expiry of a refresh token, and
+// returns its claims.
+func (app *application) parseRefreshToken(refreshToken string, opts ...jwt.ParserOption) (*Claims, error) {
+	claims := &Claims{}
+
+	_, err := jwt.NewParser(opts...).ParseWithClaims(refreshToken, claims, app.Keys.Keyfunc)
+	if err != nil {
+		return nil, err
+	}
+
+	return claims, nil
+}
+
+// rotateRefreshToken spends a refresh token and issues a new token pair in the
+// same family. Refresh tokens are single use: presenting one that was already
+// used means that it was stolen, or that the legitimate client is replaying it,
+// so the whole family is revoked and the holder has to log in again.
+func (app *application) rotateRefreshToken(ctx context.Context, claims *Claims) (TokenPairs, error) {
+	stored, err := app.DB.UseRefreshToken(ctx, claims.ID)
+	switch {
+	case errors.Is(err, dbrepo.ErrTokenReused):
+		if err := app.DB.RevokeRefreshTokenFamily(ctx, stored.FamilyID); err != nil {
+			return TokenPairs{}, err
+		}
+		return TokenPairs{}, errRefreshTokenRevoked
+	case errors.Is(err, dbrepo.ErrTokenNotFound):
+		return TokenPairs{}, errRefreshTokenUnknown
+	case err != nil:
+		return TokenPairs{}, err
+	}
+
+	// get the user id from the stored token, not the claims
+	user, err := app.DB.GetUser(ctx, stored.UserID)
+	if err != nil {
+		return TokenPairs{}, errors.New("unknown user")
+	}
+
+	tokenPairs, err := app.generateTokenPairInFamily(ctx, user, stored.FamilyID)
+	if err != nil {
+		return TokenPairs{}, err
+	}
+
+	app.Metrics.TokenIssued(metrics.TokenRefresh)
+	return tokenPairs, nil
+}
+
+// newTokenID returns a random, url-safe identifier for a token or token family.
+func newTokenID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(b), nil
+}
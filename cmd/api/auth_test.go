@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
 	"net/http"
@@ -16,7 +17,7 @@ func Test_app_getTokenFromHeaderAndVerify(t *testing.T) {
 		Email:     "admin@example.com",
 	}
 
-	tokens, _ := app.generateTokenPair(&testUser)
+	tokens, _ := app.generateTokenPair(context.Background(), &testUser)
 
 	var tests = []struct {
 		name          string
@@ -27,6 +28,7 @@ func Test_app_getTokenFromHeaderAndVerify(t *testing.T) {
 	}{
 		{"valid", fmt.Sprintf("Bearer %s", tokens.Token), false, true, app.Domain},
 		{"valid expired", fmt.Sprintf("Bearer %s", expiredToken), true, true, app.Domain},
+		{"hmac signed", fmt.Sprintf("Bearer %s", hmacToken), true, true, app.Domain},
 		{"no header", "", true, false, app.Domain},
 		{"invalid token", fmt.Sprintf("Bearer %s1", tokens.Token), true, true, app.Domain},
 		{"no bearer", fmt.Sprintf("Bear %s1", tokens.Token), true, true, app.Domain},
@@ -38,7 +40,7 @@ func Test_app_getTokenFromHeaderAndVerify(t *testing.T) {
 	for _, e := range tests {
 		if e.issuer != app.Domain {
 			app.Domain = e.issuer
-			tokens, _ = app.generateTokenPair(&testUser)
+			tokens, _ = app.generateTokenPair(context.Background(), &testUser)
 		}
 		req, _ := http.NewRequest("GET", "/", nil)
 		if e.setHeader {
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// imageURLExpiry is how long the image links in API responses stay valid.
+const imageURLExpiry = time.Hour
+
+// UserImage is a picture in a user's gallery, with links to the image and its
+// largest thumbnail.
+type UserImage struct {
+	*data.UserImage
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+}
+
+// userImageParams reads the user and image ids from the URL.
+func userImageParams(r *http.Request) (userID, imageID int, err error) {
+	userID, err = strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imageID, err = strconv.Atoi(chi.URLParam(r, "imageID"))
+	return userID, imageID, err
+}
+
+// listUserImages returns the pictures a user has uploaded, newest first. Users
+// without the users:read permission may only list their own.
+func (app *application) listUserImages(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.canAccessUser(r, data.PermUsersRead, userID) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	list, err := app.DB.ListUserImages(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	gallery := make([]UserImage, 0, len(list))
+	for _, img := range list {
+		gi := UserImage{UserImage: img}
+
+		gi.URL, err = app.Storage.SignedURL(r.Context(), img.FileName, imageURLExpiry)
+		if err == nil {
+			size := images.ThumbnailSizes[len(images.ThumbnailSizes)-1]
+			gi.ThumbnailURL, err = app.Storage.SignedURL(r.Context(), images.ThumbnailName(img.FileName, size), imageURLExpiry)
+		}
+		if err != nil {
+			app.errorJSON(w, err, http.StatusInternalServerError)
+			return
+		}
+
+		gallery = append(gallery, gi)
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, gallery)
+}
+
+// activateUserImage makes one of a user's pictures their profile picture.
+// Users without the users:update permission may only change their own.
+func (app *application) activateUserImage(w http.ResponseWriter, r *http.Request) {
+	userID, imageID, err := userImageParams(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.canAccessUser(r, data.PermUsersUpdate, userID) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	err = app.DB.SetActiveUserImage(r.Context(), userID, imageID)
+	if errors.Is(err, dbrepo.ErrImageNotFound) {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// deleteUserImage deletes one of a user's pictures, and its files once no other
+// picture uses them. Users without the users:update permission may only delete
+// their own.
+func (app *application) deleteUserImage(w http.ResponseWriter, r *http.Request) {
+	userID, imageID, err := userImageParams(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	if !app.canAccessUser(r, data.PermUsersUpdate, userID) {
+		app.errorJSON(w, errors.New("forbidden"), http.StatusForbidden)
+		return
+	}
+
+	img, err := app.DB.DeleteUserImage(r.Context(), userID, imageID)
+	if errors.Is(err, dbrepo.ErrImageNotFound) {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	err = images.RemoveUnused(r.Context(), app.DB, app.Storage, img.FileName)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
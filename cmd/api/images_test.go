@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Test_app_userImages tests listing, activating and deleting the pictures in a
+// user's gallery
+func Test_app_userImages(t *testing.T) {
+	ctx := context.Background()
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+
+	img, err := images.Process(&buf, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Put(ctx, app.Storage); err != nil {
+		t.Fatal(err)
+	}
+
+	first, _ := app.DB.InsertUserImage(ctx, data.UserImage{UserID: 2, FileName: img.Name})
+	second, _ := app.DB.InsertUserImage(ctx, data.UserImage{UserID: 2, FileName: img.Name})
+
+	var tests = []struct {
+		name           string
+		method         string
+		handler        http.HandlerFunc
+		claims         *Claims
+		userID         string
+		imageID        string
+		expectedStatus int
+	}{
+		{"list own", "GET", app.listUserImages, userClaims, "2", "", http.StatusOK},
+		{"list other user's", "GET", app.listUserImages, userClaims, "1", "", http.StatusForbidden},
+		{"list as admin", "GET", app.listUserImages, adminClaims, "2", "", http.StatusOK},
+		{"activate own", "PUT", app.activateUserImage, userClaims, "2", fmt.Sprint(first), http.StatusNoContent},
+		{"activate other user's", "PUT", app.activateUserImage, userClaims, "1", fmt.Sprint(first), http.StatusForbidden},
+		{"activate unknown", "PUT", app.activateUserImage, userClaims, "2", "999", http.StatusNotFound},
+		{"activate wrong user", "PUT", app.activateUserImage, adminClaims, "1", fmt.Sprint(first), http.StatusNotFound},
+		{"bad image id", "PUT", app.activateUserImage, userClaims, "2", "x", http.StatusBadRequest},
+		{"delete other user's", "DELETE", app.deleteUserImage, userClaims, "1", fmt.Sprint(second), http.StatusForbidden},
+		{"delete own", "DELETE", app.deleteUserImage, userClaims, "2", fmt.Sprint(second), http.StatusNoContent},
+		{"delete again", "DELETE", app.deleteUserImage, userClaims, "2", fmt.Sprint(second), http.StatusNotFound},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, "/", nil)
+		chiCtx := chi.NewRouteContext()
+		chiCtx.URLParams.Add("userID", e.userID)
+		chiCtx.URLParams.Add("imageID", e.imageID)
+		req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+		req = addClaimsToRequest(req, e.claims)
+
+		rr := httptest.NewRecorder()
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+
+	// the files are still used by the first picture
+	rc, err := app.Storage.Get(ctx, img.Name)
+	if err != nil {
+		t.Errorf("expected the image to be kept, got %s", err)
+	} else {
+		_ = rc.Close()
+	}
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", "2")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = addClaimsToRequest(req, userClaims)
+
+	rr := httptest.NewRecorder()
+	app.listUserImages(rr, req)
+
+	var gallery []UserImage
+	_ = json.NewDecoder(rr.Body).Decode(&gallery)
+
+	if len(gallery) != 1 || gallery[0].ID != first || !gallery[0].IsActive {
+		t.Fatalf("expected only picture %d, active; got %+v", first, gallery)
+	}
+
+	if gallery[0].URL != "http://localhost:8080/media/"+img.Name {
+		t.Errorf("unexpected image URL %s", gallery[0].URL)
+	}
+
+	if gallery[0].ThumbnailURL != "http://localhost:8080/media/"+images.ThumbnailName(img.Name, 256) {
+		t.Errorf("unexpected thumbnail URL %s", gallery[0].ThumbnailURL)
+	}
+
+	// deleting the last picture that uses them removes the files
+	chiCtx.URLParams.Add("imageID", fmt.Sprint(first))
+	rr = httptest.NewRecorder()
+	app.deleteUserImage(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if _, err := app.Storage.Get(ctx, img.Name); err == nil {
+		t.Error("expected the image files to be removed")
+	}
+}
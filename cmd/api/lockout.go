@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// errTooManyAttempts is returned, with a Retry-After header, to locked out
+// accounts and addresses.
+var errTooManyAttempts = errors.New("too many failed login attempts")
+
+// checkLockout reports whether email may try to log in from the request's
+// address; if not, it has already sent a 429.
+func (app *application) checkLockout(w http.ResponseWriter, r *http.Request, email string) bool {
+	wait, err := app.Lockout.Check(r.Context(), email, app.ClientIP.IP(r))
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking login lockout", "error", err)
+	}
+
+	if wait > 0 {
+		app.Metrics.AuthAttempt(metrics.AuthLocked)
+		app.tooManyAttempts(w, wait)
+		return false
+	}
+
+	return true
+}
+
+// loginFailed records a failed login as email, and sends a 429 if that locked
+// the account or address out, and err with a 401 otherwise.
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, email string, err error) {
+	app.attemptFailed(w, r, email, err, http.StatusUnauthorized)
+}
+
+// attemptFailed records a failed attempt at a password or code of email, and
+// sends a 429 if that locked the account or address out, and err with status
+// otherwise.
+func (app *application) attemptFailed(w http.ResponseWriter, r *http.Request, email string, err error, status int) {
+	app.Metrics.AuthAttempt(metrics.AuthFailure)
+
+	wait, lockErr := app.Lockout.Fail(r.Context(), email, app.ClientIP.IP(r))
+	if lockErr != nil {
+		app.Logger.ErrorContext(r.Context(), "recording failed login", "error", lockErr)
+	}
+
+	if wait > 0 {
+		app.tooManyAttempts(w, wait)
+		return
+	}
+
+	app.errorJSON(w, err, status)
+}
+
+// tooManyAttempts sends a 429, with the number of seconds to wait in Retry-After.
+func (app *application) tooManyAttempts(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	app.errorJSON(w, errTooManyAttempts, http.StatusTooManyRequests)
+}
+
+// unlockUser lifts the login lockout of a user, and forgets their failed attempts.
+func (app *application) unlockUser(w http.ResponseWriter, r *http.Request) {
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	err = app.Lockout.Unlock(r.Context(), user.Email)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
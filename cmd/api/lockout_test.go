@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func Test_app_authenticateLockout(t *testing.T) {
+	// login posts credentials for admin@example.com from an address no other test uses
+	login := func(password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"admin@example.com","password":"`+password+`"}`))
+		req.RemoteAddr = "192.0.2.20:4321"
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.authenticate).ServeHTTP(rr, req)
+		return rr
+	}
+
+	// start from a clean slate, whatever earlier tests did
+	if err := app.Lockout.Unlock(context.Background(), "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < app.Lockout.Account.Threshold; i++ {
+		if rr := login("wrong"); rr.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: expected status %d, got %d", i, http.StatusUnauthorized, rr.Code)
+		}
+	}
+
+	rr := login("wrong")
+	if rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected status %d, got %d", http.StatusTooManyRequests, rr.Code)
+	}
+
+	if rr.Header().Get("Retry-After") != "60" {
+		t.Errorf("expected Retry-After 60, got %q", rr.Header().Get("Retry-After"))
+	}
+
+	if rr := login("secret"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the right password to be turned away while locked out, got %d", rr.Code)
+	}
+
+	// an admin unlocks the account
+	req, _ := http.NewRequest("POST", "/users/1/unlock", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("userID", "1")
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	rr = httptest.NewRecorder()
+
+	http.HandlerFunc(app.unlockUser).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusNoContent {
+		t.Errorf("unlock: expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+
+	if rr := login("secret"); rr.Code != http.StatusOK {
+		t.Errorf("expected a login after the unlock, got %d", rr.Code)
+	}
+}
+
+func Test_app_disableMFALockout(t *testing.T) {
+	// disable posts a code as userClaims, user 2, from an address no other test uses
+	disable := func(code string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/mfa/disable", strings.NewReader(`{"code":"`+code+`"}`))
+		req.RemoteAddr = "192.0.2.21:4321"
+		req = addClaimsToRequest(req, userClaims)
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(app.disableMFA).ServeHTTP(rr, req)
+		return rr
+	}
+
+	ctx := context.Background()
+	if err := app.Lockout.Unlock(ctx, "jack@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	defer app.Lockout.Unlock(ctx, "jack@example.com")
+
+	for i := 1; i < app.Lockout.Account.Threshold; i++ {
+		if rr := disable("zzzzz-zzzzz"); rr.Code != http.StatusBadRequest {
+			t.Fatalf("failure %d: expected status %d, got %d", i, http.StatusBadRequest, rr.Code)
+		}
+	}
+
+	if rr := disable("zzzzz-zzzzz"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected the last wrong code to lock the account out, got %d", rr.Code)
+	}
+
+	if rr := disable("zzzzz-zzzzz"); rr.Code != http.StatusTooManyRequests {
+		t.Errorf("expected a locked out account to be turned away, got %d", rr.Code)
+	}
+}
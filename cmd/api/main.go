@@ -1,29 +1,105 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
-	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/accounts"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
+	"github.com/calvarado2004/go-testing-webapp/pkg/config"
+	"github.com/calvarado2004/go-testing-webapp/pkg/cors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/keyring"
+	"github.com/calvarado2004/go-testing-webapp/pkg/lockout"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mailer"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/migrations"
+	"github.com/calvarado2004/go-testing-webapp/pkg/ratelimit"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"github.com/calvarado2004/go-testing-webapp/pkg/server"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
 	"log"
-	"net/http"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
-const port = 8090
-
 type application struct {
-	DSN       string
-	DB        repository.DatabaseRepo
-	Domain    string
-	JWTSecret string
+	DSN     string
+	DB      repository.DatabaseRepo
+	Domain  string
+	Keys    *keyring.Keyring
+	Mailer  mailer.Mailer
+	BaseURL string
+	Lockout *lockout.Limiter
+	Storage storage.Storage
+	Logger  *slog.Logger
+	Metrics *metrics.Metrics
+	Health  *server.Health
+	CORS    *cors.Policy
+
+	RateLimiter *ratelimit.Limiter
+	ClientIP    *clientip.Resolver
+
+	// Accounts sends the password reset and email verification emails
+	Accounts *accounts.Mailer
+
+	// attributes of the refresh token cookie
+	CookieDomain string
+	CookieSecure bool
 }
 
 func main() {
 	var app application
-	flag.StringVar(&app.Domain, "domain", "example.com", "Domain for application, e.g. company.com")
-	flag.StringVar(&app.DSN, "dsn", "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5", "Posgtres connection")
-	flag.StringVar(&app.JWTSecret, "jwt-secret", "2dce505d96a53c5768052ee90f3df2055657518dad489160df9913f66042e160", "signing secret")
-	flag.Parse()
+
+	// read the configuration from a file, the environment and the command line
+	cfg, err := config.Load(config.API, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.Domain = cfg.Domain
+	app.DSN = cfg.DSN
+	app.BaseURL = cfg.BaseURL
+	app.CookieDomain = cfg.Cookie.Domain
+	app.CookieSecure = cfg.Cookie.Secure
+	app.CORS = newCORS(cfg.CORS.Origins, cfg.CORS.MaxAge)
+	jwtTokenExpiry = cfg.JWT.AccessTokenTTL
+	refreshTokenExpiry = cfg.JWT.RefreshTokenTTL
+
+	app.ClientIP, err = clientip.New(cfg.TrustedProxies, cfg.ClientIPHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// log JSON lines, including what goes through the standard log package
+	app.Logger = logging.New(os.Stdout, cfg.LogLevel)
+	slog.SetDefault(app.Logger)
+
+	if cfg.JWT.KeysDir == "" {
+		app.Logger.Warn("signing tokens with the built-in demo key, set -jwt-keys outside of development")
+		app.Keys = keyring.Demo()
+	} else {
+		keys, err := keyring.Load(cfg.JWT.KeysDir, cfg.JWT.KID)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Keys = keys
+	}
+
+	if cfg.MailDir == "" {
+		app.Mailer = &mailer.LogMailer{}
+	} else {
+		app.Mailer = &mailer.FileMailer{Dir: cfg.MailDir}
+	}
+
+	// local images are served by the web app, under /media
+	app.Storage = cfg.NewStorage(app.BaseURL + "/media")
 
 	conn, err := app.connectToDB()
 	if err != nil {
@@ -31,12 +107,46 @@ func main() {
 	}
 	defer conn.Close()
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	if cfg.Migrate {
+		applied, err := migrations.Up(context.Background(), conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Logger.Info("applied migrations", "count", len(applied))
+	}
 
-	log.Printf("Starting api on port %d\n", port)
+	app.DB = &dbrepo.PostgresDBRepo{DB: conn, Logger: app.Logger}
+	app.Accounts = &accounts.Mailer{DB: app.DB, Mailer: app.Mailer, BaseURL: app.BaseURL}
+	app.Metrics = metrics.New("api", app.DB.Connection())
+	app.Health = &server.Health{Ping: app.DB.Connection().PingContext}
 
-	err = http.ListenAndServe(fmt.Sprintf(":%d", port), app.routes())
+	switch cfg.LockoutStore {
+	case "postgres":
+		app.Lockout = lockout.New(&lockout.PostgresStore{DB: conn})
+	case "memory":
+		app.Lockout = lockout.New(lockout.NewMemoryStore())
+	default:
+		log.Fatalf("unknown lockout store %q", cfg.LockoutStore)
+	}
+
+	switch cfg.RateLimit.Store {
+	case "postgres":
+		app.RateLimiter = app.newRateLimiter(&ratelimit.PostgresStore{DB: conn}, cfg.RateLimit.Limits())
+	case "memory":
+		app.RateLimiter = app.newRateLimiter(ratelimit.NewMemoryStore(), cfg.RateLimit.Limits())
+	default:
+		log.Fatalf("unknown rate limit store %q", cfg.RateLimit.Store)
+	}
+
+	// serve until SIGINT or SIGTERM, then drain in-flight requests; the
+	// deferred Close shuts the connection pool after that
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	err = server.Run(ctx, cfg.Addr(), app.routes(), cfg.Server, app.Health, app.Logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	app.Logger.Info("api stopped")
 }
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric scrapes the metrics handler, and returns the value of series,
+// or 0 if it has not been recorded yet.
+func scrapeMetric(t *testing.T, handler http.Handler, series string) float64 {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 scraping metrics, got %d", rr.Code)
+	}
+
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("bad value for %s: %s", series, value)
+			}
+			return f
+		}
+	}
+
+	return 0
+}
+
+func Test_app_metricsRoute(t *testing.T) {
+	routes := app.routes()
+	series := `api_http_requests_total{method="GET",route="/users/{userID}",status="200"}`
+
+	tokens, _ := app.generateTokenPair(context.Background(), &data.User{ID: 1, Email: "admin@example.com", IsAdmin: 1})
+
+	before := scrapeMetric(t, routes, series)
+
+	for _, path := range []string{"/users/1", "/users/2"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		req.Header.Set("Authorization", "Bearer "+tokens.Token)
+		routes.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	if after := scrapeMetric(t, routes, series); after != before+2 {
+		t.Errorf("expected %s to go from %v to %v, got %v", series, before, before+2, after)
+	}
+}
+
+func Test_app_metricsAuthentication(t *testing.T) {
+	var tests = []struct {
+		name          string
+		requestBody   string
+		expectedDelta map[string]float64
+	}{
+		{
+			"valid user",
+			`{"email":"admin@example.com","password":"secret"}`,
+			map[string]float64{`api_auth_attempts_total{result="success"}`: 1, `api_tokens_issued_total{grant="login"}`: 1},
+		},
+		{
+			"wrong password",
+			`{"email":"admin@example.com","password":"wrong"}`,
+			map[string]float64{`api_auth_attempts_total{result="failure"}`: 1, `api_tokens_issued_total{grant="login"}`: 0},
+		},
+		{
+			"second factor pending",
+			`{"email":"mfa@example.com","password":"secret"}`,
+			map[string]float64{`api_auth_attempts_total{result="success"}`: 0, `api_tokens_issued_total{grant="login"}`: 0},
+		},
+	}
+
+	for _, e := range tests {
+		before := make(map[string]float64)
+		for series := range e.expectedDelta {
+			before[series] = scrapeMetric(t, app.Metrics.Handler(), series)
+		}
+
+		req, _ := http.NewRequest("POST", "/auth", strings.NewReader(e.requestBody))
+		req.RemoteAddr = "192.0.2.1:1234"
+		http.HandlerFunc(app.authenticate).ServeHTTP(httptest.NewRecorder(), req)
+
+		for series, delta := range e.expectedDelta {
+			if after := scrapeMetric(t, app.Metrics.Handler(), series); after != before[series]+delta {
+				t.Errorf("%s: expected %s to go up by %v, got %v", e.name, series, delta, after-before[series])
+			}
+		}
+	}
+}
+
+func Test_app_metricsRefresh(t *testing.T) {
+	series := `api_tokens_issued_total{grant="refresh"}`
+
+	tokens, _ := app.generateTokenPair(context.Background(), &data.User{ID: 1, Email: "admin@example.com"})
+
+	before := scrapeMetric(t, app.Metrics.Handler(), series)
+
+	req, _ := http.NewRequest("GET", "/web/refresh-token", nil)
+	req.AddCookie(&http.Cookie{Name: "refresh_token", Value: tokens.RefreshToken})
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.refreshUsingCookie).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200, got %d", rr.Code)
+	}
+
+	if after := scrapeMetric(t, app.Metrics.Handler(), series); after != before+1 {
+		t.Errorf("expected %s to go from %v to %v, got %v", series, before, before+1, after)
+	}
+}
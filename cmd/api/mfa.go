@@ -0,0 +1,281 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mfa"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// mfaTokenExpiry is how long a user has to send their two-factor code after
+// their password.
+var mfaTokenExpiry = time.Minute * 5
+
+// errInvalidMFACode is returned for wrong two-factor and recovery codes alike.
+var errInvalidMFACode = errors.New("invalid two-factor code")
+
+// MFAChallenge is sent instead of a token pair when the password was right,
+// but the user still has to send a two-factor code to /auth/mfa.
+type MFAChallenge struct {
+	MFARequired bool   `json:"mfa_required"`
+	MFAToken    string `json:"mfa_token"`
+}
+
+// mfaAudience is the audience of MFA tokens. It differs from that of access
+// tokens, and MFA tokens carry no issuer, so neither can stand in for the other.
+func (app *application) mfaAudience() string {
+	return app.Domain + "/mfa"
+}
+
+// issueMFAToken returns a short-lived token which proves that user got their
+// password right.
+func (app *application) issueMFAToken(user *data.User) (string, error) {
+	claims := jwt.MapClaims{}
+	claims["sub"] = fmt.Sprint(user.ID)
+	claims["aud"] = app.mfaAudience()
+	claims["exp"] = time.Now().Add(mfaTokenExpiry).Unix()
+
+	return app.Keys.Sign(claims)
+}
+
+// parseMFAToken verifies an MFA token, and returns the id of its user.
+func (app *application) parseMFAToken(token string) (int, error) {
+	claims := &Claims{}
+
+	_, err := jwt.ParseWithClaims(token, claims, app.Keys.Keyfunc)
+	if err != nil {
+		return 0, err
+	}
+
+	if !claims.VerifyAudience(app.mfaAudience(), true) {
+		return 0, errors.New("not an mfa token")
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// verifyMFA completes a login which authenticate answered with an MFAChallenge,
+// given the MFA token and a two-factor or recovery code, and sends the token pair.
+func (app *application) verifyMFA(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		MFAToken string `json:"mfa_token"`
+		Code     string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	userID, err := app.parseMFAToken(payload.MFAToken)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	// codes are guessed at like passwords, so they count towards the lockout
+	if !app.checkLockout(w, r, user.Email) {
+		return
+	}
+
+	ok, err := mfa.CheckSecondFactor(r.Context(), app.DB, userID, payload.Code)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking second factor", "user_id", userID, "error", err)
+	}
+	if !ok {
+		app.loginFailed(w, r, user.Email, errInvalidMFACode)
+		return
+	}
+
+	tokenPairs, err := app.generateTokenPair(r.Context(), user)
+	if err != nil {
+		app.errorJSON(w, errors.New("unauthorized"), http.StatusUnauthorized)
+		return
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+	app.Metrics.AuthAttempt(metrics.AuthSuccess)
+	app.Metrics.TokenIssued(metrics.TokenLogin)
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     "refresh_token",
+		Path:     "/",
+		Value:    tokenPairs.RefreshToken,
+		Expires:  time.Now().Add(refreshTokenExpiry),
+		MaxAge:   int(refreshTokenExpiry.Seconds()),
+		Domain:   app.CookieDomain,
+		SameSite: http.SameSiteStrictMode,
+		HttpOnly: true,
+		Secure:   app.CookieSecure,
+	})
+
+	_ = app.writeJSON(w, http.StatusOK, tokenPairs)
+}
+
+// currentUserID returns the id of the user the request's access token was issued to.
+func currentUserID(r *http.Request) (int, error) {
+	claims := claimsFromContext(r.Context())
+	if claims == nil {
+		return 0, errors.New("unauthorized")
+	}
+
+	return strconv.Atoi(claims.Subject)
+}
+
+// setupMFA starts two-factor enrollment for the current user, and sends their
+// secret, both on its own and as an otpauth:// URL for QR codes. Calling it again
+// sends the same secret until enrollment ends with enableMFA.
+func (app *application) setupMFA(w http.ResponseWriter, r *http.Request) {
+	userID, err := currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	key, err := mfa.PendingKey(r.Context(), app.DB, user.ID, user.Email)
+	if errors.Is(err, dbrepo.ErrTOTPEnabled) {
+		app.errorJSON(w, err, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, map[string]string{
+		"secret":      key.Secret,
+		"otpauth_url": key.URI,
+	})
+}
+
+// enableMFA turns on two-factor authentication once the user confirms the secret
+// from setupMFA with a code, and sends their recovery codes, which are not
+// stored in plain text and can't be shown again.
+func (app *application) enableMFA(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	t, err := app.DB.GetTOTP(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	if t.Enabled() {
+		app.errorJSON(w, dbrepo.ErrTOTPEnabled, http.StatusConflict)
+		return
+	}
+
+	if t.Secret == "" || !mfa.Validate(payload.Code, t.Secret) {
+		app.errorJSON(w, errInvalidMFACode, http.StatusBadRequest)
+		return
+	}
+
+	codes, err := mfa.NewRecoveryCodes(mfa.RecoveryCodeCount)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = data.HashToken(mfa.NormalizeRecoveryCode(code))
+	}
+
+	err = app.DB.EnableTOTP(r.Context(), userID, hashes)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	_ = app.writeJSON(w, http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// disableMFA turns off two-factor authentication for the current user, given a
+// two-factor or recovery code. Wrong codes count towards the login lockout.
+func (app *application) disableMFA(w http.ResponseWriter, r *http.Request) {
+	var payload struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &payload)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusBadRequest)
+		return
+	}
+
+	userID, err := currentUserID(r)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusNotFound)
+		return
+	}
+
+	// codes are guessed at like passwords, so they count towards the lockout
+	// here too, or a stolen access token could try recovery codes at will
+	if !app.checkLockout(w, r, user.Email) {
+		return
+	}
+
+	ok, err := mfa.CheckSecondFactor(r.Context(), app.DB, userID, payload.Code)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		app.attemptFailed(w, r, user.Email, errInvalidMFACode, http.StatusBadRequest)
+		return
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+
+	err = app.DB.DisableTOTP(r.Context(), userID)
+	if err != nil {
+		app.errorJSON(w, err, http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/pquerna/otp/totp"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_app_authenticateWithMFA(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"mfa@example.com","password":"secret"}`))
+	rr := httptest.NewRecorder()
+
+	http.HandlerFunc(app.authenticate).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Fatalf("expected status %d, got %d", http.StatusAccepted, rr.Code)
+	}
+
+	var challenge MFAChallenge
+	if err := json.NewDecoder(rr.Body).Decode(&challenge); err != nil {
+		t.Fatal(err)
+	}
+
+	if !challenge.MFARequired || challenge.MFAToken == "" {
+		t.Errorf("expected an mfa challenge, got %+v", challenge)
+	}
+
+	if len(rr.Result().Cookies()) != 0 {
+		t.Error("expected no refresh cookie before the second factor")
+	}
+
+	// the mfa token must not work as an access token
+	req, _ = http.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+challenge.MFAToken)
+
+	if _, _, err := app.getTokenFromHeaderAndVerify(httptest.NewRecorder(), req); err == nil {
+		t.Error("expected the mfa token to be rejected as an access token")
+	}
+}
+
+func Test_app_verifyMFA(t *testing.T) {
+	mfaToken, err := app.issueMFAToken(&data.User{ID: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expiredMFAToken, err := app.Keys.Sign(jwt.MapClaims{
+		"sub": "6",
+		"aud": app.mfaAudience(),
+		"exp": time.Now().Add(-time.Minute).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	accessToken, err := app.generateTokenPair(context.Background(), &data.User{ID: 6})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, err := totp.GenerateCode(dbrepo.TestTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name               string
+		mfaToken           string
+		code               string
+		expectedStatusCode int
+	}{
+		{"valid code", mfaToken, code, http.StatusOK},
+		{"replayed code", mfaToken, code, http.StatusUnauthorized},
+		{"wrong code", mfaToken, "000000", http.StatusUnauthorized},
+		{"recovery code", mfaToken, dbrepo.TestRecoveryCode, http.StatusOK},
+		{"spent recovery code", mfaToken, dbrepo.TestRecoveryCode, http.StatusUnauthorized},
+		{"expired mfa token", expiredMFAToken, code, http.StatusUnauthorized},
+		{"access token", accessToken.Token, code, http.StatusUnauthorized},
+		{"no mfa token", "", code, http.StatusUnauthorized},
+	}
+
+	for _, e := range tests {
+		body, _ := json.Marshal(map[string]string{"mfa_token": e.mfaToken, "code": e.code})
+		req, _ := http.NewRequest("POST", "/auth/mfa", strings.NewReader(string(body)))
+		rr := httptest.NewRecorder()
+
+		http.HandlerFunc(app.verifyMFA).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatusCode {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatusCode, rr.Code)
+		}
+
+		if e.expectedStatusCode == http.StatusOK {
+			var pair TokenPairs
+			if err := json.NewDecoder(rr.Body).Decode(&pair); err != nil || pair.Token == "" {
+				t.Errorf("%s: expected a token pair, got %v", e.name, err)
+			}
+		}
+	}
+}
+
+func Test_app_mfaEnrollment(t *testing.T) {
+	// serve runs handler as userClaims, user 2
+	serve := func(handler http.HandlerFunc, body string) *httptest.ResponseRecorder {
+		r, _ := http.NewRequest("POST", "/", strings.NewReader(body))
+		r = addClaimsToRequest(r, userClaims)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, r)
+		return rr
+	}
+
+	rr := serve(app.setupMFA, "")
+	if rr.Code != http.StatusOK {
+		t.Fatalf("setup: expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var setup struct {
+		Secret     string `json:"secret"`
+		OTPAuthURL string `json:"otpauth_url"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&setup); err != nil {
+		t.Fatal(err)
+	}
+
+	if setup.Secret == "" || !strings.HasPrefix(setup.OTPAuthURL, "otpauth://totp/") {
+		t.Fatalf("setup: unexpected response %+v", setup)
+	}
+
+	// setting up again sends the same secret, which an app may hold already
+	again := setup
+	if err := json.NewDecoder(serve(app.setupMFA, "").Body).Decode(&again); err != nil {
+		t.Fatal(err)
+	}
+
+	if again != setup {
+		t.Fatalf("setup again: expected %+v, got %+v", setup, again)
+	}
+
+	if rr := serve(app.enableMFA, `{"code":"000000"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("enable with a wrong code: expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	code, _ := totp.GenerateCode(setup.Secret, time.Now())
+
+	rr = serve(app.enableMFA, `{"code":"`+code+`"}`)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("enable: expected status %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.NewDecoder(rr.Body).Decode(&enabled); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(enabled.RecoveryCodes) != 10 {
+		t.Errorf("enable: expected 10 recovery codes, got %d", len(enabled.RecoveryCodes))
+	}
+
+	if rr := serve(app.setupMFA, ""); rr.Code != http.StatusConflict {
+		t.Errorf("setup when enabled: expected status %d, got %d", http.StatusConflict, rr.Code)
+	}
+
+	if rr := serve(app.disableMFA, `{"code":"000000"}`); rr.Code != http.StatusBadRequest {
+		t.Errorf("disable with a wrong code: expected status %d, got %d", http.StatusBadRequest, rr.Code)
+	}
+
+	if rr := serve(app.disableMFA, `{"code":"`+enabled.RecoveryCodes[0]+`"}`); rr.Code != http.StatusNoContent {
+		t.Errorf("disable: expected status %d, got %d", http.StatusNoContent, rr.Code)
+	}
+}
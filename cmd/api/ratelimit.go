@@ -0,0 +1,43 @@
+package main
+
+import (
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/ratelimit"
+	"net/http"
+)
+
+// errTooManyRequests is returned, with a Retry-After header, to clients over
+// a rate limit.
+var errTooManyRequests = errors.New("too many requests")
+
+// newRateLimiter returns the rate limiter of the API, with limits per route
+// group: auth, refresh and users.
+func (app *application) newRateLimiter(store ratelimit.Store, limits map[string]ratelimit.Limit) *ratelimit.Limiter {
+	l := ratelimit.New(store, limits, app.Logger)
+	l.Denied = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		app.errorJSON(w, errTooManyRequests, http.StatusTooManyRequests)
+	})
+
+	return l
+}
+
+// rateLimit limits the requests of a route group per client address.
+func (app *application) rateLimit(group string) func(http.Handler) http.Handler {
+	return app.RateLimiter.Middleware(group, func(r *http.Request) string {
+		return "ip:" + app.ClientIP.IP(r)
+	})
+}
+
+// rateLimitUser limits the requests of a route group per user, for requests
+// with a valid access token, and per client address otherwise. It checks the
+// token itself, so that it runs before authRequired and also counts the
+// requests that authRequired refuses.
+func (app *application) rateLimitUser(group string) func(http.Handler) http.Handler {
+	return app.RateLimiter.Middleware(group, func(r *http.Request) string {
+		if _, claims, err := app.verifyAuthHeader(r); err == nil {
+			return "user:" + claims.Subject
+		}
+
+		return "ip:" + app.ClientIP.IP(r)
+	})
+}
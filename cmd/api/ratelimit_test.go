@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/ratelimit"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_app_rateLimit(t *testing.T) {
+	limiter := app.RateLimiter
+	defer func() { app.RateLimiter = limiter }()
+
+	app.RateLimiter = app.newRateLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		"auth":  {Requests: 2, Period: time.Minute},
+		"users": {Requests: 1, Period: time.Minute},
+	})
+	routes := app.routes()
+
+	admin, _ := app.generateTokenPair(context.Background(), &data.User{ID: 1, Email: "admin@example.com", IsAdmin: 1})
+	other, _ := app.generateTokenPair(context.Background(), &data.User{ID: 2, Email: "jack@example.com"})
+
+	var tests = []struct {
+		name            string
+		method          string
+		path            string
+		body            string
+		remoteAddr      string
+		token           string
+		expectStatus    int
+		expectRemaining string
+	}{
+		{"first login", "POST", "/auth", `{"email":"admin@example.com","password":"wrong"}`, "10.0.0.1:1234", "", http.StatusUnauthorized, "1"},
+		{"second login", "POST", "/web/auth", `{"email":"admin@example.com","password":"wrong"}`, "10.0.0.1:1234", "", http.StatusUnauthorized, "0"},
+		{"third login", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "10.0.0.1:1234", "", http.StatusTooManyRequests, "0"},
+		{"login from another address", "POST", "/auth", `{"email":"admin@example.com","password":"secret"}`, "10.0.0.2:1234", "", http.StatusOK, "1"},
+		{"refresh without a limit", "POST", "/refresh-token", `{"refresh_token":"bad"}`, "10.0.0.1:1234", "", http.StatusBadRequest, ""},
+		{"first user request", "GET", "/users/2", "", "10.0.0.1:1234", other.Token, http.StatusOK, "0"},
+		{"second user request", "GET", "/users/2", "", "10.0.0.2:1234", other.Token, http.StatusTooManyRequests, "0"},
+		{"other user", "GET", "/users/2", "", "10.0.0.1:1234", admin.Token, http.StatusOK, "0"},
+		{"forged token", "GET", "/users/2", "", "10.0.0.3:1234", hmacToken, http.StatusUnauthorized, "0"},
+		{"forged token again", "GET", "/users/2", "", "10.0.0.3:1234", hmacToken, http.StatusTooManyRequests, "0"},
+		{"no token to mfa", "POST", "/mfa/setup", "", "10.0.0.4:1234", "", http.StatusUnauthorized, "0"},
+		{"no token to mfa again", "POST", "/mfa/disable", "", "10.0.0.4:1234", "", http.StatusTooManyRequests, "0"},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest(e.method, e.path, strings.NewReader(e.body))
+		req.RemoteAddr = e.remoteAddr
+		if e.token != "" {
+			req.Header.Set("Authorization", "Bearer "+e.token)
+		}
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectStatus, rr.Code)
+		}
+
+		if got := rr.Header().Get("RateLimit-Remaining"); got != e.expectRemaining {
+			t.Errorf("%s: expected RateLimit-Remaining %q, got %q", e.name, e.expectRemaining, got)
+		}
+
+		if e.expectStatus == http.StatusTooManyRequests {
+			if rr.Header().Get("Retry-After") == "" {
+				t.Errorf("%s: expected a Retry-After header", e.name)
+			}
+
+			if !strings.Contains(rr.Body.String(), errTooManyRequests.Error()) {
+				t.Errorf("%s: expected a JSON error, got %s", e.name, rr.Body.String())
+			}
+		}
+	}
+}
+
+func Test_app_rateLimitBehindProxy(t *testing.T) {
+	limiter, resolver := app.RateLimiter, app.ClientIP
+	defer func() { app.RateLimiter, app.ClientIP = limiter, resolver }()
+
+	app.RateLimiter = app.newRateLimiter(ratelimit.NewMemoryStore(), map[string]ratelimit.Limit{
+		"auth": {Requests: 1, Period: time.Minute},
+	})
+	app.ClientIP, _ = clientip.New([]string{"10.0.0.0/8"}, clientip.XForwardedFor)
+	routes := app.routes()
+
+	var tests = []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  string
+		expectAllowed bool
+	}{
+		{"client through the proxy", "10.0.0.1:1234", "198.51.100.7", true},
+		{"same client again", "10.0.0.1:1234", "198.51.100.7", false},
+		{"same client spoofing an address", "10.0.0.1:1234", "203.0.113.9, 198.51.100.7", false},
+		{"other client through the proxy", "10.0.0.1:1234", "198.51.100.8", true},
+		{"untrusted client sending the header", "192.0.2.1:1234", "198.51.100.9", true},
+		{"untrusted client spoofing another", "192.0.2.1:1234", "198.51.100.10", false},
+	}
+
+	for _, e := range tests {
+		req, _ := http.NewRequest("POST", "/auth", strings.NewReader(`{"email":"admin@example.com","password":"wrong"}`))
+		req.RemoteAddr = e.remoteAddr
+		req.Header.Set("X-Forwarded-For", e.forwardedFor)
+		rr := httptest.NewRecorder()
+
+		routes.ServeHTTP(rr, req)
+
+		if allowed := rr.Code != http.StatusTooManyRequests; allowed != e.expectAllowed {
+			t.Errorf("%s: expected allowed %v, got status %d", e.name, e.expectAllowed, rr.Code)
+		}
+	}
+}
@@ -3,14 +3,17 @@ package main
 import (
 	"flag"
 	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/keyring"
 	"github.com/golang-jwt/jwt/v4"
 	"log"
 	"time"
 )
 
 type application struct {
-	JWTSecret string
-	Action    string
+	JWTKeys string
+	JWTKID  string
+	Action  string
 }
 
 // This is used to generate a token, so that we can test our api. Run this with go run ./cmd/cli and copy
@@ -21,28 +24,31 @@ type application struct {
 // main is the entry point for the application.
 func main() {
 	var app application
-	flag.StringVar(&app.JWTSecret, "jwt-secret", "2dce505d96a53c5768052ee90f3df2055657518dad489160df9913f66042e160", "secret")
+	flag.StringVar(&app.JWTKeys, "jwt-keys", "", "directory of PEM signing keys; the built-in demo key is used if empty")
+	flag.StringVar(&app.JWTKID, "jwt-kid", "", "id of the key to sign with; defaults to the newest key")
 	flag.StringVar(&app.Action, "action", "valid", "action: valid|expired")
 	flag.Parse()
 
-	// generate a token
-	token := jwt.New(jwt.SigningMethodHS256)
+	// use the same keys as the api, so that it accepts the token
+	keys := keyring.Demo()
+	if app.JWTKeys != "" {
+		var err error
+		keys, err = keyring.Load(app.JWTKeys, app.JWTKID)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// mint the claims the api issues to an admin, so that every route accepts the token
+	user := &data.User{ID: 1, FirstName: "John", LastName: "Doe", IsAdmin: 1}
+	roles := []*data.Role{{Name: data.RoleAdmin, Permissions: data.AllPermissions}}
 
-	// set claims
-	claims := token.Claims.(jwt.MapClaims)
-	claims["name"] = "John Doe"
-	claims["sub"] = "1"
-	claims["admin"] = true
-	claims["aud"] = "example.com"
-	claims["iss"] = "example.com"
 	// leave this to 3 days, for easy manual testing
-	if app.Action == "valid" {
-		expires := time.Now().UTC().Add(time.Hour * 72)
-		claims["exp"] = expires.Unix()
-	} else {
-		expires := time.Now().UTC().Add(time.Hour * 100 * -1)
-		claims["exp"] = expires.Unix()
+	expires := time.Now().UTC().Add(time.Hour * 72)
+	if app.Action != "valid" {
+		expires = time.Now().UTC().Add(time.Hour * 100 * -1)
 	}
+	claims := jwt.MapClaims(data.AccessClaims(user, roles, "example.com", expires))
 
 	// create the token as a slice of bytes
 	if app.Action == "valid" {
@@ -50,7 +56,7 @@ func main() {
 	} else {
 		fmt.Println("EXPIRED Token:")
 	}
-	signedAccessToken, err := token.SignedString([]byte(app.JWTSecret))
+	signedAccessToken, err := keys.Sign(claims)
 	if err != nil {
 		log.Fatal(err)
 	}
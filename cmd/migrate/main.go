@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/calvarado2004/go-testing-webapp/pkg/migrations"
+	_ "github.com/jackc/pgconn"
+	_ "github.com/jackc/pgx/v4"
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+//go run ./cmd/migrate status
+//go run ./cmd/migrate up
+//go run ./cmd/migrate down 1
+//go run ./cmd/migrate to 1
+//go run ./cmd/migrate create add_something
+
+const usage = `usage: migrate [flags] <command>
+
+commands:
+  up             apply every pending migration
+  down [n]       roll back the last n migrations (default 1)
+  to <version>   migrate up or down to version; 0 rolls back everything
+  status         list migrations and whether they are applied
+  create <name>  write an empty pair of migration files to -dir
+
+flags:
+`
+
+func main() {
+	dsn := flag.String("dsn", os.Getenv("DSN"), "Postgres DSN")
+	dir := flag.String("dir", "pkg/migrations/sql", "directory new migrations are created in")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	// create only writes files, so it doesn't need a database
+	if args[0] == "create" {
+		if len(args) != 2 {
+			log.Fatal("create needs a migration name")
+		}
+
+		up, down, err := migrations.Create(*dir, args[1])
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("created %s\ncreated %s\n", up, down)
+		return
+	}
+
+	db, err := sql.Open("pgx", *dsn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer db.Close()
+
+	m, err := migrations.New(db)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	var done []migrations.Migration
+
+	switch args[0] {
+	case "up":
+		done, err = m.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("invalid number of steps %q", args[1])
+			}
+		}
+		done, err = m.Down(ctx, steps)
+	case "to":
+		if len(args) != 2 {
+			log.Fatal("to needs a version")
+		}
+		version, perr := strconv.ParseInt(args[1], 10, 64)
+		if perr != nil {
+			log.Fatalf("invalid version %q", args[1])
+		}
+		done, err = m.To(ctx, version)
+	case "status":
+		statuses, err := m.Status(ctx)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = "applied " + s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%04d %-40s %s\n", s.Version, s.Name, applied)
+		}
+		return
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	for _, migration := range done {
+		fmt.Printf("%04d %s\n", migration.Version, migration.Name)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if len(done) == 0 {
+		fmt.Println("nothing to do")
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"net/http"
+	"strings"
+)
+
+// AccountPage shows the forms to edit the user's profile and change their password
+func (app *application) AccountPage(w http.ResponseWriter, r *http.Request) {
+
+	err := app.render(w, r, "account.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// UpdateProfile saves the name and email address of the user, once they have
+// confirmed it is them with their current password. A new email address has to
+// be confirmed, like the one they signed up with.
+func (app *application) UpdateProfile(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+
+	if form.Errors.Get("email") == "" {
+		other, err := app.DB.GetUserByEmail(r.Context(), form.Data.Get("email"))
+		form.Check(err != nil || other.ID == user.ID, "email", "An account with this email address already exists")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("first_name", "last_name", "email"))
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return
+	}
+
+	emailChanged := !strings.EqualFold(user.Email, form.Data.Get("email"))
+
+	user.FirstName = form.Data.Get("first_name")
+	user.LastName = form.Data.Get("last_name")
+	user.Email = form.Data.Get("email")
+
+	err = app.DB.UpdateUser(r.Context(), *user)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "updating profile", "user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "Your profile could not be saved, please try again.")
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return
+	}
+
+	flash := "Your profile has been saved."
+	if emailChanged {
+		if err := app.DB.UnverifyEmail(r.Context(), user.ID); err != nil {
+			app.Logger.ErrorContext(r.Context(), "unverifying email", "user_id", user.ID, "error", err)
+		}
+
+		if err := app.Accounts.SendEmailVerification(r.Context(), user); err != nil {
+			app.Logger.ErrorContext(r.Context(), "sending email verification", "user_id", user.ID, "error", err)
+		}
+
+		flash = "Your profile has been saved. Follow the link we've emailed to your new address to confirm it."
+	}
+
+	app.accountChanged(r.Context(), user.ID)
+
+	app.Session.Put(r.Context(), "flash", flash)
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// ChangePassword sets a new password for the user, once they have confirmed it
+// is them with their current password. Like any password reset, it signs them
+// out of the API everywhere.
+func (app *application) ChangePassword(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user, ok := app.confirmPassword(w, r)
+	if !ok {
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("password", "confirm_password")
+	form.StrongPassword("password")
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "The passwords do not match")
+	form.Check(form.Data.Get("password") != form.Data.Get("current_password"), "password", "The new password must be different from the current one")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("password", "confirm_password"))
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.ResetPassword(r.Context(), user.ID, form.Data.Get("password"))
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "changing password", "user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "Your password could not be changed, please try again.")
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return
+	}
+
+	app.accountChanged(r.Context(), user.ID)
+
+	app.Session.Put(r.Context(), "flash", "Your password has been changed.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// confirmPassword loads the signed in user from the database, and checks the
+// current_password of the posted form against it. If it doesn't match, it
+// redirects back to the account page and returns false. Wrong passwords count
+// towards the login lockout, so that a stolen session can't be used to guess
+// at the password.
+func (app *application) confirmPassword(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+
+	sessionUser := app.Session.Get(r.Context(), "user").(data.User)
+
+	user, err := app.DB.GetUser(r.Context(), sessionUser.ID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "loading user", "user_id", sessionUser.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	ip := app.ipFromContext(r.Context())
+
+	wait, err := app.Lockout.Check(r.Context(), user.Email, ip)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking login lockout", "error", err)
+	}
+	if wait > 0 {
+		app.Session.Put(r.Context(), "error", lockedOutMessage(wait))
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return nil, false
+	}
+
+	matches, err := user.PasswordMatches(r.PostForm.Get("current_password"))
+	if err != nil || !matches {
+		app.Metrics.AuthAttempt(metrics.AuthFailure)
+
+		msg := "Your current password is not correct"
+
+		wait, err := app.Lockout.Fail(r.Context(), user.Email, ip)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "recording failed login", "error", err)
+		}
+		if wait > 0 {
+			msg = lockedOutMessage(wait)
+		}
+
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/user/account", http.StatusSeeOther)
+		return nil, false
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+
+	return user, true
+}
+
+// accountChanged reloads the user in the session after their profile or
+// password changed, and gives the session a new id, so that a copy of the old
+// cookie doesn't stay signed in to the changed account.
+func (app *application) accountChanged(ctx context.Context, userID int) {
+
+	if err := app.renewSession(ctx); err != nil {
+		app.Logger.ErrorContext(ctx, "renewing session", "user_id", userID, "error", err)
+	}
+
+	app.refreshSessionUser(ctx, userID)
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// accountUser is a test account with the password "secret"
+var accountUser = data.User{ID: 6, FirstName: "Mia", LastName: "Factor", Email: "mfa@example.com"}
+
+// Test_app_AccountPage tests that the account page shows the user's details
+func Test_app_AccountPage(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/user/account", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", accountUser)
+
+	rw := httptest.NewRecorder()
+	http.HandlerFunc(app.AccountPage).ServeHTTP(rw, req)
+
+	body := rw.Body.String()
+	for _, s := range []string{`value="mfa@example.com"`, `action="/user/account"`, `action="/user/password"`, `name="current_password"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the account page to contain %q", s)
+		}
+	}
+}
+
+// Test_app_accountForms tests editing the profile and changing the password
+func Test_app_accountForms(t *testing.T) {
+
+	profile := url.Values{
+		"first_name":       {"Mia"},
+		"last_name":        {"Factor"},
+		"email":            {"mia@example.com"},
+		"current_password": {"secret"},
+	}
+
+	password := url.Values{
+		"current_password": {"secret"},
+		"password":         {"new secret 1"},
+		"confirm_password": {"new secret 1"},
+	}
+
+	with := func(v url.Values, key, value string) url.Values {
+		c := url.Values{}
+		for k, vs := range v {
+			c[k] = vs
+		}
+		c.Set(key, value)
+		return c
+	}
+
+	var theTests = []struct {
+		name             string
+		handler          http.HandlerFunc
+		form             url.Values
+		expectedLocation string
+		expectedError    string
+		expectedFlash    string
+	}{
+		{"update profile", app.UpdateProfile, profile, "/user/profile", "", "Your profile has been saved. Follow the link we've emailed to your new address to confirm it."},
+		{"update profile keeping email", app.UpdateProfile, with(profile, "email", "mfa@example.com"), "/user/profile", "", "Your profile has been saved."},
+		{"update profile with wrong password", app.UpdateProfile, with(profile, "current_password", "wrong"), "/user/account", "Your current password is not correct", ""},
+		{"update profile without password", app.UpdateProfile, with(profile, "current_password", ""), "/user/account", "Your current password is not correct", ""},
+		{"update profile without name", app.UpdateProfile, with(profile, "last_name", ""), "/user/account", "This field cannot be blank", ""},
+		{"update profile with bad email", app.UpdateProfile, with(profile, "email", "mia"), "/user/account", "This field must be a valid email address", ""},
+		{"update profile with taken email", app.UpdateProfile, with(profile, "email", "admin@example.com"), "/user/account", "An account with this email address already exists", ""},
+		{"change password", app.ChangePassword, password, "/user/profile", "", "Your password has been changed."},
+		{"change password with wrong password", app.ChangePassword, with(password, "current_password", "wrong"), "/user/account", "Your current password is not correct", ""},
+		{"change password to a weak one", app.ChangePassword, with(with(password, "password", "password"), "confirm_password", "password"), "/user/account", "The password must mix letters with digits or symbols", ""},
+		{"change password to a short one", app.ChangePassword, with(with(password, "password", "abc1"), "confirm_password", "abc1"), "/user/account", "The password must be at least 8 characters long", ""},
+		{"change password mismatch", app.ChangePassword, with(password, "confirm_password", "other secret 1"), "/user/account", "The passwords do not match", ""},
+	}
+
+	for _, tt := range theTests {
+		testMail.Reset()
+
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", accountUser)
+		csrf := app.csrfToken(req.Context())
+
+		rw := httptest.NewRecorder()
+		tt.handler.ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected %d; got %d", tt.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		if e := app.Session.GetString(req.Context(), "error"); e != tt.expectedError {
+			t.Errorf("%s: expected error %q; got %q", tt.name, tt.expectedError, e)
+		}
+
+		if f := app.Session.GetString(req.Context(), "flash"); f != tt.expectedFlash {
+			t.Errorf("%s: expected flash %q; got %q", tt.name, tt.expectedFlash, f)
+		}
+
+		// a change renews the session, and reloads the user in it
+		changed := tt.expectedFlash != ""
+		if renewed := app.Session.GetString(req.Context(), csrfSessionKey) != csrf; renewed != changed {
+			t.Errorf("%s: expected the session to be renewed %v; got %v", tt.name, changed, renewed)
+		}
+
+		if user, _ := app.Session.Get(req.Context(), "user").(data.User); changed && user.Password == "" {
+			t.Errorf("%s: expected the user in the session to be reloaded", tt.name)
+		}
+
+		// only a new email address has to be confirmed
+		newEmail := changed && tt.form.Get("email") == "mia@example.com"
+		if sent := verifyLink.MatchString(testMail.String()); sent != newEmail {
+			t.Errorf("%s: expected an email verification sent %v; got %v", tt.name, newEmail, sent)
+		}
+		if newEmail && !strings.Contains(testMail.String(), "To: mia@example.com") {
+			t.Errorf("%s: expected the link to go to the new address; got %s", tt.name, testMail.String())
+		}
+	}
+}
+
+// Test_app_confirmPasswordLockout tests that guessing at the current password
+// counts towards the login lockout
+func Test_app_confirmPasswordLockout(t *testing.T) {
+
+	ctx := context.Background()
+	defer app.Lockout.Unlock(ctx, accountUser.Email)
+
+	// the failures before the last one allowed
+	for i := 1; i < app.Lockout.Account.Threshold; i++ {
+		if _, err := app.Lockout.Fail(ctx, accountUser.Email, "unknown"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	post := func(password string) string {
+		form := url.Values{"current_password": {password}, "password": {"new secret 1"}, "confirm_password": {"new secret 1"}}
+		req, _ := http.NewRequest("POST", "/", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req = addContextAndSessionToRequest(req, app)
+		app.Session.Put(req.Context(), "user", accountUser)
+
+		rw := httptest.NewRecorder()
+		http.HandlerFunc(app.ChangePassword).ServeHTTP(rw, req)
+
+		return app.Session.GetString(req.Context(), "error")
+	}
+
+	if e := post("wrong"); !strings.HasPrefix(e, "Too many failed login attempts") {
+		t.Errorf("expected the last wrong password to lock the account out; got %q", e)
+	}
+
+	// even the right password is turned away while locked out
+	if e := post("secret"); !strings.HasPrefix(e, "Too many failed login attempts") {
+		t.Errorf("expected a locked out account to be turned away; got %q", e)
+	}
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/url"
+)
+
+// ForgotPasswordPage is the handler for the page asking for the email address of
+// the account to reset
+func (app *application) ForgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+
+	err := app.render(w, r, "forgot-password.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// ForgotPassword emails a password reset link to the address posted, if it
+// belongs to an account
+func (app *application) ForgotPassword(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("email")
+	form.IsEmail("email")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("email"))
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	// answer the same way whether or not there is such an account, so that the
+	// form can't be used to find out who is signed up
+	user, err := app.DB.GetUserByEmail(r.Context(), form.Data.Get("email"))
+	if err == nil {
+		if err := app.Accounts.SendPasswordReset(r.Context(), user); err != nil {
+			app.Logger.ErrorContext(r.Context(), "sending password reset", "user_id", user.ID, "error", err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", "If that address belongs to an account, we've sent it a link to reset the password.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// ResetPasswordPage is the handler for the page where a new password is chosen,
+// reached from the link in a password reset email
+func (app *application) ResetPasswordPage(w http.ResponseWriter, r *http.Request) {
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err := app.render(w, r, "reset-password.page.gohtml", &TemplateData{
+		Data: map[string]any{"token": token},
+	})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// ResetPassword spends a password reset token and sets the new password
+func (app *application) ResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("token", "password", "confirm_password")
+	form.MinLength("password", data.MinPasswordLength)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "The passwords do not match")
+
+	if !form.Has("token") {
+		app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("password", "confirm_password"))
+		http.Redirect(w, r, "/reset-password?token="+url.QueryEscape(form.Data.Get("token")), http.StatusSeeOther)
+		return
+	}
+
+	token, err := app.DB.UseToken(r.Context(), data.ScopePasswordReset, form.Data.Get("token"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "That reset link is invalid or has expired.")
+		http.Redirect(w, r, "/forgot-password", http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.ResetPassword(r.Context(), token.UserID, form.Data.Get("password"))
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting password", "user_id", token.UserID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your password has been reset, you can now log in.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// RegisterPage is the handler for the sign up page
+func (app *application) RegisterPage(w http.ResponseWriter, r *http.Request) {
+
+	err := app.render(w, r, "register.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// Register creates an account from the sign up form, and emails a link to
+// verify its address. The account can't log in until the link is followed.
+func (app *application) Register(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password", "confirm_password")
+	form.IsEmail("email")
+	form.MinLength("password", data.MinPasswordLength)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "The passwords do not match")
+
+	if form.Errors.Get("email") == "" {
+		_, err := app.DB.GetUserByEmail(r.Context(), form.Data.Get("email"))
+		form.Check(err != nil, "email", "An account with this email address already exists")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("first_name", "last_name", "email", "password", "confirm_password"))
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	user := data.User{
+		FirstName: form.Data.Get("first_name"),
+		LastName:  form.Data.Get("last_name"),
+		Email:     form.Data.Get("email"),
+		Password:  form.Data.Get("password"),
+	}
+
+	user.ID, err = app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "registering user", "error", err)
+		app.Session.Put(r.Context(), "error", "We couldn't create your account, please try again.")
+		http.Redirect(w, r, "/register", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Accounts.SendEmailVerification(r.Context(), &user); err != nil {
+		app.Logger.ErrorContext(r.Context(), "sending email verification", "user_id", user.ID, "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your account has been created. Follow the link we've emailed you to confirm your address, then log in.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// VerifyEmail is the handler for the link in an email verification message
+func (app *application) VerifyEmail(w http.ResponseWriter, r *http.Request) {
+
+	token, err := app.DB.UseToken(r.Context(), data.ScopeEmailVerification, r.URL.Query().Get("token"))
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "That confirmation link is invalid or has expired. Log in to get a new one.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.VerifyEmail(r.Context(), token.UserID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "verifying email", "user_id", token.UserID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "Your email address has been confirmed, you can now log in.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// resetLink matches the token of a password reset link in a sent email
+var resetLink = regexp.MustCompile(`/reset-password\?token=([A-Za-z0-9_-]+)`)
+
+// lastResetToken returns the token of the last password reset link mailed, if any
+func lastResetToken() string {
+	matches := resetLink.FindAllStringSubmatch(testMail.String(), -1)
+	if len(matches) == 0 {
+		return ""
+	}
+
+	return matches[len(matches)-1][1]
+}
+
+// postForm posts values to handler, and returns the response and the request,
+// whose context holds the session
+func postForm(handler http.HandlerFunc, values url.Values) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw, req
+}
+
+// Test_app_ForgotPassword tests that a reset link is only mailed for known accounts
+func Test_app_ForgotPassword(t *testing.T) {
+
+	var theTests = []struct {
+		name             string
+		email            string
+		expectedLocation string
+		expectMail       bool
+	}{
+		{"known account", "admin@example.com", "/", true},
+		{"unknown account", "nobody@example.com", "/", false},
+		{"invalid email", "not an email", "/forgot-password", false},
+		{"missing email", "", "/forgot-password", false},
+	}
+
+	for _, tt := range theTests {
+		testMail.Reset()
+
+		rw, _ := postForm(app.ForgotPassword, url.Values{"email": {tt.email}})
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected %d; got %d", tt.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		sent := lastResetToken() != ""
+		if sent != tt.expectMail {
+			t.Errorf("%s: expected mail sent to be %v; got %v", tt.name, tt.expectMail, sent)
+		}
+
+		if sent && !strings.Contains(testMail.String(), "To: admin@example.com") {
+			t.Errorf("%s: expected mail to admin@example.com; got %s", tt.name, testMail.String())
+		}
+	}
+}
+
+// Test_app_ResetPassword tests spending a password reset token
+func Test_app_ResetPassword(t *testing.T) {
+
+	testMail.Reset()
+	postForm(app.ForgotPassword, url.Values{"email": {"admin@example.com"}})
+
+	token := lastResetToken()
+	if token == "" {
+		t.Fatal("expected a password reset link to be mailed")
+	}
+
+	var theTests = []struct {
+		name             string
+		postedData       url.Values
+		expectedLocation string
+		expectedSession  string
+	}{
+		{
+			name:             "too short",
+			postedData:       url.Values{"token": {token}, "password": {"short"}, "confirm_password": {"short"}},
+			expectedLocation: "/reset-password?token=" + token,
+			expectedSession:  "This field is too short",
+		},
+		{
+			name:             "mismatch",
+			postedData:       url.Values{"token": {token}, "password": {"new password"}, "confirm_password": {"other password"}},
+			expectedLocation: "/reset-password?token=" + token,
+			expectedSession:  "The passwords do not match",
+		},
+		{
+			name:             "unknown token",
+			postedData:       url.Values{"token": {"not-a-token"}, "password": {"new password"}, "confirm_password": {"new password"}},
+			expectedLocation: "/forgot-password",
+			expectedSession:  "That reset link is invalid or has expired.",
+		},
+		{
+			name:             "valid",
+			postedData:       url.Values{"token": {token}, "password": {"new password"}, "confirm_password": {"new password"}},
+			expectedLocation: "/",
+			expectedSession:  "Your password has been reset, you can now log in.",
+		},
+		{
+			name:             "token already used",
+			postedData:       url.Values{"token": {token}, "password": {"new password"}, "confirm_password": {"new password"}},
+			expectedLocation: "/forgot-password",
+			expectedSession:  "That reset link is invalid or has expired.",
+		},
+	}
+
+	for _, tt := range theTests {
+		rw, req := postForm(app.ResetPassword, tt.postedData)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected %d; got %d", tt.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		message := app.Session.GetString(req.Context(), "error") + app.Session.GetString(req.Context(), "flash")
+		if message != tt.expectedSession {
+			t.Errorf("%s: expected message %q; got %q", tt.name, tt.expectedSession, message)
+		}
+	}
+}
+
+// Test_app_ResetPasswordPage tests that the reset page needs a token
+func Test_app_ResetPasswordPage(t *testing.T) {
+
+	var theTests = []struct {
+		name               string
+		url                string
+		expectedStatusCode int
+	}{
+		{"with token", "/reset-password?token=abc", http.StatusOK},
+		{"without token", "/reset-password", http.StatusSeeOther},
+	}
+
+	for _, tt := range theTests {
+		req, _ := http.NewRequest("GET", tt.url, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rw := httptest.NewRecorder()
+		http.HandlerFunc(app.ResetPasswordPage).ServeHTTP(rw, req)
+
+		if rw.Code != tt.expectedStatusCode {
+			t.Errorf("%s: expected %d; got %d", tt.name, tt.expectedStatusCode, rw.Code)
+		}
+
+		if rw.Code == http.StatusOK && !strings.Contains(rw.Body.String(), `value="abc"`) {
+			t.Errorf("%s: expected the token in the form", tt.name)
+		}
+	}
+}
+
+// verifyLink matches the token of an email verification link in a sent email
+var verifyLink = regexp.MustCompile(`/verify-email\?token=([A-Za-z0-9_-]+)`)
+
+// Test_app_Register tests signing up through the registration form
+func Test_app_Register(t *testing.T) {
+
+	valid := func() url.Values {
+		return url.Values{
+			"first_name":       {"Jane"},
+			"last_name":        {"Doe"},
+			"email":            {"jane@example.com"},
+			"password":         {"long enough"},
+			"confirm_password": {"long enough"},
+		}
+	}
+
+	with := func(field, value string) url.Values {
+		v := valid()
+		v.Set(field, value)
+		return v
+	}
+
+	var theTests = []struct {
+		name             string
+		postedData       url.Values
+		expectedLocation string
+		expectedError    string
+	}{
+		{"valid", valid(), "/", ""},
+		{"missing name", with("first_name", ""), "/register", "This field cannot be blank"},
+		{"invalid email", with("email", "jane@"), "/register", "This field must be a valid email address"},
+		{"email taken", with("email", "admin@example.com"), "/register", "An account with this email address already exists"},
+		{"password too short", with("password", "short"), "/register", "This field is too short"},
+		{"passwords differ", with("confirm_password", "something else"), "/register", "The passwords do not match"},
+	}
+
+	for _, tt := range theTests {
+		testMail.Reset()
+
+		rw, req := postForm(app.Register, tt.postedData)
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		if msg := app.Session.GetString(req.Context(), "error"); msg != tt.expectedError {
+			t.Errorf("%s: expected error %q; got %q", tt.name, tt.expectedError, msg)
+		}
+
+		sent := verifyLink.MatchString(testMail.String())
+		if sent != (tt.expectedError == "") {
+			t.Errorf("%s: expected a verification mail only on success; sent is %v", tt.name, sent)
+		}
+	}
+}
+
+// Test_app_VerifyEmail tests following an email verification link
+func Test_app_VerifyEmail(t *testing.T) {
+
+	testMail.Reset()
+	postForm(app.Register, url.Values{
+		"first_name":       {"Jane"},
+		"last_name":        {"Doe"},
+		"email":            {"jane@example.com"},
+		"password":         {"long enough"},
+		"confirm_password": {"long enough"},
+	})
+
+	matches := verifyLink.FindStringSubmatch(testMail.String())
+	if matches == nil {
+		t.Fatal("expected a verification link to be mailed")
+	}
+
+	var theTests = []struct {
+		name         string
+		token        string
+		expectedKey  string
+		expectedText string
+	}{
+		{"valid", matches[1], "flash", "Your email address has been confirmed, you can now log in."},
+		{"already used", matches[1], "error", "That confirmation link is invalid or has expired. Log in to get a new one."},
+		{"unknown", "not-a-token", "error", "That confirmation link is invalid or has expired. Log in to get a new one."},
+	}
+
+	for _, tt := range theTests {
+		req, _ := http.NewRequest("GET", "/verify-email?token="+tt.token, nil)
+		req = addContextAndSessionToRequest(req, app)
+
+		rw := httptest.NewRecorder()
+		http.HandlerFunc(app.VerifyEmail).ServeHTTP(rw, req)
+
+		if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/" {
+			t.Errorf("%s: expected a redirect to /; got %d %s", tt.name, rw.Code, rw.Header().Get("Location"))
+		}
+
+		if msg := app.Session.GetString(req.Context(), tt.expectedKey); msg != tt.expectedText {
+			t.Errorf("%s: expected %s %q; got %q", tt.name, tt.expectedKey, tt.expectedText, msg)
+		}
+	}
+}
+
+// Test_app_LoginUnverified tests that an unverified account is sent a new link
+// instead of being logged in
+func Test_app_LoginUnverified(t *testing.T) {
+
+	testMail.Reset()
+
+	rw, req := postForm(app.Login, url.Values{"email": {"unverified@example.com"}, "password": {"secret"}})
+
+	if rw.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to /; got %s", rw.Header().Get("Location"))
+	}
+
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("expected the unverified user not to be logged in")
+	}
+
+	if !verifyLink.MatchString(testMail.String()) || !strings.Contains(testMail.String(), "To: unverified@example.com") {
+		t.Errorf("expected a new verification link to be mailed; got %s", testMail.String())
+	}
+
+	// with the wrong password, nothing is revealed and nothing is sent
+	testMail.Reset()
+	rw, req = postForm(app.Login, url.Values{"email": {"unverified@example.com"}, "password": {"wrong"}})
+
+	if msg := app.Session.GetString(req.Context(), "error"); msg != "invalid login credentials" {
+		t.Errorf("expected invalid credentials; got %q", msg)
+	}
+
+	if testMail.Len() != 0 {
+		t.Errorf("expected no mail; got %s", testMail.String())
+	}
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminPageSize is the number of users on a page of the admin user list.
+const adminPageSize = 20
+
+// AdminUsers lists the users, a page at a time, optionally searching by email
+// address and by name
+func (app *application) AdminUsers(w http.ResponseWriter, r *http.Request) {
+
+	email := r.URL.Query().Get("email")
+	name := r.URL.Query().Get("name")
+
+	page, err := strconv.Atoi(r.URL.Query().Get("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+
+	users, err := app.DB.ListUsers(r.Context(), data.UserQuery{
+		Limit:  adminPageSize,
+		Offset: (page - 1) * adminPageSize,
+		Email:  email,
+		Name:   name,
+	})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "listing users", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	// links to the neighbouring pages keep the search
+	pageURL := func(p int) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		return "/admin/users?" + q.Encode()
+	}
+
+	td := map[string]any{
+		"users": users.Users,
+		"total": users.Total,
+		"email": email,
+		"name":  name,
+		"page":  page,
+	}
+	if page > 1 {
+		td["prev"] = pageURL(page - 1)
+	}
+	if page*adminPageSize < users.Total {
+		td["next"] = pageURL(page + 1)
+	}
+
+	err = app.render(w, r, "admin-users.page.gohtml", &TemplateData{Data: td})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// AdminNewUserPage shows the form to create a user
+func (app *application) AdminNewUserPage(w http.ResponseWriter, r *http.Request) {
+
+	err := app.render(w, r, "admin-new-user.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// AdminCreateUser creates a user from the new user form. Since an admin vouches
+// for them, their email address counts as verified.
+func (app *application) AdminCreateUser(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email", "password", "confirm_password")
+	form.IsEmail("email")
+	form.MinLength("password", data.MinPasswordLength)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "The passwords do not match")
+
+	if form.Errors.Get("email") == "" {
+		_, err := app.DB.GetUserByEmail(r.Context(), form.Data.Get("email"))
+		form.Check(err != nil, "email", "An account with this email address already exists")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("first_name", "last_name", "email", "password", "confirm_password"))
+		http.Redirect(w, r, "/admin/users/new", http.StatusSeeOther)
+		return
+	}
+
+	now := time.Now()
+	user := data.User{
+		FirstName:       form.Data.Get("first_name"),
+		LastName:        form.Data.Get("last_name"),
+		Email:           form.Data.Get("email"),
+		Password:        form.Data.Get("password"),
+		IsAdmin:         adminFlag(form),
+		EmailVerifiedAt: &now,
+	}
+
+	user.ID, err = app.DB.InsertUser(r.Context(), user)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "creating user", "error", err)
+		app.Session.Put(r.Context(), "error", "The user could not be created, please try again.")
+		http.Redirect(w, r, "/admin/users/new", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been created.", user.Email))
+	http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+}
+
+// AdminEditUserPage shows the forms to edit a user, reset their password, sign
+// them out or delete them
+func (app *application) AdminEditUserPage(w http.ResponseWriter, r *http.Request) {
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	devices, err := app.userDevices(r.Context(), user.ID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "listing sessions", "target_user_id", user.ID, "error", err)
+	}
+
+	err = app.render(w, r, "admin-user.page.gohtml", &TemplateData{Data: map[string]any{"user": user, "devices": devices}})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// AdminUpdateUser saves the name, email address and admin flag of a user.
+// Admins can't take away their own admin flag, so that there is always one
+// left who could give it back.
+func (app *application) AdminUpdateUser(w http.ResponseWriter, r *http.Request) {
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	self := app.Session.Get(r.Context(), "user").(data.User)
+	editURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	form := NewForm(r.PostForm)
+	form.Required("first_name", "last_name", "email")
+	form.IsEmail("email")
+	form.Check(user.ID != self.ID || adminFlag(form) == 1, "is_admin", "You can't take away your own admin rights")
+
+	if form.Errors.Get("email") == "" {
+		other, err := app.DB.GetUserByEmail(r.Context(), form.Data.Get("email"))
+		form.Check(err != nil || other.ID == user.ID, "email", "An account with this email address already exists")
+	}
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("first_name", "last_name", "email", "is_admin"))
+		http.Redirect(w, r, editURL, http.StatusSeeOther)
+		return
+	}
+
+	adminChanged := user.IsAdmin != adminFlag(form)
+
+	user.FirstName = form.Data.Get("first_name")
+	user.LastName = form.Data.Get("last_name")
+	user.Email = form.Data.Get("email")
+	user.IsAdmin = adminFlag(form)
+
+	err = app.DB.UpdateUser(r.Context(), *user)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "updating user", "target_user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "The user could not be saved, please try again.")
+		http.Redirect(w, r, editURL, http.StatusSeeOther)
+		return
+	}
+
+	if user.ID == self.ID {
+		app.refreshSessionUser(r.Context(), user.ID)
+	}
+
+	// sessions keep a copy of the user, admin flag included, so the user has to
+	// sign in again for a change of rights to take effect
+	if adminChanged && user.ID != self.ID {
+		if _, err := app.revokeSessions(r.Context(), user.ID, func(device) bool { return true }); err != nil {
+			app.Logger.ErrorContext(r.Context(), "revoking sessions", "target_user_id", user.ID, "error", err)
+		}
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been saved.", user.Email))
+	http.Redirect(w, r, editURL, http.StatusSeeOther)
+}
+
+// AdminResetPassword sets a new password for a user. Like any password reset,
+// it signs them out of the API everywhere, and out of the web app on every
+// device but the one asking.
+func (app *application) AdminResetPassword(w http.ResponseWriter, r *http.Request) {
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	editURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	form := NewForm(r.PostForm)
+	form.Required("password", "confirm_password")
+	form.MinLength("password", data.MinPasswordLength)
+	form.Check(form.Data.Get("password") == form.Data.Get("confirm_password"), "confirm_password", "The passwords do not match")
+
+	if !form.Valid() {
+		app.Session.Put(r.Context(), "error", form.FirstError("password", "confirm_password"))
+		http.Redirect(w, r, editURL, http.StatusSeeOther)
+		return
+	}
+
+	err = app.DB.ResetPassword(r.Context(), user.ID, form.Data.Get("password"))
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting password", "target_user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "The password could not be changed, please try again.")
+		http.Redirect(w, r, editURL, http.StatusSeeOther)
+		return
+	}
+
+	// whoever knew the old password is signed out with it
+	if _, err := app.revokeSessions(r.Context(), user.ID, func(device) bool { return true }); err != nil {
+		app.Logger.ErrorContext(r.Context(), "revoking sessions", "target_user_id", user.ID, "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("The password of %s has been changed.", user.Email))
+	http.Redirect(w, r, editURL, http.StatusSeeOther)
+}
+
+// AdminDeleteUser deletes a user, and signs them out of every device. Admins
+// can't delete themselves.
+func (app *application) AdminDeleteUser(w http.ResponseWriter, r *http.Request) {
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	self := app.Session.Get(r.Context(), "user").(data.User)
+	if user.ID == self.ID {
+		app.Session.Put(r.Context(), "error", "You can't delete your own account.")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	err := app.DB.DeleteUser(r.Context(), user.ID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "deleting user", "target_user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "The user could not be deleted, please try again.")
+		http.Redirect(w, r, fmt.Sprintf("/admin/users/%d", user.ID), http.StatusSeeOther)
+		return
+	}
+
+	if _, err := app.revokeSessions(r.Context(), user.ID, func(device) bool { return true }); err != nil {
+		app.Logger.ErrorContext(r.Context(), "revoking sessions", "target_user_id", user.ID, "error", err)
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been deleted.", user.Email))
+	http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+}
+
+// adminTargetUser returns the user named by the userID URL parameter. If there
+// is no such user, it redirects to the user list and returns false.
+func (app *application) adminTargetUser(w http.ResponseWriter, r *http.Request) (*data.User, bool) {
+
+	var user *data.User
+	userID, err := strconv.Atoi(chi.URLParam(r, "userID"))
+	if err == nil {
+		user, err = app.DB.GetUser(r.Context(), userID)
+	}
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "That user could not be found.")
+		http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		return nil, false
+	}
+
+	return user, true
+}
+
+// adminFlag returns the is_admin column value for the admin checkbox of form.
+func adminFlag(form *Form) int {
+	if form.Has("is_admin") {
+		return 1
+	}
+
+	return 0
+}
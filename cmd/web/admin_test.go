@@ -0,0 +1,172 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// adminUser is the admin of the test repository
+var adminUser = data.User{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com", IsAdmin: 1}
+
+// adminRequest sends a request to an admin handler as adminUser, with userID
+// as the URL parameter, if any, and returns the response and request
+func adminRequest(handler http.HandlerFunc, method, target, userID string, form url.Values) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	chiCtx := chi.NewRouteContext()
+	if userID != "" {
+		chiCtx.URLParams.Add("userID", userID)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", adminUser)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw, req
+}
+
+// Test_app_AdminUsers tests listing and searching users
+func Test_app_AdminUsers(t *testing.T) {
+
+	var theTests = []struct {
+		name          string
+		query         string
+		expectedHTML  []string
+		forbiddenHTML []string
+	}{
+		{"all", "", []string{"admin@example.com", "jack@example.com", "4 users, page 1"}, []string{"Next"}},
+		{"by email", "?email=jill", []string{"jill@example.com", "1 users"}, []string{"jack@example.com"}},
+		{"by name", "?name=smith", []string{"Jack Smith", "Jill Smith"}, []string{"admin@example.com"}},
+		{"nothing found", "?email=nobody", []string{"No users found."}, nil},
+		{"page past the end", "?page=2", []string{"No users found.", "Previous"}, nil},
+		{"bad page", "?page=x", []string{"page 1"}, []string{"Previous"}},
+	}
+
+	for _, tt := range theTests {
+		rw, _ := adminRequest(app.AdminUsers, "GET", "/admin/users"+tt.query, "", nil)
+
+		if rw.Code != http.StatusOK {
+			t.Errorf("%s: expected 200; got %d", tt.name, rw.Code)
+		}
+
+		body := rw.Body.String()
+		for _, s := range tt.expectedHTML {
+			if !strings.Contains(body, s) {
+				t.Errorf("%s: expected to find %q", tt.name, s)
+			}
+		}
+		for _, s := range tt.forbiddenHTML {
+			if strings.Contains(body, s) {
+				t.Errorf("%s: did not expect to find %q", tt.name, s)
+			}
+		}
+	}
+}
+
+// Test_app_AdminPages tests that the new and edit user pages render their forms
+func Test_app_AdminPages(t *testing.T) {
+
+	rw, _ := adminRequest(app.AdminNewUserPage, "GET", "/admin/users/new", "", nil)
+	if !strings.Contains(rw.Body.String(), `action="/admin/users/new"`) {
+		t.Error("expected the new user form")
+	}
+
+	rw, _ = adminRequest(app.AdminEditUserPage, "GET", "/admin/users/2", "2", nil)
+	body := rw.Body.String()
+	for _, s := range []string{`value="jack@example.com"`, `action="/admin/users/2/password"`, `action="/admin/users/2/delete"`, `name="csrf_token"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the edit page to contain %q", s)
+		}
+	}
+
+	// admins can't delete themselves, so they aren't offered to
+	rw, _ = adminRequest(app.AdminEditUserPage, "GET", "/admin/users/1", "1", nil)
+	if strings.Contains(rw.Body.String(), `action="/admin/users/1/delete"`) {
+		t.Error("did not expect a delete form on the admin's own page")
+	}
+
+	rw, _ = adminRequest(app.AdminEditUserPage, "GET", "/admin/users/99", "99", nil)
+	if rw.Header().Get("Location") != "/admin/users" {
+		t.Errorf("expected a missing user to redirect to the list; got %q", rw.Header().Get("Location"))
+	}
+}
+
+// Test_app_AdminForms tests validating and submitting the admin forms
+func Test_app_AdminForms(t *testing.T) {
+
+	newUser := url.Values{
+		"first_name":       {"New"},
+		"last_name":        {"User"},
+		"email":            {"new@example.com"},
+		"password":         {"password1"},
+		"confirm_password": {"password1"},
+	}
+
+	with := func(v url.Values, key, value string) url.Values {
+		c := url.Values{}
+		for k, vs := range v {
+			c[k] = vs
+		}
+		c.Set(key, value)
+		return c
+	}
+
+	jack := url.Values{"first_name": {"Jack"}, "last_name": {"Smith"}, "email": {"jack@example.com"}}
+	self := url.Values{"first_name": {"Admin"}, "last_name": {"User"}, "email": {"admin@example.com"}, "is_admin": {"1"}}
+	password := url.Values{"password": {"password1"}, "confirm_password": {"password1"}}
+
+	var theTests = []struct {
+		name             string
+		handler          http.HandlerFunc
+		userID           string
+		form             url.Values
+		expectedLocation string
+		expectedError    string
+		expectedFlash    string
+	}{
+		{"create", app.AdminCreateUser, "", newUser, "/admin/users/2", "", "new@example.com has been created."},
+		{"create without name", app.AdminCreateUser, "", with(newUser, "first_name", ""), "/admin/users/new", "This field cannot be blank", ""},
+		{"create with bad email", app.AdminCreateUser, "", with(newUser, "email", "nope"), "/admin/users/new", "This field must be a valid email address", ""},
+		{"create with taken email", app.AdminCreateUser, "", with(newUser, "email", "admin@example.com"), "/admin/users/new", "An account with this email address already exists", ""},
+		{"create with short password", app.AdminCreateUser, "", with(with(newUser, "password", "short"), "confirm_password", "short"), "/admin/users/new", "This field is too short", ""},
+		{"create with mismatched passwords", app.AdminCreateUser, "", with(newUser, "confirm_password", "password2"), "/admin/users/new", "The passwords do not match", ""},
+		{"update", app.AdminUpdateUser, "2", jack, "/admin/users/2", "", "jack@example.com has been saved."},
+		{"update with taken email", app.AdminUpdateUser, "2", with(jack, "email", "admin@example.com"), "/admin/users/2", "An account with this email address already exists", ""},
+		{"update self", app.AdminUpdateUser, "1", self, "/admin/users/1", "", "admin@example.com has been saved."},
+		{"update self without admin", app.AdminUpdateUser, "1", with(self, "is_admin", ""), "/admin/users/1", "You can't take away your own admin rights", ""},
+		{"update missing user", app.AdminUpdateUser, "99", jack, "/admin/users", "That user could not be found.", ""},
+		{"reset password", app.AdminResetPassword, "2", password, "/admin/users/2", "", "The password of jack@example.com has been changed."},
+		{"reset password mismatch", app.AdminResetPassword, "2", with(password, "confirm_password", "x"), "/admin/users/2", "The passwords do not match", ""},
+		{"delete", app.AdminDeleteUser, "2", nil, "/admin/users", "", "jack@example.com has been deleted."},
+		{"delete self", app.AdminDeleteUser, "1", nil, "/admin/users/1", "You can't delete your own account.", ""},
+	}
+
+	for _, tt := range theTests {
+		rw, req := adminRequest(tt.handler, "POST", "/", tt.userID, tt.form)
+
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected %d; got %d", tt.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		if e := app.Session.GetString(req.Context(), "error"); e != tt.expectedError {
+			t.Errorf("%s: expected error %q; got %q", tt.name, tt.expectedError, e)
+		}
+
+		if f := app.Session.GetString(req.Context(), "flash"); f != tt.expectedFlash {
+			t.Errorf("%s: expected flash %q; got %q", tt.name, tt.expectedFlash, f)
+		}
+	}
+}
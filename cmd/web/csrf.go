@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"strings"
+)
+
+// csrfSessionKey is where the session keeps its CSRF token, csrfField the form
+// field forms send it back in, and csrfHeader the header scripts may send it in
+// instead.
+const (
+	csrfSessionKey = "csrf_token"
+	csrfField      = "csrf_token"
+	csrfHeader     = "X-CSRF-Token"
+)
+
+// csrfToken returns the CSRF token of the session in ctx, creating one the
+// first time it is asked for.
+func (app *application) csrfToken(ctx context.Context) string {
+	if token := app.Session.GetString(ctx, csrfSessionKey); token != "" {
+		return token
+	}
+
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	token := base64.RawURLEncoding.EncodeToString(b)
+	app.Session.Put(ctx, csrfSessionKey, token)
+
+	return token
+}
+
+// csrf refuses requests that may change state, anything but GET, HEAD, OPTIONS
+// and TRACE, unless they send back the CSRF token of their session, which only
+// our own pages know. It must run after the session is loaded.
+func (app *application) csrf(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace:
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		sent := r.Header.Get(csrfHeader)
+		if sent == "" {
+			// parse uploads the way the upload handler would, so that it
+			// finds the form parsed the same way: with the body capped, and
+			// the temporary files removed once the request is served
+			if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+				cleanup, _ := parseMultipartForm(w, r)
+				defer cleanup()
+			}
+			sent = r.PostFormValue(csrfField)
+		}
+
+		expected := app.Session.GetString(r.Context(), csrfSessionKey)
+		if expected == "" || subtle.ConstantTimeCompare([]byte(sent), []byte(expected)) != 1 {
+			app.csrfFailed(w, r)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+// csrfFailed explains that a form couldn't be accepted, typically because it
+// was left open while the session expired, or was posted from another site.
+func (app *application) csrfFailed(w http.ResponseWriter, r *http.Request) {
+	app.Logger.WarnContext(r.Context(), "rejected request without a valid CSRF token", "method", r.Method, "path", r.URL.Path)
+
+	w.WriteHeader(http.StatusForbidden)
+	err := app.render(w, r, "csrf.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	_ "github.com/jackc/pgconn"
 	_ "github.com/jackc/pgx/v4"
 	_ "github.com/jackc/pgx/v4/stdlib"
-	"log"
 )
 
 // openDB returns a sql.DB connection pool for the named data source.
@@ -30,7 +29,7 @@ func (app *application) connectToDB() (*sql.DB, error) {
 		return nil, err
 	}
 
-	log.Println("Connected to Postgres!")
+	app.Logger.Info("connected to Postgres")
 
 	return connection, nil
 
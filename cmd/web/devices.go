@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// Logout signs the user out of this browser by destroying its session
+func (app *application) Logout(w http.ResponseWriter, r *http.Request) {
+
+	err := app.Session.Destroy(r.Context())
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "destroying session", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", "You have been logged out.")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// DevicesPage lists the devices the user is signed in on
+func (app *application) DevicesPage(w http.ResponseWriter, r *http.Request) {
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	devices, err := app.userDevices(r.Context(), user.ID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "listing sessions", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{
+		"devices": devices,
+		"current": app.currentDevice(r.Context()),
+	}
+
+	err = app.render(w, r, "devices.page.gohtml", &TemplateData{Data: td})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// RevokeDevice signs the user out of one of their devices. Revoking the
+// current device is the same as logging out.
+func (app *application) RevokeDevice(w http.ResponseWriter, r *http.Request) {
+
+	deviceID := chi.URLParam(r, "deviceID")
+	if deviceID == app.currentDevice(r.Context()) {
+		app.Logout(w, r)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	revoked, err := app.revokeSessions(r.Context(), user.ID, func(d device) bool { return d.ID == deviceID })
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "revoking session", "error", err)
+		app.Session.Put(r.Context(), "error", "The device could not be signed out, please try again.")
+		http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+		return
+	}
+
+	if revoked == 0 {
+		app.Session.Put(r.Context(), "error", "That device is not signed in any more.")
+	} else {
+		app.Session.Put(r.Context(), "flash", "The device has been signed out.")
+	}
+	http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+}
+
+// RevokeOtherDevices signs the user out of every device but this one
+func (app *application) RevokeOtherDevices(w http.ResponseWriter, r *http.Request) {
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	revoked, err := app.revokeSessions(r.Context(), user.ID, func(device) bool { return true })
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "revoking sessions", "error", err)
+		app.Session.Put(r.Context(), "error", "The other devices could not be signed out, please try again.")
+		http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("Signed out of %s.", countOf(revoked, "other device")))
+	http.Redirect(w, r, "/user/devices", http.StatusSeeOther)
+}
+
+// AdminRevokeSessions signs a user out of all of their devices. When admins do
+// it to themselves, they stay signed in on the device they did it from.
+func (app *application) AdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+
+	user, ok := app.adminTargetUser(w, r)
+	if !ok {
+		return
+	}
+
+	editURL := fmt.Sprintf("/admin/users/%d", user.ID)
+
+	revoked, err := app.revokeSessions(r.Context(), user.ID, func(device) bool { return true })
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "revoking sessions", "target_user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "The sessions could not be signed out, please try again.")
+		http.Redirect(w, r, editURL, http.StatusSeeOther)
+		return
+	}
+
+	app.Session.Put(r.Context(), "flash", fmt.Sprintf("%s has been signed out of %s.", user.Email, countOf(revoked, "device")))
+	http.Redirect(w, r, editURL, http.StatusSeeOther)
+}
+
+// countOf spells out n of noun, e.g. "1 device" or "2 devices".
+func countOf(n int, noun string) string {
+	if n == 1 {
+		return "1 " + noun
+	}
+
+	return fmt.Sprintf("%d %ss", n, noun)
+}
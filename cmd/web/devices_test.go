@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"github.com/alexedwards/scs/v2/memstore"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// signIn stores a session signed in as user on device d, and returns its token
+func signIn(t *testing.T, user data.User, d device) string {
+	ctx, _ := app.Session.Load(context.Background(), "")
+	app.Session.Put(ctx, "user", user)
+	if d.ID != "" {
+		app.Session.Put(ctx, deviceSessionKey, d)
+	}
+
+	token, _, err := app.Session.Commit(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return token
+}
+
+// sessionExists reports whether the session with token is still in the store
+func sessionExists(t *testing.T, token string) bool {
+	_, found, err := app.Session.Store.Find(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return found
+}
+
+// sessionRequest sends a request to handler in the session with token, with
+// the URL parameter key set to value, if any
+func sessionRequest(handler http.HandlerFunc, token, key, value string) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", "/", nil)
+	req.Header.Set("X-Session", token)
+	chiCtx := chi.NewRouteContext()
+	if key != "" {
+		chiCtx.URLParams.Add(key, value)
+	}
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = addContextAndSessionToRequest(req, app)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw, req
+}
+
+// Test_app_trackDevice tests that signed in sessions keep their device up to date
+func Test_app_trackDevice(t *testing.T) {
+
+	var seen device
+	handler := app.trackDevice(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = app.Session.Get(r.Context(), deviceSessionKey).(device)
+	}))
+
+	// getCtx gives every request the IP address "unknown"
+	stale := device{ID: "stale", IP: "unknown", UserAgent: "test", LastSeen: time.Now().Add(-time.Hour)}
+	fresh := device{ID: "fresh", IP: "unknown", UserAgent: "test", LastSeen: time.Now().Add(-time.Second)}
+
+	var theTests = []struct {
+		name         string
+		user         *data.User
+		device       *device
+		userAgent    string
+		expectedID   string
+		expectUpdate bool
+	}{
+		{"signed out", nil, nil, "test", "", false},
+		{"new device", &data.User{ID: 1}, nil, "test", "", true},
+		{"fresh device", &data.User{ID: 1}, &fresh, "test", "fresh", false},
+		{"stale device", &data.User{ID: 1}, &stale, "test", "stale", true},
+		{"other browser", &data.User{ID: 1}, &fresh, "other", "fresh", true},
+	}
+
+	for _, tt := range theTests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("User-Agent", tt.userAgent)
+		req = addContextAndSessionToRequest(req, app)
+		if tt.user != nil {
+			app.Session.Put(req.Context(), "user", *tt.user)
+		}
+		if tt.device != nil {
+			app.Session.Put(req.Context(), deviceSessionKey, *tt.device)
+		}
+
+		seen = device{}
+		handler.ServeHTTP(httptest.NewRecorder(), req)
+
+		if tt.user == nil {
+			if seen != (device{}) {
+				t.Errorf("%s: expected no device; got %+v", tt.name, seen)
+			}
+			continue
+		}
+
+		if seen.ID == "" || (tt.expectedID != "" && seen.ID != tt.expectedID) {
+			t.Errorf("%s: expected device id %q; got %q", tt.name, tt.expectedID, seen.ID)
+		}
+
+		updated := !seen.LastSeen.IsZero()
+		if tt.device != nil {
+			updated = !seen.LastSeen.Equal(tt.device.LastSeen)
+		}
+
+		if updated != tt.expectUpdate {
+			t.Errorf("%s: expected the device to be updated %v; got %+v", tt.name, tt.expectUpdate, seen)
+		}
+
+		if tt.expectUpdate && (seen.IP != app.ipFromContext(req.Context()) || seen.UserAgent != tt.userAgent) {
+			t.Errorf("%s: expected the IP address and browser of the request; got %+v", tt.name, seen)
+		}
+	}
+}
+
+// Test_app_Logout tests that logging out destroys the session
+func Test_app_Logout(t *testing.T) {
+
+	token := signIn(t, data.User{ID: 80}, device{ID: "logout"})
+
+	rw, req := sessionRequest(app.Logout, token, "", "")
+
+	if rw.Code != http.StatusSeeOther || rw.Header().Get("Location") != "/" {
+		t.Errorf("expected a redirect to /; got %d %s", rw.Code, rw.Header().Get("Location"))
+	}
+
+	if sessionExists(t, token) {
+		t.Error("expected the session to be destroyed")
+	}
+
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("expected the user to be signed out")
+	}
+
+	if f := app.Session.GetString(req.Context(), "flash"); f != "You have been logged out." {
+		t.Errorf("expected the logged out flash; got %q", f)
+	}
+}
+
+// Test_app_DevicesPage tests the list of the user's devices
+func Test_app_DevicesPage(t *testing.T) {
+
+	user := data.User{ID: 81}
+	current := signIn(t, user, device{ID: "laptop", UserAgent: "Laptop Browser", LastSeen: time.Now()})
+	signIn(t, user, device{ID: "phone", UserAgent: "Phone Browser", LastSeen: time.Now().Add(-time.Hour)})
+	signIn(t, data.User{ID: 82}, device{ID: "other", UserAgent: "Someone Else's Browser", LastSeen: time.Now()})
+
+	rw, _ := sessionRequest(app.DevicesPage, current, "", "")
+
+	body := rw.Body.String()
+	for _, s := range []string{"Laptop Browser", "Phone Browser", "This device", `action="/user/devices/phone/revoke"`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected the devices page to contain %q", s)
+		}
+	}
+
+	if strings.Contains(body, "Someone Else") {
+		t.Error("expected the devices of other users to be left out")
+	}
+
+	if strings.Index(body, "Laptop Browser") > strings.Index(body, "Phone Browser") {
+		t.Error("expected the most recently seen device first")
+	}
+}
+
+// Test_app_revokeDevices tests signing out of other devices
+func Test_app_revokeDevices(t *testing.T) {
+
+	user := data.User{ID: 83}
+
+	current := signIn(t, user, device{ID: "current"})
+	phone := signIn(t, user, device{ID: "phone"})
+	tablet := signIn(t, user, device{ID: "tablet"})
+	other := signIn(t, data.User{ID: 84}, device{ID: "phone"})
+
+	// one device
+	rw, req := sessionRequest(app.RevokeDevice, current, "deviceID", "phone")
+	if rw.Header().Get("Location") != "/user/devices" || app.Session.GetString(req.Context(), "flash") != "The device has been signed out." {
+		t.Errorf("expected the device to be signed out; got %s %v", rw.Header().Get("Location"), app.Session.GetString(req.Context(), "error"))
+	}
+
+	if sessionExists(t, phone) || !sessionExists(t, tablet) || !sessionExists(t, current) || !sessionExists(t, other) {
+		t.Error("expected only the phone of the user to be signed out")
+	}
+
+	// a device that is gone already
+	_, req = sessionRequest(app.RevokeDevice, current, "deviceID", "phone")
+	if e := app.Session.GetString(req.Context(), "error"); e != "That device is not signed in any more." {
+		t.Errorf("expected the device to be gone; got %q", e)
+	}
+
+	// everything else
+	_, req = sessionRequest(app.RevokeOtherDevices, current, "", "")
+	if f := app.Session.GetString(req.Context(), "flash"); f != "Signed out of 1 other device." {
+		t.Errorf("expected the other device to be signed out; got %q", f)
+	}
+
+	if sessionExists(t, tablet) || !sessionExists(t, current) || !sessionExists(t, other) {
+		t.Error("expected the other devices of the user to be signed out")
+	}
+
+	// this device
+	rw, _ = sessionRequest(app.RevokeDevice, current, "deviceID", "current")
+	if rw.Header().Get("Location") != "/" || sessionExists(t, current) {
+		t.Error("expected signing out this device to log out")
+	}
+}
+
+// Test_app_AdminRevokeSessions tests that admins can sign a user out everywhere
+func Test_app_AdminRevokeSessions(t *testing.T) {
+
+	target := data.User{ID: 2}
+	phone := signIn(t, target, device{ID: "phone"})
+	untracked := signIn(t, target, device{})
+	admin := signIn(t, adminUser, device{ID: "admin"})
+
+	rw, req := sessionRequest(app.AdminRevokeSessions, admin, "userID", "2")
+
+	if rw.Header().Get("Location") != "/admin/users/2" {
+		t.Errorf("expected a redirect to the user; got %s", rw.Header().Get("Location"))
+	}
+
+	if f := app.Session.GetString(req.Context(), "flash"); !strings.HasSuffix(f, "has been signed out of 2 devices.") {
+		t.Errorf("expected both sessions to be signed out; got %q", f)
+	}
+
+	if sessionExists(t, phone) || sessionExists(t, untracked) || !sessionExists(t, admin) {
+		t.Error("expected only the sessions of the user to be destroyed")
+	}
+
+	// admins signing themselves out stay signed in where they are
+	other := signIn(t, adminUser, device{ID: "admin's phone"})
+
+	sessionRequest(app.AdminRevokeSessions, admin, "userID", "1")
+
+	if sessionExists(t, other) || !sessionExists(t, admin) {
+		t.Error("expected the admin to stay signed in on this device only")
+	}
+}
+
+// Test_app_adminSignsUserOut tests that resetting the password of a user,
+// changing their admin flag, or deleting them, signs them out of every device
+func Test_app_adminSignsUserOut(t *testing.T) {
+
+	password := url.Values{"password": {"password1"}, "confirm_password": {"password1"}}
+	jack := url.Values{"first_name": {"Jack"}, "last_name": {"Smith"}, "email": {"jack@example.com"}}
+	jackAdmin := url.Values{"first_name": {"Jack"}, "last_name": {"Smith"}, "email": {"jack@example.com"}, "is_admin": {"1"}}
+
+	var theTests = []struct {
+		name            string
+		handler         http.HandlerFunc
+		form            url.Values
+		expectSignedOut bool
+	}{
+		{"update", app.AdminUpdateUser, jack, false},
+		{"make admin", app.AdminUpdateUser, jackAdmin, true},
+		{"reset password", app.AdminResetPassword, password, true},
+		{"delete", app.AdminDeleteUser, nil, true},
+	}
+
+	for _, tt := range theTests {
+		phone := signIn(t, data.User{ID: 2}, device{ID: "phone"})
+		other := signIn(t, data.User{ID: 3}, device{ID: "phone"})
+
+		rw, _ := adminRequest(tt.handler, "POST", "/", "2", tt.form)
+		if rw.Code != http.StatusSeeOther {
+			t.Errorf("%s: expected %d; got %d", tt.name, http.StatusSeeOther, rw.Code)
+		}
+
+		if sessionExists(t, phone) == tt.expectSignedOut {
+			t.Errorf("%s: expected the user to be signed out %v", tt.name, tt.expectSignedOut)
+		}
+
+		if !sessionExists(t, other) {
+			t.Errorf("%s: expected other users to stay signed in", tt.name)
+		}
+	}
+}
+
+// indexedStore is a session store with an index of the sessions by user, like
+// sessions.PostgresStore, which records the users looked up
+type indexedStore struct {
+	*memstore.MemStore
+	lookups []int
+}
+
+func (s *indexedStore) UserSessionsCtx(ctx context.Context, userID int) (map[string][]byte, error) {
+	s.lookups = append(s.lookups, userID)
+
+	all, err := s.All()
+	if err != nil {
+		return nil, err
+	}
+
+	for token, b := range all {
+		if app.sessionUserID(b) != userID {
+			delete(all, token)
+		}
+	}
+
+	return all, nil
+}
+
+// Test_app_userSessionsIndex tests that the sessions of a user are looked up by
+// user when the store can
+func Test_app_userSessionsIndex(t *testing.T) {
+
+	store := &indexedStore{MemStore: memstore.New()}
+	defer store.StopCleanup()
+
+	saved := app.Session.Store
+	app.Session.Store = store
+	defer func() { app.Session.Store = saved }()
+
+	signIn(t, data.User{ID: 85}, device{ID: "phone"})
+	signIn(t, data.User{ID: 86}, device{ID: "phone"})
+
+	devices, err := app.userDevices(context.Background(), 85)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(devices) != 1 || len(store.lookups) != 1 || store.lookups[0] != 85 {
+		t.Errorf("expected one device found through the index; got %v, lookups %v", devices, store.lookups)
+	}
+}
+
+// Test_countOf tests that counts of devices read well
+func Test_countOf(t *testing.T) {
+
+	var tests = []struct {
+		n        int
+		expected string
+	}{
+		{0, "0 other devices"},
+		{1, "1 other device"},
+		{2, "2 other devices"},
+	}
+
+	for _, e := range tests {
+		if got := countOf(e.n, "other device"); got != e.expected {
+			t.Errorf("%d: expected %q; got %q", e.n, e.expected, got)
+		}
+	}
+}
@@ -1,6 +1,16 @@
 package main
 
-import "net/url"
+import (
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"net/url"
+	"strings"
+	"unicode"
+)
+
+// maxPasswordBytes is the longest password bcrypt hashes in full; it ignores
+// anything after that.
+const maxPasswordBytes = 72
 
 // errors is a map of field names to a slice of error messages.
 type errors map[string][]string
@@ -79,7 +89,8 @@ func (f *Form) Valid() bool {
 	return len(f.Errors) == 0
 }
 
-// IsEmail checks if the provided field is a valid email address.
+// IsEmail checks if the provided field is a valid email address: a local part
+// and a domain with at least one dot, separated by a single @.
 func (f *Form) IsEmail(field string) {
 	value := f.Data.Get(field)
 	if value != "" {
@@ -91,6 +102,11 @@ func (f *Form) IsEmail(field string) {
 			f.Errors.Add(field, "This field must be a valid email address")
 			return
 		}
+		at := strings.Index(value, "@")
+		if at < 1 || strings.Count(value, "@") != 1 || !strings.Contains(value[at+1:], ".") || value[at+1] == '.' {
+			f.Errors.Add(field, "This field must be a valid email address")
+			return
+		}
 		for i := 0; i < len(value); i++ {
 			switch value[i] {
 			case '@':
@@ -110,3 +126,43 @@ func (f *Form) IsEmail(field string) {
 		}
 	}
 }
+
+// FirstError returns the first error message found for fields, checked in order,
+// or the empty string if none of them has an error.
+func (f *Form) FirstError(fields ...string) string {
+	for _, field := range fields {
+		if message := f.Errors.Get(field); message != "" {
+			return message
+		}
+	}
+
+	return ""
+}
+
+// StrongPassword checks that the provided field is a password that is hard to
+// guess: at least data.MinPasswordLength long, no longer than bcrypt hashes,
+// and mixing letters with digits or symbols.
+func (f *Form) StrongPassword(field string) {
+	value := f.Data.Get(field)
+	if value == "" {
+		return
+	}
+
+	var letters, others bool
+	for _, r := range value {
+		if unicode.IsLetter(r) {
+			letters = true
+		} else {
+			others = true
+		}
+	}
+
+	switch {
+	case len(value) < data.MinPasswordLength:
+		f.Errors.Add(field, fmt.Sprintf("The password must be at least %d characters long", data.MinPasswordLength))
+	case len(value) > maxPasswordBytes:
+		f.Errors.Add(field, fmt.Sprintf("The password must be at most %d characters long", maxPasswordBytes))
+	case !letters || !others:
+		f.Errors.Add(field, "The password must mix letters with digits or symbols")
+	}
+}
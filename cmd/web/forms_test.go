@@ -3,6 +3,7 @@ package main
 import (
 	"net/http/httptest"
 	"net/url"
+	"strings"
 	"testing"
 )
 
@@ -200,3 +201,78 @@ func TestForm_MinLength(t *testing.T) {
 		}
 	}
 }
+
+// TestForm_FirstError tests the FirstError() method of the Form type.
+func TestForm_FirstError(t *testing.T) {
+
+	form := NewForm(nil)
+
+	if s := form.FirstError("a", "b"); s != "" {
+		t.Errorf("Expected no error, got %q", s)
+	}
+
+	form.Check(false, "b", "b is wrong")
+	form.Check(false, "c", "c is wrong")
+
+	if s := form.FirstError("a", "c", "b"); s != "c is wrong" {
+		t.Errorf("Expected the error for c, got %q", s)
+	}
+}
+
+// TestForm_IsEmailValidates tests that IsEmail() itself tells valid addresses
+// from invalid ones.
+func TestForm_IsEmailValidates(t *testing.T) {
+
+	var theTests = []struct {
+		input       string
+		expectValid bool
+	}{
+		{"me@here.com", true},
+		{"first.last@mail.here.com", true},
+		{"", true},
+		{"me", false},
+		{"me@", false},
+		{"@here.com", false},
+		{"me@here", false},
+		{"me@here.", false},
+		{"me@.com", false},
+		{"me@you@here.com", false},
+		{"me here@there.com", false},
+	}
+
+	for _, tt := range theTests {
+		f := NewForm(url.Values{"email": []string{tt.input}})
+		f.IsEmail("email")
+
+		if f.Valid() != tt.expectValid {
+			t.Errorf("%q: expected valid to be %v; got %v", tt.input, tt.expectValid, f.Valid())
+		}
+	}
+}
+
+// TestForm_StrongPassword tests the StrongPassword() method of the Form type.
+func TestForm_StrongPassword(t *testing.T) {
+
+	var theTests = []struct {
+		name          string
+		password      string
+		expectedError string
+	}{
+		{"empty", "", ""},
+		{"strong", "correct horse 1", ""},
+		{"symbols", "pass-word!", ""},
+		{"too short", "abc12", "The password must be at least 8 characters long"},
+		{"too long", strings.Repeat("a1", 40), "The password must be at most 72 characters long"},
+		{"only letters", "password", "The password must mix letters with digits or symbols"},
+		{"only digits", "12345678", "The password must mix letters with digits or symbols"},
+	}
+
+	for _, tt := range theTests {
+		f := NewForm(url.Values{"password": {tt.password}})
+		f.StrongPassword("password")
+
+		if e := f.Errors.Get("password"); e != tt.expectedError {
+			t.Errorf("%s: expected error %q; got %q", tt.name, tt.expectedError, e)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"net/http"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ActivateProfilePic makes one of the user's earlier pictures their profile picture
+func (app *application) ActivateProfilePic(w http.ResponseWriter, r *http.Request) {
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err == nil {
+		err = app.DB.SetActiveUserImage(r.Context(), user.ID, imageID)
+	}
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "activating image", "user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "That picture could not be found.")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	app.refreshSessionUser(r.Context(), user.ID)
+
+	app.Session.Put(r.Context(), "flash", "Your profile picture has been changed.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// DeleteProfilePic deletes one of the user's pictures, along with its files
+func (app *application) DeleteProfilePic(w http.ResponseWriter, r *http.Request) {
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	var img *data.UserImage
+	imageID, err := strconv.Atoi(chi.URLParam(r, "imageID"))
+	if err == nil {
+		img, err = app.DB.DeleteUserImage(r.Context(), user.ID, imageID)
+	}
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "deleting image", "user_id", user.ID, "error", err)
+		app.Session.Put(r.Context(), "error", "That picture could not be found.")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+		return
+	}
+
+	if err := images.RemoveUnused(r.Context(), app.DB, app.Storage, img.FileName); err != nil {
+		app.Logger.ErrorContext(r.Context(), "removing image files", "image_id", img.ID, "error", err)
+	}
+
+	app.refreshSessionUser(r.Context(), user.ID)
+
+	app.Session.Put(r.Context(), "flash", "The picture has been deleted.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// refreshSessionUser reloads the user in the session, after their profile changed.
+func (app *application) refreshSessionUser(ctx context.Context, userID int) {
+
+	user, err := app.DB.GetUser(ctx, userID)
+	if err != nil {
+		app.Logger.ErrorContext(ctx, "reloading user", "user_id", userID, "error", err)
+		return
+	}
+
+	app.Session.Put(ctx, "user", *user)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// postImageAction posts to a gallery handler for imageID, as user
+func postImageAction(handler http.HandlerFunc, user data.User, imageID int) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", "/", nil)
+	chiCtx := chi.NewRouteContext()
+	chiCtx.URLParams.Add("imageID", fmt.Sprint(imageID))
+	req = req.WithContext(context.WithValue(req.Context(), chi.RouteCtxKey, chiCtx))
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", user)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw, req
+}
+
+// Test_app_gallery tests switching between and deleting profile pictures
+func Test_app_gallery(t *testing.T) {
+
+	defer cleanUploads(t)
+
+	ctx := context.Background()
+	user := data.User{ID: 3, Email: "jill@example.com"}
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+
+	img, err := images.Process(&buf, maxUploadSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := img.Put(ctx, app.Storage); err != nil {
+		t.Fatal(err)
+	}
+
+	// the same picture, uploaded twice, shares its files
+	first, _ := app.DB.InsertUserImage(ctx, data.UserImage{UserID: user.ID, FileName: img.Name})
+	second, _ := app.DB.InsertUserImage(ctx, data.UserImage{UserID: user.ID, FileName: img.Name})
+
+	rw, req := postImageAction(app.ActivateProfilePic, user, first)
+	if rw.Header().Get("Location") != "/user/profile" || app.Session.GetString(req.Context(), "error") != "" {
+		t.Errorf("expected the picture to be activated; got %q", app.Session.GetString(req.Context(), "error"))
+	}
+
+	if pic := app.Session.Get(req.Context(), "user").(data.User).ProfilePic; pic.ID != first {
+		t.Errorf("expected picture %d in the session; got %d", first, pic.ID)
+	}
+
+	// other users' pictures are off limits
+	_, req = postImageAction(app.ActivateProfilePic, data.User{ID: 4}, first)
+	if app.Session.GetString(req.Context(), "error") == "" {
+		t.Error("expected an error activating another user's picture")
+	}
+
+	_, req = postImageAction(app.DeleteProfilePic, user, second)
+	if app.Session.GetString(req.Context(), "error") != "" {
+		t.Errorf("expected the picture to be deleted; got %q", app.Session.GetString(req.Context(), "error"))
+	}
+
+	if _, err := os.Stat("./testdata/uploads/" + img.Name); err != nil {
+		t.Error("expected the files to be kept while another picture uses them")
+	}
+
+	_, req = postImageAction(app.DeleteProfilePic, user, first)
+
+	if _, err := os.Stat("./testdata/uploads/" + img.Name); !os.IsNotExist(err) {
+		t.Error("expected the files to be removed with the last picture using them")
+	}
+
+	if pic := app.Session.Get(req.Context(), "user").(data.User).ProfilePic; pic.FileName != "" {
+		t.Errorf("expected no profile picture in the session; got %+v", pic)
+	}
+
+	if list, _ := app.DB.ListUserImages(ctx, user.ID); len(list) != 0 {
+		t.Errorf("expected no pictures left; got %d", len(list))
+	}
+}
+
+// Test_app_ProfileGallery tests that the profile page lists the user's pictures
+func Test_app_ProfileGallery(t *testing.T) {
+
+	ctx := context.Background()
+	id, _ := app.DB.InsertUserImage(ctx, data.UserImage{UserID: 4, FileName: "abc.png"})
+	defer app.DB.DeleteUserImage(ctx, 4, id)
+
+	req, _ := http.NewRequest("GET", "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 4})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(rr, req)
+
+	for _, expected := range []string{`src="/media/abc_128.png"`, fmt.Sprintf(`action="/user/images/%d/delete"`, id)} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %s in the profile page", expected)
+		}
+	}
+}
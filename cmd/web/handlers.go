@@ -1,20 +1,25 @@
 package main
 
 import (
+	"context"
+	stderrors "errors"
 	"fmt"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
 	"html/template"
-	"io"
-	"log"
+	"math"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"path"
-	"path/filepath"
 	"time"
 )
 
 var pathToTemplates = "./templates/"
-var uploadPath = "./static/img/"
+
+// imageURLExpiry is how long the image URLs in a rendered page stay valid.
+const imageURLExpiry = time.Hour
 
 // Home is the handler for the home page
 func (app *application) Home(w http.ResponseWriter, r *http.Request) {
@@ -24,17 +29,17 @@ func (app *application) Home(w http.ResponseWriter, r *http.Request) {
 	if app.Session.Exists(r.Context(), "test") {
 		message := app.Session.GetString(r.Context(), "test")
 		td["test"] = message
-		log.Printf("session exists, message: %v", message)
+		app.Logger.DebugContext(r.Context(), "session exists", "message", message)
 	} else {
 		app.Session.Put(r.Context(), "test", "Hit this page at "+time.Now().UTC().String())
-		log.Printf("session created, it was empty")
+		app.Logger.DebugContext(r.Context(), "session created, it was empty")
 	}
 
 	err := app.render(w, r, "home.page.gohtml", &TemplateData{
 		Data: td,
 	})
 	if err != nil {
-		log.Printf("error rendering template: %v", err)
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
 	}
 
 }
@@ -47,15 +52,26 @@ func (app *application) Profile(w http.ResponseWriter, r *http.Request) {
 	if app.Session.Exists(r.Context(), "test") {
 		message := app.Session.GetString(r.Context(), "test")
 		td["test"] = message
-		log.Printf("session exists, message: %v", message)
+		app.Logger.DebugContext(r.Context(), "session exists", "message", message)
 	} else {
 		app.Session.Put(r.Context(), "test", "Hit this page at "+time.Now().UTC().String())
-		log.Printf("session created, it was empty")
+		app.Logger.DebugContext(r.Context(), "session created, it was empty")
+	}
+
+	// the user's pictures, for the gallery
+	if app.Session.Exists(r.Context(), "user") {
+		user := app.Session.Get(r.Context(), "user").(data.User)
+
+		images, err := app.DB.ListUserImages(r.Context(), user.ID)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "listing images", "user_id", user.ID, "error", err)
+		}
+		td["images"] = images
 	}
 
-	err := app.render(w, r, "profile.page.gohtml", &TemplateData{})
+	err := app.render(w, r, "profile.page.gohtml", &TemplateData{Data: td})
 	if err != nil {
-		log.Printf("error rendering template: %v", err)
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
 	}
 
 }
@@ -66,13 +82,15 @@ type TemplateData struct {
 	Error string
 	Flash string
 	User  data.User
+	// CSRFToken must be sent back by every form that posts, see csrf.
+	CSRFToken string
 }
 
 // render is a helper function that parses a template file and writes the
 func (app *application) render(w http.ResponseWriter, r *http.Request, t string, td *TemplateData) error {
 
 	// parse the template from disk
-	parsedTemplate, err := template.ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
+	parsedTemplate, err := template.New(t).Funcs(app.templateFuncs(r)).ParseFiles(path.Join(pathToTemplates, t), path.Join(pathToTemplates, "base.layout.gohtml"))
 	if err != nil {
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return err
@@ -84,6 +102,8 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, t string,
 
 	td.Flash = app.Session.PopString(r.Context(), "flash")
 
+	td.CSRFToken = app.csrfToken(r.Context())
+
 	// add the current user to the template data, if any
 	if app.Session.Exists(r.Context(), "user") {
 		td.User = app.Session.Get(r.Context(), "user").(data.User)
@@ -99,12 +119,28 @@ func (app *application) render(w http.ResponseWriter, r *http.Request, t string,
 	return nil
 }
 
+// templateFuncs returns the functions available to templates: imageURL and
+// thumbnailURL resolve stored images through app.Storage.
+func (app *application) templateFuncs(r *http.Request) template.FuncMap {
+
+	imageURL := func(key string) (string, error) {
+		return app.Storage.SignedURL(r.Context(), key, imageURLExpiry)
+	}
+
+	return template.FuncMap{
+		"imageURL": imageURL,
+		"thumbnailURL": func(key string, size int) (string, error) {
+			return imageURL(images.ThumbnailName(key, size))
+		},
+	}
+}
+
 // Login is the handler for the login page
 func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 	err := r.ParseForm()
 	if err != nil {
-		log.Printf("error parsing form: %v", err)
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
 		http.Error(w, "bad request", http.StatusBadRequest)
 		return
 	}
@@ -123,23 +159,56 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 	email := r.Form.Get("email")
 	password := r.Form.Get("password")
+	ip := app.ipFromContext(r.Context())
 
-	user, err := app.DB.GetUserByEmail(email)
+	// turn away accounts and addresses that are locked out before even
+	// looking at the password
+	wait, err := app.Lockout.Check(r.Context(), email, ip)
 	if err != nil {
-		app.Session.Put(r.Context(), "error", "invalid login credentials")
-		http.Redirect(w, r, "/", http.StatusSeeOther)
+		app.Logger.ErrorContext(r.Context(), "checking login lockout", "error", err)
+	}
+	if wait > 0 {
+		app.Metrics.AuthAttempt(metrics.AuthLocked)
+		app.tooManyAttempts(w, r, wait)
+		return
+	}
+
+	user, err := app.DB.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		app.loginFailed(w, r, email, ip)
 		return
 	}
 
 	// authenticate the user
-	if !app.authenticate(r, user, password) {
-		app.Session.Put(r.Context(), "error", "invalid login credentials")
+	err = app.authenticate(r, user, password)
+	if stderrors.Is(err, errEmailNotVerified) {
+		// the password was right, so it's safe to say what is wrong, and to send
+		// a fresh link in case the first one expired
+		if err := app.Accounts.SendEmailVerification(r.Context(), user); err != nil {
+			app.Logger.ErrorContext(r.Context(), "sending email verification", "user_id", user.ID, "error", err)
+		}
+		app.Session.Put(r.Context(), "error", "Please confirm your email address before logging in. We've emailed you a new link.")
 		http.Redirect(w, r, "/", http.StatusSeeOther)
 		return
 	}
+	if stderrors.Is(err, errSecondFactorRequired) {
+		// the session now holds a login waiting for its second factor
+		_ = app.renewSession(r.Context())
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+	if err != nil {
+		app.loginFailed(w, r, email, ip)
+		return
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+	app.Metrics.AuthAttempt(metrics.AuthSuccess)
 
 	// prevent fixation attack
-	_ = app.Session.RenewToken(r.Context())
+	_ = app.renewSession(r.Context())
 
 	// store success message in session
 
@@ -149,27 +218,106 @@ func (app *application) Login(w http.ResponseWriter, r *http.Request) {
 
 }
 
-// authenticate checks the provided password against the hashed password stored in the database for a specific user.
-func (app *application) authenticate(r *http.Request, user *data.User, password string) bool {
+// loginFailed records a failed login as email from ip, and sends the user back
+// to the login form, telling them if they are now locked out.
+func (app *application) loginFailed(w http.ResponseWriter, r *http.Request, email, ip string) {
+
+	app.Metrics.AuthAttempt(metrics.AuthFailure)
+
+	wait, err := app.Lockout.Fail(r.Context(), email, ip)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "recording failed login", "error", err)
+	}
+	if wait > 0 {
+		app.tooManyAttempts(w, r, wait)
+		return
+	}
+
+	app.Session.Put(r.Context(), "error", "invalid login credentials")
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// tooManyAttempts sends a locked out user back to the login form, telling them
+// when they can try again.
+func (app *application) tooManyAttempts(w http.ResponseWriter, r *http.Request, wait time.Duration) {
+
+	app.Session.Put(r.Context(), "error", lockedOutMessage(wait))
+	http.Redirect(w, r, "/", http.StatusSeeOther)
+}
+
+// lockedOutMessage tells a locked out user when they can try again.
+func lockedOutMessage(wait time.Duration) string {
+
+	minutes := int(math.Ceil(wait.Minutes()))
+	when := "a minute"
+	if minutes > 1 {
+		when = fmt.Sprintf("%d minutes", minutes)
+	}
+
+	return fmt.Sprintf("Too many failed login attempts. Please try again in %s.", when)
+}
+
+// errInvalidCredentials and errEmailNotVerified are the reasons authenticate
+// turns a user away; errSecondFactorRequired means the password was right, but
+// the user still has to enter a two-factor code.
+var (
+	errInvalidCredentials   = stderrors.New("invalid login credentials")
+	errEmailNotVerified     = stderrors.New("email address not verified")
+	errSecondFactorRequired = stderrors.New("second factor required")
+)
+
+// authenticate checks the provided password against the hashed password stored
+// in the database for a specific user, and that the user has verified their
+// email address. On success the user is stored in the session, unless they use
+// two-factor authentication, in which case the login is left pending until they
+// enter a code.
+func (app *application) authenticate(r *http.Request, user *data.User, password string) error {
 
 	// Check whether the provided password matches the hashed password in the database.
 	if valid, err := user.PasswordMatches(password); err != nil || !valid {
-		return false
+		return errInvalidCredentials
+	}
+
+	if !user.EmailVerified() {
+		return errEmailNotVerified
+	}
+
+	if user.TOTPEnabled {
+		app.Session.Put(r.Context(), pendingUserKey, user.ID)
+		app.Session.Put(r.Context(), pendingUntilKey, time.Now().Add(pendingLoginTTL))
+		return errSecondFactorRequired
 	}
 
 	app.Session.Put(r.Context(), "user", user)
 
-	return true
+	return nil
 }
 
 // UploadProfilePic is the handler for the upload profile pic page
 func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request) {
 
+	// the CSRF check may have parsed the form already; either way, the
+	// temporary files go once the upload is handled
+	cleanup, err := parseMultipartForm(w, r)
+	defer cleanup()
+
+	// a profile picture is a single image; refuse any other upload before a
+	// file of it is put, since only one would be recorded
+	if err == nil {
+		if n := countFiles(r.MultipartForm); n != 1 {
+			err = fmt.Errorf("%d files uploaded, expected one", n)
+		}
+	}
+
 	// call a function that extracts a file from an upload
-	files, err := app.UploadFiles(r, uploadPath)
+	var files []*UploadedFile
+	if err == nil {
+		files, err = app.UploadFiles(r, app.Storage)
+	}
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		app.Session.Put(r.Context(), "error", "error uploading file")
+		app.Logger.ErrorContext(r.Context(), "uploading profile picture", "error", err)
+		app.Session.Put(r.Context(), "error", fmt.Sprintf("Please upload one JPEG, PNG or GIF image of at most %g MB.", float64(maxUploadSize)/(1<<20)))
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 		return
 	}
 
@@ -179,87 +327,152 @@ func (app *application) UploadProfilePic(w http.ResponseWriter, r *http.Request)
 	// create a var of file data.UserImage
 	var imageVar = data.UserImage{
 		UserID:   user.ID,
-		FileName: files[0].OriginalFileName,
+		FileName: files[0].FileName,
+		MIMEType: files[0].MIMEType,
+		Width:    files[0].Width,
+		Height:   files[0].Height,
+		Size:     files[0].FileSize,
 	}
 
 	// insert the user image into user_images
-	_, err = app.DB.InsertUserImage(imageVar)
+	_, err = app.DB.InsertUserImage(r.Context(), imageVar)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		app.Session.Put(r.Context(), "error", "error uploading file")
+		app.Logger.ErrorContext(r.Context(), "saving profile picture", "user_id", user.ID, "error", err)
+		app.removeUploads(r.Context(), app.Storage, files)
+		app.Session.Put(r.Context(), "error", "Your profile picture could not be saved, please try again.")
+		http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 		return
 	}
 
-	// update the user's profile pic session variable "user"
-	updatedUser, err := app.DB.GetUser(user.ID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		app.Session.Put(r.Context(), "error", "error uploading file")
-		return
+	// deleting a picture of the same content may have removed the files since
+	// they were put; now that this picture holds on to them, put them again
+	if err := files[0].image.Put(r.Context(), app.Storage); err != nil {
+		app.Logger.ErrorContext(r.Context(), "saving profile picture", "file_name", imageVar.FileName, "error", err)
 	}
 
-	app.Session.Put(r.Context(), "user", updatedUser)
+	// update the user's profile pic session variable "user"
+	app.refreshSessionUser(r.Context(), user.ID)
 
 	// redirect to profile page
 	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
 
 }
 
-// UploadedFile is a struct that holds the original file name and the file size
+// maxUploadSize is the largest image, in bytes, that UploadFiles accepts. It
+// is set from the configuration.
+var maxUploadSize int64 = 10 << 20
+
+// maxUploadOverhead is the room a multipart body gets, beyond maxUploadSize,
+// for its other fields and part headers.
+const maxUploadOverhead = 1 << 20
+
+// parseMultipartForm parses the multipart body of r, refusing bodies larger
+// than an upload may be. The returned function removes the temporary files the
+// parse spilled to disk, and must be deferred: net/http only does that for the
+// request it created, not for the copies middleware makes with WithContext.
+func parseMultipartForm(w http.ResponseWriter, r *http.Request) (func(), error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+maxUploadOverhead)
+	err := r.ParseMultipartForm(maxUploadSize)
+
+	return func() {
+		if r.MultipartForm != nil {
+			_ = r.MultipartForm.RemoveAll()
+		}
+	}, err
+}
+
+// UploadedFile describes an uploaded image, as stored: FileName is its
+// content-addressed name, and FileSize the size of the re-encoded image.
 type UploadedFile struct {
 	OriginalFileName string
+	FileName         string
 	FileSize         int64
+	MIMEType         string
+	Width            int
+	Height           int
+
+	// image is the processed upload, kept to put it again; see UploadProfilePic
+	image *images.Image
 }
 
-// UploadFiles is the handler for the upload files page
-func (app *application) UploadFiles(r *http.Request, uploadDir string) ([]*UploadedFile, error) {
+// countFiles returns the number of files in form, over all of its fields.
+func countFiles(form *multipart.Form) int {
+	n := 0
+	for _, fileHeaders := range form.File {
+		n += len(fileHeaders)
+	}
+
+	return n
+}
+
+// UploadFiles validates every image in a multipart upload, re-encodes it, and
+// puts it with its thumbnails in store. Files that aren't JPEG, PNG or GIF
+// images fail the whole upload, and the images put before them are removed.
+func (app *application) UploadFiles(r *http.Request, store storage.Storage) ([]*UploadedFile, error) {
 
 	var uploadedFiles []*UploadedFile
 
-	err := r.ParseMultipartForm(int64(1024 * 1024 * 100))
+	err := r.ParseMultipartForm(maxUploadSize)
 	if err != nil {
-		return nil, fmt.Errorf("error parsing multipart form, bigger than 100Mib: %v", err)
+		return nil, fmt.Errorf("error parsing multipart form: %v", err)
 	}
 
 	for _, fileHeaders := range r.MultipartForm.File {
 		for _, hdr := range fileHeaders {
-			uploadedFiles, err = func(uploadedFiles []*UploadedFile) ([]*UploadedFile, error) {
-
-				var uploadedFile UploadedFile
-
-				infile, err := hdr.Open()
-				if err != nil {
-					return nil, fmt.Errorf("error opening file: %v", err)
-				}
-				defer infile.Close()
+			uploadedFile, err := saveImage(r.Context(), hdr, store)
+			if err != nil {
+				// nothing records the images put so far, so nothing else would remove them
+				app.removeUploads(r.Context(), store, uploadedFiles)
+				return nil, fmt.Errorf("error uploading %s: %w", hdr.Filename, err)
+			}
+			app.Metrics.Uploaded(hdr.Size)
 
-				uploadedFile.OriginalFileName = hdr.Filename
+			uploadedFiles = append(uploadedFiles, uploadedFile)
+		}
+	}
 
-				var outfile *os.File
+	return uploadedFiles, nil
+}
 
-				defer outfile.Close()
+// removeUploads removes the files of uploads from store, unless a picture is
+// stored in them.
+func (app *application) removeUploads(ctx context.Context, store storage.Storage, uploads []*UploadedFile) {
+	for _, f := range uploads {
+		if err := images.RemoveUnused(ctx, app.DB, store, f.FileName); err != nil {
+			app.Logger.ErrorContext(ctx, "removing uploaded image", "file_name", f.FileName, "error", err)
+		}
+	}
+}
 
-				if outfile, err = os.Create(filepath.Join(uploadDir, uploadedFile.OriginalFileName)); err != nil {
-					return nil, fmt.Errorf("error creating file: %v", err)
-				} else {
-					fileSize, err := io.Copy(outfile, infile)
-					if err != nil {
-						return nil, fmt.Errorf("error copying file: %v", err)
-					}
+// saveImage processes one uploaded file, and puts it in store.
+func saveImage(ctx context.Context, hdr *multipart.FileHeader, store storage.Storage) (*UploadedFile, error) {
 
-					uploadedFile.FileSize = fileSize
-				}
+	if hdr.Size > maxUploadSize {
+		return nil, images.ErrTooLarge
+	}
 
-				uploadedFiles = append(uploadedFiles, &uploadedFile)
+	infile, err := hdr.Open()
+	if err != nil {
+		return nil, fmt.Errorf("error opening file: %v", err)
+	}
+	defer infile.Close()
 
-				return uploadedFiles, nil
+	img, err := images.Process(infile, maxUploadSize)
+	if err != nil {
+		return nil, err
+	}
 
-			}(uploadedFiles)
-			if err != nil {
-				return uploadedFiles, err
-			}
-		}
+	if err := img.Put(ctx, store); err != nil {
+		return nil, fmt.Errorf("error saving file: %v", err)
 	}
 
-	return uploadedFiles, nil
+	return &UploadedFile{
+		OriginalFileName: hdr.Filename,
+		FileName:         img.Name,
+		FileSize:         img.Size(),
+		MIMEType:         img.MIMEType,
+		Width:            img.Width,
+		Height:           img.Height,
+		image:            img,
+	}, nil
 }
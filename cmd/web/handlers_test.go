@@ -4,15 +4,21 @@ import (
 	"bytes"
 	"context"
 	"crypto/tls"
+	stderrors "errors"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/images"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository"
 	"image"
 	"image/png"
 	"io"
 	"mime/multipart"
 	"net/http"
+	"net/http/cookiejar"
 	"net/http/httptest"
 	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strings"
 	"sync"
 	"testing"
@@ -270,6 +276,15 @@ func Test_app_Login(t *testing.T) {
 			expectedStatusCode: http.StatusSeeOther,
 			expectedLocation:   "/",
 		},
+		{
+			name: "email not verified",
+			postedData: url.Values{
+				"email":    {"unverified@example.com"},
+				"password": {"secret"},
+			},
+			expectedStatusCode: http.StatusSeeOther,
+			expectedLocation:   "/",
+		},
 	}
 
 	// loop through the tests
@@ -300,6 +315,55 @@ func Test_app_Login(t *testing.T) {
 
 }
 
+// Test_app_LoginLockout tests that repeated failures lock an account out, even
+// for the right password, until an admin unlocks it
+func Test_app_LoginLockout(t *testing.T) {
+
+	login := func(password string) (*httptest.ResponseRecorder, *http.Request) {
+		values := url.Values{"email": {"admin@example.com"}, "password": {password}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(values.Encode()))
+		req = req.WithContext(context.WithValue(req.Context(), contextUserKey, "192.0.2.10"))
+		ctx, _ := app.Session.Load(req.Context(), "")
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		rw := httptest.NewRecorder()
+		http.HandlerFunc(app.Login).ServeHTTP(rw, req)
+
+		return rw, req
+	}
+
+	// start from a clean slate, whatever earlier tests did
+	if err := app.Lockout.Unlock(context.Background(), "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < app.Lockout.Account.Threshold; i++ {
+		_, req := login("wrong")
+		if msg := app.Session.GetString(req.Context(), "error"); msg != "invalid login credentials" {
+			t.Fatalf("failure %d: expected invalid credentials; got %q", i, msg)
+		}
+	}
+
+	_, req := login("wrong")
+	if msg := app.Session.GetString(req.Context(), "error"); !strings.HasPrefix(msg, "Too many failed login attempts") {
+		t.Errorf("expected a lockout message; got %q", msg)
+	}
+
+	rw, req := login("secret")
+	if rw.Header().Get("Location") != "/" || app.Session.Exists(req.Context(), "user") {
+		t.Error("expected the right password to be turned away while locked out")
+	}
+
+	if err := app.Lockout.Unlock(req.Context(), "admin@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if rw, _ := login("secret"); rw.Header().Get("Location") != "/user/profile" {
+		t.Errorf("expected a login after the unlock; got %s", rw.Header().Get("Location"))
+	}
+}
+
 // Test_app_UploadFiles tests the upload files handler
 func Test_app_UploadFiles(t *testing.T) {
 
@@ -321,23 +385,203 @@ func Test_app_UploadFiles(t *testing.T) {
 	request.Header.Add("Content-Type", writer.FormDataContentType())
 
 	// call app.UploadFiles with the request and response recorder
-	uploadedFiles, err := app.UploadFiles(request, "./testdata/uploads/")
+	uploadedFiles, err := app.UploadFiles(request, app.Storage)
 	if err != nil {
 		t.Error(err)
 	}
 
 	// perform the tests
-	if _, err := os.Stat("./testdata/uploads/" + uploadedFiles[0].OriginalFileName); os.IsNotExist(err) {
+	if _, err := os.Stat("./testdata/uploads/" + uploadedFiles[0].FileName); os.IsNotExist(err) {
 		t.Error("file was not uploaded, file does not exist")
 	}
 
+	if uploadedFiles[0].FileName == uploadedFiles[0].OriginalFileName || uploadedFiles[0].MIMEType != "image/png" {
+		t.Errorf("expected a content-addressed png, got %+v", uploadedFiles[0])
+	}
+
+	if _, err := os.Stat("./testdata/uploads/" + images.ThumbnailName(uploadedFiles[0].FileName, 64)); os.IsNotExist(err) {
+		t.Error("thumbnail was not saved")
+	}
+
 	// clean up the files
-	_ = os.Remove("./testdata/uploads/" + uploadedFiles[0].OriginalFileName)
+	cleanUploads(t)
 
 	wg.Wait()
 
 }
 
+// Test_app_UploadFilesRejectsNonImages tests that a file which merely claims
+// to be an image is not saved
+func Test_app_UploadFilesRejectsNonImages(t *testing.T) {
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	w, _ := mw.CreateFormFile("file", "evil.png")
+	_, _ = w.Write([]byte("<script>alert('hi')</script>"))
+	mw.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", mw.FormDataContentType())
+
+	_, err := app.UploadFiles(request, app.Storage)
+	if wrapped, ok := err.(interface{ Unwrap() error }); !ok || wrapped.Unwrap() != images.ErrUnsupported {
+		t.Errorf("expected ErrUnsupported, got %v", err)
+	}
+
+	if entries, _ := os.ReadDir("./testdata/uploads/"); len(entries) != 0 {
+		t.Errorf("expected nothing to be saved, got %d files", len(entries))
+	}
+}
+
+// Test_app_UploadFilesRemovesPartialUploads tests that the images put before a
+// file that fails the upload don't stay behind
+func Test_app_UploadFilesRemovesPartialUploads(t *testing.T) {
+
+	// content no picture of the other tests is stored in
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	m.Pix[0] = 42
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	w, _ := mw.CreateFormFile("file", "good.png")
+	_ = png.Encode(w, m)
+
+	// in the same field, so that it comes second
+	w, _ = mw.CreateFormFile("file", "evil.png")
+	_, _ = w.Write([]byte("<script>alert('hi')</script>"))
+	mw.Close()
+
+	request := httptest.NewRequest("POST", "/", body)
+	request.Header.Add("Content-Type", mw.FormDataContentType())
+
+	files, err := app.UploadFiles(request, app.Storage)
+	if err == nil || files != nil {
+		t.Errorf("expected the upload to fail, got %v and %v", files, err)
+	}
+
+	if entries, _ := os.ReadDir("./testdata/uploads/"); len(entries) != 0 {
+		t.Errorf("expected the good image to be removed, got %d files", len(entries))
+		cleanUploads(t)
+	}
+}
+
+// Test_app_UploadProfilePicOneFile tests that a profile picture upload of
+// several files is refused before any of them is saved
+func Test_app_UploadProfilePicOneFile(t *testing.T) {
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+
+	for _, field := range []string{"file", "file", "other"} {
+		w, _ := mw.CreateFormFile(field, "img.png")
+		_ = png.Encode(w, image.NewRGBA(image.Rect(0, 0, 2, 2)))
+	}
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.UploadProfilePic).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || !strings.Contains(app.Session.GetString(req.Context(), "error"), "Please upload one") {
+		t.Errorf("expected a redirect with an error, got %d", rr.Code)
+	}
+
+	if entries, _ := os.ReadDir("./testdata/uploads/"); len(entries) != 0 {
+		t.Errorf("expected nothing to be saved, got %d files", len(entries))
+		cleanUploads(t)
+	}
+}
+
+// failingImageDB is a database whose pictures can't be added
+type failingImageDB struct {
+	repository.DatabaseRepo
+}
+
+func (db failingImageDB) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	return 0, stderrors.New("database is down")
+}
+
+// Test_app_UploadProfilePicNotRecorded tests that the files of a profile
+// picture that can't be added are removed, and the user is told
+func Test_app_UploadProfilePicNotRecorded(t *testing.T) {
+
+	db := app.DB
+	app.DB = failingImageDB{db}
+	defer func() { app.DB = db }()
+
+	// content no picture of the other tests is stored in
+	m := image.NewRGBA(image.Rect(0, 0, 3, 3))
+	m.Pix[0] = 43
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	w, _ := mw.CreateFormFile("file", "img.png")
+	_ = png.Encode(w, m)
+	mw.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/upload", body)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1})
+	req.Header.Add("Content-Type", mw.FormDataContentType())
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.UploadProfilePic).ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusSeeOther || rr.Header().Get("Location") != "/user/profile" {
+		t.Errorf("expected a redirect to the profile, got %d %s", rr.Code, rr.Header().Get("Location"))
+	}
+
+	if strings.Contains(rr.Body.String(), "database is down") {
+		t.Error("expected the error to be kept from the user")
+	}
+
+	if !strings.Contains(app.Session.GetString(req.Context(), "error"), "could not be saved") {
+		t.Error("expected an error message")
+	}
+
+	if entries, _ := os.ReadDir("./testdata/uploads/"); len(entries) != 0 {
+		t.Errorf("expected the files to be removed, got %d files", len(entries))
+		cleanUploads(t)
+	}
+}
+
+// cleanUploads removes whatever the upload tests saved
+func cleanUploads(t *testing.T) {
+
+	entries, err := os.ReadDir("./testdata/uploads/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, entry := range entries {
+		_ = os.Remove(filepath.Join("./testdata/uploads/", entry.Name()))
+	}
+}
+
+// Test_app_ProfileImageURLs tests that the profile page links images through
+// the storage backend
+func Test_app_ProfileImageURLs(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/user/profile", nil)
+	req = addContextAndSessionToRequest(req, app)
+	app.Session.Put(req.Context(), "user", data.User{ID: 1, ProfilePic: data.UserImage{FileName: "abc.png"}})
+
+	rr := httptest.NewRecorder()
+	http.HandlerFunc(app.Profile).ServeHTTP(rr, req)
+
+	for _, expected := range []string{`href="/media/abc.png"`, `src="/media/abc_256.png"`} {
+		if !strings.Contains(rr.Body.String(), expected) {
+			t.Errorf("expected %s in the profile page", expected)
+		}
+	}
+}
+
 // simulatePNGUpload simulates uploading a png file
 func simulatePNGUpload(fileToUpload string, writer *multipart.Writer, t *testing.T, wg *sync.WaitGroup) {
 
@@ -374,7 +618,6 @@ func simulatePNGUpload(fileToUpload string, writer *multipart.Writer, t *testing
 
 // Test_app_UploadProfilePic tests the upload profile pic handler
 func Test_app_UploadProfilePic(t *testing.T) {
-	uploadPath = "./testdata/uploads"
 	filePath := "./testdata/img.png"
 
 	// specify a field name for the form
@@ -417,5 +660,200 @@ func Test_app_UploadProfilePic(t *testing.T) {
 		t.Errorf("wrong status code")
 	}
 
-	_ = os.Remove("./testdata/uploads/img.png")
+	cleanUploads(t)
+}
+
+// Test_app_csrf tests that requests which may change state need the CSRF token
+// of their session, in the form or in a header
+func Test_app_csrf(t *testing.T) {
+
+	multipartBody := func(token string) (string, string) {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField(csrfField, token)
+		mw.Close()
+		return body.String(), mw.FormDataContentType()
+	}
+
+	var theTests = []struct {
+		name               string
+		method             string
+		sessionToken       string
+		formToken          string
+		headerToken        string
+		multipart          bool
+		expectedStatusCode int
+	}{
+		{"get without token", "GET", "good", "", "", false, http.StatusOK},
+		{"head without token", "HEAD", "good", "", "", false, http.StatusOK},
+		{"post with form token", "POST", "good", "good", "", false, http.StatusOK},
+		{"post with header token", "POST", "good", "", "good", false, http.StatusOK},
+		{"post with multipart token", "POST", "good", "good", "", true, http.StatusOK},
+		{"post without token", "POST", "good", "", "", false, http.StatusForbidden},
+		{"post with wrong token", "POST", "good", "bad", "", false, http.StatusForbidden},
+		{"post with wrong multipart token", "POST", "good", "bad", "", true, http.StatusForbidden},
+		{"post without session token", "POST", "", "", "", false, http.StatusForbidden},
+		{"delete without token", "DELETE", "good", "", "", false, http.StatusForbidden},
+	}
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, tt := range theTests {
+		body, contentType := url.Values{csrfField: {tt.formToken}}.Encode(), "application/x-www-form-urlencoded"
+		if tt.multipart {
+			body, contentType = multipartBody(tt.formToken)
+		}
+
+		req, _ := http.NewRequest(tt.method, "/login", strings.NewReader(body))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", contentType)
+		if tt.headerToken != "" {
+			req.Header.Set(csrfHeader, tt.headerToken)
+		}
+		if tt.sessionToken != "" {
+			app.Session.Put(req.Context(), csrfSessionKey, tt.sessionToken)
+		}
+
+		rr := httptest.NewRecorder()
+		app.csrf(next).ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatusCode {
+			t.Errorf("%s: expected %d; got %d", tt.name, tt.expectedStatusCode, rr.Code)
+		}
+
+		if tt.expectedStatusCode == http.StatusForbidden && !strings.Contains(rr.Body.String(), "This form has expired") {
+			t.Errorf("%s: expected the friendly error page, got %s", tt.name, rr.Body.String())
+		}
+	}
+}
+
+// Test_app_csrfMultipart tests that the CSRF check caps multipart bodies, and
+// removes the temporary files it parses them into once the request is served
+func Test_app_csrfMultipart(t *testing.T) {
+
+	defer func(size int64) { maxUploadSize = size }(maxUploadSize)
+	maxUploadSize = 1 << 10
+
+	var theTests = []struct {
+		name               string
+		fileSize           int
+		expectedStatusCode int
+	}{
+		{"file spilled to disk", 4 << 10, http.StatusOK},
+		{"body over the limit", 2 << 20, http.StatusForbidden},
+	}
+
+	for _, tt := range theTests {
+		body := new(bytes.Buffer)
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField(csrfField, "good")
+		part, _ := mw.CreateFormFile("profilePic", "big.png")
+		_, _ = part.Write(bytes.Repeat([]byte{'x'}, tt.fileSize))
+		mw.Close()
+
+		req, _ := http.NewRequest("POST", "/login", body)
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", mw.FormDataContentType())
+		app.Session.Put(req.Context(), csrfSessionKey, "good")
+
+		var file *multipart.FileHeader
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			file = r.MultipartForm.File["profilePic"][0]
+			if f, err := file.Open(); err != nil {
+				t.Errorf("%s: expected the file while the request is served: %s", tt.name, err)
+			} else {
+				f.Close()
+			}
+		})
+
+		rr := httptest.NewRecorder()
+		app.csrf(next).ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedStatusCode {
+			t.Errorf("%s: expected %d; got %d", tt.name, tt.expectedStatusCode, rr.Code)
+		}
+
+		if file != nil {
+			if f, err := file.Open(); err == nil {
+				f.Close()
+				t.Errorf("%s: expected the temporary file to be removed", tt.name)
+			}
+		}
+	}
+}
+
+// Test_app_csrfForms tests that the rendered forms carry the session's CSRF
+// token, and that posting them works through the routes with it and fails
+// without it
+func Test_app_csrfForms(t *testing.T) {
+
+	ts := httptest.NewTLSServer(app.routes())
+	defer ts.Close()
+
+	jar, _ := cookiejar.New(nil)
+	client := ts.Client()
+	client.Jar = jar
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+
+	resp, err := client.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	page, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	match := regexp.MustCompile(`name="csrf_token" value="([^"]+)"`).FindSubmatch(page)
+	if match == nil {
+		t.Fatal("expected the login form to carry a CSRF token")
+	}
+	token := string(match[1])
+
+	var theTests = []struct {
+		name               string
+		token              string
+		expectedStatusCode int
+	}{
+		{"login without token", "", http.StatusForbidden},
+		{"login with another token", "not-the-token", http.StatusForbidden},
+		{"login with token", token, http.StatusSeeOther},
+	}
+
+	for _, tt := range theTests {
+		values := url.Values{"email": {"admin@example.com"}, "password": {"wrong"}}
+		if tt.token != "" {
+			values.Set(csrfField, tt.token)
+		}
+
+		resp, err := client.PostForm(ts.URL+"/login", values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != tt.expectedStatusCode {
+			t.Errorf("%s: expected %d; got %d", tt.name, tt.expectedStatusCode, resp.StatusCode)
+		}
+	}
+}
+
+// Test_app_renewSession tests that logging in hands out a new CSRF token
+func Test_app_renewSession(t *testing.T) {
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	req = addContextAndSessionToRequest(req, app)
+
+	before := app.csrfToken(req.Context())
+	if again := app.csrfToken(req.Context()); again != before {
+		t.Errorf("expected the token to stay the same within a session, got %s and %s", before, again)
+	}
+
+	if err := app.renewSession(req.Context()); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := app.csrfToken(req.Context()); after == before {
+		t.Error("expected a new token after the session was renewed")
+	}
 }
@@ -1,39 +1,86 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/gob"
 	"flag"
 	"github.com/alexedwards/scs/v2"
-	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/accounts"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
+	"github.com/calvarado2004/go-testing-webapp/pkg/config"
+	"github.com/calvarado2004/go-testing-webapp/pkg/lockout"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mailer"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/migrations"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"github.com/calvarado2004/go-testing-webapp/pkg/server"
+	"github.com/calvarado2004/go-testing-webapp/pkg/sessions"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
 	"log"
-	"net/http"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 type application struct {
 	DB      repository.DatabaseRepo
 	DSN     string
 	Session *scs.SessionManager
+	Mailer  mailer.Mailer
+	BaseURL string
+	Lockout *lockout.Limiter
+	Storage storage.Storage
+	Logger  *slog.Logger
+	Metrics *metrics.Metrics
+	Health  *server.Health
+
+	// ClientIP finds the address of clients behind the trusted proxies
+	ClientIP *clientip.Resolver
+
+	// Accounts sends the password reset and email verification emails
+	Accounts *accounts.Mailer
 }
 
 //export DSN="host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5"
-//export JWT_SECRET="2dce505d96a53c5768052ee90f3df2055657518dad489160df9913f66042e160"
-//go run ./cmd/web
+//go run ./cmd/web -config config.yaml
 
 func main() {
 
-	// register the user model with gob
-	gob.Register(data.User{})
-
 	// set up an app config
 	app := application{}
 
-	// read the DSN from the command line or environment variable
-	flag.StringVar(&app.DSN, "dsn", os.Getenv("DSN"), "Postgres DSN")
-	flag.Parse()
+	// read the configuration from a file, the environment and the command line
+	cfg, err := config.Load(config.Web, os.Args[1:])
+	if err == flag.ErrHelp {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	app.DSN = cfg.DSN
+	app.BaseURL = cfg.BaseURL
+	maxUploadSize = cfg.MaxUploadBytes
+
+	app.ClientIP, err = clientip.New(cfg.TrustedProxies, cfg.ClientIPHeader)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// log JSON lines, including what goes through the standard log package
+	app.Logger = logging.New(os.Stdout, cfg.LogLevel)
+	slog.SetDefault(app.Logger)
+
+	if cfg.MailDir == "" {
+		app.Mailer = &mailer.LogMailer{}
+	} else {
+		app.Mailer = &mailer.FileMailer{Dir: cfg.MailDir}
+	}
+
+	app.Storage = cfg.NewStorage("/media")
 
 	conn, err := app.connectToDB()
 	if err != nil {
@@ -47,20 +94,60 @@ func main() {
 		}
 	}(conn)
 
-	app.DB = &dbrepo.PostgresDBRepo{DB: conn}
+	if cfg.Migrate {
+		applied, err := migrations.Up(context.Background(), conn)
+		if err != nil {
+			log.Fatal(err)
+		}
+		app.Logger.Info("applied migrations", "count", len(applied))
+	}
+
+	app.DB = &dbrepo.PostgresDBRepo{DB: conn, Logger: app.Logger}
+	app.Accounts = &accounts.Mailer{DB: app.DB, Mailer: app.Mailer, BaseURL: app.BaseURL}
+	app.Metrics = metrics.New("web", app.DB.Connection())
+	app.Health = &server.Health{Ping: app.DB.Connection().PingContext}
+
+	switch cfg.LockoutStore {
+	case "postgres":
+		app.Lockout = lockout.New(&lockout.PostgresStore{DB: conn})
+	case "memory":
+		app.Lockout = lockout.New(lockout.NewMemoryStore())
+	default:
+		log.Fatalf("unknown lockout store %q", cfg.LockoutStore)
+	}
 
 	// get a session manager
 	app.Session = getSession()
+	app.Session.Cookie.Domain = cfg.Cookie.Domain
+	app.Session.Cookie.Secure = cfg.Cookie.Secure
+
+	var sessionStore *sessions.PostgresStore
+	switch cfg.Sessions.Store {
+	case "postgres":
+		sessionStore = &sessions.PostgresStore{DB: conn, UserID: app.sessionUserID}
+		app.Session.Store = sessionStore
+	case "memory":
+		// scs keeps sessions in memory unless told otherwise
+	default:
+		log.Fatalf("unknown session store %q", cfg.Sessions.Store)
+	}
 
 	// get application routes
 	mux := app.routes()
 
-	// print out a message
-	log.Println("Starting server on :8080")
+	// serve until SIGINT or SIGTERM, then drain in-flight requests; the
+	// deferred Close shuts the connection pool after that
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
-	// start the server
-	err = http.ListenAndServe(":8080", mux)
+	if sessionStore != nil {
+		go sessionStore.Cleanup(ctx, cfg.Sessions.Cleanup, app.Logger)
+	}
+
+	err = server.Run(ctx, cfg.Addr(), mux, cfg.Server, app.Health, app.Logger)
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	app.Logger.Info("server stopped")
 }
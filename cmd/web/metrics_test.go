@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// scrapeMetric scrapes the metrics handler, and returns the value of series,
+// or 0 if it has not been recorded yet.
+func scrapeMetric(t *testing.T, handler http.Handler, series string) float64 {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 scraping metrics, got %d", rr.Code)
+	}
+
+	scanner := bufio.NewScanner(rr.Body)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(scanner.Text(), series+" "); ok {
+			f, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				t.Fatalf("bad value for %s: %s", series, value)
+			}
+			return f
+		}
+	}
+
+	return 0
+}
+
+// Test_app_metricsRoute tests that requests are counted by route, and that the
+// routes serve the metrics.
+func Test_app_metricsRoute(t *testing.T) {
+
+	routes := app.routes()
+	series := `web_http_requests_total{method="GET",route="/",status="200"}`
+
+	before := scrapeMetric(t, routes, series)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	routes.ServeHTTP(httptest.NewRecorder(), req)
+
+	if after := scrapeMetric(t, routes, series); after != before+1 {
+		t.Errorf("expected %s to go from %v to %v; got %v", series, before, before+1, after)
+	}
+}
+
+// Test_app_metricsLogins tests that logins are counted by result.
+func Test_app_metricsLogins(t *testing.T) {
+
+	var theTests = []struct {
+		name     string
+		email    string
+		password string
+		series   string
+	}{
+		{"valid credentials", "admin@example.com", "secret", `web_auth_attempts_total{result="success"}`},
+		{"wrong password", "admin@example.com", "wrong", `web_auth_attempts_total{result="failure"}`},
+		{"unknown user", "nobody@example.com", "secret", `web_auth_attempts_total{result="failure"}`},
+	}
+
+	for _, tt := range theTests {
+		before := scrapeMetric(t, app.Metrics.Handler(), tt.series)
+
+		form := url.Values{"email": {tt.email}, "password": {tt.password}}
+		req, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		req = addContextAndSessionToRequest(req, app)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		http.HandlerFunc(app.Login).ServeHTTP(httptest.NewRecorder(), req)
+
+		if after := scrapeMetric(t, app.Metrics.Handler(), tt.series); after != before+1 {
+			t.Errorf("%s: expected %s to go from %v to %v; got %v", tt.name, tt.series, before, before+1, after)
+		}
+	}
+}
+
+// Test_app_metricsUploads tests that the bytes of accepted uploads are counted.
+func Test_app_metricsUploads(t *testing.T) {
+
+	defer cleanUploads(t)
+
+	var img bytes.Buffer
+	_ = png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 10, 10)))
+	size := img.Len()
+
+	body := new(bytes.Buffer)
+	mw := multipart.NewWriter(body)
+	part, _ := mw.CreateFormFile("file", "pic.png")
+	_, _ = part.Write(img.Bytes())
+	_ = mw.Close()
+
+	req := httptest.NewRequest("POST", "/", body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+
+	before := scrapeMetric(t, app.Metrics.Handler(), "web_upload_bytes_total")
+
+	if _, err := app.UploadFiles(req, app.Storage); err != nil {
+		t.Fatal(err)
+	}
+
+	if after := scrapeMetric(t, app.Metrics.Handler(), "web_upload_bytes_total"); after != before+float64(size) {
+		t.Errorf("expected %v bytes to be counted; got %v", size, after-before)
+	}
+}
@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
-	"fmt"
-	"net"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
 	"net/http"
 )
 
@@ -16,53 +16,27 @@ func (app *application) ipFromContext(ctx context.Context) string {
 	return ctx.Value(contextUserKey).(string)
 }
 
+// addIPToContext adds the address of the client, as far as the trusted proxies
+// in front of the app can tell, to the context and the access log line.
 func (app *application) addIPToContext(next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		ctx := context.Background()
-		// Get the IP address from the request and add it to the context.
-		ip, err := getIP(r)
-		if err != nil {
-			ip, _, _ = net.SplitHostPort(r.RemoteAddr)
-			if len(ip) == 0 {
-				ip = "unknown"
-			}
-
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
-
-		} else {
-			ctx = context.WithValue(r.Context(), contextUserKey, ip)
-		}
+		ip := app.ClientIP.IP(r)
+		ctx := context.WithValue(r.Context(), contextUserKey, ip)
+		logging.SetIP(ctx, ip)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
-func getIP(r *http.Request) (string, error) {
-
-	//192.0.0.1:1234
-	ip, _, err := net.SplitHostPort(r.RemoteAddr)
-	if err != nil {
-		return "unknown", err
-	}
-
-	userIP := net.ParseIP(ip)
-	if userIP == nil {
-		return "unknown", fmt.Errorf("invalid IP address: %s", r.RemoteAddr)
-	}
-
-	forward := r.Header.Get("X-Forwarded-For")
-	if len(forward) > 0 {
+// logUser adds the signed in user, if any, to the access log line of the request.
+func (app *application) logUser(next http.Handler) http.Handler {
 
-		ip = forward
-	}
-
-	if len(ip) == 0 {
-
-		ip = "forwarded"
-
-	}
-
-	return ip, nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := app.Session.Get(r.Context(), "user").(data.User); ok {
+			logging.SetUserID(r.Context(), user.ID)
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 // auth is a middleware that checks if a user is authenticated (signed in).
@@ -77,3 +51,16 @@ func (app *application) auth(next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// admin lets only admins through. It must run after auth.
+func (app *application) admin(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, ok := app.Session.Get(r.Context(), "user").(data.User); !ok || user.IsAdmin != 1 {
+			app.Session.Put(r.Context(), "error", "You don't have access to that page")
+			http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
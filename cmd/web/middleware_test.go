@@ -1,8 +1,13 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"strings"
@@ -16,30 +21,32 @@ func Test_application_addIPToContext(t *testing.T) {
 		headerValue string
 		addr        string
 		emptyAddr   bool
+		trusted     []string
+		expected    string
 	}{
-		{"", "", "", false},
-		{"", "", "", true},
-		{"X-Forwarded-For", "192.10.2.2", "", false},
-		{"", "", "hello:world", false},
+		{"", "", "", false, nil, "192.0.2.1"},
+		{"", "", "", true, nil, "unknown"},
+		{"X-Forwarded-For", "192.10.2.2", "", false, nil, "192.0.2.1"},
+		{"X-Forwarded-For", "192.10.2.2", "", false, []string{"192.0.2.0/24"}, "192.10.2.2"},
+		{"", "", "hello:world", false, nil, "unknown"},
 	}
 
-	// create a dummy handler that will check the context
-	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		// make sure that the value exists in the context
-		val := r.Context().Value(contextUserKey)
-		if val == nil {
-			t.Error("context value is nil")
-		}
+	defer func(r *clientip.Resolver) { app.ClientIP = r }(app.ClientIP)
+
+	for _, tt := range tests {
+		var ip any
+
+		// create a dummy handler that will check the context
+		nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ip = r.Context().Value(contextUserKey)
+		})
 
-		// make sure that the value is a string
-		ip, ok := val.(string)
-		if !ok {
-			t.Errorf("context value is not a string")
+		var err error
+		app.ClientIP, err = clientip.New(tt.trusted, clientip.XForwardedFor)
+		if err != nil {
+			t.Fatal(err)
 		}
-		t.Log(ip)
-	})
 
-	for _, tt := range tests {
 		// create the handler to test
 		handlerToTest := app.addIPToContext(nextHandler)
 
@@ -60,6 +67,10 @@ func Test_application_addIPToContext(t *testing.T) {
 
 		// create a dummy response writer
 		handlerToTest.ServeHTTP(httptest.NewRecorder(), req)
+
+		if ip != tt.expected {
+			t.Errorf("%s %q from %q: expected %s but got %v", tt.headerName, tt.headerValue, req.RemoteAddr, tt.expected, ip)
+		}
 	}
 }
 
@@ -116,3 +127,79 @@ func Test_app_auth(t *testing.T) {
 
 	}
 }
+
+// Test_app_admin tests that only admins get through to the admin console
+func Test_app_admin(t *testing.T) {
+
+	nextHandler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	})
+
+	var theTests = []struct {
+		name         string
+		user         *data.User
+		expectedCode int
+	}{
+		{"admin", &data.User{ID: 1, IsAdmin: 1}, http.StatusOK},
+		{"not an admin", &data.User{ID: 2}, http.StatusSeeOther},
+		{"not logged in", nil, http.StatusSeeOther},
+	}
+
+	for _, tt := range theTests {
+		req := httptest.NewRequest("GET", "http://testing", nil)
+		req = addContextAndSessionToRequest(req, app)
+		if tt.user != nil {
+			app.Session.Put(req.Context(), "user", *tt.user)
+		}
+		rr := httptest.NewRecorder()
+		app.admin(nextHandler).ServeHTTP(rr, req)
+
+		if rr.Code != tt.expectedCode {
+			t.Errorf("%s: expected %d but got %d", tt.name, tt.expectedCode, rr.Code)
+		}
+	}
+}
+
+// Test_app_accessLog tests that access log lines carry the client address and
+// the signed in user.
+func Test_app_accessLog(t *testing.T) {
+
+	var theTests = []struct {
+		name           string
+		user           *data.User
+		expectedUserID any
+	}{
+		{"signed in", &data.User{ID: 3}, float64(3)},
+		{"anonymous", nil, nil},
+	}
+
+	// httptest requests come from 192.0.2.1, here a trusted proxy
+	defer func(r *clientip.Resolver) { app.ClientIP = r }(app.ClientIP)
+	app.ClientIP, _ = clientip.New([]string{"192.0.2.1"}, clientip.XForwardedFor)
+
+	for _, tt := range theTests {
+		var buf bytes.Buffer
+
+		var handlerToTest http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+		handlerToTest = app.logUser(handlerToTest)
+		handlerToTest = app.addIPToContext(handlerToTest)
+		handlerToTest = logging.AccessLog(logging.New(&buf, slog.LevelInfo))(handlerToTest)
+
+		req := httptest.NewRequest("GET", "http://testing/user/profile", nil)
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req = addContextAndSessionToRequest(req, app)
+		if tt.user != nil {
+			app.Session.Put(req.Context(), "user", *tt.user)
+		}
+
+		handlerToTest.ServeHTTP(httptest.NewRecorder(), req)
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("%s: expected one JSON log line, got %q", tt.name, buf.String())
+		}
+
+		if record["ip"] != "203.0.113.9" || record["user_id"] != tt.expectedUserID || record["path"] != "/user/profile" {
+			t.Errorf("%s: unexpected log line %v", tt.name, record)
+		}
+	}
+}
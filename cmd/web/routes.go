@@ -1,6 +1,9 @@
 package main
 
 import (
+	"github.com/calvarado2004/go-testing-webapp/pkg/config"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"net/http"
@@ -11,23 +14,77 @@ func (app *application) routes() http.Handler {
 	mux := chi.NewRouter()
 
 	// register middleware for unauthenticated routes
+	mux.Use(logging.RequestIDMiddleware)
+	mux.Use(logging.AccessLog(app.Logger))
+	mux.Use(app.Metrics.Middleware)
 	mux.Use(middleware.Recoverer)
 	mux.Use(app.addIPToContext)
 	mux.Use(app.Session.LoadAndSave)
+	mux.Use(app.logUser)
+	mux.Use(app.trackDevice)
+	mux.Use(app.csrf)
 	// register the unauthenticated routes
 	mux.Get("/", app.Home)
 	mux.Post("/login", app.Login)
 	mux.Get("/user/login", app.Login)
+	mux.Get("/forgot-password", app.ForgotPasswordPage)
+	mux.Post("/forgot-password", app.ForgotPassword)
+	mux.Get("/reset-password", app.ResetPasswordPage)
+	mux.Post("/reset-password", app.ResetPassword)
+	mux.Get("/register", app.RegisterPage)
+	mux.Post("/register", app.Register)
+	mux.Get("/verify-email", app.VerifyEmail)
+	mux.Get("/login/2fa", app.TwoFactorPage)
+	mux.Post("/login/2fa", app.TwoFactor)
+	mux.Post("/logout", app.Logout)
 
 	// register middleware for authenticated routes
 	mux.Route("/user", func(muxAuth chi.Router) {
 		muxAuth.Use(app.auth)
 		muxAuth.Get("/profile", app.Profile)
 		muxAuth.Post("/upload-profile-pic", app.UploadProfilePic)
+		muxAuth.Post("/images/{imageID}/activate", app.ActivateProfilePic)
+		muxAuth.Post("/images/{imageID}/delete", app.DeleteProfilePic)
+		muxAuth.Get("/account", app.AccountPage)
+		muxAuth.Post("/account", app.UpdateProfile)
+		muxAuth.Post("/password", app.ChangePassword)
+		muxAuth.Get("/2fa", app.TwoFactorSettings)
+		muxAuth.Post("/2fa/enable", app.EnableTwoFactor)
+		muxAuth.Post("/2fa/disable", app.DisableTwoFactor)
+		muxAuth.Get("/devices", app.DevicesPage)
+		muxAuth.Post("/devices/revoke", app.RevokeOtherDevices)
+		muxAuth.Post("/devices/{deviceID}/revoke", app.RevokeDevice)
 	})
 
+	// admin console
+	mux.Route("/admin", func(muxAdmin chi.Router) {
+		muxAdmin.Use(app.auth)
+		muxAdmin.Use(app.admin)
+		muxAdmin.Get("/", func(w http.ResponseWriter, r *http.Request) {
+			http.Redirect(w, r, "/admin/users", http.StatusSeeOther)
+		})
+		muxAdmin.Get("/users", app.AdminUsers)
+		muxAdmin.Get("/users/new", app.AdminNewUserPage)
+		muxAdmin.Post("/users/new", app.AdminCreateUser)
+		muxAdmin.Get("/users/{userID}", app.AdminEditUserPage)
+		muxAdmin.Post("/users/{userID}", app.AdminUpdateUser)
+		muxAdmin.Post("/users/{userID}/password", app.AdminResetPassword)
+		muxAdmin.Post("/users/{userID}/sessions/revoke", app.AdminRevokeSessions)
+		muxAdmin.Post("/users/{userID}/delete", app.AdminDeleteUser)
+	})
+
+	// uploaded images, when they are kept on local disk
+	if local, ok := app.Storage.(*storage.Local); ok {
+		mux.Handle("/media/*", http.StripPrefix("/media", local.Handler()))
+	}
+
+	// Prometheus metrics, and liveness and readiness probes
+	mux.Handle("/metrics", app.Metrics.Handler())
+	mux.Get("/healthz", app.Health.Live)
+	mux.Get("/readyz", app.Health.Ready)
+
 	// static files
-	fileServer := http.FileServer(http.Dir("./static/"))
+	fileServer := http.FileServer(http.Dir(config.StaticDir))
 
 	mux.Handle("/static/*", http.StripPrefix("/static", fileServer))
 
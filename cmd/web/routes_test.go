@@ -17,7 +17,41 @@ func Test_application_routes(t *testing.T) {
 		{"/", "GET"},
 		{"/login", "POST"},
 		{"/user/login", "GET"},
+		{"/forgot-password", "GET"},
+		{"/forgot-password", "POST"},
+		{"/reset-password", "GET"},
+		{"/reset-password", "POST"},
+		{"/register", "GET"},
+		{"/register", "POST"},
+		{"/verify-email", "GET"},
+		{"/login/2fa", "GET"},
+		{"/login/2fa", "POST"},
+		{"/logout", "POST"},
+		{"/user/images/{imageID}/activate", "POST"},
+		{"/user/images/{imageID}/delete", "POST"},
+		{"/user/account", "GET"},
+		{"/user/account", "POST"},
+		{"/user/password", "POST"},
+		{"/user/2fa", "GET"},
+		{"/user/2fa/enable", "POST"},
+		{"/user/2fa/disable", "POST"},
+		{"/user/devices", "GET"},
+		{"/user/devices/revoke", "POST"},
+		{"/user/devices/{deviceID}/revoke", "POST"},
+		{"/admin/", "GET"},
+		{"/admin/users", "GET"},
+		{"/admin/users/new", "GET"},
+		{"/admin/users/new", "POST"},
+		{"/admin/users/{userID}", "GET"},
+		{"/admin/users/{userID}", "POST"},
+		{"/admin/users/{userID}/password", "POST"},
+		{"/admin/users/{userID}/sessions/revoke", "POST"},
+		{"/admin/users/{userID}/delete", "POST"},
 		{"/static/*", "GET"},
+		{"/media/*", "GET"},
+		{"/metrics", "GET"},
+		{"/healthz", "GET"},
+		{"/readyz", "GET"},
 	}
 
 	mux := app.routes()
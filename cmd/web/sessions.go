@@ -1,13 +1,40 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
 	"github.com/alexedwards/scs/v2"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
 	"net/http"
+	"sort"
 	"time"
 )
 
+// deviceSessionKey is where a signed in session keeps its device.
+const deviceSessionKey = "device"
+
+// lastSeenEvery is how stale the LastSeen of a device may get before a request
+// updates it, so that not every request writes the session to the store.
+const lastSeenEvery = time.Minute
+
+// device describes the browser a session is signed in on, for the user's list
+// of devices. ID names the session without giving its token away.
+type device struct {
+	ID        string
+	IP        string
+	UserAgent string
+	LastSeen  time.Time
+}
+
 // getSession returns a new session manager
 func getSession() *scs.SessionManager {
+	// register the types kept in sessions with gob
+	gob.Register(data.User{})
+	gob.Register(device{})
+
 	session := scs.New()
 
 	session.Lifetime = 24 * time.Hour
@@ -17,3 +44,164 @@ func getSession() *scs.SessionManager {
 
 	return session
 }
+
+// renewSession gives the session in ctx a new id and a new CSRF token, so that
+// neither can be planted before a login and used after it.
+func (app *application) renewSession(ctx context.Context) error {
+	app.Session.Remove(ctx, csrfSessionKey)
+
+	return app.Session.RenewToken(ctx)
+}
+
+// trackDevice keeps the device of signed in sessions up to date. It must run
+// after the session is loaded and the IP address is added to the context.
+func (app *application) trackDevice(next http.Handler) http.Handler {
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if app.Session.Exists(ctx, "user") {
+			d, _ := app.Session.Get(ctx, deviceSessionKey).(device)
+			ip := app.ipFromContext(ctx)
+			now := time.Now()
+
+			if d.ID == "" || d.IP != ip || d.UserAgent != r.UserAgent() || now.Sub(d.LastSeen) >= lastSeenEvery {
+				if d.ID == "" {
+					d.ID = newDeviceID()
+				}
+				d.IP = ip
+				d.UserAgent = r.UserAgent()
+				d.LastSeen = now
+				app.Session.Put(ctx, deviceSessionKey, d)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// newDeviceID returns a random id for a device.
+func newDeviceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// currentDevice returns the id of the device of the session in ctx.
+func (app *application) currentDevice(ctx context.Context) string {
+	d, _ := app.Session.Get(ctx, deviceSessionKey).(device)
+
+	return d.ID
+}
+
+// sessionIndex is implemented by session stores that can find the sessions of
+// a user without reading every session, like sessions.PostgresStore.
+type sessionIndex interface {
+	UserSessionsCtx(ctx context.Context, userID int) (map[string][]byte, error)
+}
+
+// decodeSession returns the user and device of the session data b. Both are
+// zero if the session isn't signed in, and the device is zero for sessions that
+// haven't been seen since the devices were tracked.
+func (app *application) decodeSession(b []byte) (data.User, device, error) {
+	_, values, err := app.Session.Codec.Decode(b)
+	if err != nil {
+		return data.User{}, device{}, err
+	}
+
+	user, _ := values["user"].(data.User)
+	d, _ := values[deviceSessionKey].(device)
+
+	return user, d, nil
+}
+
+// sessionUserID returns the id of the user the session data b is signed in as,
+// or 0, for the session store to index sessions by.
+func (app *application) sessionUserID(b []byte) int {
+	user, _, _ := app.decodeSession(b)
+
+	return user.ID
+}
+
+// userSessions returns the devices of the sessions signed in as userID, by
+// session token.
+func (app *application) userSessions(ctx context.Context, userID int) (map[string]device, error) {
+	var all map[string][]byte
+	var err error
+
+	switch store := app.Session.Store.(type) {
+	case sessionIndex:
+		all, err = store.UserSessionsCtx(ctx, userID)
+	case scs.IterableStore:
+		// stores without an index, like the one in memory, are read in full
+		all, err = store.All()
+	default:
+		err = fmt.Errorf("session store %T can't list sessions", store)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make(map[string]device)
+	for token, b := range all {
+		user, d, err := app.decodeSession(b)
+		if err != nil {
+			return nil, err
+		}
+		if user.ID == userID {
+			sessions[token] = d
+		}
+	}
+
+	return sessions, nil
+}
+
+// userDevices returns the devices userID is signed in on, most recently seen
+// first.
+func (app *application) userDevices(ctx context.Context, userID int) ([]device, error) {
+	sessions, err := app.userSessions(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+
+	devices := make([]device, 0, len(sessions))
+	for _, d := range sessions {
+		devices = append(devices, d)
+	}
+
+	sort.Slice(devices, func(i, j int) bool { return devices[i].LastSeen.After(devices[j].LastSeen) })
+
+	return devices, nil
+}
+
+// revokeSessions destroys the sessions of userID whose device revoke returns
+// true for, and returns how many there were. The session in ctx, the one
+// asking, is never destroyed.
+func (app *application) revokeSessions(ctx context.Context, userID int, revoke func(device) bool) (int, error) {
+	current := app.Session.Token(ctx)
+
+	sessions, err := app.userSessions(ctx, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	revoked := 0
+	for token, d := range sessions {
+		if token == current || !revoke(d) {
+			continue
+		}
+
+		if store, ok := app.Session.Store.(scs.CtxStore); ok {
+			err = store.DeleteCtx(ctx, token)
+		} else {
+			err = app.Session.Store.Delete(token)
+		}
+		if err != nil {
+			return revoked, err
+		}
+		revoked++
+	}
+
+	return revoked, nil
+}
@@ -1,13 +1,27 @@
 package main
 
 import (
+	"bytes"
+	"github.com/calvarado2004/go-testing-webapp/pkg/accounts"
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
+	"github.com/calvarado2004/go-testing-webapp/pkg/lockout"
+	"github.com/calvarado2004/go-testing-webapp/pkg/logging"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mailer"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"github.com/calvarado2004/go-testing-webapp/pkg/server"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
+	"io"
+	"log/slog"
 	"os"
 	"testing"
 )
 
 var app application
 
+// testMail collects the mail the handlers send
+var testMail bytes.Buffer
+
 // TestMain is the entry point for all tests.
 func TestMain(m *testing.M) {
 
@@ -17,5 +31,23 @@ func TestMain(m *testing.M) {
 
 	app.DB = &dbrepo.TestDBRepo{}
 
+	app.Mailer = &mailer.LogMailer{Out: &testMail}
+
+	app.BaseURL = "http://localhost:8080"
+
+	app.Accounts = &accounts.Mailer{DB: app.DB, Mailer: app.Mailer, BaseURL: app.BaseURL}
+
+	app.Lockout = lockout.New(lockout.NewMemoryStore())
+
+	app.ClientIP = &clientip.Resolver{}
+
+	app.Storage = &storage.Local{Dir: "./testdata/uploads", BaseURL: "/media"}
+
+	app.Logger = logging.New(io.Discard, slog.LevelDebug)
+
+	app.Metrics = metrics.New("web", nil)
+
+	app.Health = &server.Health{}
+
 	os.Exit(m.Run())
 }
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/metrics"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mfa"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// pendingUserKey and pendingUntilKey hold, in the session, a login whose password
+// was right but which still waits for a two-factor code.
+const (
+	pendingUserKey  = "pending_2fa_user_id"
+	pendingUntilKey = "pending_2fa_until"
+)
+
+// pendingLoginTTL is how long a user has to enter their code after their password.
+const pendingLoginTTL = 5 * time.Minute
+
+// pendingUserID returns the id of the user whose login waits for a second
+// factor, or 0 if there is none or it has expired.
+func (app *application) pendingUserID(ctx context.Context) int {
+
+	if time.Now().After(app.Session.GetTime(ctx, pendingUntilKey)) {
+		return 0
+	}
+
+	return app.Session.GetInt(ctx, pendingUserKey)
+}
+
+// TwoFactorPage is the handler for the second step of logging in, which asks
+// for a two-factor code
+func (app *application) TwoFactorPage(w http.ResponseWriter, r *http.Request) {
+
+	if app.pendingUserID(r.Context()) == 0 {
+		app.Session.Put(r.Context(), "error", "Your login has expired, please log in again.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	err := app.render(w, r, "two-factor.page.gohtml", &TemplateData{})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// TwoFactor completes a pending login with a two-factor or recovery code
+func (app *application) TwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	userID := app.pendingUserID(r.Context())
+	if userID == 0 {
+		app.Session.Put(r.Context(), "error", "Your login has expired, please log in again.")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	user, err := app.DB.GetUser(r.Context(), userID)
+	if err != nil {
+		app.Session.Put(r.Context(), "error", "invalid login credentials")
+		http.Redirect(w, r, "/", http.StatusSeeOther)
+		return
+	}
+
+	// codes are guessed at like passwords, so they count towards the lockout
+	ip := app.ipFromContext(r.Context())
+
+	wait, err := app.Lockout.Check(r.Context(), user.Email, ip)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking login lockout", "error", err)
+	}
+	if wait > 0 {
+		app.Metrics.AuthAttempt(metrics.AuthLocked)
+		app.tooManyAttempts(w, r, wait)
+		return
+	}
+
+	form := NewForm(r.PostForm)
+	form.Required("code")
+
+	ok := false
+	if form.Valid() {
+		ok, err = mfa.CheckSecondFactor(r.Context(), app.DB, userID, form.Data.Get("code"))
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "checking second factor", "user_id", userID, "error", err)
+		}
+	}
+
+	if !ok {
+		app.Metrics.AuthAttempt(metrics.AuthFailure)
+
+		wait, err := app.Lockout.Fail(r.Context(), user.Email, ip)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "recording failed login", "error", err)
+		}
+		if wait > 0 {
+			app.tooManyAttempts(w, r, wait)
+			return
+		}
+
+		app.Session.Put(r.Context(), "error", "That code is not valid, please try again.")
+		http.Redirect(w, r, "/login/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+	app.Metrics.AuthAttempt(metrics.AuthSuccess)
+
+	// prevent fixation attack
+	_ = app.renewSession(r.Context())
+
+	app.Session.Remove(r.Context(), pendingUserKey)
+	app.Session.Remove(r.Context(), pendingUntilKey)
+	app.Session.Put(r.Context(), "user", user)
+
+	app.Session.Put(r.Context(), "flash", "You've been logged in successfully!")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
+
+// TwoFactorSettings is the handler for the two-factor authentication page of the
+// profile. A user who isn't enrolled is shown their secret as a QR code, the
+// same one until they enroll, which they confirm with a first code to turn
+// two-factor authentication on.
+func (app *application) TwoFactorSettings(w http.ResponseWriter, r *http.Request) {
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	t, err := app.DB.GetTOTP(r.Context(), user.ID)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "getting two-factor state", "user_id", user.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	td := map[string]any{"enabled": t.Enabled()}
+
+	if !t.Enabled() {
+		key, err := mfa.PendingKey(r.Context(), app.DB, user.ID, user.Email)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "getting two-factor secret", "user_id", user.ID, "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		qr, err := key.QRCode(200)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "rendering QR code", "error", err)
+			http.Error(w, "internal server error", http.StatusInternalServerError)
+			return
+		}
+
+		td["secret"] = key.Secret
+		td["uri"] = key.URI
+		td["qr"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(qr))
+	}
+
+	err = app.render(w, r, "two-factor-settings.page.gohtml", &TemplateData{Data: td})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// EnableTwoFactor turns on two-factor authentication once the user confirms
+// their new secret with a code, and shows them their recovery codes, once
+func (app *application) EnableTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+
+	t, err := app.DB.GetTOTP(r.Context(), user.ID)
+	if err != nil || t.Enabled() || !mfa.Validate(r.PostForm.Get("code"), t.Secret) {
+		app.Session.Put(r.Context(), "error", "That code is not valid, please try again.")
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	codes, err := mfa.NewRecoveryCodes(mfa.RecoveryCodeCount)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "generating recovery codes", "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	hashes := make([]string, len(codes))
+	for i, code := range codes {
+		hashes[i] = data.HashToken(mfa.NormalizeRecoveryCode(code))
+	}
+
+	if err := app.DB.EnableTOTP(r.Context(), user.ID, hashes); err != nil {
+		app.Logger.ErrorContext(r.Context(), "enabling two-factor authentication", "user_id", user.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user.TOTPEnabled = true
+	app.Session.Put(r.Context(), "user", user)
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is on. Keep these recovery codes somewhere safe: each one logs you in once if you lose your device. They won't be shown again.")
+
+	err = app.render(w, r, "two-factor-settings.page.gohtml", &TemplateData{
+		Data: map[string]any{"enabled": true, "recovery_codes": strings.Join(codes, "\n")},
+	})
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "rendering template", "error", err)
+	}
+}
+
+// DisableTwoFactor turns off two-factor authentication, given a current code.
+// Wrong codes count towards the login lockout.
+func (app *application) DisableTwoFactor(w http.ResponseWriter, r *http.Request) {
+
+	err := r.ParseForm()
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "parsing form", "error", err)
+		http.Error(w, "bad request", http.StatusBadRequest)
+		return
+	}
+
+	user := app.Session.Get(r.Context(), "user").(data.User)
+	ip := app.ipFromContext(r.Context())
+
+	// codes are guessed at like passwords, so they count towards the lockout
+	// here too, or a stolen session could try recovery codes at will
+	wait, err := app.Lockout.Check(r.Context(), user.Email, ip)
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking login lockout", "error", err)
+	}
+	if wait > 0 {
+		app.Session.Put(r.Context(), "error", lockedOutMessage(wait))
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	ok, err := mfa.CheckSecondFactor(r.Context(), app.DB, user.ID, r.PostForm.Get("code"))
+	if err != nil {
+		app.Logger.ErrorContext(r.Context(), "checking second factor", "user_id", user.ID, "error", err)
+	}
+	if !ok {
+		app.Metrics.AuthAttempt(metrics.AuthFailure)
+
+		msg := "That code is not valid, please try again."
+
+		wait, err := app.Lockout.Fail(r.Context(), user.Email, ip)
+		if err != nil {
+			app.Logger.ErrorContext(r.Context(), "recording failed login", "error", err)
+		}
+		if wait > 0 {
+			msg = lockedOutMessage(wait)
+		}
+
+		app.Session.Put(r.Context(), "error", msg)
+		http.Redirect(w, r, "/user/2fa", http.StatusSeeOther)
+		return
+	}
+
+	if err := app.Lockout.Succeed(r.Context(), user.Email); err != nil {
+		app.Logger.ErrorContext(r.Context(), "resetting login lockout", "error", err)
+	}
+
+	if err := app.DB.DisableTOTP(r.Context(), user.ID); err != nil {
+		app.Logger.ErrorContext(r.Context(), "disabling two-factor authentication", "user_id", user.ID, "error", err)
+		http.Error(w, "internal server error", http.StatusInternalServerError)
+		return
+	}
+
+	user.TOTPEnabled = false
+	app.Session.Put(r.Context(), "user", user)
+
+	app.Session.Put(r.Context(), "flash", "Two-factor authentication is off.")
+	http.Redirect(w, r, "/user/profile", http.StatusSeeOther)
+}
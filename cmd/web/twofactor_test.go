@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/lockout"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"github.com/pquerna/otp/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// recoveryCodesPattern matches the recovery codes shown on the settings page
+var recoveryCodesPattern = regexp.MustCompile(`<pre>([a-z2-7]{5}-[a-z2-7]{5}\n?)+</pre>`)
+
+// postFormWithSession posts values to handler, after seed has filled the session
+func postFormWithSession(handler http.HandlerFunc, values url.Values, seed func(req *http.Request)) (*httptest.ResponseRecorder, *http.Request) {
+	req, _ := http.NewRequest("POST", "/", strings.NewReader(values.Encode()))
+	req = addContextAndSessionToRequest(req, app)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	seed(req)
+
+	rw := httptest.NewRecorder()
+	handler.ServeHTTP(rw, req)
+
+	return rw, req
+}
+
+// Test_app_LoginTwoFactor tests that a correct password alone doesn't log in a
+// user who has two-factor authentication on
+func Test_app_LoginTwoFactor(t *testing.T) {
+
+	rw, req := postForm(app.Login, url.Values{"email": {"mfa@example.com"}, "password": {"secret"}})
+
+	if rw.Header().Get("Location") != "/login/2fa" {
+		t.Errorf("expected a redirect to /login/2fa; got %s", rw.Header().Get("Location"))
+	}
+
+	if app.Session.Exists(req.Context(), "user") {
+		t.Error("expected the user not to be logged in yet")
+	}
+
+	if app.pendingUserID(req.Context()) != 6 {
+		t.Errorf("expected a pending login of user 6; got %d", app.pendingUserID(req.Context()))
+	}
+}
+
+// Test_app_TwoFactor tests the second step of logging in
+func Test_app_TwoFactor(t *testing.T) {
+
+	code, err := totp.GenerateCode(dbrepo.TestTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var theTests = []struct {
+		name             string
+		code             string
+		pendingUntil     time.Time
+		expectedLocation string
+		expectLoggedIn   bool
+	}{
+		{"valid code", code, time.Now().Add(time.Minute), "/user/profile", true},
+		{"replayed code", code, time.Now().Add(time.Minute), "/login/2fa", false},
+		{"wrong code", "000000", time.Now().Add(time.Minute), "/login/2fa", false},
+		{"recovery code", strings.ToUpper(dbrepo.TestRecoveryCode), time.Now().Add(time.Minute), "/user/profile", true},
+		{"spent recovery code", dbrepo.TestRecoveryCode, time.Now().Add(time.Minute), "/login/2fa", false},
+		{"missing code", "", time.Now().Add(time.Minute), "/login/2fa", false},
+		{"expired login", code, time.Now().Add(-time.Minute), "/", false},
+	}
+
+	for _, tt := range theTests {
+		rw, req := postFormWithSession(app.TwoFactor, url.Values{"code": {tt.code}}, func(req *http.Request) {
+			app.Session.Put(req.Context(), pendingUserKey, 6)
+			app.Session.Put(req.Context(), pendingUntilKey, tt.pendingUntil)
+		})
+
+		if rw.Header().Get("Location") != tt.expectedLocation {
+			t.Errorf("%s: expected location %s; got %s", tt.name, tt.expectedLocation, rw.Header().Get("Location"))
+		}
+
+		if app.Session.Exists(req.Context(), "user") != tt.expectLoggedIn {
+			t.Errorf("%s: expected logged in to be %v", tt.name, tt.expectLoggedIn)
+		}
+
+		if tt.expectLoggedIn && app.Session.Exists(req.Context(), pendingUserKey) {
+			t.Errorf("%s: expected the pending login to be cleared", tt.name)
+		}
+	}
+}
+
+// Test_app_TwoFactorSettings tests turning two-factor authentication on and off
+func Test_app_TwoFactorSettings(t *testing.T) {
+
+	user := data.User{ID: 2, Email: "jack@example.com"}
+	asUser := func(req *http.Request) { app.Session.Put(req.Context(), "user", user) }
+
+	req, _ := http.NewRequest("GET", "/user/2fa", nil)
+	req = addContextAndSessionToRequest(req, app)
+	asUser(req)
+
+	rw := httptest.NewRecorder()
+	http.HandlerFunc(app.TwoFactorSettings).ServeHTTP(rw, req)
+
+	if rw.Code != http.StatusOK || !strings.Contains(rw.Body.String(), "data:image/png;base64,") {
+		t.Fatalf("expected the enrollment page with a QR code; got %d", rw.Code)
+	}
+
+	state, _ := app.DB.GetTOTP(req.Context(), user.ID)
+	if state.Secret == "" || state.Enabled() {
+		t.Fatalf("expected a pending secret; got %+v", state)
+	}
+
+	// reloading the page shows the same secret, which an app may hold already
+	page := rw.Body.String()
+	rw = httptest.NewRecorder()
+	http.HandlerFunc(app.TwoFactorSettings).ServeHTTP(rw, req)
+
+	if reloaded, _ := app.DB.GetTOTP(req.Context(), user.ID); reloaded.Secret != state.Secret || rw.Body.String() != page {
+		t.Fatalf("expected the pending secret to be kept on reload; got %+v", reloaded)
+	}
+
+	// a wrong code leaves it off
+	rw, _ = postFormWithSession(app.EnableTwoFactor, url.Values{"code": {"000000"}}, asUser)
+	if rw.Header().Get("Location") != "/user/2fa" {
+		t.Errorf("expected a redirect to /user/2fa; got %s", rw.Header().Get("Location"))
+	}
+
+	code, _ := totp.GenerateCode(state.Secret, time.Now())
+	rw, req = postFormWithSession(app.EnableTwoFactor, url.Values{"code": {code}}, asUser)
+
+	if rw.Code != http.StatusOK {
+		t.Errorf("expected %d; got %d", http.StatusOK, rw.Code)
+	}
+
+	if codes := recoveryCodesPattern.FindString(rw.Body.String()); strings.Count(codes, "-") != 10 {
+		t.Errorf("expected 10 recovery codes; got %q", codes)
+	}
+
+	if !app.Session.Get(req.Context(), "user").(data.User).TOTPEnabled {
+		t.Error("expected the session user to have two-factor authentication on")
+	}
+
+	rw, _ = postFormWithSession(app.DisableTwoFactor, url.Values{"code": {code}}, asUser)
+	if rw.Header().Get("Location") != "/user/profile" {
+		t.Errorf("expected a redirect to /user/profile; got %s", rw.Header().Get("Location"))
+	}
+
+	if state, _ := app.DB.GetTOTP(req.Context(), user.ID); state.Enabled() {
+		t.Error("expected two-factor authentication to be off")
+	}
+}
+
+// Test_app_DisableTwoFactorLockout tests that wrong codes to turn two-factor
+// authentication off count towards the lockout, like wrong codes to log in
+func Test_app_DisableTwoFactorLockout(t *testing.T) {
+
+	user := data.User{ID: 6, Email: "mfa@example.com", TOTPEnabled: true}
+	asUser := func(req *http.Request) { app.Session.Put(req.Context(), "user", user) }
+
+	// start from a clean slate, whatever earlier tests did from the same address
+	limiter := app.Lockout
+	app.Lockout = lockout.New(lockout.NewMemoryStore())
+	defer func() { app.Lockout = limiter }()
+
+	ctx := context.Background()
+
+	// the failures before the last two allowed
+	for i := 1; i < app.Lockout.Account.Threshold-1; i++ {
+		if _, err := app.Lockout.Fail(ctx, user.Email, "unknown"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	_, req := postFormWithSession(app.DisableTwoFactor, url.Values{"code": {"zzzzz-zzzzz"}}, asUser)
+	if e := app.Session.GetString(req.Context(), "error"); e != "That code is not valid, please try again." {
+		t.Errorf("expected a wrong code to be refused; got %q", e)
+	}
+
+	_, req = postFormWithSession(app.DisableTwoFactor, url.Values{"code": {"zzzzz-zzzzz"}}, asUser)
+	if e := app.Session.GetString(req.Context(), "error"); !strings.HasPrefix(e, "Too many failed login attempts") {
+		t.Errorf("expected the last wrong code to lock the account out; got %q", e)
+	}
+
+	// even a right code is turned away while locked out
+	code, _ := totp.GenerateCode(dbrepo.TestTOTPSecret, time.Now())
+	_, req = postFormWithSession(app.DisableTwoFactor, url.Values{"code": {code}}, asUser)
+	if e := app.Session.GetString(req.Context(), "error"); !strings.HasPrefix(e, "Too many failed login attempts") {
+		t.Errorf("expected a locked out account to be turned away; got %q", e)
+	}
+
+	if state, _ := app.DB.GetTOTP(ctx, user.ID); !state.Enabled() {
+		t.Error("expected two-factor authentication to stay on")
+	}
+}
@@ -0,0 +1,79 @@
+// Package accounts sends the emails that let users manage their accounts, with
+// links to the web app carrying single-use tokens. The web app and the API send
+// the same emails, so the links work whichever of them the user started from.
+package accounts
+
+import (
+	"context"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mailer"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository"
+	"net/url"
+	"time"
+)
+
+// PasswordResetTTL is how long a password reset link stays valid.
+const PasswordResetTTL = time.Hour
+
+// EmailVerificationTTL is how long an email verification link stays valid.
+const EmailVerificationTTL = 24 * time.Hour
+
+// Mailer issues account tokens and emails their links.
+type Mailer struct {
+	DB     repository.DatabaseRepo
+	Mailer mailer.Mailer
+	// BaseURL is where the web app serves the pages the links lead to.
+	BaseURL string
+}
+
+// issue stores a new token of scope for user, replacing any earlier one, and
+// returns the link to path that spends it.
+func (m *Mailer) issue(ctx context.Context, user *data.User, scope string, ttl time.Duration, path string) (string, error) {
+	if err := m.DB.DeleteUserTokens(ctx, user.ID, scope); err != nil {
+		return "", err
+	}
+
+	token, err := data.NewToken(user.ID, ttl, scope)
+	if err != nil {
+		return "", err
+	}
+
+	if err := m.DB.InsertToken(ctx, *token); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%s%s?token=%s", m.BaseURL, path, url.QueryEscape(token.Plaintext)), nil
+}
+
+// SendPasswordReset issues a new password reset token for user, replacing any
+// earlier one, and emails them a link to the reset form.
+func (m *Mailer) SendPasswordReset(ctx context.Context, user *data.User) error {
+	link, err := m.issue(ctx, user, data.ScopePasswordReset, PasswordResetTTL, "/reset-password")
+	if err != nil {
+		return err
+	}
+
+	return m.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Reset your password",
+		Body: fmt.Sprintf("Somebody asked to reset the password of your account. If it was you, follow this link within %s:\r\n\r\n%s\r\n\r\nIf it wasn't, you can ignore this message.",
+			PasswordResetTTL, link),
+	})
+}
+
+// SendEmailVerification issues a new email verification token for user,
+// replacing any earlier one, and emails them a link to confirm their address.
+func (m *Mailer) SendEmailVerification(ctx context.Context, user *data.User) error {
+	link, err := m.issue(ctx, user, data.ScopeEmailVerification, EmailVerificationTTL, "/verify-email")
+	if err != nil {
+		return err
+	}
+
+	return m.Mailer.Send(ctx, mailer.Message{
+		To:      user.Email,
+		Subject: "Confirm your email address",
+		Body: fmt.Sprintf("Welcome, %s! Follow this link within %s to confirm your email address:\r\n\r\n%s\r\n\r\nIf you didn't sign up, you can ignore this message.",
+			user.FirstName, EmailVerificationTTL, link),
+	})
+}
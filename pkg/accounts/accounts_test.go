@@ -0,0 +1,63 @@
+package accounts
+
+import (
+	"bytes"
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/mailer"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"regexp"
+	"testing"
+)
+
+// newMailer returns a Mailer on the test database, and the buffer its mail is
+// written to
+func newMailer() (*Mailer, *bytes.Buffer) {
+	var out bytes.Buffer
+
+	return &Mailer{DB: &dbrepo.TestDBRepo{}, Mailer: &mailer.LogMailer{Out: &out}, BaseURL: "http://localhost:8080"}, &out
+}
+
+func TestMailer_SendPasswordReset(t *testing.T) {
+	ctx := context.Background()
+	m, out := newMailer()
+	user := &data.User{ID: 1, Email: "admin@example.com"}
+
+	if err := m.SendPasswordReset(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	first := regexp.MustCompile(`http://localhost:8080/reset-password\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(out.String())
+	if first == nil {
+		t.Fatalf("expected a reset link in %s", out.String())
+	}
+
+	if err := m.SendPasswordReset(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// a new link replaces the earlier one
+	if _, err := m.DB.UseToken(ctx, data.ScopePasswordReset, first[1]); err == nil {
+		t.Error("expected the first link to stop working")
+	}
+}
+
+func TestMailer_SendEmailVerification(t *testing.T) {
+	ctx := context.Background()
+	m, out := newMailer()
+	user := &data.User{ID: 1, FirstName: "Admin", Email: "admin@example.com"}
+
+	if err := m.SendEmailVerification(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	link := regexp.MustCompile(`http://localhost:8080/verify-email\?token=([A-Za-z0-9_-]+)`).FindStringSubmatch(out.String())
+	if link == nil {
+		t.Fatalf("expected a verification link in %s", out.String())
+	}
+
+	token, err := m.DB.UseToken(ctx, data.ScopeEmailVerification, link[1])
+	if err != nil || token.UserID != user.ID {
+		t.Errorf("expected the link to verify user %d, got %+v, %v", user.ID, token, err)
+	}
+}
@@ -0,0 +1,192 @@
+// Package clientip works out the address of the client that sent a request,
+// looking through the proxies in front of the server that are trusted to
+// report it.
+//
+// The headers proxies add to are read right to left, since each proxy appends
+// the address it got the request from: addresses are skipped for as long as
+// they belong to trusted proxies, and the first one that doesn't is the
+// client's. Anything further left was written by the client, or by proxies
+// that aren't trusted, and could be forged.
+//
+// Only the one header the trusted proxies write is read. A proxy that appends
+// to X-Forwarded-For passes a Forwarded header from the client through
+// untouched, so reading whichever header is present would let clients pick
+// their own address.
+package clientip
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// Unknown is the address of requests whose RemoteAddr can't be parsed.
+const Unknown = "unknown"
+
+// The headers trusted proxies may report client addresses in.
+const (
+	XForwardedFor = "x-forwarded-for"
+	Forwarded     = "forwarded"
+	XRealIP       = "x-real-ip"
+)
+
+// ValidHeader reports whether header is one of XForwardedFor, Forwarded and
+// XRealIP.
+func ValidHeader(header string) bool {
+	return header == XForwardedFor || header == Forwarded || header == XRealIP
+}
+
+// Resolver finds the client address of requests. Without trusted proxies it
+// is the address the request came from, and headers are ignored.
+type Resolver struct {
+	Trusted []netip.Prefix
+	// Header is the one header the trusted proxies write, XForwardedFor if
+	// empty.
+	Header string
+}
+
+// New returns a Resolver that reads header from the proxies in trusted, each a
+// CIDR range like 10.0.0.0/8 or a single address.
+func New(trusted []string, header string) (*Resolver, error) {
+	if header != "" && !ValidHeader(header) {
+		return nil, fmt.Errorf("%q is not a client IP header: use %s, %s or %s", header, XForwardedFor, Forwarded, XRealIP)
+	}
+
+	res := &Resolver{Header: header}
+	for _, s := range trusted {
+		p, err := ParsePrefix(s)
+		if err != nil {
+			return nil, err
+		}
+		res.Trusted = append(res.Trusted, p)
+	}
+
+	return res, nil
+}
+
+// ParsePrefix parses a CIDR range, or a single address as a range of one.
+func ParsePrefix(s string) (netip.Prefix, error) {
+	s = strings.TrimSpace(s)
+	if strings.Contains(s, "/") {
+		p, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, fmt.Errorf("%q is not a CIDR range like 10.0.0.0/8", s)
+		}
+		return p.Masked(), nil
+	}
+
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("%q is not an IP address or a CIDR range", s)
+	}
+	addr = addr.Unmap()
+
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// trusts reports whether addr belongs to a trusted proxy.
+func (res *Resolver) trusts(addr netip.Addr) bool {
+	for _, p := range res.Trusted {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IP returns the address of the client of r. If the request came from a
+// trusted proxy, the address is read from the header of the Resolver, and any
+// other forwarding header is ignored.
+func (res *Resolver) IP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+
+	peer, err := netip.ParseAddr(host)
+	if err != nil {
+		return Unknown
+	}
+	peer = peer.Unmap()
+
+	if !res.trusts(peer) {
+		return peer.String()
+	}
+
+	var hops []string
+	switch res.Header {
+	case Forwarded:
+		hops = forwardedFor(r.Header.Values("Forwarded"))
+	case XRealIP:
+		if ip := r.Header.Get("X-Real-IP"); ip != "" {
+			hops = []string{ip}
+		}
+	default:
+		hops = splitList(r.Header.Values("X-Forwarded-For"))
+	}
+
+	client := peer
+	for i := len(hops) - 1; i >= 0; i-- {
+		addr, ok := parseHop(hops[i])
+		if !ok {
+			// an obfuscated or garbled hop hides who is to its left
+			break
+		}
+
+		client = addr
+		if !res.trusts(addr) {
+			break
+		}
+	}
+
+	return client.String()
+}
+
+// splitList returns the comma-separated items of the header values.
+func splitList(values []string) []string {
+	var items []string
+	for _, v := range values {
+		for _, item := range strings.Split(v, ",") {
+			items = append(items, strings.TrimSpace(item))
+		}
+	}
+
+	return items
+}
+
+// forwardedFor returns the for= node of every element of Forwarded header
+// values, like `for=192.0.2.60;proto=https, for="[2001:db8::1]:4711"`. An
+// element without one gets an empty node, which stops the walk there.
+func forwardedFor(values []string) []string {
+	var nodes []string
+	for _, element := range splitList(values) {
+		node := ""
+		for _, pair := range strings.Split(element, ";") {
+			name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+			if ok && strings.EqualFold(name, "for") {
+				node = strings.Trim(value, `"`)
+			}
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// parseHop parses an address from a forwarding header, which may come with a
+// port, and, for IPv6, in brackets.
+func parseHop(s string) (netip.Addr, bool) {
+	if addrPort, err := netip.ParseAddrPort(s); err == nil {
+		return addrPort.Addr().Unmap(), true
+	}
+
+	addr, err := netip.ParseAddr(strings.TrimSuffix(strings.TrimPrefix(s, "["), "]"))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+
+	return addr.Unmap(), true
+}
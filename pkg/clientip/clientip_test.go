@@ -0,0 +1,113 @@
+package clientip
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParsePrefix(t *testing.T) {
+	var tests = []struct {
+		s           string
+		expected    string
+		expectError bool
+	}{
+		{"10.0.0.0/8", "10.0.0.0/8", false},
+		{"10.1.2.3/8", "10.0.0.0/8", false},
+		{" 192.0.2.1 ", "192.0.2.1/32", false},
+		{"2001:db8::/32", "2001:db8::/32", false},
+		{"::1", "::1/128", false},
+		{"::ffff:192.0.2.1", "192.0.2.1/32", false},
+		{"10.0.0.0/33", "", true},
+		{"proxy.example.com", "", true},
+		{"", "", true},
+	}
+
+	for _, e := range tests {
+		p, err := ParsePrefix(e.s)
+		if (err != nil) != e.expectError {
+			t.Errorf("%q: expected error %v, got %v", e.s, e.expectError, err)
+		}
+
+		if err == nil && p.String() != e.expected {
+			t.Errorf("%q: expected %s, got %s", e.s, e.expected, p)
+		}
+	}
+
+	if _, err := New([]string{"10.0.0.0/8", "nonsense"}, XForwardedFor); err == nil {
+		t.Error("expected New to reject a bad range")
+	}
+
+	if _, err := New([]string{"10.0.0.0/8"}, "x-client-ip"); err == nil {
+		t.Error("expected New to reject an unknown header")
+	}
+}
+
+func TestResolver_IP(t *testing.T) {
+	trusted := []string{"10.0.0.0/8", "2001:db8::/32"}
+	xff := "X-Forwarded-For"
+
+	var tests = []struct {
+		name       string
+		header     string
+		remoteAddr string
+		headers    map[string][]string
+		expected   string
+	}{
+		{"direct", XForwardedFor, "192.0.2.1:1234", nil, "192.0.2.1"},
+		{"untrusted peer sending headers", XForwardedFor, "192.0.2.1:1234", map[string][]string{xff: {"198.51.100.7"}}, "192.0.2.1"},
+		{"trusted peer without headers", XForwardedFor, "10.0.0.1:1234", nil, "10.0.0.1"},
+		{"bad remote address", XForwardedFor, "hello:world", nil, Unknown},
+		{"empty remote address", XForwardedFor, "", nil, Unknown},
+		{"remote address without port", XForwardedFor, "192.0.2.1", nil, "192.0.2.1"},
+		{"mapped remote address", XForwardedFor, "[::ffff:192.0.2.1]:1234", nil, "192.0.2.1"},
+
+		{"x-forwarded-for", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"198.51.100.7"}}, "198.51.100.7"},
+		{"x-forwarded-for by default", "", "10.0.0.1:1234", map[string][]string{xff: {"198.51.100.7"}}, "198.51.100.7"},
+		{"x-forwarded-for through proxies", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"198.51.100.7, 10.0.0.3, 10.0.0.2"}}, "198.51.100.7"},
+		{"x-forwarded-for spoofed on the left", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"203.0.113.9, 198.51.100.7"}}, "198.51.100.7"},
+		{"x-forwarded-for over several lines", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"203.0.113.9, 198.51.100.7", "10.0.0.2"}}, "198.51.100.7"},
+		{"x-forwarded-for with a port", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"198.51.100.7:5555"}}, "198.51.100.7"},
+		{"x-forwarded-for garbled", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"198.51.100.7, garbage, 10.0.0.2"}}, "10.0.0.2"},
+		{"x-forwarded-for all trusted", XForwardedFor, "10.0.0.1:1234", map[string][]string{xff: {"10.0.0.3, 10.0.0.2"}}, "10.0.0.3"},
+		{"x-forwarded-for ipv6", XForwardedFor, "[2001:db8::1]:1234", map[string][]string{xff: {"2001:db8:ffff::1, 2001:db9::7"}}, "2001:db9::7"},
+		{"forwarded from the client next to x-forwarded-for", XForwardedFor, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=1.2.3.4"}, xff: {"198.51.100.7"}}, "198.51.100.7"},
+		{"x-real-ip from the client", XForwardedFor, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"1.2.3.4"}}, "10.0.0.1"},
+
+		{"x-real-ip", XRealIP, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"198.51.100.7"}}, "198.51.100.7"},
+		{"x-real-ip garbled", XRealIP, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"somewhere"}}, "10.0.0.1"},
+		{"x-forwarded-for from the client next to x-real-ip", XRealIP, "10.0.0.1:1234", map[string][]string{"X-Real-Ip": {"198.51.100.7"}, xff: {"1.2.3.4"}}, "198.51.100.7"},
+
+		{"forwarded", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.7;proto=https"}}, "198.51.100.7"},
+		{"forwarded through proxies", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {`for=203.0.113.9, For="198.51.100.7:4711";by=10.0.0.2, for=10.0.0.2`}}, "198.51.100.7"},
+		{"forwarded ipv6", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {`for="[2001:db9::7]:4711"`}}, "2001:db9::7"},
+		{"forwarded obfuscated", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=_hidden, for=10.0.0.2"}}, "10.0.0.2"},
+		{"forwarded without for", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"proto=https"}}, "10.0.0.1"},
+		{"x-forwarded-for from the client next to forwarded", Forwarded, "10.0.0.1:1234", map[string][]string{"Forwarded": {"for=198.51.100.7"}, xff: {"1.2.3.4"}}, "198.51.100.7"},
+	}
+
+	for _, e := range tests {
+		res, err := New(trusted, e.header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = e.remoteAddr
+		for name, values := range e.headers {
+			req.Header[name] = values
+		}
+
+		if ip := res.IP(req); ip != e.expected {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, ip)
+		}
+	}
+
+	// without trusted proxies, headers are never read
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "10.0.0.1:1234"
+	req.Header.Set("X-Forwarded-For", "198.51.100.7")
+
+	if ip := (&Resolver{}).IP(req); ip != "10.0.0.1" {
+		t.Errorf("expected the remote address without trusted proxies, got %s", ip)
+	}
+}
@@ -0,0 +1,449 @@
+// Package config loads the settings of the web app and the API from built-in
+// defaults, a YAML file, environment variables and command-line flags, and
+// validates them.
+//
+// Every setting is named after its flag. In the file the name is the key, e.g.
+// "read-timeout: 1m"; in the environment it is upper-cased with underscores,
+// e.g. READ_TIMEOUT=1m. Flags win over the environment, which wins over the
+// file. Secrets that shouldn't show up in process listings, such as the S3
+// keys, can only be set in the file or the environment.
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/calvarado2004/go-testing-webapp/pkg/clientip"
+	"github.com/calvarado2004/go-testing-webapp/pkg/cors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/ratelimit"
+	"github.com/calvarado2004/go-testing-webapp/pkg/server"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
+	"gopkg.in/yaml.v3"
+)
+
+// The binaries a configuration is for. Some settings only apply to one of them.
+const (
+	Web = "web"
+	API = "api"
+)
+
+// The environments a server runs in. Production refuses insecure settings.
+const (
+	Development = "development"
+	Production  = "production"
+)
+
+// StaticDir is the directory the web app serves as is under /static/.
+const StaticDir = "./static/"
+
+// defaultDSN points at the Postgres of docker-compose.yml.
+const defaultDSN = "host=localhost port=5432 user=postgres password=postgres dbname=users sslmode=disable timezone=UTC connect_timeout=5"
+
+// Config holds the settings of one binary.
+type Config struct {
+	App          string
+	Environment  string
+	Port         int
+	DSN          string
+	BaseURL      string
+	LogLevel     slog.Level
+	Migrate      bool
+	MailDir      string
+	LockoutStore string
+	// TrustedProxies are the CIDR ranges of the proxies trusted to report
+	// client addresses in ClientIPHeader.
+	TrustedProxies []string
+	ClientIPHeader string
+	Server         server.Config
+	Storage        Storage
+	Cookie         Cookie
+
+	// API only
+	Domain    string
+	JWT       JWT
+	CORS      CORS
+	RateLimit RateLimit
+
+	// web app only
+	MaxUploadBytes int64
+	Sessions       Sessions
+}
+
+// Storage says where uploaded images are kept.
+type Storage struct {
+	Backend     string
+	Dir         string
+	Secret      string
+	S3Endpoint  string
+	S3Region    string
+	S3Bucket    string
+	S3PathStyle bool
+	S3AccessKey string
+	S3SecretKey string
+}
+
+// Cookie holds the attributes of the cookies the servers set.
+type Cookie struct {
+	Domain string
+	Secure bool
+}
+
+// JWT holds the signing keys and lifetimes of the API's tokens.
+type JWT struct {
+	KeysDir         string
+	KID             string
+	AccessTokenTTL  time.Duration
+	RefreshTokenTTL time.Duration
+}
+
+// CORS says which browser origins may call the API. An origin's host may
+// start with "*." to allow every subdomain.
+type CORS struct {
+	Origins []string
+	MaxAge  time.Duration
+}
+
+// RateLimit says how many requests a client, by address or by user, may make
+// to each group of API routes.
+type RateLimit struct {
+	Store   string
+	Auth    ratelimit.Limit
+	Refresh ratelimit.Limit
+	Users   ratelimit.Limit
+}
+
+// Limits returns the limits by route group.
+func (r RateLimit) Limits() map[string]ratelimit.Limit {
+	return map[string]ratelimit.Limit{"auth": r.Auth, "refresh": r.Refresh, "users": r.Users}
+}
+
+// Sessions says where the web app keeps its sessions, and how often expired
+// ones are deleted from Postgres.
+type Sessions struct {
+	Store   string
+	Cleanup time.Duration
+}
+
+// Load reads the configuration of app, Web or API, from the command-line
+// arguments args, the environment, and the YAML file named by -config or
+// CONFIG_FILE. It returns flag.ErrHelp if args asked for usage.
+func Load(app string, args []string) (*Config, error) {
+	return load(app, args, os.LookupEnv)
+}
+
+func load(app string, args []string, lookupEnv func(string) (string, bool)) (*Config, error) {
+	if app != Web && app != API {
+		return nil, fmt.Errorf("unknown app %q", app)
+	}
+
+	cfg := &Config{App: app}
+	fs := flag.NewFlagSet(app, flag.ContinueOnError)
+	configFile := fs.String("config", "", "YAML file to read settings from; also CONFIG_FILE")
+	secrets := cfg.register(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	// remember the flags given, so that they can win over the file and the
+	// environment applied next
+	given := make(map[string]string)
+	fs.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+
+	path := *configFile
+	if path == "" {
+		path, _ = lookupEnv("CONFIG_FILE")
+	}
+	if path != "" {
+		if err := applyFile(fs, secrets, path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(fs, secrets, lookupEnv); err != nil {
+		return nil, err
+	}
+
+	for name, value := range given {
+		if err := fs.Set(name, value); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// register defines a flag for every setting of the app in fs, and returns the
+// secrets, which have no flag.
+func (c *Config) register(fs *flag.FlagSet) map[string]*string {
+	port := 8080
+	if c.App == API {
+		port = 8090
+	}
+
+	fs.StringVar(&c.Environment, "environment", Development, "development, or production to refuse insecure settings")
+	fs.IntVar(&c.Port, "port", port, "port to listen on")
+	fs.StringVar(&c.DSN, "dsn", defaultDSN, "Postgres connection string")
+	fs.StringVar(&c.BaseURL, "base-url", "http://localhost:8080", "public URL of the web app, used in links sent by email")
+	fs.TextVar(&c.LogLevel, "log-level", slog.LevelInfo, "least severe level to log: debug, info, warn or error")
+	fs.BoolVar(&c.Migrate, "migrate", false, "apply pending database migrations before starting")
+	fs.StringVar(&c.MailDir, "mail-dir", "", "directory to save outgoing mail to; mail is logged if empty")
+	fs.StringVar(&c.LockoutStore, "lockout-store", "postgres", "where to count failed logins: postgres, or memory for a single instance")
+	fs.Var((*listValue)(&c.TrustedProxies), "trusted-proxies", "comma-separated CIDR ranges of the proxies in front of the server, whose client-ip-header is believed")
+	fs.StringVar(&c.ClientIPHeader, "client-ip-header", clientip.XForwardedFor, "the one header the trusted proxies write the client address to: x-forwarded-for, forwarded or x-real-ip")
+	c.Server.RegisterFlags(fs)
+
+	fs.StringVar(&c.Storage.Backend, "storage", "local", "where uploaded images are kept: local or s3")
+	fs.StringVar(&c.Storage.Dir, "storage-dir", "./uploads/", "directory of the local image store, outside the static directory so that image URLs stay signed")
+	fs.StringVar(&c.Storage.Secret, "storage-secret", "", "key that signs local image URLs, the same for both servers; URLs are not signed if empty")
+	fs.StringVar(&c.Storage.S3Endpoint, "s3-endpoint", "https://s3.amazonaws.com", "URL of the S3-compatible image store")
+	fs.StringVar(&c.Storage.S3Region, "s3-region", "us-east-1", "region of the S3 bucket")
+	fs.StringVar(&c.Storage.S3Bucket, "s3-bucket", "", "S3 bucket images are kept in")
+	fs.BoolVar(&c.Storage.S3PathStyle, "s3-path-style", false, "put the bucket in the path of S3 URLs, as MinIO expects")
+
+	fs.StringVar(&c.Cookie.Domain, "cookie-domain", "localhost", "domain of the cookies set")
+	fs.BoolVar(&c.Cookie.Secure, "cookie-secure", true, "only send cookies over HTTPS")
+
+	switch c.App {
+	case API:
+		fs.StringVar(&c.Domain, "domain", "example.com", "domain of the application, the issuer and audience of its tokens")
+		fs.StringVar(&c.JWT.KeysDir, "jwt-keys", "", "directory of PEM signing keys; the built-in demo key is used if empty")
+		fs.StringVar(&c.JWT.KID, "jwt-kid", "", "id of the key that signs new tokens; defaults to the newest key")
+		fs.DurationVar(&c.JWT.AccessTokenTTL, "access-token-ttl", 15*time.Minute, "lifetime of access tokens")
+		fs.DurationVar(&c.JWT.RefreshTokenTTL, "refresh-token-ttl", 24*time.Hour, "lifetime of refresh tokens")
+		c.CORS.Origins = []string{"http://localhost:8090"}
+		fs.Var((*listValue)(&c.CORS.Origins), "cors-origins", "comma-separated origins allowed to call the API from a browser, e.g. https://*.example.com")
+		fs.DurationVar(&c.CORS.MaxAge, "cors-max-age", 10*time.Minute, "how long browsers may cache the answer to a CORS preflight request")
+		fs.StringVar(&c.RateLimit.Store, "rate-limit-store", "postgres", "where to count requests: postgres, or memory for a single instance")
+		fs.TextVar(&c.RateLimit.Auth, "rate-limit-auth", ratelimit.Limit{Requests: 10, Period: time.Minute}, "requests per client to log in, sign up and reset passwords, like 10/1m, or off")
+		fs.TextVar(&c.RateLimit.Refresh, "rate-limit-refresh", ratelimit.Limit{Requests: 30, Period: time.Minute}, "requests per client to refresh tokens, like 30/1m, or off")
+		fs.TextVar(&c.RateLimit.Users, "rate-limit-users", ratelimit.Limit{Requests: 300, Period: time.Minute}, "requests per client to the user routes, like 300/1m, or off")
+	case Web:
+		fs.Int64Var(&c.MaxUploadBytes, "max-upload-bytes", 10<<20, "largest image that may be uploaded, in bytes")
+		fs.StringVar(&c.Sessions.Store, "session-store", "postgres", "where to keep sessions: postgres, or memory for a single instance that logs everyone out on restart")
+		fs.DurationVar(&c.Sessions.Cleanup, "session-cleanup", 5*time.Minute, "how often to delete expired sessions from postgres")
+	}
+
+	return map[string]*string{
+		"s3-access-key": &c.Storage.S3AccessKey,
+		"s3-secret-key": &c.Storage.S3SecretKey,
+	}
+}
+
+// applyFile sets the settings in the YAML file at path.
+func applyFile(fs *flag.FlagSet, secrets map[string]*string, path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading config: %w", err)
+	}
+
+	var settings map[string]any
+	if err := yaml.Unmarshal(b, &settings); err != nil {
+		return fmt.Errorf("parsing %s: %w", path, err)
+	}
+
+	for name, v := range settings {
+		var value string
+		switch v := v.(type) {
+		case []any:
+			items := make([]string, len(v))
+			for i, item := range v {
+				items[i] = fmt.Sprint(item)
+			}
+			value = strings.Join(items, ",")
+		case map[string]any:
+			return fmt.Errorf("%s: %s: expected a value, got a mapping", path, name)
+		default:
+			value = fmt.Sprint(v)
+		}
+
+		if err := set(fs, secrets, name, value); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+
+	return nil
+}
+
+// applyEnv sets the settings found in the environment.
+func applyEnv(fs *flag.FlagSet, secrets map[string]*string, lookupEnv func(string) (string, bool)) error {
+	var errs []error
+
+	apply := func(name string) {
+		if value, ok := lookupEnv(envName(name)); ok {
+			if err := set(fs, secrets, name, value); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %w", envName(name), err))
+			}
+		}
+	}
+
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" {
+			apply(f.Name)
+		}
+	})
+	for name := range secrets {
+		apply(name)
+	}
+
+	return errors.Join(errs...)
+}
+
+// set sets the setting name, a flag or a secret, to value.
+func set(fs *flag.FlagSet, secrets map[string]*string, name, value string) error {
+	if p, ok := secrets[name]; ok {
+		*p = value
+		return nil
+	}
+
+	if name == "config" || fs.Lookup(name) == nil {
+		return fmt.Errorf("unknown setting %q", name)
+	}
+
+	if err := fs.Set(name, value); err != nil {
+		return fmt.Errorf("%s: %w", name, err)
+	}
+
+	return nil
+}
+
+// envName returns the environment variable of the setting name, e.g.
+// READ_TIMEOUT for read-timeout.
+func envName(name string) string {
+	return strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// Validate reports every setting that is out of range, inconsistent, or
+// insecure in production.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	check(c.Environment == Development || c.Environment == Production, "environment must be %s or %s, got %q", Development, Production, c.Environment)
+	check(c.Port > 0 && c.Port < 65536, "port must be between 1 and 65535, got %d", c.Port)
+	check(c.DSN != "", "dsn is required")
+	check(validURL(c.BaseURL), "base-url must be an http or https URL, got %q", c.BaseURL)
+	check(c.LockoutStore == "postgres" || c.LockoutStore == "memory", "lockout-store must be postgres or memory, got %q", c.LockoutStore)
+	for _, proxy := range c.TrustedProxies {
+		_, err := clientip.ParsePrefix(proxy)
+		check(err == nil, "trusted-proxies: %v", err)
+	}
+	check(clientip.ValidHeader(c.ClientIPHeader), "client-ip-header must be %s, %s or %s, got %q", clientip.XForwardedFor, clientip.Forwarded, clientip.XRealIP, c.ClientIPHeader)
+	check(c.Server.ReadTimeout > 0 && c.Server.WriteTimeout > 0 && c.Server.IdleTimeout > 0 && c.Server.ShutdownTimeout > 0, "server timeouts must be positive")
+
+	switch c.Storage.Backend {
+	case "local":
+		check(!insideDir(c.Storage.Dir, StaticDir), "storage-dir must not be inside %s, which is served without signed URLs, got %q", StaticDir, c.Storage.Dir)
+	case "s3":
+		check(c.Storage.S3Bucket != "", "s3-bucket is required with storage s3")
+	default:
+		errs = append(errs, fmt.Errorf("storage must be local or s3, got %q", c.Storage.Backend))
+	}
+
+	switch c.App {
+	case API:
+		check(c.Domain != "", "domain is required")
+		check(c.JWT.AccessTokenTTL > 0, "access-token-ttl must be positive")
+		check(c.JWT.RefreshTokenTTL > c.JWT.AccessTokenTTL, "refresh-token-ttl must be longer than access-token-ttl")
+		for _, origin := range c.CORS.Origins {
+			check(cors.ValidOrigin(origin), "cors-origins: %q is not an origin like https://example.com or https://*.example.com", origin)
+		}
+		check(c.CORS.MaxAge >= 0, "cors-max-age must not be negative")
+		check(c.RateLimit.Store == "postgres" || c.RateLimit.Store == "memory", "rate-limit-store must be postgres or memory, got %q", c.RateLimit.Store)
+	case Web:
+		check(c.MaxUploadBytes > 0, "max-upload-bytes must be positive")
+		check(c.Sessions.Store == "postgres" || c.Sessions.Store == "memory", "session-store must be postgres or memory, got %q", c.Sessions.Store)
+		check(c.Sessions.Cleanup > 0, "session-cleanup must be positive")
+	}
+
+	if c.Environment == Production {
+		check(c.App != API || c.JWT.KeysDir != "", "jwt-keys is required in production, the built-in demo key is public")
+		check(c.Cookie.Secure, "cookie-secure must be on in production")
+	}
+
+	return errors.Join(errs...)
+}
+
+// insideDir reports whether dir is root or a directory below it.
+func insideDir(dir, root string) bool {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return false
+	}
+
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// validURL reports whether s is an http or https URL.
+func validURL(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+// Addr returns the address to listen on.
+func (c *Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// NewStorage returns the image store of the configuration. Local images are
+// served under localBaseURL.
+func (c *Config) NewStorage(localBaseURL string) storage.Storage {
+	if c.Storage.Backend == "s3" {
+		return &storage.S3{
+			Endpoint:  c.Storage.S3Endpoint,
+			Region:    c.Storage.S3Region,
+			Bucket:    c.Storage.S3Bucket,
+			AccessKey: c.Storage.S3AccessKey,
+			SecretKey: c.Storage.S3SecretKey,
+			PathStyle: c.Storage.S3PathStyle,
+		}
+	}
+
+	return &storage.Local{
+		Dir:     c.Storage.Dir,
+		BaseURL: localBaseURL,
+		Secret:  []byte(c.Storage.Secret),
+	}
+}
+
+// listValue is a flag holding a comma-separated list. Setting it replaces the
+// list rather than appending to it, so that a flag can override the file.
+type listValue []string
+
+func (l *listValue) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listValue) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+
+	return nil
+}
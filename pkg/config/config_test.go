@@ -0,0 +1,184 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calvarado2004/go-testing-webapp/pkg/ratelimit"
+)
+
+// env returns a lookup function over vars, in place of os.LookupEnv.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+// writeFile writes a config file to a temporary directory, and returns its path.
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestLoadDefaults(t *testing.T) {
+	web, err := load(Web, nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if web.Port != 8080 || web.MaxUploadBytes != 10<<20 || web.Environment != Development || !web.Cookie.Secure || web.Sessions.Store != "postgres" {
+		t.Errorf("unexpected web defaults %+v", web)
+	}
+
+	api, err := load(API, nil, env(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if api.Port != 8090 || api.JWT.AccessTokenTTL != 15*time.Minute || api.JWT.RefreshTokenTTL != 24*time.Hour || len(api.CORS.Origins) != 1 || api.CORS.MaxAge != 10*time.Minute {
+		t.Errorf("unexpected api defaults %+v", api)
+	}
+
+	// settings of the other app are unknown
+	if _, err := load(Web, []string{"-jwt-keys", "keys"}, env(nil)); err == nil {
+		t.Error("expected an error for an api flag given to the web app")
+	}
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `
+port: 9000
+dsn: host=file
+read-timeout: 1m
+cookie-domain: file.example.com
+rate-limit-auth: 5/1m
+cors-origins:
+  - https://a.example.com
+  - https://*.b.example.com
+s3-access-key: file-key
+`)
+
+	var tests = []struct {
+		name   string
+		args   []string
+		env    map[string]string
+		expect func(c *Config) bool
+	}{
+		{
+			"file over defaults",
+			[]string{"-config", path},
+			nil,
+			func(c *Config) bool {
+				return c.Port == 9000 && c.DSN == "host=file" && c.Server.ReadTimeout == time.Minute &&
+					strings.Join(c.CORS.Origins, " ") == "https://a.example.com https://*.b.example.com" &&
+					c.Storage.S3AccessKey == "file-key" && c.Server.WriteTimeout == 30*time.Second &&
+					c.RateLimit.Auth == ratelimit.Limit{Requests: 5, Period: time.Minute} && c.RateLimit.Users.Requests == 300
+			},
+		},
+		{
+			"file named in the environment",
+			nil,
+			map[string]string{"CONFIG_FILE": path},
+			func(c *Config) bool { return c.Port == 9000 },
+		},
+		{
+			"environment over file",
+			[]string{"-config", path},
+			map[string]string{"PORT": "9100", "COOKIE_DOMAIN": "env.example.com", "S3_ACCESS_KEY": "env-key"},
+			func(c *Config) bool {
+				return c.Port == 9100 && c.Cookie.Domain == "env.example.com" && c.Storage.S3AccessKey == "env-key" && c.DSN == "host=file"
+			},
+		},
+		{
+			"flags over environment",
+			[]string{"-config", path, "-port", "9200", "-cors-origins", "https://c.example.com"},
+			map[string]string{"PORT": "9100", "DSN": "host=env", "TRUSTED_PROXIES": "10.0.0.0/8, 192.0.2.1"},
+			func(c *Config) bool {
+				return c.Port == 9200 && c.DSN == "host=env" && strings.Join(c.CORS.Origins, " ") == "https://c.example.com" &&
+					strings.Join(c.TrustedProxies, " ") == "10.0.0.0/8 192.0.2.1"
+			},
+		},
+	}
+
+	for _, e := range tests {
+		cfg, err := load(API, e.args, env(e.env))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+			continue
+		}
+
+		if !e.expect(cfg) {
+			t.Errorf("%s: unexpected config %+v", e.name, cfg)
+		}
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	var tests = []struct {
+		name        string
+		app         string
+		args        []string
+		env         map[string]string
+		file        string
+		expectError string
+	}{
+		{"unknown file setting", API, nil, nil, "prot: 80", `unknown setting "prot"`},
+		{"nested file setting", API, nil, nil, "jwt:\n  keys: x", "expected a value"},
+		{"bad env value", API, nil, map[string]string{"PORT": "eighty"}, "", "PORT"},
+		{"port out of range", Web, []string{"-port", "70000"}, nil, "", "port must be"},
+		{"bad environment", Web, []string{"-environment", "staging"}, nil, "", "environment must be"},
+		{"bad storage", Web, []string{"-storage", "ftp"}, nil, "", "storage must be"},
+		{"images in the static directory", Web, []string{"-storage-dir", "./static/img/"}, nil, "", "storage-dir must not be inside"},
+		{"images as the static directory", API, []string{"-storage-dir", "static"}, nil, "", "storage-dir must not be inside"},
+		{"s3 without bucket", Web, []string{"-storage", "s3"}, nil, "", "s3-bucket is required"},
+		{"bad upload limit", Web, []string{"-max-upload-bytes", "0"}, nil, "", "max-upload-bytes"},
+		{"bad client ip header", API, []string{"-client-ip-header", "x-client-ip"}, nil, "", "client-ip-header"},
+		{"bad trusted proxy", Web, []string{"-trusted-proxies", "10.0.0.0/8,proxy.local"}, nil, "", "trusted-proxies"},
+		{"bad session store", Web, []string{"-session-store", "redis"}, nil, "", "session-store"},
+		{"bad session cleanup", Web, []string{"-session-cleanup", "0s"}, nil, "", "session-cleanup"},
+		{"refresh shorter than access", API, []string{"-refresh-token-ttl", "1m"}, nil, "", "refresh-token-ttl"},
+		{"bad origin", API, []string{"-cors-origins", "https://example.com/path"}, nil, "", "cors-origins"},
+		{"wildcard in the middle of an origin", API, []string{"-cors-origins", "https://a.*.example.com"}, nil, "", "cors-origins"},
+		{"negative cors max age", API, []string{"-cors-max-age", "-1s"}, nil, "", "cors-max-age"},
+		{"bad rate limit", API, []string{"-rate-limit-auth", "10"}, nil, "", "rate-limit-auth"},
+		{"bad rate limit store", API, []string{"-rate-limit-store", "redis"}, nil, "", "rate-limit-store"},
+		{"demo key in production", API, []string{"-environment", "production"}, nil, "", "jwt-keys is required in production"},
+		{"insecure cookies in production", Web, []string{"-environment", "production", "-cookie-secure=false"}, nil, "", "cookie-secure"},
+	}
+
+	for _, e := range tests {
+		args := e.args
+		if e.file != "" {
+			args = append([]string{"-config", writeFile(t, e.file)}, args...)
+		}
+
+		_, err := load(e.app, args, env(e.env))
+		if err == nil {
+			t.Errorf("%s: expected an error, got nil", e.name)
+			continue
+		}
+
+		if !strings.Contains(err.Error(), e.expectError) {
+			t.Errorf("%s: expected an error about %q, got %s", e.name, e.expectError, err)
+		}
+	}
+
+	// production is fine with real keys; the web app has no keys to check
+	if _, err := load(API, []string{"-environment", "production", "-jwt-keys", "/etc/keys"}, env(nil)); err != nil {
+		t.Errorf("expected production with keys to load, got %s", err)
+	}
+
+	if _, err := load(Web, []string{"-environment", "production"}, env(nil)); err != nil {
+		t.Errorf("expected the web app to load in production, got %s", err)
+	}
+}
@@ -0,0 +1,249 @@
+// Package cors implements the Cross-Origin Resource Sharing policy of the API:
+// which browser origins may call it, with which methods and headers, and
+// whether they may send credentials.
+package cors
+
+import (
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Options configure a Policy.
+type Options struct {
+	// AllowedOrigins lists the origins that may call the server, such as
+	// https://app.example.com. A host starting with "*.", as in
+	// https://*.example.com, allows every subdomain of it, but not the
+	// domain itself.
+	AllowedOrigins []string
+
+	// AllowedMethods and AllowedHeaders answer preflight requests for paths
+	// none of Routes applies to.
+	AllowedMethods []string
+	AllowedHeaders []string
+
+	// ExposedHeaders are the response headers scripts may read.
+	ExposedHeaders []string
+
+	// AllowCredentials lets browsers send cookies and read the responses of
+	// requests that carry them.
+	AllowCredentials bool
+
+	// MaxAge is how long browsers may cache the answer to a preflight
+	// request. Zero leaves it to the browser.
+	MaxAge time.Duration
+
+	// Routes narrow the allowed methods and headers below a path.
+	Routes []Route
+}
+
+// Route overrides the allowed methods and headers of the paths below Prefix,
+// e.g. /users applies to /users and /users/1 but not to /userscount. The
+// longest matching prefix wins.
+type Route struct {
+	Prefix  string
+	Methods []string
+	Headers []string
+}
+
+// Policy is a compiled set of Options.
+type Policy struct {
+	origins     map[string]bool
+	wildcards   []wildcard
+	credentials bool
+	maxAge      string
+	exposed     string
+	fallback    rule
+	routes      []route
+}
+
+// wildcard matches the origins with scheme whose host ends in suffix.
+type wildcard struct {
+	scheme string
+	suffix string
+}
+
+type rule struct {
+	methods []string
+	headers []string
+}
+
+type route struct {
+	prefix string
+	rule
+}
+
+// New returns the policy described by opts. Origins that aren't valid, see
+// ValidOrigin, are never allowed.
+func New(opts Options) *Policy {
+	p := &Policy{
+		origins:     make(map[string]bool),
+		credentials: opts.AllowCredentials,
+		exposed:     strings.Join(opts.ExposedHeaders, ", "),
+		fallback:    newRule(opts.AllowedMethods, opts.AllowedHeaders),
+	}
+
+	if opts.MaxAge > 0 {
+		p.maxAge = strconv.Itoa(int(opts.MaxAge.Seconds()))
+	}
+
+	for _, origin := range opts.AllowedOrigins {
+		if !ValidOrigin(origin) {
+			continue
+		}
+		origin = strings.ToLower(origin)
+		if scheme, host, ok := strings.Cut(origin, "://*."); ok {
+			p.wildcards = append(p.wildcards, wildcard{scheme: scheme + "://", suffix: "." + host})
+		} else {
+			p.origins[origin] = true
+		}
+	}
+
+	for _, r := range opts.Routes {
+		p.routes = append(p.routes, route{
+			prefix: strings.TrimSuffix(r.Prefix, "/"),
+			rule:   newRule(r.Methods, r.Headers),
+		})
+	}
+
+	return p
+}
+
+func newRule(methods, headers []string) rule {
+	r := rule{}
+	for _, m := range methods {
+		r.methods = append(r.methods, strings.ToUpper(m))
+	}
+	for _, h := range headers {
+		r.headers = append(r.headers, http.CanonicalHeaderKey(h))
+	}
+	return r
+}
+
+// ValidOrigin reports whether s is an origin the policy understands: an http
+// or https scheme and a host with an optional port, where the host may start
+// with "*." to match subdomains.
+func ValidOrigin(s string) bool {
+	u, err := url.Parse(strings.Replace(s, "://*.", "://wildcard.", 1))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return false
+	}
+
+	return u.Path == "" && u.RawQuery == "" && u.Fragment == "" && u.User == nil && !strings.Contains(u.Host, "*")
+}
+
+// AllowOrigin reports whether origin may call the server.
+func (p *Policy) AllowOrigin(origin string) bool {
+	origin = strings.ToLower(origin)
+	if p.origins[origin] {
+		return true
+	}
+
+	for _, wc := range p.wildcards {
+		host, ok := strings.CutPrefix(origin, wc.scheme)
+		if ok && strings.HasSuffix(host, wc.suffix) && len(host) > len(wc.suffix) && !strings.ContainsAny(host, "/@") {
+			return true
+		}
+	}
+
+	return false
+}
+
+// rule returns the methods and headers allowed for path.
+func (p *Policy) rule(path string) rule {
+	best, bestLen := p.fallback, -1
+	for _, r := range p.routes {
+		if len(r.prefix) > bestLen && (path == r.prefix || strings.HasPrefix(path, r.prefix+"/") || r.prefix == "") {
+			best, bestLen = r.rule, len(r.prefix)
+		}
+	}
+	return best
+}
+
+// Handler applies the policy to the requests of next. Preflight requests are
+// answered without calling next: with 204 if the origin, method and headers
+// are allowed, and with 403 otherwise. Other requests always reach next, but
+// only allowed origins get the CORS headers that let browsers read the
+// response.
+func (p *Policy) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		// the response depends on the origin, so caches must not share it
+		// between origins, even when the origin is refused
+		w.Header().Add("Vary", "Origin")
+		if preflight {
+			w.Header().Add("Vary", "Access-Control-Request-Method")
+			w.Header().Add("Vary", "Access-Control-Request-Headers")
+		}
+
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		allowed := p.AllowOrigin(origin)
+
+		if !preflight {
+			if allowed {
+				p.setOrigin(w, origin)
+				if p.exposed != "" {
+					w.Header().Set("Access-Control-Expose-Headers", p.exposed)
+				}
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		rule := p.rule(r.URL.Path)
+		if !allowed || !rule.allowMethod(r.Header.Get("Access-Control-Request-Method")) ||
+			!rule.allowHeaders(r.Header.Get("Access-Control-Request-Headers")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+
+		p.setOrigin(w, origin)
+		w.Header().Set("Access-Control-Allow-Methods", strings.Join(rule.methods, ", "))
+		if len(rule.headers) > 0 {
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(rule.headers, ", "))
+		}
+		if p.maxAge != "" {
+			w.Header().Set("Access-Control-Max-Age", p.maxAge)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+// setOrigin sets the headers every response to an allowed origin carries. The
+// origin is echoed rather than answered with "*", which browsers refuse for
+// requests with credentials.
+func (p *Policy) setOrigin(w http.ResponseWriter, origin string) {
+	w.Header().Set("Access-Control-Allow-Origin", origin)
+	if p.credentials {
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+	}
+}
+
+func (r rule) allowMethod(method string) bool {
+	return slices.Contains(r.methods, method)
+}
+
+// allowHeaders reports whether every header of the comma-separated list
+// requested is allowed.
+func (r rule) allowHeaders(requested string) bool {
+	for _, h := range strings.Split(requested, ",") {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			continue
+		}
+
+		if !slices.Contains(r.headers, http.CanonicalHeaderKey(h)) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,216 @@
+package cors
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidOrigin(t *testing.T) {
+	var tests = []struct {
+		origin string
+		valid  bool
+	}{
+		{"https://example.com", true},
+		{"http://localhost:8090", true},
+		{"https://*.example.com", true},
+		{"https://*.example.com:8443", true},
+		{"*", false},
+		{"https://*", false},
+		{"https://a.*.example.com", false},
+		{"ftp://example.com", false},
+		{"https://example.com/path", false},
+		{"https://user@example.com", false},
+		{"example.com", false},
+	}
+
+	for _, e := range tests {
+		if got := ValidOrigin(e.origin); got != e.valid {
+			t.Errorf("ValidOrigin(%q) = %v, expected %v", e.origin, got, e.valid)
+		}
+	}
+}
+
+func TestPolicy_AllowOrigin(t *testing.T) {
+	p := New(Options{AllowedOrigins: []string{
+		"http://localhost:8090",
+		"https://*.example.com",
+		"https://example.org/not-an-origin",
+	}})
+
+	var tests = []struct {
+		origin  string
+		allowed bool
+	}{
+		{"http://localhost:8090", true},
+		{"HTTP://LOCALHOST:8090", true},
+		{"http://localhost:8091", false},
+		{"https://localhost:8090", false},
+		{"https://app.example.com", true},
+		{"https://a.b.example.com", true},
+		{"https://example.com", false},
+		{"http://app.example.com", false},
+		{"https://app.example.com.evil.com", false},
+		{"https://evilexample.com", false},
+		{"https://example.org", false},
+		{"null", false},
+	}
+
+	for _, e := range tests {
+		if got := p.AllowOrigin(e.origin); got != e.allowed {
+			t.Errorf("AllowOrigin(%q) = %v, expected %v", e.origin, got, e.allowed)
+		}
+	}
+}
+
+func TestPolicy_Handler(t *testing.T) {
+	p := New(Options{
+		AllowedOrigins:   []string{"https://app.example.com"},
+		AllowedMethods:   []string{"GET", "POST", "DELETE"},
+		AllowedHeaders:   []string{"Content-Type", "Authorization"},
+		ExposedHeaders:   []string{"X-Request-ID"},
+		AllowCredentials: true,
+		MaxAge:           10 * time.Minute,
+		Routes: []Route{
+			{Prefix: "/web", Methods: []string{"GET", "POST"}, Headers: []string{"Content-Type"}},
+			{Prefix: "/web/refresh-token", Methods: []string{"GET"}},
+		},
+	})
+
+	var tests = []struct {
+		name           string
+		method         string
+		path           string
+		origin         string
+		requestMethod  string
+		requestHeaders string
+		expectStatus   int
+		expectNext     bool
+		expectHeaders  map[string]string
+	}{
+		{
+			name: "same origin", method: "GET", path: "/users",
+			expectStatus: http.StatusOK, expectNext: true,
+			expectHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Vary": "Origin"},
+		},
+		{
+			name: "allowed origin", method: "GET", path: "/users", origin: "https://app.example.com",
+			expectStatus: http.StatusOK, expectNext: true,
+			expectHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Expose-Headers":    "X-Request-ID",
+				"Access-Control-Allow-Methods":     "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name: "refused origin", method: "GET", path: "/users", origin: "https://evil.com",
+			expectStatus: http.StatusOK, expectNext: true,
+			expectHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+				"Vary":                             "Origin",
+			},
+		},
+		{
+			name: "options without preflight", method: "OPTIONS", path: "/users", origin: "https://app.example.com",
+			expectStatus: http.StatusOK, expectNext: true,
+			expectHeaders: map[string]string{"Access-Control-Allow-Origin": "https://app.example.com", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name: "preflight", method: "OPTIONS", path: "/users/1", origin: "https://app.example.com",
+			requestMethod: "DELETE", requestHeaders: "authorization, content-type",
+			expectStatus: http.StatusNoContent,
+			expectHeaders: map[string]string{
+				"Access-Control-Allow-Origin":      "https://app.example.com",
+				"Access-Control-Allow-Credentials": "true",
+				"Access-Control-Allow-Methods":     "GET, POST, DELETE",
+				"Access-Control-Allow-Headers":     "Content-Type, Authorization",
+				"Access-Control-Max-Age":           "600",
+				"Vary":                             "Origin, Access-Control-Request-Method, Access-Control-Request-Headers",
+			},
+		},
+		{
+			name: "preflight refused origin", method: "OPTIONS", path: "/users", origin: "https://evil.com",
+			requestMethod: "GET",
+			expectStatus:  http.StatusForbidden,
+			expectHeaders: map[string]string{"Access-Control-Allow-Origin": "", "Access-Control-Allow-Methods": ""},
+		},
+		{
+			name: "preflight method not allowed", method: "OPTIONS", path: "/users", origin: "https://app.example.com",
+			requestMethod: "PATCH",
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			name: "preflight header not allowed", method: "OPTIONS", path: "/users", origin: "https://app.example.com",
+			requestMethod: "GET", requestHeaders: "X-Secret",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "route rule", method: "OPTIONS", path: "/web/auth", origin: "https://app.example.com",
+			requestMethod: "POST", requestHeaders: "Content-Type",
+			expectStatus:  http.StatusNoContent,
+			expectHeaders: map[string]string{"Access-Control-Allow-Methods": "GET, POST", "Access-Control-Allow-Headers": "Content-Type"},
+		},
+		{
+			name: "route rule refuses method", method: "OPTIONS", path: "/web/auth", origin: "https://app.example.com",
+			requestMethod: "DELETE",
+			expectStatus:  http.StatusForbidden,
+		},
+		{
+			name: "route rule refuses header", method: "OPTIONS", path: "/web/auth", origin: "https://app.example.com",
+			requestMethod: "POST", requestHeaders: "Authorization",
+			expectStatus: http.StatusForbidden,
+		},
+		{
+			name: "longest prefix wins", method: "OPTIONS", path: "/web/refresh-token", origin: "https://app.example.com",
+			requestMethod: "GET",
+			expectStatus:  http.StatusNoContent,
+			expectHeaders: map[string]string{"Access-Control-Allow-Methods": "GET", "Access-Control-Allow-Headers": ""},
+		},
+		{
+			name: "prefix matches whole segments", method: "OPTIONS", path: "/website", origin: "https://app.example.com",
+			requestMethod: "DELETE",
+			expectStatus:  http.StatusNoContent,
+			expectHeaders: map[string]string{"Access-Control-Allow-Methods": "GET, POST, DELETE"},
+		},
+	}
+
+	for _, e := range tests {
+		called := false
+		next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			called = true
+		})
+
+		req := httptest.NewRequest(e.method, e.path, nil)
+		if e.origin != "" {
+			req.Header.Set("Origin", e.origin)
+		}
+		if e.requestMethod != "" {
+			req.Header.Set("Access-Control-Request-Method", e.requestMethod)
+		}
+		if e.requestHeaders != "" {
+			req.Header.Set("Access-Control-Request-Headers", e.requestHeaders)
+		}
+		rr := httptest.NewRecorder()
+
+		p.Handler(next).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectStatus, rr.Code)
+		}
+
+		if called != e.expectNext {
+			t.Errorf("%s: expected next to be called %v, got %v", e.name, e.expectNext, called)
+		}
+
+		for name, value := range e.expectHeaders {
+			if got := strings.Join(rr.Header().Values(name), ", "); got != value {
+				t.Errorf("%s: expected %s %q, got %q", e.name, name, value, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,22 @@
+package data
+
+import (
+	"fmt"
+	"time"
+)
+
+// AccessClaims returns the claims of an access token that issuer grants user,
+// who holds roles, until expires. Both the api and the token tool mint their
+// access tokens from it, so that the api accepts either.
+func AccessClaims(user *User, roles []*Role, issuer string, expires time.Time) map[string]any {
+	return map[string]any{
+		"name":  fmt.Sprintf("%s %s", user.FirstName, user.LastName),
+		"sub":   fmt.Sprint(user.ID),
+		"aud":   issuer,
+		"iss":   issuer,
+		"admin": user.IsAdmin == 1,
+		"roles": RoleNames(roles),
+		"perms": RolePermissions(roles),
+		"exp":   expires.Unix(),
+	}
+}
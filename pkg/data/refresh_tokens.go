@@ -0,0 +1,16 @@
+package data
+
+import "time"
+
+// RefreshToken is the server-side record of an issued refresh token. ID is the
+// token's jti claim. Every token that is rotated out of another one shares its
+// FamilyID, so a whole chain of tokens can be revoked at once.
+type RefreshToken struct {
+	ID        string
+	FamilyID  string
+	UserID    int
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	RevokedAt *time.Time
+	CreatedAt time.Time
+}
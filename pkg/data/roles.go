@@ -0,0 +1,55 @@
+package data
+
+// The permissions the api checks for. A user holds a permission when any of
+// their roles grants it.
+const (
+	PermUsersList   = "users:list"
+	PermUsersRead   = "users:read"
+	PermUsersCreate = "users:create"
+	PermUsersUpdate = "users:update"
+	PermUsersDelete = "users:delete"
+)
+
+// AllPermissions lists every permission, all of which the admin role is granted.
+var AllPermissions = []string{PermUsersList, PermUsersRead, PermUsersCreate, PermUsersUpdate, PermUsersDelete}
+
+// The built-in roles. Admins hold every permission; plain users hold none, and
+// may only read and update their own record.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// Role is a named set of permissions that can be granted to users.
+type Role struct {
+	ID          int      `json:"id"`
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+// RoleNames returns the names of roles.
+func RoleNames(roles []*Role) []string {
+	names := make([]string, 0, len(roles))
+	for _, r := range roles {
+		names = append(names, r.Name)
+	}
+
+	return names
+}
+
+// RolePermissions returns every permission granted by roles, without duplicates.
+func RolePermissions(roles []*Role) []string {
+	seen := make(map[string]bool)
+	var perms []string
+
+	for _, r := range roles {
+		for _, p := range r.Permissions {
+			if !seen[p] {
+				seen[p] = true
+				perms = append(perms, p)
+			}
+		}
+	}
+
+	return perms
+}
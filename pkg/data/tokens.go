@@ -0,0 +1,55 @@
+package data
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"time"
+)
+
+// Token scopes; a token issued for one purpose can't be used for another.
+const (
+	ScopePasswordReset     = "password_reset"
+	ScopeEmailVerification = "email_verification"
+)
+
+// MinPasswordLength is the shortest password a user may choose.
+const MinPasswordLength = 8
+
+// Token is a single-use token sent to a user by email. Only the hash of the token
+// is stored, so Plaintext is only set on a freshly generated token.
+type Token struct {
+	Plaintext string
+	Hash      string
+	UserID    int
+	Scope     string
+	ExpiresAt time.Time
+	UsedAt    *time.Time
+	CreatedAt time.Time
+}
+
+// NewToken generates a random token for userID, valid for ttl.
+func NewToken(userID int, ttl time.Duration, scope string) (*Token, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return nil, err
+	}
+
+	plaintext := base64.RawURLEncoding.EncodeToString(b)
+
+	return &Token{
+		Plaintext: plaintext,
+		Hash:      HashToken(plaintext),
+		UserID:    userID,
+		Scope:     scope,
+		ExpiresAt: time.Now().Add(ttl),
+	}, nil
+}
+
+// HashToken returns the hex encoded SHA-256 hash under which a token is stored.
+// The tokens are long and random, so a fast hash is enough.
+func HashToken(plaintext string) string {
+	sum := sha256.Sum256([]byte(plaintext))
+	return hex.EncodeToString(sum[:])
+}
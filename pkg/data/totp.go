@@ -0,0 +1,17 @@
+package data
+
+import "time"
+
+// TOTP is a user's two-factor authentication secret. The secret is kept out of
+// User, so that it never ends up in a session or a JSON response. EnabledAt is
+// nil while the user is still enrolling, before they have confirmed a first code.
+type TOTP struct {
+	UserID    int
+	Secret    string
+	EnabledAt *time.Time
+}
+
+// Enabled reports whether logging in needs a second factor.
+func (t *TOTP) Enabled() bool {
+	return t != nil && t.EnabledAt != nil && t.Secret != ""
+}
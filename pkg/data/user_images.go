@@ -2,11 +2,19 @@ package data
 
 import "time"
 
-// UserImage is the type for user profile images.
+// UserImage is the type for user profile images. FileName is the
+// content-addressed name of the processed image; its thumbnails are named
+// after it, see images.ThumbnailName. Users keep every picture they upload
+// until they delete it, and the active one is their profile picture.
 type UserImage struct {
 	ID        int       `json:"id"`
 	UserID    int       `json:"user_id"`
 	FileName  string    `json:"file_name"`
-	CreatedAt time.Time `json:"-"`
+	MIMEType  string    `json:"mime_type"`
+	Width     int       `json:"width"`
+	Height    int       `json:"height"`
+	Size      int64     `json:"size"`
+	IsActive  bool      `json:"is_active"`
+	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"-"`
 }
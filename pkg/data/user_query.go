@@ -0,0 +1,80 @@
+package data
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+const (
+	// DefaultUserPageSize is the page size used when a UserQuery does not set one.
+	DefaultUserPageSize = 25
+	// MaxUserPageSize is the largest page a UserQuery may ask for.
+	MaxUserPageSize = 100
+)
+
+// UserSortFields is the whitelist of fields a user listing may be sorted by.
+var UserSortFields = []string{"id", "email", "first_name", "last_name", "created_at"}
+
+// UserQuery describes one page of a filtered, sorted user listing. Either
+// Cursor or Offset may be used to pick the page, but not both.
+type UserQuery struct {
+	Limit         int
+	Offset        int
+	Cursor        string
+	Email         string
+	Name          string
+	IsAdmin       *int
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+	SortBy        string
+	SortDesc      bool
+}
+
+// UserPage is one page of users, along with the total number of users matching
+// the filters and the cursor to fetch the next page, if there is one.
+type UserPage struct {
+	Users      []*User `json:"users"`
+	Total      int     `json:"total"`
+	NextCursor string  `json:"next_cursor,omitempty"`
+}
+
+// Normalize fills in defaults for the query and checks that it is sane.
+func (q *UserQuery) Normalize() error {
+	if q.Limit == 0 {
+		q.Limit = DefaultUserPageSize
+	}
+
+	if q.Limit < 0 || q.Limit > MaxUserPageSize {
+		return fmt.Errorf("limit must be between 1 and %d", MaxUserPageSize)
+	}
+
+	if q.Offset < 0 {
+		return errors.New("offset must not be negative")
+	}
+
+	if q.Cursor != "" && q.Offset > 0 {
+		return errors.New("cursor and offset cannot be combined")
+	}
+
+	if q.SortBy == "" {
+		q.SortBy = "last_name"
+	}
+
+	valid := false
+	for _, field := range UserSortFields {
+		if field == q.SortBy {
+			valid = true
+			break
+		}
+	}
+	if !valid {
+		return fmt.Errorf("cannot sort by %q", q.SortBy)
+	}
+
+	if !q.CreatedAfter.IsZero() && !q.CreatedBefore.IsZero() && q.CreatedBefore.Before(q.CreatedAfter) {
+		return errors.New("created_before must not be earlier than created_after")
+	}
+
+	return nil
+}
@@ -17,6 +17,18 @@ type User struct {
 	CreatedAt  time.Time `json:"-"`
 	UpdatedAt  time.Time `json:"-"`
 	ProfilePic UserImage `json:"-"`
+
+	// EmailVerifiedAt is when the user confirmed their email address; users
+	// can't log in until they have.
+	EmailVerifiedAt *time.Time `json:"email_verified_at,omitempty"`
+
+	// TOTPEnabled is set when logging in needs a second factor.
+	TOTPEnabled bool `json:"totp_enabled"`
+}
+
+// EmailVerified reports whether the user has confirmed their email address.
+func (u *User) EmailVerified() bool {
+	return u.EmailVerifiedAt != nil
 }
 
 // PasswordMatches uses Go's bcrypt package to compare a user supplied password
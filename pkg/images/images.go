@@ -0,0 +1,324 @@
+// Package images validates uploaded pictures and prepares them for storage.
+// An upload is sniffed, decoded and re-encoded, which drops any metadata such
+// as EXIF, and then named after the hash of its content, so that names never
+// collide and the same picture is only stored once. Thumbnails are made in
+// ThumbnailSizes.
+package images
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+// ThumbnailSizes are the sizes, in pixels, of the square boxes that thumbnails
+// are fitted into.
+var ThumbnailSizes = []int{64, 128, 256}
+
+// MaxPixels bounds the width times height of an image, so that a small file
+// can't decode into a huge one.
+const MaxPixels = 25_000_000
+
+// MaxFrames bounds the number of frames of an animated GIF. Together with
+// MaxPixels, which also bounds the frames times the width times the height, it
+// keeps a small file from decoding into a huge animation.
+const MaxFrames = 1000
+
+// jpegQuality is the quality images are re-encoded with as JPEG.
+const jpegQuality = 90
+
+var (
+	// ErrUnsupported is returned for anything but JPEG, PNG and GIF images.
+	ErrUnsupported = errors.New("images: not a JPEG, PNG or GIF image")
+	// ErrTooLarge is returned for files over the size limit, and for images
+	// over MaxPixels.
+	ErrTooLarge = errors.New("images: image too large")
+
+	// errMalformedGIF is returned by gifFrames for a GIF it can't walk.
+	errMalformedGIF = errors.New("images: malformed GIF")
+)
+
+// formats maps the sniffed MIME types that are accepted to file extensions.
+var formats = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/gif":  ".gif",
+}
+
+// Image is a processed upload, ready to be saved.
+type Image struct {
+	// Name is the content-addressed file name, e.g. "<sha256>.png".
+	Name       string
+	MIMEType   string
+	Width      int
+	Height     int
+	Data       []byte
+	Thumbnails []Thumbnail
+}
+
+// Size returns the size, in bytes, of the re-encoded image.
+func (i *Image) Size() int64 {
+	return int64(len(i.Data))
+}
+
+// Thumbnail is a scaled down copy of an Image.
+type Thumbnail struct {
+	// MaxSize is the entry of ThumbnailSizes the thumbnail was fitted into.
+	MaxSize int
+	Name    string
+	Width   int
+	Height  int
+	Data    []byte
+}
+
+// ThumbnailName returns the file name of the thumbnail of the image named name
+// that fits into size.
+func ThumbnailName(name string, size int) string {
+	ext := filepath.Ext(name)
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(name, ext), size, ext)
+}
+
+// Process reads an upload of at most maxBytes from r, checks that it really is
+// a JPEG, PNG or GIF image, and re-encodes it in the same format, along with
+// its thumbnails.
+func Process(r io.Reader, maxBytes int64) (*Image, error) {
+	raw, err := io.ReadAll(io.LimitReader(r, maxBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(raw)) > maxBytes {
+		return nil, ErrTooLarge
+	}
+
+	// trust the content, never the file name or the client's content type
+	mimeType := http.DetectContentType(raw)
+	ext, ok := formats[mimeType]
+	if !ok {
+		return nil, ErrUnsupported
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(raw))
+	if err != nil {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width <= 0 || cfg.Height <= 0 {
+		return nil, ErrUnsupported
+	}
+	if cfg.Width*cfg.Height > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img := &Image{MIMEType: mimeType, Width: cfg.Width, Height: cfg.Height}
+
+	var first image.Image
+	var buf bytes.Buffer
+
+	if mimeType == "image/gif" {
+		// keep every frame of animated GIFs, once it's clear that they fit
+		frames, err := gifFrames(raw)
+		if err != nil {
+			return nil, ErrUnsupported
+		}
+		if frames > MaxFrames || frames*cfg.Width*cfg.Height > MaxPixels {
+			return nil, ErrTooLarge
+		}
+
+		g, err := gif.DecodeAll(bytes.NewReader(raw))
+		if err != nil {
+			return nil, ErrUnsupported
+		}
+		if err := gif.EncodeAll(&buf, g); err != nil {
+			return nil, err
+		}
+		first = g.Image[0]
+	} else {
+		first, _, err = image.Decode(bytes.NewReader(raw))
+		if err != nil {
+			return nil, ErrUnsupported
+		}
+		if err := encode(&buf, first, mimeType); err != nil {
+			return nil, err
+		}
+	}
+
+	img.Data = buf.Bytes()
+
+	sum := sha256.Sum256(img.Data)
+	img.Name = hex.EncodeToString(sum[:]) + ext
+
+	for _, size := range ThumbnailSizes {
+		t, err := thumbnail(first, size, mimeType)
+		if err != nil {
+			return nil, err
+		}
+		t.Name = ThumbnailName(img.Name, size)
+		img.Thumbnails = append(img.Thumbnails, *t)
+	}
+
+	return img, nil
+}
+
+// gifFrames counts the frames of the GIF raw by walking its blocks, without
+// decoding them. It stops counting after MaxFrames+1.
+func gifFrames(raw []byte) (int, error) {
+	// header and logical screen descriptor, then the global color table
+	if len(raw) < 13 {
+		return 0, errMalformedGIF
+	}
+	i := 13
+	if raw[10]&0x80 != 0 {
+		i += 3 << (raw[10]&0x07 + 1)
+	}
+
+	// skipSubBlocks moves i past a sequence of data sub-blocks
+	skipSubBlocks := func() error {
+		for {
+			if i >= len(raw) {
+				return errMalformedGIF
+			}
+			n := int(raw[i])
+			i += 1 + n
+			if n == 0 {
+				return nil
+			}
+		}
+	}
+
+	frames := 0
+	for frames <= MaxFrames {
+		if i >= len(raw) {
+			return 0, errMalformedGIF
+		}
+
+		switch raw[i] {
+		case 0x21: // extension: label, then sub-blocks
+			i += 2
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+		case 0x2C: // image descriptor, local color table, LZW code size, then sub-blocks
+			if i+10 > len(raw) {
+				return 0, errMalformedGIF
+			}
+			flags := raw[i+9]
+			i += 10
+			if flags&0x80 != 0 {
+				i += 3 << (flags&0x07 + 1)
+			}
+			i++
+			if err := skipSubBlocks(); err != nil {
+				return 0, err
+			}
+			frames++
+		case 0x3B: // trailer
+			return frames, nil
+		default:
+			return 0, errMalformedGIF
+		}
+	}
+
+	return frames, nil
+}
+
+// encode writes m to w in the format of mimeType.
+func encode(w io.Writer, m image.Image, mimeType string) error {
+	switch mimeType {
+	case "image/jpeg":
+		return jpeg.Encode(w, m, &jpeg.Options{Quality: jpegQuality})
+	case "image/png":
+		return png.Encode(w, m)
+	case "image/gif":
+		return gif.Encode(w, m, nil)
+	}
+
+	return ErrUnsupported
+}
+
+// thumbnail scales src down to fit into a size by size box, keeping its aspect
+// ratio. Images that already fit are not scaled up.
+func thumbnail(src image.Image, size int, mimeType string) (*Thumbnail, error) {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	if w > size || h > size {
+		if w >= h {
+			w, h = size, h*size/w
+		} else {
+			w, h = w*size/h, size
+		}
+	}
+
+	// very thin images still get a pixel
+	if w < 1 {
+		w = 1
+	}
+	if h < 1 {
+		h = 1
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := encode(&buf, dst, mimeType); err != nil {
+		return nil, err
+	}
+
+	return &Thumbnail{MaxSize: size, Width: w, Height: h, Data: buf.Bytes()}, nil
+}
+
+// Put stores the image and its thumbnails, keyed by their names. Storing an
+// image twice is harmless, since names are content-addressed.
+func (i *Image) Put(ctx context.Context, store storage.Storage) error {
+	if err := store.Put(ctx, i.Name, bytes.NewReader(i.Data), i.MIMEType); err != nil {
+		return err
+	}
+
+	for _, t := range i.Thumbnails {
+		if err := store.Put(ctx, t.Name, bytes.NewReader(t.Data), i.MIMEType); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes the image named name, and its thumbnails, from store.
+func Delete(ctx context.Context, store storage.Storage, name string) error {
+	for _, size := range ThumbnailSizes {
+		if err := store.Delete(ctx, ThumbnailName(name, size)); err != nil {
+			return err
+		}
+	}
+
+	return store.Delete(ctx, name)
+}
+
+// Releaser is the part of the user database that RemoveUnused needs.
+type Releaser interface {
+	ReleaseUserImageFile(ctx context.Context, fileName string, remove func(ctx context.Context) error) error
+}
+
+// RemoveUnused removes the image named name, and its thumbnails, from store,
+// unless a picture in db is still stored in them. db keeps pictures of the same
+// content from being added while the files go; an upload that races with the
+// removal puts its files again once its picture is added.
+func RemoveUnused(ctx context.Context, db Releaser, store storage.Storage, name string) error {
+	return db.ReleaseUserImageFile(ctx, name, func(ctx context.Context) error {
+		return Delete(ctx, store, name)
+	})
+}
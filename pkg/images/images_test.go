@@ -0,0 +1,290 @@
+package images
+
+import (
+	"bytes"
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/storage"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testImage returns a w by h image with a gradient, so that it compresses like a photo
+func testImage(w, h int) *image.RGBA {
+	m := image.NewRGBA(image.Rect(0, 0, w, h))
+	for x := 0; x < w; x++ {
+		for y := 0; y < h; y++ {
+			m.Set(x, y, color.RGBA{uint8(x), uint8(y), 128, 255})
+		}
+	}
+	return m
+}
+
+// withExif inserts an APP1 segment holding EXIF data after the SOI marker of a JPEG
+func withExif(jpg []byte) []byte {
+	payload := []byte("Exif\x00\x00GPS 51.5N 0.1W")
+	segment := []byte{0xFF, 0xE1, 0, byte(len(payload) + 2)}
+	segment = append(segment, payload...)
+
+	out := append([]byte{}, jpg[:2]...)
+	out = append(out, segment...)
+	return append(out, jpg[2:]...)
+}
+
+func TestProcess(t *testing.T) {
+	var pngBuf, jpgBuf, gifBuf bytes.Buffer
+	_ = png.Encode(&pngBuf, testImage(400, 200))
+	_ = jpeg.Encode(&jpgBuf, testImage(100, 300), nil)
+	_ = gif.Encode(&gifBuf, testImage(50, 50), nil)
+
+	var tests = []struct {
+		name         string
+		data         []byte
+		maxBytes     int64
+		expectErr    error
+		expectedMIME string
+		expectedExt  string
+		expectedW    int
+		expectedH    int
+		expectedBig  [2]int
+	}{
+		{"png", pngBuf.Bytes(), 1 << 20, nil, "image/png", ".png", 400, 200, [2]int{256, 128}},
+		{"jpeg with exif", withExif(jpgBuf.Bytes()), 1 << 20, nil, "image/jpeg", ".jpg", 100, 300, [2]int{85, 256}},
+		{"small gif", gifBuf.Bytes(), 1 << 20, nil, "image/gif", ".gif", 50, 50, [2]int{50, 50}},
+		{"text", []byte("<html>not an image</html>"), 1 << 20, ErrUnsupported, "", "", 0, 0, [2]int{}},
+		{"truncated png", pngBuf.Bytes()[:100], 1 << 20, ErrUnsupported, "", "", 0, 0, [2]int{}},
+		{"too large", pngBuf.Bytes(), 100, ErrTooLarge, "", "", 0, 0, [2]int{}},
+	}
+
+	for _, e := range tests {
+		img, err := Process(bytes.NewReader(e.data), e.maxBytes)
+
+		if e.expectErr != nil {
+			if err != e.expectErr {
+				t.Errorf("%s: expected %v, got %v", e.name, e.expectErr, err)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+			continue
+		}
+
+		if img.MIMEType != e.expectedMIME || img.Width != e.expectedW || img.Height != e.expectedH {
+			t.Errorf("%s: expected %s %dx%d, got %s %dx%d", e.name, e.expectedMIME, e.expectedW, e.expectedH, img.MIMEType, img.Width, img.Height)
+		}
+
+		if len(img.Name) != 64+len(e.expectedExt) || !strings.HasSuffix(img.Name, e.expectedExt) {
+			t.Errorf("%s: expected a content-addressed name, got %s", e.name, img.Name)
+		}
+
+		if bytes.Contains(img.Data, []byte("Exif")) {
+			t.Errorf("%s: expected metadata to be stripped", e.name)
+		}
+
+		if len(img.Thumbnails) != len(ThumbnailSizes) {
+			t.Fatalf("%s: expected %d thumbnails, got %d", e.name, len(ThumbnailSizes), len(img.Thumbnails))
+		}
+
+		big := img.Thumbnails[len(img.Thumbnails)-1]
+		if big.Width != e.expectedBig[0] || big.Height != e.expectedBig[1] {
+			t.Errorf("%s: expected the largest thumbnail to be %v, got %dx%d", e.name, e.expectedBig, big.Width, big.Height)
+		}
+
+		if big.Name != ThumbnailName(img.Name, 256) {
+			t.Errorf("%s: unexpected thumbnail name %s", e.name, big.Name)
+		}
+
+		if _, _, err := image.Decode(bytes.NewReader(big.Data)); err != nil {
+			t.Errorf("%s: thumbnail doesn't decode: %s", e.name, err)
+		}
+	}
+}
+
+// animation returns an animated GIF of frames blank w by h frames
+func animation(w, h, frames int) []byte {
+	palette := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < frames; i++ {
+		g.Image = append(g.Image, image.NewPaletted(image.Rect(0, 0, w, h), palette))
+		g.Delay = append(g.Delay, 0)
+	}
+
+	var buf bytes.Buffer
+	_ = gif.EncodeAll(&buf, g)
+	return buf.Bytes()
+}
+
+func TestProcess_animatedGIF(t *testing.T) {
+	var tests = []struct {
+		name      string
+		data      []byte
+		expectErr error
+	}{
+		{"few frames", animation(50, 50, 3), nil},
+		{"too many frames", animation(1, 1, MaxFrames+1), ErrTooLarge},
+		{"too many pixels over all frames", animation(1000, 1000, 26), ErrTooLarge},
+		{"truncated", animation(50, 50, 3)[:40], ErrUnsupported},
+	}
+
+	for _, e := range tests {
+		img, err := Process(bytes.NewReader(e.data), 10<<20)
+		if err != e.expectErr {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expectErr, err)
+			continue
+		}
+
+		if err == nil {
+			g, err := gif.DecodeAll(bytes.NewReader(img.Data))
+			if err != nil || len(g.Image) != 3 {
+				t.Errorf("%s: expected 3 frames to be kept, got %v %v", e.name, g, err)
+			}
+		}
+	}
+}
+
+func TestGIFFrames(t *testing.T) {
+	var withLocalPalette bytes.Buffer
+	_ = gif.Encode(&withLocalPalette, testImage(50, 50), nil)
+
+	var tests = []struct {
+		name           string
+		data           []byte
+		expectedFrames int
+		expectErr      bool
+	}{
+		{"single frame", withLocalPalette.Bytes(), 1, false},
+		{"animation", animation(10, 10, 7), 7, false},
+		{"stops counting", animation(1, 1, MaxFrames+5), MaxFrames + 1, false},
+		{"header only", []byte("GIF89a"), 0, true},
+		{"no trailer", animation(10, 10, 2)[:len(animation(10, 10, 2))-1], 0, true},
+	}
+
+	for _, e := range tests {
+		frames, err := gifFrames(e.data)
+		if e.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got nil", e.name)
+			}
+			continue
+		}
+
+		if err != nil || frames != e.expectedFrames {
+			t.Errorf("%s: expected %d frames, got %d %v", e.name, e.expectedFrames, frames, err)
+		}
+	}
+}
+
+func TestProcess_sameContentSameName(t *testing.T) {
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, testImage(20, 20))
+
+	a, err := Process(bytes.NewReader(buf.Bytes()), 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, _ := Process(bytes.NewReader(buf.Bytes()), 1<<20)
+	if a.Name != b.Name {
+		t.Errorf("expected the same name, got %s and %s", a.Name, b.Name)
+	}
+}
+
+func TestImage_PutAndDelete(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.Local{Dir: dir}
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, testImage(300, 300))
+
+	img, err := Process(&buf, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.Put(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+
+	// storing again is harmless
+	if err := img.Put(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1+len(ThumbnailSizes) {
+		t.Errorf("expected %d files, got %d", 1+len(ThumbnailSizes), len(entries))
+	}
+
+	stored, err := os.ReadFile(filepath.Join(dir, img.Name))
+	if err != nil || !bytes.Equal(stored, img.Data) {
+		t.Errorf("expected %s to hold the image, got %v", img.Name, err)
+	}
+
+	if err := Delete(context.Background(), store, img.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the image and its thumbnails to be deleted, got %d files", len(entries))
+	}
+}
+
+// releaser is a Releaser that holds the files of the names in inUse
+type releaser struct {
+	inUse map[string]bool
+}
+
+func (r releaser) ReleaseUserImageFile(ctx context.Context, fileName string, remove func(ctx context.Context) error) error {
+	if r.inUse[fileName] {
+		return nil
+	}
+
+	return remove(ctx)
+}
+
+func TestRemoveUnused(t *testing.T) {
+	dir := t.TempDir()
+	store := &storage.Local{Dir: dir}
+
+	var buf bytes.Buffer
+	_ = png.Encode(&buf, testImage(100, 100))
+
+	img, err := Process(&buf, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := img.Put(context.Background(), store); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := RemoveUnused(context.Background(), releaser{inUse: map[string]bool{img.Name: true}}, store, img.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 1+len(ThumbnailSizes) {
+		t.Errorf("expected the files in use to be kept, got %d files", len(entries))
+	}
+
+	if err := RemoveUnused(context.Background(), releaser{}, store, img.Name); err != nil {
+		t.Fatal(err)
+	}
+
+	if entries, _ := os.ReadDir(dir); len(entries) != 0 {
+		t.Errorf("expected the unused files to be removed, got %d files", len(entries))
+	}
+}
+
+func TestThumbnailName(t *testing.T) {
+	if name := ThumbnailName("abc.jpg", 64); name != "abc_64.jpg" {
+		t.Errorf("expected abc_64.jpg, got %s", name)
+	}
+}
@@ -0,0 +1,79 @@
+//go:build integration
+
+// Package pgtest runs the integration tests of a package against Postgres in a
+// throwaway Docker container, with every migration applied. Each package gets
+// a container of its own, on a free port, so packages can be tested in
+// parallel.
+package pgtest
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"github.com/calvarado2004/go-testing-webapp/pkg/migrations"
+	_ "github.com/jackc/pgx/v4/stdlib"
+	"github.com/ory/dockertest/v3"
+	"log"
+	"os"
+	"testing"
+)
+
+const (
+	user     = "postgres"
+	password = "postgres"
+	dbname   = "users_test"
+	dsn      = "host=localhost port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
+)
+
+// Main starts the container, applies the migrations, hands the database to
+// setup, runs the tests, and removes the container. It is meant to be the
+// whole of a TestMain; it fails if docker is not running.
+func Main(m *testing.M, setup func(db *sql.DB)) {
+
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Fatalf("Could not connect to docker: %v", err)
+	}
+
+	resource, err := pool.RunWithOptions(&dockertest.RunOptions{
+		Repository: "postgres",
+		Tag:        "14.5",
+		Env: []string{
+			"POSTGRES_USER=" + user,
+			"POSTGRES_PASSWORD=" + password,
+			"POSTGRES_DB=" + dbname,
+		},
+	})
+	if err != nil {
+		log.Fatalf("Could not start resource: %v", err)
+	}
+
+	// wait for postgres to accept connections
+	var db *sql.DB
+	if err = pool.Retry(func() error {
+		var err error
+		db, err = sql.Open("pgx", fmt.Sprintf(dsn, resource.GetPort("5432/tcp"), user, password, dbname))
+		if err != nil {
+			return err
+		}
+		return db.Ping()
+	}); err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("Could not connect to postgres at all: %s", err)
+	}
+
+	if _, err := migrations.Up(context.Background(), db); err != nil {
+		_ = pool.Purge(resource)
+		log.Fatalf("Could not apply migrations: %s", err)
+	}
+
+	setup(db)
+
+	code := m.Run()
+
+	if err = pool.Purge(resource); err != nil {
+		log.Fatalf("Could not purge resource: %v", err)
+	}
+
+	os.Exit(code)
+}
@@ -0,0 +1,193 @@
+// Package keyring holds the asymmetric keys used to sign and verify JWTs. One
+// key signs new tokens, while every key on the ring is accepted when verifying,
+// so that keys can be rotated without invalidating tokens already handed out.
+package keyring
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// minRSABits is the smallest RSA modulus we are willing to sign or verify with.
+const minRSABits = 2048
+
+// Key is one signing key. Private is nil for keys that are only kept around to
+// verify tokens signed before a rotation.
+type Key struct {
+	ID      string
+	Method  jwt.SigningMethod
+	Private crypto.Signer
+	Public  crypto.PublicKey
+}
+
+// Keyring is a set of keys, indexed by key id, one of which signs new tokens.
+type Keyring struct {
+	keys    map[string]*Key
+	signing *Key
+}
+
+// New builds a keyring from keys. signingKID names the key used to sign new
+// tokens; if it is empty, the private key with the greatest id is used, so that
+// naming key files by date makes the newest one the signing key.
+func New(signingKID string, keys ...*Key) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]*Key)}
+
+	for _, key := range keys {
+		if _, exists := k.keys[key.ID]; exists {
+			return nil, fmt.Errorf("keyring: duplicate key id %q", key.ID)
+		}
+		k.keys[key.ID] = key
+
+		if key.Private == nil {
+			continue
+		}
+
+		if signingKID == "" && (k.signing == nil || key.ID > k.signing.ID) {
+			k.signing = key
+		}
+	}
+
+	if signingKID != "" {
+		k.signing = k.keys[signingKID]
+		if k.signing == nil || k.signing.Private == nil {
+			return nil, fmt.Errorf("keyring: no private key with id %q", signingKID)
+		}
+	}
+
+	if k.signing == nil {
+		return nil, errors.New("keyring: no private key to sign with")
+	}
+
+	return k, nil
+}
+
+// Load reads every .pem file in dir onto a keyring. The key id is the file name
+// without its extension. Files may hold an RSA or Ed25519 private key, in PKCS #8
+// or (for RSA) PKCS #1 form, or a PKIX public key for a verify-only key.
+func Load(dir string, signingKID string) (*Keyring, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.pem"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(paths)
+
+	var keys []*Key
+	for _, path := range paths {
+		pemBytes, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		kid := strings.TrimSuffix(filepath.Base(path), ".pem")
+		key, err := ParseKey(kid, pemBytes)
+		if err != nil {
+			return nil, fmt.Errorf("keyring: %s: %w", path, err)
+		}
+
+		keys = append(keys, key)
+	}
+
+	return New(signingKID, keys...)
+}
+
+// ParseKey parses one PEM encoded key and gives it the id kid.
+func ParseKey(kid string, pemBytes []byte) (*Key, error) {
+	block, _ := pem.Decode(pemBytes)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	var parsed any
+	var err error
+
+	switch block.Type {
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PUBLIC KEY":
+		parsed, err = x509.ParsePKIXPublicKey(block.Bytes)
+	default:
+		return nil, fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := &Key{ID: kid}
+
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		key.Private, key.Public = k, &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Private, key.Public = k, k.Public()
+	case *rsa.PublicKey, ed25519.PublicKey:
+		key.Public = k
+	default:
+		return nil, fmt.Errorf("unsupported key type %T", parsed)
+	}
+
+	switch pub := key.Public.(type) {
+	case *rsa.PublicKey:
+		if pub.N.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key is %d bits, need at least %d", pub.N.BitLen(), minRSABits)
+		}
+		key.Method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		key.Method = jwt.SigningMethodEdDSA
+	}
+
+	return key, nil
+}
+
+// GenerateEd25519 returns a new, random Ed25519 key with the id kid.
+func GenerateEd25519(kid string) (*Key, error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{ID: kid, Method: jwt.SigningMethodEdDSA, Private: priv, Public: pub}, nil
+}
+
+// SigningKeyID returns the id of the key that signs new tokens.
+func (k *Keyring) SigningKeyID() string {
+	return k.signing.ID
+}
+
+// Sign signs claims with the signing key, and records its id in the kid header.
+func (k *Keyring) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(k.signing.Method, claims)
+	token.Header["kid"] = k.signing.ID
+
+	return token.SignedString(k.signing.Private)
+}
+
+// Keyfunc is a jwt.Keyfunc that picks the verification key named by the kid
+// header of a token, and makes sure the token uses that key's algorithm.
+func (k *Keyring) Keyfunc(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+
+	key, ok := k.keys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown signing key %q", kid)
+	}
+
+	if token.Method.Alg() != key.Method.Alg() {
+		return nil, fmt.Errorf("unexepected signing method: %v", token.Header["alg"])
+	}
+
+	return key.Public, nil
+}
@@ -0,0 +1,179 @@
+package keyring
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// writeKeys writes an RSA key, an Ed25519 key and a verify-only public key to a
+// temporary directory, and returns the directory.
+func writeKeys(t *testing.T) string {
+	dir := t.TempDir()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)})
+
+	edKey, err := GenerateEd25519("unused")
+	if err != nil {
+		t.Fatal(err)
+	}
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey.Private)
+	edPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: edDER})
+
+	oldKey, _ := GenerateEd25519("unused")
+	oldDER, _ := x509.MarshalPKIXPublicKey(oldKey.Public)
+	oldPEM := pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: oldDER})
+
+	files := map[string][]byte{
+		"2023-01-rsa.pem":     rsaPEM,
+		"2023-06-ed25519.pem": edPEM,
+		"2022-12-old.pem":     oldPEM,
+		"README.txt":          []byte("not a key"),
+	}
+
+	for name, contents := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), contents, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestLoad(t *testing.T) {
+	dir := writeKeys(t)
+
+	k, err := Load(dir, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k.SigningKeyID() != "2023-06-ed25519" {
+		t.Errorf("expected the newest private key to sign, got %s", k.SigningKeyID())
+	}
+
+	k, err = Load(dir, "2023-01-rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if k.SigningKeyID() != "2023-01-rsa" {
+		t.Errorf("expected 2023-01-rsa to sign, got %s", k.SigningKeyID())
+	}
+
+	if _, err := Load(dir, "2022-12-old"); err == nil {
+		t.Error("expected an error signing with a public key, got nil")
+	}
+
+	if _, err := Load(t.TempDir(), ""); err == nil {
+		t.Error("expected an error loading an empty directory, got nil")
+	}
+}
+
+func TestKeyring_SignAndVerify(t *testing.T) {
+	dir := writeKeys(t)
+
+	rsaRing, _ := Load(dir, "2023-01-rsa")
+	edRing, _ := Load(dir, "2023-06-ed25519")
+	otherRing := Demo()
+
+	claims := jwt.RegisteredClaims{
+		Subject:   "1",
+		ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Minute)),
+	}
+
+	var tests = []struct {
+		name        string
+		signer      *Keyring
+		expectValid bool
+		expectedAlg string
+	}{
+		{"rsa", rsaRing, true, "RS256"},
+		{"ed25519", edRing, true, "EdDSA"},
+		{"key not on ring", otherRing, false, "EdDSA"},
+	}
+
+	for _, e := range tests {
+		signed, err := e.signer.Sign(claims)
+		if err != nil {
+			t.Fatalf("%s: %s", e.name, err)
+		}
+
+		// both rings hold the same keys, so either may verify
+		token, err := jwt.ParseWithClaims(signed, &jwt.RegisteredClaims{}, rsaRing.Keyfunc)
+
+		if e.expectValid && err != nil {
+			t.Errorf("%s: expected token to verify, got %s", e.name, err)
+		}
+
+		if !e.expectValid && err == nil {
+			t.Errorf("%s: expected token not to verify", e.name)
+		}
+
+		if token != nil && token.Header["alg"] != e.expectedAlg {
+			t.Errorf("%s: expected alg %s, got %v", e.name, e.expectedAlg, token.Header["alg"])
+		}
+	}
+}
+
+func TestKeyring_KeyfuncRejectsAlgorithmSwitch(t *testing.T) {
+	k := Demo()
+
+	// an HMAC token claiming to be signed by the demo key must be rejected
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.RegisteredClaims{Subject: "1"})
+	token.Header["kid"] = DemoKeyID
+	signed, _ := token.SignedString([]byte("secret"))
+
+	if _, err := jwt.Parse(signed, k.Keyfunc); err == nil {
+		t.Error("expected a token with the wrong algorithm to be rejected")
+	}
+}
+
+func TestKeyring_JWKS(t *testing.T) {
+	k, err := Load(writeKeys(t), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := k.JWKS()
+
+	if len(set.Keys) != 3 {
+		t.Fatalf("expected 3 keys, got %d", len(set.Keys))
+	}
+
+	expected := []struct {
+		kid string
+		kty string
+		alg string
+	}{
+		{"2022-12-old", "OKP", "EdDSA"},
+		{"2023-01-rsa", "RSA", "RS256"},
+		{"2023-06-ed25519", "OKP", "EdDSA"},
+	}
+
+	for i, e := range expected {
+		got := set.Keys[i]
+		if got.KeyID != e.kid || got.KeyType != e.kty || got.Algorithm != e.alg || got.Use != "sig" {
+			t.Errorf("key %d: expected %s/%s/%s, got %+v", i, e.kid, e.kty, e.alg, got)
+		}
+	}
+
+	if set.Keys[1].N == "" || set.Keys[1].E != "AQAB" {
+		t.Errorf("expected RSA modulus and exponent, got %+v", set.Keys[1])
+	}
+
+	if set.Keys[0].Curve != "Ed25519" || set.Keys[0].X == "" {
+		t.Errorf("expected Ed25519 public key, got %+v", set.Keys[0])
+	}
+}
@@ -0,0 +1,189 @@
+// Package lockout slows down password guessing. It counts failed login attempts
+// per account and per client IP, and once there are too many, locks the key out
+// for a while, doubling the lockout with every further failure.
+package lockout
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Policy says how many failures a key may have before it is locked out, and for
+// how long.
+type Policy struct {
+	// Threshold is the number of failures allowed before the first lockout.
+	Threshold int
+	// BaseDelay is the first lockout; each further failure doubles it.
+	BaseDelay time.Duration
+	// MaxDelay caps the lockout.
+	MaxDelay time.Duration
+	// Window is how long failures are remembered after the last one.
+	Window time.Duration
+}
+
+// DefaultAccountPolicy locks an account out for a minute after five failures,
+// and for up to an hour after that.
+var DefaultAccountPolicy = Policy{Threshold: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 24 * time.Hour}
+
+// DefaultIPPolicy is more lenient than DefaultAccountPolicy, since many users
+// may share an address.
+var DefaultIPPolicy = Policy{Threshold: 20, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: 24 * time.Hour}
+
+// Record is what a Store keeps for a key.
+type Record struct {
+	Key         string
+	Failures    int
+	LastFailure time.Time
+	LockedUntil time.Time
+}
+
+// delay returns the lockout that follows the nth failure.
+func (p Policy) delay(failures int) time.Duration {
+	if failures < p.Threshold {
+		return 0
+	}
+
+	d := p.BaseDelay
+	for i := p.Threshold; i < failures && d < p.MaxDelay; i++ {
+		d *= 2
+	}
+
+	if d > p.MaxDelay {
+		d = p.MaxDelay
+	}
+
+	return d
+}
+
+// stale reports whether r has been forgotten by now.
+func (p Policy) stale(r Record, now time.Time) bool {
+	return now.Sub(r.LastFailure) > p.Window && !now.Before(r.LockedUntil)
+}
+
+// forgetAt returns when r will be forgotten, unless there are more failures.
+func (p Policy) forgetAt(r Record) time.Time {
+	t := r.LastFailure.Add(p.Window)
+	if r.LockedUntil.After(t) {
+		return r.LockedUntil
+	}
+
+	return t
+}
+
+// Fail returns r updated with a failure at now. Stores use it, so that they all
+// apply a policy the same way.
+func (p Policy) Fail(r Record, now time.Time) Record {
+	if p.stale(r, now) {
+		r.Failures = 0
+	}
+
+	r.Failures++
+	r.LastFailure = now
+	if d := p.delay(r.Failures); d > 0 {
+		r.LockedUntil = now.Add(d)
+	}
+
+	return r
+}
+
+// Store keeps failure records.
+type Store interface {
+	// Get returns the record of key, which is the zero Record, apart from its
+	// key, if there were no failures.
+	Get(ctx context.Context, key string) (Record, error)
+	// Fail atomically records a failure of key under p, and returns the new record.
+	Fail(ctx context.Context, key string, p Policy, now time.Time) (Record, error)
+	// Reset forgets the failures of key.
+	Reset(ctx context.Context, key string) error
+}
+
+// Limiter tracks failed logins per account, by email address, and per client IP.
+type Limiter struct {
+	Store   Store
+	Account Policy
+	IP      Policy
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+}
+
+// New returns a Limiter with the default policies.
+func New(store Store) *Limiter {
+	return &Limiter{Store: store, Account: DefaultAccountPolicy, IP: DefaultIPPolicy, now: time.Now}
+}
+
+// accountKey and ipKey are the store keys of an account and a client IP.
+func accountKey(email string) string {
+	return "account:" + strings.ToLower(strings.TrimSpace(email))
+}
+
+func ipKey(ip string) string {
+	return "ip:" + ip
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+
+	return l.now()
+}
+
+// Check returns how long a client at ip has to wait before it may try to log
+// in as email again; it is 0 if it may try now.
+func (l *Limiter) Check(ctx context.Context, email, ip string) (time.Duration, error) {
+	now := l.clock()
+
+	var wait time.Duration
+	for _, key := range []string{accountKey(email), ipKey(ip)} {
+		r, err := l.Store.Get(ctx, key)
+		if err != nil {
+			return 0, err
+		}
+
+		if d := r.LockedUntil.Sub(now); d > wait {
+			wait = d
+		}
+	}
+
+	return wait, nil
+}
+
+// Fail records a failed login as email from ip, and returns how long the client
+// has to wait before trying again.
+func (l *Limiter) Fail(ctx context.Context, email, ip string) (time.Duration, error) {
+	now := l.clock()
+
+	account, err := l.Store.Fail(ctx, accountKey(email), l.Account, now)
+	if err != nil {
+		return 0, err
+	}
+
+	client, err := l.Store.Fail(ctx, ipKey(ip), l.IP, now)
+	if err != nil {
+		return 0, err
+	}
+
+	wait := account.LockedUntil.Sub(now)
+	if d := client.LockedUntil.Sub(now); d > wait {
+		wait = d
+	}
+
+	if wait < 0 {
+		wait = 0
+	}
+
+	return wait, nil
+}
+
+// Succeed forgets the failures of an account after it logs in. Failures of the
+// IP are kept, so that one good password doesn't hide guessing at others.
+func (l *Limiter) Succeed(ctx context.Context, email string) error {
+	return l.Store.Reset(ctx, accountKey(email))
+}
+
+// Unlock lifts the lockout of an account, and forgets its failures.
+func (l *Limiter) Unlock(ctx context.Context, email string) error {
+	return l.Store.Reset(ctx, accountKey(email))
+}
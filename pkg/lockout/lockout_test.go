@@ -0,0 +1,135 @@
+package lockout
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPolicy_delay(t *testing.T) {
+	p := Policy{Threshold: 3, BaseDelay: time.Minute, MaxDelay: 10 * time.Minute}
+
+	var tests = []struct {
+		failures int
+		expected time.Duration
+	}{
+		{1, 0},
+		{2, 0},
+		{3, time.Minute},
+		{4, 2 * time.Minute},
+		{5, 4 * time.Minute},
+		{6, 8 * time.Minute},
+		{7, 10 * time.Minute},
+		{100, 10 * time.Minute},
+	}
+
+	for _, e := range tests {
+		if d := p.delay(e.failures); d != e.expected {
+			t.Errorf("%d failures: expected %s, got %s", e.failures, e.expected, d)
+		}
+	}
+}
+
+func TestPolicy_forgetAt(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	p := Policy{Window: time.Hour}
+
+	var tests = []struct {
+		name     string
+		r        Record
+		expected time.Time
+	}{
+		{"not locked", Record{LastFailure: now}, now.Add(time.Hour)},
+		{"locked within the window", Record{LastFailure: now, LockedUntil: now.Add(time.Minute)}, now.Add(time.Hour)},
+		{"locked past the window", Record{LastFailure: now, LockedUntil: now.Add(2 * time.Hour)}, now.Add(2 * time.Hour)},
+	}
+
+	for _, e := range tests {
+		if at := p.forgetAt(e.r); !at.Equal(e.expected) {
+			t.Errorf("%s: expected %s, got %s", e.name, e.expected, at)
+		}
+
+		if p.stale(e.r, e.expected.Add(-time.Second)) || !p.stale(e.r, e.expected.Add(time.Second)) {
+			t.Errorf("%s: expected the record to go stale at %s", e.name, e.expected)
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	l := New(NewMemoryStore())
+	l.Account = Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	l.IP = Policy{Threshold: 4, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	l.now = func() time.Time { return now }
+
+	if wait, _ := l.Fail(ctx, "jack@example.com", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected no lockout after one failure, got %s", wait)
+	}
+
+	if wait, _ := l.Fail(ctx, "Jack@Example.com", "10.0.0.1"); wait != time.Minute {
+		t.Errorf("expected a minute's lockout after two failures, got %s", wait)
+	}
+
+	if wait, _ := l.Check(ctx, "jack@example.com", "10.0.0.2"); wait != time.Minute {
+		t.Errorf("expected the account to be locked from any address, got %s", wait)
+	}
+
+	if wait, _ := l.Check(ctx, "jill@example.com", "10.0.0.1"); wait != 0 {
+		t.Errorf("expected other accounts to be open, got %s", wait)
+	}
+
+	// the address is locked out after guessing at several accounts
+	l.Fail(ctx, "jill@example.com", "10.0.0.1")
+	l.Fail(ctx, "john@example.com", "10.0.0.1")
+
+	if wait, _ := l.Check(ctx, "admin@example.com", "10.0.0.1"); wait != time.Minute {
+		t.Errorf("expected the address to be locked, got %s", wait)
+	}
+
+	now = now.Add(time.Minute)
+
+	if wait, _ := l.Check(ctx, "jack@example.com", "10.0.0.2"); wait != 0 {
+		t.Errorf("expected the lockout to be over, got %s", wait)
+	}
+
+	if wait, _ := l.Fail(ctx, "jack@example.com", "10.0.0.2"); wait != 2*time.Minute {
+		t.Errorf("expected the lockout to double, got %s", wait)
+	}
+
+	if err := l.Unlock(ctx, "jack@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	if wait, _ := l.Check(ctx, "jack@example.com", "10.0.0.2"); wait != 0 {
+		t.Errorf("expected the account to be unlocked, got %s", wait)
+	}
+
+	// failures are forgotten after the window
+	l.Fail(ctx, "jill@example.com", "10.0.0.3")
+	now = now.Add(2 * time.Hour)
+
+	if wait, _ := l.Fail(ctx, "jill@example.com", "10.0.0.3"); wait != 0 {
+		t.Errorf("expected old failures to be forgotten, got %s", wait)
+	}
+}
+
+func TestMemoryStore_sweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	p := Policy{Threshold: 5, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+
+	s := NewMemoryStore()
+	s.Fail(ctx, "old", p, now.Add(-2*time.Hour))
+	s.Fail(ctx, "new", p, now)
+	s.sweep(now)
+
+	if r, _ := s.Get(ctx, "old"); r.Failures != 0 {
+		t.Errorf("expected the old record to be swept, got %+v", r)
+	}
+
+	if r, _ := s.Get(ctx, "new"); r.Failures != 1 {
+		t.Errorf("expected the new record to be kept, got %+v", r)
+	}
+}
@@ -0,0 +1,94 @@
+package lockout
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many failures a store records between sweeps of forgotten
+// records.
+const sweepEvery = 1000
+
+// MemoryStore keeps records in memory. It suits a single instance; use
+// PostgresStore when several share the load.
+type MemoryStore struct {
+	mu      sync.Mutex
+	records map[string]Record
+	windows map[string]Policy
+	fails   int
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{records: map[string]Record{}, windows: map[string]Policy{}}
+}
+
+// Get returns the record of key.
+func (s *MemoryStore) Get(ctx context.Context, key string) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		return Record{Key: key}, nil
+	}
+
+	return r, nil
+}
+
+// Fail records a failure of key.
+func (s *MemoryStore) Fail(ctx context.Context, key string, p Policy, now time.Time) (Record, error) {
+	if err := ctx.Err(); err != nil {
+		return Record{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	r, ok := s.records[key]
+	if !ok {
+		r = Record{Key: key}
+	}
+
+	r = p.Fail(r, now)
+	s.records[key] = r
+	s.windows[key] = p
+
+	s.fails++
+	if s.fails%sweepEvery == 0 {
+		s.sweep(now)
+	}
+
+	return r, nil
+}
+
+// sweep drops the records that have been forgotten, so that guesses at many
+// accounts don't grow the store without bound.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, r := range s.records {
+		if s.windows[key].stale(r, now) {
+			delete(s.records, key)
+			delete(s.windows, key)
+		}
+	}
+}
+
+// Reset forgets the failures of key.
+func (s *MemoryStore) Reset(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.records, key)
+	delete(s.windows, key)
+
+	return nil
+}
@@ -0,0 +1,101 @@
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+// dbTimeout bounds every query of PostgresStore.
+const dbTimeout = 3 * time.Second
+
+// PostgresStore keeps records in the login_attempts table, so that every
+// instance of the app sees the same failures.
+type PostgresStore struct {
+	DB *sql.DB
+
+	fails atomic.Int64
+}
+
+// Get returns the record of key.
+func (s *PostgresStore) Get(ctx context.Context, key string) (Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select failures, last_failure_at, locked_until from login_attempts where key = $1`
+
+	r := Record{Key: key}
+	var lockedUntil sql.NullTime
+
+	err := s.DB.QueryRowContext(ctx, query, key).Scan(&r.Failures, &r.LastFailure, &lockedUntil)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r, nil
+	}
+	if err != nil {
+		return Record{}, err
+	}
+
+	r.LockedUntil = lockedUntil.Time
+
+	return r, nil
+}
+
+// Fail records a failure of key. The row is locked while the new record is
+// worked out, so that concurrent failures are all counted.
+func (s *PostgresStore) Fail(ctx context.Context, key string, p Policy, now time.Time) (Record, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// the columns have no time zone, so every time is stored in UTC
+	now = now.UTC()
+
+	if s.fails.Add(1)%sweepEvery == 0 {
+		if _, err := s.DB.ExecContext(ctx, `delete from login_attempts where forget_at < $1`, now); err != nil {
+			return Record{}, err
+		}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Record{}, err
+	}
+	defer tx.Rollback()
+
+	stmt := `insert into login_attempts (key, failures, last_failure_at, forget_at) values ($1, 0, $2, $2) on conflict (key) do nothing`
+	if _, err := tx.ExecContext(ctx, stmt, key, now); err != nil {
+		return Record{}, err
+	}
+
+	query := `select failures, last_failure_at, locked_until from login_attempts where key = $1 for update`
+
+	r := Record{Key: key}
+	var lockedUntil sql.NullTime
+
+	if err := tx.QueryRowContext(ctx, query, key).Scan(&r.Failures, &r.LastFailure, &lockedUntil); err != nil {
+		return Record{}, err
+	}
+	r.LockedUntil = lockedUntil.Time
+
+	r = p.Fail(r, now)
+
+	stmt = `update login_attempts set failures = $1, last_failure_at = $2, locked_until = $3, forget_at = $4 where key = $5`
+	lockedUntil = sql.NullTime{Time: r.LockedUntil, Valid: !r.LockedUntil.IsZero()}
+	_, err = tx.ExecContext(ctx, stmt, r.Failures, r.LastFailure, lockedUntil, p.forgetAt(r), key)
+	if err != nil {
+		return Record{}, err
+	}
+
+	return r, tx.Commit()
+}
+
+// Reset forgets the failures of key.
+func (s *PostgresStore) Reset(ctx context.Context, key string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `delete from login_attempts where key = $1`, key)
+
+	return err
+}
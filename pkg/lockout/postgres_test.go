@@ -0,0 +1,77 @@
+//go:build integration
+
+package lockout
+
+import (
+	"context"
+	"database/sql"
+	"github.com/calvarado2004/go-testing-webapp/pkg/internal/pgtest"
+	"testing"
+	"time"
+)
+
+var testDB *sql.DB
+
+// TestMain runs the tests against Postgres in a container
+func TestMain(m *testing.M) {
+	pgtest.Main(m, func(db *sql.DB) { testDB = db })
+}
+
+// TestLockoutPostgresStore checks the login lockout store against the
+// login_attempts table
+func TestLockoutPostgresStore(t *testing.T) {
+	ctx := context.Background()
+	store := &PostgresStore{DB: testDB}
+	p := Policy{Threshold: 2, BaseDelay: time.Minute, MaxDelay: time.Hour, Window: time.Hour}
+	// a zone other than UTC, as the stored times have none
+	now := time.Now().In(time.FixedZone("UTC-8", -8*60*60)).Truncate(time.Second)
+
+	r, err := store.Get(ctx, "account:jack@example.com")
+	if err != nil || r.Failures != 0 {
+		t.Fatalf("expected no failures, got %+v, %v", r, err)
+	}
+
+	if _, err := store.Fail(ctx, "account:jack@example.com", p, now); err != nil {
+		t.Fatalf("fail failed: %s", err)
+	}
+
+	r, err = store.Fail(ctx, "account:jack@example.com", p, now)
+	if err != nil {
+		t.Fatalf("fail failed: %s", err)
+	}
+
+	if r.Failures != 2 || !r.LockedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected two failures and a minute's lockout, got %+v", r)
+	}
+
+	r, _ = store.Get(ctx, "account:jack@example.com")
+	if r.Failures != 2 || !r.LockedUntil.Equal(now.Add(time.Minute)) {
+		t.Errorf("expected the record to be stored, got %+v", r)
+	}
+
+	if err := store.Reset(ctx, "account:jack@example.com"); err != nil {
+		t.Fatalf("reset failed: %s", err)
+	}
+
+	if r, _ := store.Get(ctx, "account:jack@example.com"); r.Failures != 0 {
+		t.Errorf("expected the record to be gone, got %+v", r)
+	}
+
+	// the next failure after these sweeps forgotten records
+	if _, err := store.Fail(ctx, "account:old@example.com", p, now.Add(-2*time.Hour)); err != nil {
+		t.Fatalf("fail failed: %s", err)
+	}
+	store.fails.Store(sweepEvery - 1)
+
+	if _, err := store.Fail(ctx, "account:new@example.com", p, now); err != nil {
+		t.Fatalf("fail failed: %s", err)
+	}
+
+	if r, _ := store.Get(ctx, "account:old@example.com"); r.Failures != 0 {
+		t.Errorf("expected the old record to be swept, got %+v", r)
+	}
+
+	if r, _ := store.Get(ctx, "account:new@example.com"); r.Failures != 1 {
+		t.Errorf("expected the new record to be kept, got %+v", r)
+	}
+}
@@ -0,0 +1,136 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	var buf bytes.Buffer
+	logger := New(&buf, slog.LevelInfo)
+
+	logger.DebugContext(context.Background(), "hidden")
+	logger.InfoContext(WithRequestID(context.Background(), "abc"), "shown", "user_id", 3)
+
+	if strings.Contains(buf.String(), "hidden") {
+		t.Error("expected debug records to be dropped")
+	}
+
+	var record map[string]any
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("expected one JSON record, got %q: %s", buf.String(), err)
+	}
+
+	if record["msg"] != "shown" || record["request_id"] != "abc" || record["user_id"] != float64(3) {
+		t.Errorf("unexpected record %v", record)
+	}
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var tests = []struct {
+		name     string
+		header   string
+		expectID string
+	}{
+		{"none", "", ""},
+		{"from proxy", "proxy-id_1.2", "proxy-id_1.2"},
+		{"unsafe", "bad id\n", ""},
+		{"too long", strings.Repeat("a", 65), ""},
+	}
+
+	for _, e := range tests {
+		var seen string
+		handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			seen = RequestID(r.Context())
+		}))
+
+		req, _ := http.NewRequest("GET", "/", nil)
+		if e.header != "" {
+			req.Header.Set(RequestIDHeader, e.header)
+		}
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		if seen == "" || rr.Header().Get(RequestIDHeader) != seen {
+			t.Errorf("%s: expected the id %q in the context to be sent back, got %q", e.name, seen, rr.Header().Get(RequestIDHeader))
+		}
+
+		if e.expectID != "" && seen != e.expectID {
+			t.Errorf("%s: expected id %q, got %q", e.name, e.expectID, seen)
+		}
+
+		if e.expectID == "" && seen == e.header {
+			t.Errorf("%s: expected a new id, got %q", e.name, seen)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var tests = []struct {
+		name         string
+		userID       int
+		ip           string
+		status       int
+		expectUserID any
+		expectIP     string
+	}{
+		{"anonymous", 0, "", 0, nil, "192.0.2.1"},
+		{"signed in", 7, "203.0.113.9", http.StatusNotFound, float64(7), "203.0.113.9"},
+	}
+
+	for _, e := range tests {
+		var buf bytes.Buffer
+
+		handler := RequestIDMiddleware(AccessLog(New(&buf, slog.LevelInfo))(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if e.userID != 0 {
+				SetUserID(r.Context(), e.userID)
+			}
+			if e.ip != "" {
+				SetIP(r.Context(), e.ip)
+			}
+			if e.status != 0 {
+				w.WriteHeader(e.status)
+			}
+			_, _ = w.Write([]byte("hello"))
+		})))
+
+		req, _ := http.NewRequest("POST", "/path?q=1", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		var record map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Fatalf("%s: expected one JSON record, got %q: %s", e.name, buf.String(), err)
+		}
+
+		expectStatus := e.status
+		if expectStatus == 0 {
+			expectStatus = http.StatusOK
+		}
+
+		if record["method"] != "POST" || record["path"] != "/path" || record["status"] != float64(expectStatus) || record["bytes"] != float64(5) {
+			t.Errorf("%s: unexpected record %v", e.name, record)
+		}
+
+		if record["ip"] != e.expectIP || record["user_id"] != e.expectUserID {
+			t.Errorf("%s: expected ip %v and user %v, got %v", e.name, e.expectIP, e.expectUserID, record)
+		}
+
+		if record["request_id"] != rr.Header().Get(RequestIDHeader) {
+			t.Errorf("%s: expected the request id in the log line, got %v", e.name, record)
+		}
+
+		if _, ok := record["latency"]; !ok {
+			t.Errorf("%s: expected the latency to be logged", e.name)
+		}
+	}
+}
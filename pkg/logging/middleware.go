@@ -0,0 +1,116 @@
+package logging
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// RequestIDHeader is the header that carries request ids, both ways.
+const RequestIDHeader = "X-Request-ID"
+
+// maxRequestIDLength bounds the ids accepted from clients and proxies.
+const maxRequestIDLength = 64
+
+// RequestIDMiddleware gives every request an id, stored in its context and sent
+// back in the X-Request-ID header. An id set by a proxy in the same header is
+// kept, as long as it looks like one.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(RequestIDHeader)
+		if !validRequestID(id) {
+			id = NewRequestID()
+		}
+
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// validRequestID reports whether id is short, and only made of letters, digits
+// and a little punctuation, so that it is safe to log.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+const accessEntryKey contextKey = "access_entry"
+
+// accessEntry collects what handlers further down know about a request, for
+// its access log line.
+type accessEntry struct {
+	userID int
+	ip     string
+}
+
+// SetUserID records the signed in user in the access log line of the request
+// ctx belongs to.
+func SetUserID(ctx context.Context, id int) {
+	if e, ok := ctx.Value(accessEntryKey).(*accessEntry); ok {
+		e.userID = id
+	}
+}
+
+// SetIP records the client address in the access log line of the request ctx
+// belongs to. Without it, the address the request came from is logged.
+func SetIP(ctx context.Context, ip string) {
+	if e, ok := ctx.Value(accessEntryKey).(*accessEntry); ok {
+		e.ip = ip
+	}
+}
+
+// AccessLog logs a line for every request once it has been served, with its
+// method, path, status, size and latency, and the user and address set with
+// SetUserID and SetIP. It should run after RequestIDMiddleware.
+func AccessLog(logger *slog.Logger) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+
+			entry := &accessEntry{}
+			entry.ip, _, _ = net.SplitHostPort(r.RemoteAddr)
+
+			ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+			ctx := context.WithValue(r.Context(), accessEntryKey, entry)
+
+			defer func() {
+				status := ww.Status()
+				if status == 0 {
+					status = http.StatusOK
+				}
+
+				attrs := []slog.Attr{
+					slog.String("method", r.Method),
+					slog.String("path", r.URL.Path),
+					slog.Int("status", status),
+					slog.Int("bytes", ww.BytesWritten()),
+					slog.Duration("latency", time.Since(start)),
+					slog.String("ip", entry.ip),
+				}
+				if entry.userID != 0 {
+					attrs = append(attrs, slog.Int("user_id", entry.userID))
+				}
+
+				logger.LogAttrs(ctx, slog.LevelInfo, "request", attrs...)
+			}()
+
+			next.ServeHTTP(ww, r.WithContext(ctx))
+		})
+	}
+}
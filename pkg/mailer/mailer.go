@@ -0,0 +1,83 @@
+// Package mailer delivers the emails the application sends, such as password
+// reset links. Delivery is behind the Mailer interface, so that development and
+// tests can log or save messages instead of talking to a mail server.
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Message is a plain text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// String formats the message the way it would appear on the wire.
+func (m Message) String() string {
+	return fmt.Sprintf("To: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.To, m.Subject, m.Body)
+}
+
+// Mailer sends messages.
+type Mailer interface {
+	Send(ctx context.Context, msg Message) error
+}
+
+// LogMailer writes every message to Out instead of sending it.
+type LogMailer struct {
+	Out io.Writer
+
+	mu sync.Mutex
+}
+
+// Send writes msg to Out, or to stderr if Out is nil.
+func (m *LogMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	out := m.Out
+	if out == nil {
+		out = os.Stderr
+	}
+
+	_, err := fmt.Fprintf(out, "---- mail ----\n%s---- end mail ----\n", msg)
+
+	return err
+}
+
+// FileMailer saves every message as a .eml file in Dir.
+type FileMailer struct {
+	Dir string
+
+	mu  sync.Mutex
+	seq int
+}
+
+// Send writes msg to a new file in Dir. File names sort in the order the messages
+// were sent.
+func (m *FileMailer) Send(ctx context.Context, msg Message) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.seq++
+	recipient := strings.NewReplacer("@", "_at_", "/", "_", "\\", "_").Replace(msg.To)
+	name := fmt.Sprintf("%s-%04d-%s.eml", time.Now().UTC().Format("20060102T150405"), m.seq, recipient)
+
+	return os.WriteFile(filepath.Join(m.Dir, name), []byte(msg.String()), 0600)
+}
@@ -0,0 +1,55 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogMailer_Send(t *testing.T) {
+	var out bytes.Buffer
+	m := &LogMailer{Out: &out}
+
+	err := m.Send(context.Background(), Message{To: "jack@example.com", Subject: "Hello", Body: "a link"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, expected := range []string{"To: jack@example.com", "Subject: Hello", "a link"} {
+		if !strings.Contains(out.String(), expected) {
+			t.Errorf("expected %q in %q", expected, out.String())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if err := m.Send(ctx, Message{}); err == nil {
+		t.Error("expected an error with a cancelled context, got nil")
+	}
+}
+
+func TestFileMailer_Send(t *testing.T) {
+	dir := t.TempDir()
+	m := &FileMailer{Dir: dir}
+
+	for _, subject := range []string{"first", "second"} {
+		if err := m.Send(context.Background(), Message{To: "jill@example.com", Subject: subject}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if len(files) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(files))
+	}
+
+	// glob sorts, and the names sort in the order the messages were sent
+	last, _ := os.ReadFile(files[1])
+	if !strings.Contains(string(last), "Subject: second") || !strings.Contains(files[1], "jill_at_example.com") {
+		t.Errorf("unexpected last message %s: %s", files[1], last)
+	}
+}
@@ -0,0 +1,140 @@
+// Package metrics collects the Prometheus metrics of the web app and the API:
+// HTTP requests per route, the database connection pool, logins, tokens and
+// uploads.
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// The results of a login attempt, see AuthAttempt.
+const (
+	AuthSuccess = "success"
+	AuthFailure = "failure"
+	AuthLocked  = "locked"
+)
+
+// The ways a token pair is handed out, see TokenIssued.
+const (
+	TokenLogin   = "login"
+	TokenRefresh = "refresh"
+)
+
+// unmatchedRoute labels requests that matched no route, so that scanners
+// probing random paths don't create a series per path.
+const unmatchedRoute = "unmatched"
+
+// Metrics holds the collectors of one server, in a registry of its own.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests    *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	auth        *prometheus.CounterVec
+	tokens      *prometheus.CounterVec
+	uploadBytes prometheus.Counter
+}
+
+// New returns the metrics of a server, named with namespace, e.g. web or api.
+// The stats of the db connection pool are included unless db is nil.
+func New(namespace string, db *sql.DB) *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "http_requests_total",
+			Help:      "HTTP requests served, by method, route pattern and status code.",
+		}, []string{"method", "route", "status"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by method and route pattern.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route"}),
+		auth: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "auth_attempts_total",
+			Help:      "Login attempts, by result: success, failure or locked.",
+		}, []string{"result"}),
+		tokens: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "tokens_issued_total",
+			Help:      "Token pairs issued, by grant: login or refresh.",
+		}, []string{"grant"}),
+		uploadBytes: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "upload_bytes_total",
+			Help:      "Bytes of uploaded files that were accepted.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.duration, m.auth, m.tokens, m.uploadBytes,
+	)
+
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "users"))
+	}
+
+	return m
+}
+
+// Handler serves the metrics in the Prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Middleware counts and times requests by the chi route pattern they matched,
+// so that /users/1 and /users/2 are both counted as /users/{userID}.
+func (m *Metrics) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r)
+
+		route := unmatchedRoute
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && len(rctx.RoutePatterns) > 0 {
+			// chi trims trailing slashes from patterns, the root's included
+			route = rctx.RoutePattern()
+			if route == "" {
+				route = "/"
+			}
+		}
+
+		status := ww.Status()
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		m.requests.WithLabelValues(r.Method, route, strconv.Itoa(status)).Inc()
+		m.duration.WithLabelValues(r.Method, route).Observe(time.Since(start).Seconds())
+	})
+}
+
+// AuthAttempt counts a login attempt with result AuthSuccess, AuthFailure or
+// AuthLocked.
+func (m *Metrics) AuthAttempt(result string) {
+	m.auth.WithLabelValues(result).Inc()
+}
+
+// TokenIssued counts a token pair handed out for grant TokenLogin or TokenRefresh.
+func (m *Metrics) TokenIssued(grant string) {
+	m.tokens.WithLabelValues(grant).Inc()
+}
+
+// Uploaded counts n bytes of accepted uploads.
+func (m *Metrics) Uploaded(n int64) {
+	m.uploadBytes.Add(float64(n))
+}
@@ -0,0 +1,103 @@
+package metrics
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+	_ "github.com/jackc/pgx/v4/stdlib"
+)
+
+// scrape returns what Prometheus would see at the metrics endpoint.
+func scrape(t *testing.T, m *Metrics) string {
+	t.Helper()
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected status 200 scraping metrics, got %d", rr.Code)
+	}
+
+	return rr.Body.String()
+}
+
+func TestMiddleware(t *testing.T) {
+	m := New("test", nil)
+
+	mux := chi.NewRouter()
+	mux.Use(m.Middleware)
+	mux.Get("/", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Get("/users/{userID}", func(w http.ResponseWriter, r *http.Request) {})
+	mux.Route("/admin", func(mux chi.Router) {
+		mux.Post("/", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusForbidden)
+		})
+	})
+
+	for _, path := range []string{"/", "/users/1", "/users/2", "/nope"} {
+		req, _ := http.NewRequest("GET", path, nil)
+		mux.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	req, _ := http.NewRequest("POST", "/admin/", nil)
+	mux.ServeHTTP(httptest.NewRecorder(), req)
+
+	body := scrape(t, m)
+
+	for _, expected := range []string{
+		`test_http_requests_total{method="GET",route="/users/{userID}",status="200"} 2`,
+		`test_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		`test_http_requests_total{method="GET",route="/",status="200"} 1`,
+		`test_http_requests_total{method="POST",route="/admin",status="403"} 1`,
+		`test_http_request_duration_seconds_count{method="GET",route="/users/{userID}"} 2`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s in the metrics", expected)
+		}
+	}
+
+	if strings.Contains(body, "/users/1") {
+		t.Error("expected requests to be counted by route pattern, not path")
+	}
+}
+
+func TestCounters(t *testing.T) {
+	db, err := sql.Open("pgx", "host=localhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	m := New("test", db)
+
+	m.AuthAttempt(AuthSuccess)
+	m.AuthAttempt(AuthFailure)
+	m.AuthAttempt(AuthFailure)
+	m.AuthAttempt(AuthLocked)
+	m.TokenIssued(TokenLogin)
+	m.TokenIssued(TokenRefresh)
+	m.Uploaded(1000)
+	m.Uploaded(24)
+
+	body := scrape(t, m)
+
+	for _, expected := range []string{
+		`test_auth_attempts_total{result="success"} 1`,
+		`test_auth_attempts_total{result="failure"} 2`,
+		`test_auth_attempts_total{result="locked"} 1`,
+		`test_tokens_issued_total{grant="login"} 1`,
+		`test_tokens_issued_total{grant="refresh"} 1`,
+		`test_upload_bytes_total 1024`,
+		`go_sql_open_connections{db_name="users"} 0`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("expected %s in the metrics", expected)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"time"
+)
+
+// Store is the part of the user database that CheckSecondFactor needs.
+type Store interface {
+	GetTOTP(ctx context.Context, userID int) (*data.TOTP, error)
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
+	UseRecoveryCode(ctx context.Context, userID int, hash string) error
+}
+
+// CheckSecondFactor reports whether code is either a current TOTP code of the
+// user, or one of their unused recovery codes. Either kind is spent: a TOTP code
+// is turned away once the user has logged in with it, or with a later one, so
+// that a code seen over their shoulder can't be used while it is still current.
+func CheckSecondFactor(ctx context.Context, store Store, userID int, code string) (bool, error) {
+	if IsTOTPCode(code) {
+		t, err := store.GetTOTP(ctx, userID)
+		if err != nil {
+			return false, err
+		}
+		if !t.Enabled() {
+			return false, nil
+		}
+
+		step, ok := StepAt(code, t.Secret, time.Now())
+		if !ok {
+			return false, nil
+		}
+
+		err = store.UseTOTPStep(ctx, userID, step)
+		if errors.Is(err, dbrepo.ErrTokenReused) {
+			return false, nil
+		}
+
+		return err == nil, err
+	}
+
+	err := store.UseRecoveryCode(ctx, userID, data.HashToken(NormalizeRecoveryCode(code)))
+	if errors.Is(err, dbrepo.ErrTokenNotFound) {
+		return false, nil
+	}
+
+	return err == nil, err
+}
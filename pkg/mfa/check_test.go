@@ -0,0 +1,46 @@
+package mfa
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestCheckSecondFactor(t *testing.T) {
+	ctx := context.Background()
+	store := &dbrepo.TestDBRepo{}
+
+	code, err := totp.GenerateCode(dbrepo.TestTOTPSecret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// mfa@example.com is enrolled, admin@example.com is not
+	var tests = []struct {
+		name     string
+		userID   int
+		code     string
+		expected bool
+	}{
+		{"totp code", 6, code, true},
+		{"replayed totp code", 6, code, false},
+		{"totp code of a user who isn't enrolled", 1, code, false},
+		{"recovery code", 6, dbrepo.TestRecoveryCode, true},
+		{"spent recovery code", 6, dbrepo.TestRecoveryCode, false},
+		{"unknown recovery code", 6, "zzzzz-zzzzz", false},
+	}
+
+	for _, e := range tests {
+		ok, err := CheckSecondFactor(ctx, store, e.userID, e.code)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+		}
+
+		if ok != e.expected {
+			t.Errorf("%s: expected %v, got %v", e.name, e.expected, ok)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package mfa
+
+import (
+	"context"
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+)
+
+// EnrollmentStore is the part of the user database that PendingKey needs.
+type EnrollmentStore interface {
+	GetTOTP(ctx context.Context, userID int) (*data.TOTP, error)
+	SetTOTPSecret(ctx context.Context, userID int, secret string) error
+}
+
+// PendingKey returns the key of the secret the user is enrolling with, and
+// stores a new one if they have none yet. Showing the key again doesn't replace
+// it, so an authenticator app that holds it already keeps working. Users who are
+// enrolled get dbrepo.ErrTOTPEnabled.
+func PendingKey(ctx context.Context, store EnrollmentStore, userID int, account string) (*Key, error) {
+	t, err := store.GetTOTP(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	if t.Enabled() {
+		return nil, dbrepo.ErrTOTPEnabled
+	}
+	if t.Secret != "" {
+		return KeyFor(account, t.Secret)
+	}
+
+	key, err := Generate(account)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := store.SetTOTPSecret(ctx, userID, key.Secret); err != nil {
+		return nil, err
+	}
+
+	return key, nil
+}
@@ -0,0 +1,61 @@
+package mfa
+
+import (
+	"context"
+	"errors"
+	"github.com/calvarado2004/go-testing-webapp/pkg/repository/dbrepo"
+	"testing"
+)
+
+func TestPendingKey(t *testing.T) {
+	ctx := context.Background()
+	store := &dbrepo.TestDBRepo{}
+
+	first, err := PendingKey(ctx, store, 1, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// showing the key again, as a reload does, keeps the secret
+	again, err := PendingKey(ctx, store, 1, "admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if again.Secret != first.Secret || again.URI != first.URI {
+		t.Errorf("expected the pending key %+v, got %+v", first, again)
+	}
+
+	if _, err := again.QRCode(100); err != nil {
+		t.Errorf("expected the pending key to render, got %s", err)
+	}
+
+	if tt, _ := store.GetTOTP(ctx, 1); tt.Secret != first.Secret {
+		t.Errorf("expected the secret %s to be stored, got %s", first.Secret, tt.Secret)
+	}
+
+	// mfa@example.com is enrolled already
+	if _, err := PendingKey(ctx, store, 6, "mfa@example.com"); !errors.Is(err, dbrepo.ErrTOTPEnabled) {
+		t.Errorf("expected ErrTOTPEnabled, got %v", err)
+	}
+}
+
+func TestKeyFor(t *testing.T) {
+	generated, err := Generate("jack@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	key, err := KeyFor("jack@example.com", generated.Secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if key.Secret != generated.Secret || key.URI != generated.URI {
+		t.Errorf("expected %+v, got %+v", generated, key)
+	}
+
+	if _, err := KeyFor("jack@example.com", "not base32!"); err == nil {
+		t.Error("expected an error for a malformed secret")
+	}
+}
@@ -0,0 +1,167 @@
+// Package mfa implements the second login factor: RFC 6238 time-based one-time
+// passwords (TOTP), as produced by authenticator apps, and the single-use
+// recovery codes a user can fall back on when they lose their device.
+package mfa
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"image/png"
+	"strings"
+	"time"
+
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+)
+
+// Issuer names the application in authenticator apps.
+const Issuer = "Go Testing Webapp"
+
+// RecoveryCodeCount is how many recovery codes a user gets when enrolling.
+const RecoveryCodeCount = 10
+
+// Key is a newly generated TOTP secret, and the otpauth:// URI that carries it
+// to an authenticator app.
+type Key struct {
+	Secret string
+	URI    string
+
+	key *otp.Key
+}
+
+// Generate returns a new random TOTP secret for account, usually an email address.
+func Generate(account string) (*Key, error) {
+	return newKey(account, nil)
+}
+
+// KeyFor returns the Key of an existing secret of account, as Generate returned
+// it, so that it can be shown again.
+func KeyFor(account, secret string) (*Key, error) {
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return newKey(account, raw)
+}
+
+// newKey returns the Key of account with the raw secret, or with a random one
+// if secret is nil.
+func newKey(account string, secret []byte) (*Key, error) {
+	key, err := totp.Generate(totp.GenerateOpts{
+		Issuer:      Issuer,
+		AccountName: account,
+		Secret:      secret,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &Key{Secret: key.Secret(), URI: key.URL(), key: key}, nil
+}
+
+// QRCode renders the key's URI as a PNG QR code, size pixels square.
+func (k *Key) QRCode(size int) ([]byte, error) {
+	img, err := k.key.Image(size, size)
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Validate reports whether code is the current TOTP code for secret. Codes from
+// the previous and next 30 second steps are accepted too, to allow for clock drift.
+func Validate(code, secret string) bool {
+	return ValidateAt(code, secret, time.Now())
+}
+
+// ValidateAt is Validate at time t.
+func ValidateAt(code, secret string, t time.Time) bool {
+	_, ok := StepAt(code, secret, t)
+
+	return ok
+}
+
+// period is the length of a TOTP time step, in seconds.
+const period = 30
+
+// StepAt returns the time step that code is the TOTP code of, trying the steps
+// before and after the one of t too, like ValidateAt. Steps count periods since
+// the Unix epoch, so a later code always has a later step.
+func StepAt(code, secret string, t time.Time) (int64, bool) {
+	code = strings.TrimSpace(code)
+
+	for skew := 1; skew >= -1; skew-- {
+		at := t.Add(time.Duration(skew*period) * time.Second)
+
+		expected, err := totp.GenerateCodeCustom(secret, at, totp.ValidateOpts{
+			Period:    period,
+			Digits:    otp.DigitsSix,
+			Algorithm: otp.AlgorithmSHA1,
+		})
+		if err != nil {
+			return 0, false
+		}
+
+		if subtle.ConstantTimeCompare([]byte(code), []byte(expected)) == 1 {
+			return at.Unix() / period, true
+		}
+	}
+
+	return 0, false
+}
+
+// IsTOTPCode reports whether code looks like a TOTP code rather than a recovery code.
+func IsTOTPCode(code string) bool {
+	code = strings.TrimSpace(code)
+	if len(code) != 6 {
+		return false
+	}
+
+	for _, c := range code {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// recoveryEncoding spells recovery codes in lower case, without padding.
+var recoveryEncoding = base32.NewEncoding("abcdefghijklmnopqrstuvwxyz234567").WithPadding(base32.NoPadding)
+
+// NewRecoveryCodes returns n random recovery codes, formatted as xxxxx-xxxxx.
+func NewRecoveryCodes(n int) ([]string, error) {
+	codes := make([]string, n)
+
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+
+		code := recoveryEncoding.EncodeToString(b)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+// NormalizeRecoveryCode puts a recovery code, as typed by a user, in the form it
+// is hashed in: lower case, without spaces or dashes.
+func NormalizeRecoveryCode(code string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '-' || r == ' ' {
+			return -1
+		}
+		return r
+	}, strings.ToLower(code))
+}
@@ -0,0 +1,125 @@
+package mfa
+
+import (
+	"bytes"
+	"image/png"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pquerna/otp/totp"
+)
+
+func TestGenerateAndValidate(t *testing.T) {
+	key, err := Generate("jack@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(key.URI, "otpauth://totp/") || !strings.Contains(key.URI, "secret="+key.Secret) {
+		t.Errorf("unexpected provisioning URI %s", key.URI)
+	}
+
+	now := time.Now()
+	code, err := totp.GenerateCode(key.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name        string
+		code        string
+		at          time.Time
+		expectValid bool
+	}{
+		{"current", code, now, true},
+		{"previous step", code, now.Add(30 * time.Second), true},
+		{"too old", code, now.Add(2 * time.Minute), false},
+		{"wrong", "000000", now, code == "000000"},
+		{"not a number", "abcdef", now, false},
+	}
+
+	for _, e := range tests {
+		if valid := ValidateAt(e.code, key.Secret, e.at); valid != e.expectValid {
+			t.Errorf("%s: expected valid to be %v, got %v", e.name, e.expectValid, valid)
+		}
+	}
+}
+
+func TestKey_QRCode(t *testing.T) {
+	key, _ := Generate("jack@example.com")
+
+	b, err := key.QRCode(200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := png.Decode(bytes.NewReader(b))
+	if err != nil {
+		t.Fatalf("expected a PNG, got %s", err)
+	}
+
+	if img.Bounds().Dx() != 200 {
+		t.Errorf("expected a 200 pixel wide image, got %d", img.Bounds().Dx())
+	}
+}
+
+func TestNewRecoveryCodes(t *testing.T) {
+	codes, err := NewRecoveryCodes(RecoveryCodeCount)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("unexpected recovery code format %q", code)
+		}
+
+		if IsTOTPCode(code) {
+			t.Errorf("recovery code %q looks like a TOTP code", code)
+		}
+
+		if seen[code] {
+			t.Errorf("duplicate recovery code %q", code)
+		}
+		seen[code] = true
+	}
+
+	if len(seen) != RecoveryCodeCount {
+		t.Errorf("expected %d codes, got %d", RecoveryCodeCount, len(seen))
+	}
+
+	if NormalizeRecoveryCode(" ABCDE-fghij ") != "abcdefghij" {
+		t.Errorf("unexpected normalized code %q", NormalizeRecoveryCode(" ABCDE-fghij "))
+	}
+}
+
+func TestStepAt(t *testing.T) {
+	key, _ := Generate("jack@example.com")
+	now := time.Unix(1700000010, 0)
+
+	code, err := totp.GenerateCode(key.Secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tests = []struct {
+		name         string
+		at           time.Time
+		expectedStep int64
+		expectValid  bool
+	}{
+		{"current", now, 1700000010 / 30, true},
+		{"a step later", now.Add(30 * time.Second), 1700000010 / 30, true},
+		{"a step earlier", now.Add(-30 * time.Second), 1700000010 / 30, true},
+		{"two steps later", now.Add(time.Minute), 0, false},
+	}
+
+	for _, e := range tests {
+		step, ok := StepAt(code, key.Secret, e.at)
+		if ok != e.expectValid || step != e.expectedStep {
+			t.Errorf("%s: expected step %d valid %v, got %d %v", e.name, e.expectedStep, e.expectValid, step, ok)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package migrations
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+func TestLoad(t *testing.T) {
+	var tests = []struct {
+		name             string
+		files            fstest.MapFS
+		expectErr        bool
+		expectedVersions []int64
+	}{
+		{
+			"ordered",
+			fstest.MapFS{
+				"0002_second.up.sql":   {Data: []byte("up 2")},
+				"0002_second.down.sql": {Data: []byte("down 2")},
+				"0001_first.up.sql":    {Data: []byte("up 1")},
+				"0001_first.down.sql":  {Data: []byte("down 1")},
+				"README.md":            {Data: []byte("ignored")},
+			},
+			false,
+			[]int64{1, 2},
+		},
+		{
+			"missing down",
+			fstest.MapFS{
+				"0001_first.up.sql": {Data: []byte("up 1")},
+			},
+			true,
+			nil,
+		},
+		{
+			"duplicate version",
+			fstest.MapFS{
+				"0001_first.up.sql":   {Data: []byte("up 1")},
+				"0001_first.down.sql": {Data: []byte("down 1")},
+				"0001_other.up.sql":   {Data: []byte("up 1")},
+				"0001_other.down.sql": {Data: []byte("down 1")},
+			},
+			true,
+			nil,
+		},
+		{
+			"bad name",
+			fstest.MapFS{
+				"first.sql": {Data: []byte("up 1")},
+			},
+			true,
+			nil,
+		},
+	}
+
+	for _, e := range tests {
+		migrations, err := Load(e.files)
+
+		if e.expectErr {
+			if err == nil {
+				t.Errorf("%s: expected an error, got nil", e.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", e.name, err)
+			continue
+		}
+
+		if len(migrations) != len(e.expectedVersions) {
+			t.Errorf("%s: expected %d migrations, got %d", e.name, len(e.expectedVersions), len(migrations))
+			continue
+		}
+
+		for i, v := range e.expectedVersions {
+			if migrations[i].Version != v {
+				t.Errorf("%s: expected version %d at %d, got %d", e.name, v, i, migrations[i].Version)
+			}
+		}
+	}
+}
+
+func TestEmbedded(t *testing.T) {
+	migrations, err := Embedded()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(migrations) == 0 || migrations[0].Version != 1 || migrations[0].Name != "baseline" {
+		t.Errorf("expected the baseline migration first, got %+v", migrations)
+	}
+}
+
+func TestCreate(t *testing.T) {
+	dir := t.TempDir()
+
+	up, down, err := Create(dir, "Add Widgets")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(up) != "0001_add_widgets.up.sql" || filepath.Base(down) != "0001_add_widgets.down.sql" {
+		t.Errorf("unexpected file names %s and %s", up, down)
+	}
+
+	up, _, err = Create(dir, "more")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if filepath.Base(up) != "0002_more.up.sql" {
+		t.Errorf("expected the next version, got %s", up)
+	}
+
+	if _, err := os.Stat(up); err != nil {
+		t.Errorf("expected %s to exist: %s", up, err)
+	}
+
+	if _, _, err := Create(dir, "  "); err == nil {
+		t.Error("expected an error for an empty name, got nil")
+	}
+}
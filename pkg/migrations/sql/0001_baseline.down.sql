@@ -0,0 +1,7 @@
+DROP TABLE IF EXISTS public.user_roles;
+DROP TABLE IF EXISTS public.role_permissions;
+DROP TABLE IF EXISTS public.permissions;
+DROP TABLE IF EXISTS public.roles;
+DROP TABLE IF EXISTS public.refresh_tokens;
+DROP TABLE IF EXISTS public.user_images;
+DROP TABLE IF EXISTS public.users;
@@ -0,0 +1,68 @@
+-- The schema as it was when migrations were introduced. Every statement is
+-- guarded, so that databases created from sql/users.sql can adopt it too.
+
+CREATE TABLE IF NOT EXISTS public.users (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    first_name character varying(255),
+    last_name character varying(255),
+    email character varying(255),
+    password character varying(60),
+    is_admin integer,
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.user_images (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    user_id integer REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    file_name character varying(255),
+    created_at timestamp without time zone,
+    updated_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.refresh_tokens (
+    id character varying(64) PRIMARY KEY,
+    family_id character varying(64) NOT NULL,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    revoked_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_family_id_idx ON public.refresh_tokens USING btree (family_id);
+
+CREATE INDEX IF NOT EXISTS refresh_tokens_user_id_idx ON public.refresh_tokens USING btree (user_id);
+
+CREATE TABLE IF NOT EXISTS public.roles (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE,
+    created_at timestamp without time zone
+);
+
+CREATE TABLE IF NOT EXISTS public.permissions (
+    id integer GENERATED ALWAYS AS IDENTITY PRIMARY KEY,
+    name character varying(64) NOT NULL UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS public.role_permissions (
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    permission_id integer NOT NULL REFERENCES public.permissions(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (role_id, permission_id)
+);
+
+CREATE TABLE IF NOT EXISTS public.user_roles (
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    role_id integer NOT NULL REFERENCES public.roles(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    PRIMARY KEY (user_id, role_id)
+);
+
+INSERT INTO public.roles (name, created_at) VALUES ('admin', now()), ('user', now())
+    ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.permissions (name) VALUES ('users:list'), ('users:read'), ('users:create'), ('users:update'), ('users:delete')
+    ON CONFLICT (name) DO NOTHING;
+
+INSERT INTO public.role_permissions (role_id, permission_id)
+    SELECT r.id, p.id FROM public.roles r CROSS JOIN public.permissions p WHERE r.name = 'admin'
+    ON CONFLICT DO NOTHING;
@@ -0,0 +1,10 @@
+CREATE TABLE public.user_tokens (
+    hash character(64) PRIMARY KEY,
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    scope character varying(32) NOT NULL,
+    expires_at timestamp without time zone NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone
+);
+
+CREATE INDEX user_tokens_user_id_scope_idx ON public.user_tokens USING btree (user_id, scope);
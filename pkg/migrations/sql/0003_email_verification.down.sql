@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.users_email_key;
+
+ALTER TABLE public.users DROP COLUMN IF EXISTS email_verified_at;
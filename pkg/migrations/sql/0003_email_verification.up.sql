@@ -0,0 +1,7 @@
+-- Accounts that existed before self-service registration were created by an
+-- admin, so their addresses count as verified.
+ALTER TABLE public.users ADD COLUMN email_verified_at timestamp without time zone;
+
+UPDATE public.users SET email_verified_at = coalesce(created_at, now());
+
+CREATE UNIQUE INDEX users_email_key ON public.users USING btree (lower(email));
@@ -0,0 +1,11 @@
+ALTER TABLE public.users ADD COLUMN totp_secret character varying(64);
+
+ALTER TABLE public.users ADD COLUMN totp_enabled_at timestamp without time zone;
+
+CREATE TABLE public.user_recovery_codes (
+    user_id integer NOT NULL REFERENCES public.users(id) ON UPDATE CASCADE ON DELETE CASCADE,
+    hash character(64) NOT NULL,
+    used_at timestamp without time zone,
+    created_at timestamp without time zone,
+    PRIMARY KEY (user_id, hash)
+);
@@ -0,0 +1,5 @@
+ALTER TABLE public.user_images
+    DROP COLUMN IF EXISTS size_bytes,
+    DROP COLUMN IF EXISTS height,
+    DROP COLUMN IF EXISTS width,
+    DROP COLUMN IF EXISTS mime_type;
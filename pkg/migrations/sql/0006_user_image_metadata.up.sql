@@ -0,0 +1,5 @@
+ALTER TABLE public.user_images
+    ADD COLUMN mime_type character varying(32) NOT NULL DEFAULT '',
+    ADD COLUMN width integer NOT NULL DEFAULT 0,
+    ADD COLUMN height integer NOT NULL DEFAULT 0,
+    ADD COLUMN size_bytes bigint NOT NULL DEFAULT 0;
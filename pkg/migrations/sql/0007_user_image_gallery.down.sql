@@ -0,0 +1,8 @@
+DROP INDEX IF EXISTS public.user_images_file_name_idx;
+
+DROP INDEX IF EXISTS public.user_images_active_idx;
+
+-- only the active pictures survive the way back
+DELETE FROM public.user_images WHERE NOT is_active;
+
+ALTER TABLE public.user_images DROP COLUMN IF EXISTS is_active;
@@ -0,0 +1,8 @@
+ALTER TABLE public.user_images ADD COLUMN is_active boolean NOT NULL DEFAULT false;
+
+-- until now, users only had the one picture
+UPDATE public.user_images SET is_active = true;
+
+CREATE UNIQUE INDEX user_images_active_idx ON public.user_images USING btree (user_id) WHERE is_active;
+
+CREATE INDEX user_images_file_name_idx ON public.user_images USING btree (file_name);
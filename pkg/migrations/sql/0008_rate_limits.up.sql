@@ -0,0 +1,8 @@
+CREATE TABLE public.rate_limits (
+    key character varying(400) PRIMARY KEY,
+    tokens double precision NOT NULL,
+    updated_at timestamp without time zone NOT NULL,
+    full_at timestamp without time zone NOT NULL
+);
+
+CREATE INDEX rate_limits_full_at_idx ON public.rate_limits USING btree (full_at);
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.login_attempts_forget_at_idx;
+
+ALTER TABLE public.login_attempts DROP COLUMN IF EXISTS forget_at;
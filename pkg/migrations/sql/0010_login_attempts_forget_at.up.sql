@@ -0,0 +1,8 @@
+ALTER TABLE public.login_attempts ADD COLUMN forget_at timestamp without time zone;
+
+UPDATE public.login_attempts
+    SET forget_at = greatest(last_failure_at + interval '24 hours', coalesce(locked_until, last_failure_at));
+
+ALTER TABLE public.login_attempts ALTER COLUMN forget_at SET NOT NULL;
+
+CREATE INDEX login_attempts_forget_at_idx ON public.login_attempts USING btree (forget_at);
@@ -0,0 +1 @@
+ALTER TABLE public.users ADD COLUMN totp_last_step bigint;
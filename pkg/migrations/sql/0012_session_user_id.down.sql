@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS public.sessions_user_id_idx;
+
+ALTER TABLE public.sessions DROP COLUMN IF EXISTS user_id;
@@ -0,0 +1,3 @@
+ALTER TABLE public.sessions ADD COLUMN user_id integer;
+
+CREATE INDEX sessions_user_id_idx ON public.sessions USING btree (user_id);
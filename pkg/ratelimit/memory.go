@@ -0,0 +1,66 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// sweepEvery is how many requests a store takes between sweeps of full
+// buckets.
+const sweepEvery = 1000
+
+// MemoryStore keeps buckets in memory. It suits a single instance; use
+// PostgresStore when several share the load.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]memoryBucket
+	takes   int
+}
+
+// memoryBucket is a bucket, and when it will be full, so that it can be
+// dropped from then on.
+type memoryBucket struct {
+	Bucket
+	fullAt time.Time
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]memoryBucket{}}
+}
+
+// Take takes a token from the bucket of key.
+func (s *MemoryStore) Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var b *Bucket
+	if mb, ok := s.buckets[key]; ok {
+		b = &mb.Bucket
+	}
+
+	bucket, res := l.Take(b, now)
+	s.buckets[key] = memoryBucket{Bucket: bucket, fullAt: now.Add(res.Reset)}
+
+	s.takes++
+	if s.takes%sweepEvery == 0 {
+		s.sweep(now)
+	}
+
+	return res, nil
+}
+
+// sweep drops the buckets that are full by now, which are no different from
+// missing ones, so that many clients don't grow the store without bound.
+func (s *MemoryStore) sweep(now time.Time) {
+	for key, b := range s.buckets {
+		if !now.Before(b.fullAt) {
+			delete(s.buckets, key)
+		}
+	}
+}
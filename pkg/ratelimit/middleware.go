@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// KeyFunc returns who a request counts against, e.g. "ip:10.0.0.1" or
+// "user:1".
+type KeyFunc func(r *http.Request) string
+
+// Limiter applies limits per route group to the requests of HTTP handlers.
+type Limiter struct {
+	Store  Store
+	Logger *slog.Logger
+	// Limits maps route groups to their limits; groups without one aren't
+	// limited.
+	Limits map[string]Limit
+	// Denied answers refused requests with a 429; plain text is sent if nil.
+	Denied http.Handler
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+}
+
+// New returns a Limiter that keeps its buckets in store.
+func New(store Store, limits map[string]Limit, logger *slog.Logger) *Limiter {
+	return &Limiter{Store: store, Limits: limits, Logger: logger, now: time.Now}
+}
+
+func (l *Limiter) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+
+	return l.now()
+}
+
+// Middleware limits the requests of group, with a bucket per key. Allowed
+// requests get RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset
+// headers; others are refused with a 429 and Retry-After. If the store fails,
+// requests are let through rather than taking the API down with it.
+func (l *Limiter) Middleware(group string, key KeyFunc) func(http.Handler) http.Handler {
+	limit := l.Limits[group]
+
+	return func(next http.Handler) http.Handler {
+		if limit.Off() {
+			return next
+		}
+
+		policy := strconv.Itoa(limit.Requests) + ";w=" + strconv.Itoa(int(math.Ceil(limit.Period.Seconds())))
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			res, err := l.Store.Take(r.Context(), group+":"+key(r), limit, l.clock())
+			if err != nil {
+				l.Logger.ErrorContext(r.Context(), "taking rate limit token", "group", group, "error", err)
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			w.Header().Set("RateLimit-Policy", policy)
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(res.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(res.Remaining))
+			w.Header().Set("RateLimit-Reset", seconds(res.Reset))
+
+			if !res.Allowed {
+				w.Header().Set("Retry-After", seconds(res.RetryAfter))
+				if l.Denied != nil {
+					l.Denied.ServeHTTP(w, r)
+				} else {
+					http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				}
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// seconds formats d in whole seconds, rounded up, as the headers expect.
+func seconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
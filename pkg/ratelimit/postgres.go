@@ -0,0 +1,63 @@
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"sync/atomic"
+	"time"
+)
+
+// dbTimeout bounds every query of PostgresStore.
+const dbTimeout = 3 * time.Second
+
+// PostgresStore keeps buckets in the rate_limits table, so that every instance
+// of the app counts against the same limits.
+type PostgresStore struct {
+	DB *sql.DB
+
+	takes atomic.Int64
+}
+
+// Take takes a token from the bucket of key. The row is locked while the new
+// bucket is worked out, so that concurrent requests are all counted.
+func (s *PostgresStore) Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// the columns have no time zone, so every time is stored in UTC
+	now = now.UTC()
+
+	if s.takes.Add(1)%sweepEvery == 0 {
+		if _, err := s.DB.ExecContext(ctx, `delete from rate_limits where full_at <= $1`, now); err != nil {
+			return Result{}, err
+		}
+	}
+
+	tx, err := s.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return Result{}, err
+	}
+	defer tx.Rollback()
+
+	// a missing bucket is a full one
+	stmt := `insert into rate_limits (key, tokens, updated_at, full_at) values ($1, $2, $3, $3) on conflict (key) do nothing`
+	if _, err := tx.ExecContext(ctx, stmt, key, l.Requests, now); err != nil {
+		return Result{}, err
+	}
+
+	query := `select tokens, updated_at from rate_limits where key = $1 for update`
+
+	var b Bucket
+	if err := tx.QueryRowContext(ctx, query, key).Scan(&b.Tokens, &b.Updated); err != nil {
+		return Result{}, err
+	}
+
+	b, res := l.Take(&b, now)
+
+	stmt = `update rate_limits set tokens = $1, updated_at = $2, full_at = $3 where key = $4`
+	if _, err := tx.ExecContext(ctx, stmt, b.Tokens, b.Updated, now.Add(res.Reset), key); err != nil {
+		return Result{}, err
+	}
+
+	return res, tx.Commit()
+}
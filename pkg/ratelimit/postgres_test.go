@@ -0,0 +1,53 @@
+//go:build integration
+
+package ratelimit
+
+import (
+	"context"
+	"database/sql"
+	"github.com/calvarado2004/go-testing-webapp/pkg/internal/pgtest"
+	"testing"
+	"time"
+)
+
+var testDB *sql.DB
+
+// TestMain runs the tests against Postgres in a container
+func TestMain(m *testing.M) {
+	pgtest.Main(m, func(db *sql.DB) { testDB = db })
+}
+
+// TestRateLimitPostgresStore checks the rate limit store against the
+// rate_limits table
+func TestRateLimitPostgresStore(t *testing.T) {
+	ctx := context.Background()
+	store := &PostgresStore{DB: testDB}
+	l := Limit{Requests: 2, Period: time.Minute}
+	// a zone other than UTC, as the stored times have none
+	now := time.Now().In(time.FixedZone("UTC-8", -8*60*60)).Truncate(time.Second)
+
+	for i, expected := range []bool{true, true, false} {
+		res, err := store.Take(ctx, "auth:ip:10.0.0.1", l, now)
+		if err != nil {
+			t.Fatalf("take failed: %s", err)
+		}
+
+		if res.Allowed != expected {
+			t.Errorf("request %d: expected allowed %v, got %+v", i+1, expected, res)
+		}
+	}
+
+	// another instance sees the same bucket
+	other := &PostgresStore{DB: testDB}
+	if res, _ := other.Take(ctx, "auth:ip:10.0.0.1", l, now); res.Allowed || res.RetryAfter != 30*time.Second {
+		t.Errorf("expected the shared bucket to be empty, got %+v", res)
+	}
+
+	if res, _ := store.Take(ctx, "auth:ip:10.0.0.1", l, now.Add(30*time.Second)); !res.Allowed {
+		t.Errorf("expected the bucket to refill, got %+v", res)
+	}
+
+	if res, _ := store.Take(ctx, "auth:ip:10.0.0.2", l, now); !res.Allowed || res.Remaining != 1 {
+		t.Errorf("expected other clients to have a bucket of their own, got %+v", res)
+	}
+}
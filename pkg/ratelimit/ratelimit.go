@@ -0,0 +1,129 @@
+// Package ratelimit throttles clients with token buckets. Every client, by
+// address or by authenticated user, gets a bucket per route group that holds up
+// to a number of requests, refills steadily over a period, and is emptied by
+// one request at a time.
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Limit allows Requests requests per Period, all of which may come at once.
+// The zero Limit allows everything.
+type Limit struct {
+	Requests int
+	Period   time.Duration
+}
+
+// Off reports whether l allows everything.
+func (l Limit) Off() bool {
+	return l.Requests <= 0 || l.Period <= 0
+}
+
+// MarshalText writes l as requests/period, e.g. 10/1m0s, or "off".
+func (l Limit) MarshalText() ([]byte, error) {
+	if l.Off() {
+		return []byte("off"), nil
+	}
+
+	return []byte(fmt.Sprintf("%d/%s", l.Requests, l.Period)), nil
+}
+
+// UnmarshalText reads a limit written like 10/1m, or "off".
+func (l *Limit) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "off" || s == "0" {
+		*l = Limit{}
+		return nil
+	}
+
+	requests, period, ok := strings.Cut(s, "/")
+	if !ok {
+		return fmt.Errorf("rate limit %q should look like 10/1m", s)
+	}
+
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return fmt.Errorf("rate limit %q should allow a positive number of requests", s)
+	}
+
+	d, err := time.ParseDuration(period)
+	if err != nil || d <= 0 {
+		return fmt.Errorf("rate limit %q should have a positive period", s)
+	}
+
+	*l = Limit{Requests: n, Period: d}
+	return nil
+}
+
+// rate returns how many tokens a bucket gains per second.
+func (l Limit) rate() float64 {
+	return float64(l.Requests) / l.Period.Seconds()
+}
+
+// Bucket is what a Store keeps for a key: the tokens left at Updated.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Result says whether a request was allowed, and what is left of its limit.
+type Result struct {
+	Allowed bool
+	// Limit is the size of the bucket.
+	Limit int
+	// Remaining is the number of requests that could be made right away.
+	Remaining int
+	// Reset is how long until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is how long to wait before the next request is allowed; it
+	// is 0 if one would be allowed now.
+	RetryAfter time.Duration
+}
+
+// Take returns b after a request at now, refilled and with a token taken if
+// there was one. A nil b is a full bucket. Stores use it, so that they all
+// apply a limit the same way.
+func (l Limit) Take(b *Bucket, now time.Time) (Bucket, Result) {
+	capacity := float64(l.Requests)
+
+	tokens := capacity
+	if b != nil {
+		elapsed := now.Sub(b.Updated).Seconds()
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		tokens = math.Min(capacity, b.Tokens+elapsed*l.rate())
+	}
+
+	res := Result{Limit: l.Requests}
+	if tokens >= 1 {
+		tokens--
+		res.Allowed = true
+	}
+
+	res.Remaining = int(math.Floor(tokens))
+	res.Reset = l.wait(capacity - tokens)
+	if tokens < 1 {
+		res.RetryAfter = l.wait(1 - tokens)
+	}
+
+	return Bucket{Tokens: tokens, Updated: now}, res
+}
+
+// wait returns how long a bucket takes to gain tokens.
+func (l Limit) wait(tokens float64) time.Duration {
+	return time.Duration(math.Ceil(tokens / l.rate() * float64(time.Second)))
+}
+
+// Store keeps buckets.
+type Store interface {
+	// Take atomically takes a token from the bucket of key under l, and
+	// returns the result.
+	Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error)
+}
@@ -0,0 +1,173 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLimit_UnmarshalText(t *testing.T) {
+	var tests = []struct {
+		text        string
+		expected    Limit
+		expectError bool
+	}{
+		{"10/1m", Limit{Requests: 10, Period: time.Minute}, false},
+		{" 5/30s ", Limit{Requests: 5, Period: 30 * time.Second}, false},
+		{"off", Limit{}, false},
+		{"0", Limit{}, false},
+		{"10", Limit{}, true},
+		{"ten/1m", Limit{}, true},
+		{"-1/1m", Limit{}, true},
+		{"10/soon", Limit{}, true},
+		{"10/0s", Limit{}, true},
+	}
+
+	for _, e := range tests {
+		var l Limit
+		err := l.UnmarshalText([]byte(e.text))
+		if (err != nil) != e.expectError {
+			t.Errorf("%q: expected error %v, got %v", e.text, e.expectError, err)
+		}
+
+		if err == nil && l != e.expected {
+			t.Errorf("%q: expected %+v, got %+v", e.text, e.expected, l)
+		}
+	}
+
+	if b, _ := (Limit{Requests: 10, Period: time.Minute}).MarshalText(); string(b) != "10/1m0s" {
+		t.Errorf("expected 10/1m0s, got %s", b)
+	}
+}
+
+func TestLimit_Take(t *testing.T) {
+	l := Limit{Requests: 3, Period: 3 * time.Second}
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+
+	var tests = []struct {
+		name            string
+		after           time.Duration
+		expectAllowed   bool
+		expectRemaining int
+		expectReset     time.Duration
+		expectRetry     time.Duration
+	}{
+		{"first", 0, true, 2, time.Second, 0},
+		{"second", 0, true, 1, 2 * time.Second, 0},
+		{"third", 0, true, 0, 3 * time.Second, time.Second},
+		{"empty", 0, false, 0, 3 * time.Second, time.Second},
+		{"half refilled", 500 * time.Millisecond, false, 0, 2500 * time.Millisecond, 500 * time.Millisecond},
+		{"refilled", 500 * time.Millisecond, true, 0, 3 * time.Second, time.Second},
+		{"full again", time.Hour, true, 2, time.Second, 0},
+	}
+
+	var b *Bucket
+	for _, e := range tests {
+		now = now.Add(e.after)
+
+		bucket, res := l.Take(b, now)
+		b = &bucket
+
+		if res.Allowed != e.expectAllowed || res.Remaining != e.expectRemaining || res.Reset != e.expectReset || res.RetryAfter != e.expectRetry || res.Limit != 3 {
+			t.Errorf("%s: unexpected result %+v", e.name, res)
+		}
+	}
+}
+
+func TestMemoryStore_sweep(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	l := Limit{Requests: 10, Period: time.Minute}
+
+	s := NewMemoryStore()
+	s.Take(ctx, "old", l, now.Add(-time.Hour))
+	s.Take(ctx, "new", l, now)
+	s.sweep(now)
+
+	if _, ok := s.buckets["old"]; ok {
+		t.Error("expected the full bucket to be swept")
+	}
+
+	if _, ok := s.buckets["new"]; !ok {
+		t.Error("expected the bucket in use to be kept")
+	}
+}
+
+// failingStore is a Store that is down.
+type failingStore struct{}
+
+func (failingStore) Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error) {
+	return Result{}, errors.New("store is down")
+}
+
+func TestLimiter_Middleware(t *testing.T) {
+	now := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	l := New(NewMemoryStore(), map[string]Limit{
+		"auth":  {Requests: 2, Period: time.Minute},
+		"users": {},
+	}, logger)
+	l.now = func() time.Time { return now }
+
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	byHeader := func(r *http.Request) string { return r.Header.Get("X-Client") }
+
+	auth := l.Middleware("auth", byHeader)(next)
+	users := l.Middleware("users", byHeader)(next)
+	unknown := l.Middleware("unknown", byHeader)(next)
+
+	var tests = []struct {
+		name            string
+		handler         http.Handler
+		client          string
+		expectStatus    int
+		expectRemaining string
+		expectRetry     string
+	}{
+		{"first", auth, "a", http.StatusOK, "1", ""},
+		{"second", auth, "a", http.StatusOK, "0", ""},
+		{"over the limit", auth, "a", http.StatusTooManyRequests, "0", "30"},
+		{"other client", auth, "b", http.StatusOK, "1", ""},
+		{"group without limit", users, "a", http.StatusOK, "", ""},
+		{"unknown group", unknown, "a", http.StatusOK, "", ""},
+	}
+
+	for _, e := range tests {
+		req := httptest.NewRequest("POST", "/auth", nil)
+		req.Header.Set("X-Client", e.client)
+		rr := httptest.NewRecorder()
+
+		e.handler.ServeHTTP(rr, req)
+
+		if rr.Code != e.expectStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectStatus, rr.Code)
+		}
+
+		if got := rr.Header().Get("RateLimit-Remaining"); got != e.expectRemaining {
+			t.Errorf("%s: expected RateLimit-Remaining %q, got %q", e.name, e.expectRemaining, got)
+		}
+
+		if got := rr.Header().Get("Retry-After"); got != e.expectRetry {
+			t.Errorf("%s: expected Retry-After %q, got %q", e.name, e.expectRetry, got)
+		}
+
+		if e.expectRemaining != "" && (rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Policy") != "2;w=60") {
+			t.Errorf("%s: expected the limit headers, got %v", e.name, rr.Header())
+		}
+	}
+
+	// a store that is down doesn't take the API down with it
+	l.Store = failingStore{}
+	rr := httptest.NewRecorder()
+	auth.ServeHTTP(rr, httptest.NewRequest("POST", "/auth", nil))
+
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected requests to be let through when the store fails, got %d", rr.Code)
+	}
+}
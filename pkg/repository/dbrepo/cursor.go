@@ -0,0 +1,75 @@
+package dbrepo
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+)
+
+// ErrInvalidCursor is returned when a pagination cursor cannot be decoded, or
+// was issued for a different sort order than the one requested.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// userCursor marks the last row of a page. Rows are ordered by the sort field
+// and then by id, so the pair is unique and the next page starts right after it.
+type userCursor struct {
+	SortBy   string `json:"s"`
+	SortDesc bool   `json:"d,omitempty"`
+	Value    string `json:"v"`
+	ID       int    `json:"id"`
+}
+
+// encodeUserCursor builds the opaque cursor that points just past user u.
+func encodeUserCursor(q data.UserQuery, u *data.User) string {
+	c := userCursor{
+		SortBy:   q.SortBy,
+		SortDesc: q.SortDesc,
+		Value:    userSortValue(q.SortBy, u),
+		ID:       u.ID,
+	}
+
+	b, _ := json.Marshal(c)
+
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeUserCursor reverses encodeUserCursor, and makes sure the cursor was
+// issued for the same sort order as the query.
+func decodeUserCursor(q data.UserQuery) (*userCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(q.Cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c userCursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	if c.SortBy != q.SortBy || c.SortDesc != q.SortDesc {
+		return nil, fmt.Errorf("%w: it was issued for a different sort order", ErrInvalidCursor)
+	}
+
+	return &c, nil
+}
+
+// userSortValue returns the value of the sort field for u, as stored in a cursor.
+func userSortValue(field string, u *data.User) string {
+	switch field {
+	case "id":
+		return strconv.Itoa(u.ID)
+	case "email":
+		return u.Email
+	case "first_name":
+		return u.FirstName
+	case "created_at":
+		return u.CreatedAt.UTC().Format(time.RFC3339Nano)
+	default:
+		return u.LastName
+	}
+}
@@ -0,0 +1,20 @@
+package dbrepo
+
+import "errors"
+
+var (
+	// ErrTokenNotFound is returned when a token was never issued.
+	ErrTokenNotFound = errors.New("token not found")
+
+	// ErrTokenReused is returned when a single-use token has already been used,
+	// or was revoked.
+	ErrTokenReused = errors.New("token already used or revoked")
+
+	// ErrTOTPEnabled is returned when enrolling a user in two-factor
+	// authentication who is already enrolled.
+	ErrTOTPEnabled = errors.New("two-factor authentication is already enabled")
+
+	// ErrImageNotFound is returned for images that don't exist, or that belong
+	// to another user.
+	ErrImageNotFound = errors.New("image not found")
+)
@@ -3,16 +3,34 @@ package dbrepo
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
 	"golang.org/x/crypto/bcrypt"
-	"log"
+	"log/slog"
+	"strings"
 	"time"
 )
 
+// dbTimeout bounds every query. It is layered on top of the caller's context,
+// so whichever deadline comes first wins.
 const dbTimeout = 3 * time.Second
 
 type PostgresDBRepo struct {
 	DB *sql.DB
+
+	// Logger gets the errors that are not returned to the caller; it logs
+	// with the caller's context, so records carry its request id. The default
+	// logger is used if it is nil.
+	Logger *slog.Logger
+}
+
+func (m *PostgresDBRepo) logger() *slog.Logger {
+	if m.Logger == nil {
+		return slog.Default()
+	}
+
+	return m.Logger
 }
 
 func (m *PostgresDBRepo) Connection() *sql.DB {
@@ -20,11 +38,11 @@ func (m *PostgresDBRepo) Connection() *sql.DB {
 }
 
 // AllUsers returns all users as a slice of *data.User
-func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	query := `select id, email, first_name, last_name, password, is_admin, created_at, updated_at
+	query := `select id, email, first_name, last_name, password, is_admin, email_verified_at, totp_enabled_at is not null, created_at, updated_at
 	from users order by last_name`
 
 	rows, err := m.DB.QueryContext(ctx, query)
@@ -44,11 +62,13 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 			&user.LastName,
 			&user.Password,
 			&user.IsAdmin,
+			&user.EmailVerifiedAt,
+			&user.TOTPEnabled,
 			&user.CreatedAt,
 			&user.UpdatedAt,
 		)
 		if err != nil {
-			log.Println("Error scanning", err)
+			m.logger().ErrorContext(ctx, "scanning user", "error", err)
 			return nil, err
 		}
 
@@ -58,17 +78,155 @@ func (m *PostgresDBRepo) AllUsers() ([]*data.User, error) {
 	return users, nil
 }
 
+// userSortColumns maps the whitelisted sort fields to the SQL expression used
+// to order by them, and the type a cursor value must be cast to. Nullable
+// columns are coalesced so that keyset comparisons never hit a null.
+var userSortColumns = map[string]struct {
+	expr string
+	cast string
+}{
+	"id":         {"u.id", "integer"},
+	"email":      {"coalesce(u.email, '')", "text"},
+	"first_name": {"coalesce(u.first_name, '')", "text"},
+	"last_name":  {"coalesce(u.last_name, '')", "text"},
+	"created_at": {"coalesce(u.created_at, 'epoch'::timestamp)", "timestamp"},
+}
+
+// ListUsers returns one page of users matching the filters in q, sorted by a
+// whitelisted field. Pages are selected either by offset or by the cursor
+// returned with the previous page.
+func (m *PostgresDBRepo) ListUsers(ctx context.Context, q data.UserQuery) (*data.UserPage, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	if err := q.Normalize(); err != nil {
+		return nil, err
+	}
+
+	var conditions []string
+	var args []any
+
+	addArg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	if q.Email != "" {
+		conditions = append(conditions, "u.email ilike "+addArg(likePattern(q.Email)))
+	}
+
+	if q.Name != "" {
+		conditions = append(conditions, "(coalesce(u.first_name, '') || ' ' || coalesce(u.last_name, '')) ilike "+addArg(likePattern(q.Name)))
+	}
+
+	if q.IsAdmin != nil {
+		conditions = append(conditions, "u.is_admin = "+addArg(*q.IsAdmin))
+	}
+
+	if !q.CreatedAfter.IsZero() {
+		conditions = append(conditions, "u.created_at >= "+addArg(q.CreatedAfter))
+	}
+
+	if !q.CreatedBefore.IsZero() {
+		conditions = append(conditions, "u.created_at < "+addArg(q.CreatedBefore))
+	}
+
+	where := ""
+	if len(conditions) > 0 {
+		where = "where " + strings.Join(conditions, " and ")
+	}
+
+	page := data.UserPage{Users: []*data.User{}}
+
+	// the total ignores the cursor, so it stays the same from page to page
+	err := m.DB.QueryRowContext(ctx, "select count(*) from users u "+where, args...).Scan(&page.Total)
+	if err != nil {
+		return nil, err
+	}
+
+	sort := userSortColumns[q.SortBy]
+	direction, comparison := "asc", ">"
+	if q.SortDesc {
+		direction, comparison = "desc", "<"
+	}
+
+	if q.Cursor != "" {
+		c, err := decodeUserCursor(q)
+		if err != nil {
+			return nil, err
+		}
+
+		keyset := fmt.Sprintf("(%s, u.id) %s (%s::%s, %s)", sort.expr, comparison, addArg(c.Value), sort.cast, addArg(c.ID))
+		if where == "" {
+			where = "where " + keyset
+		} else {
+			where += " and " + keyset
+		}
+	}
+
+	// fetch one extra row, to find out whether there is a next page
+	query := fmt.Sprintf(`select u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.email_verified_at, u.totp_enabled_at is not null, u.created_at, u.updated_at
+	from users u %s order by %s %s, u.id %s limit %s offset %s`,
+		where, sort.expr, direction, direction, addArg(q.Limit+1), addArg(q.Offset))
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var user data.User
+		err := rows.Scan(
+			&user.ID,
+			&user.Email,
+			&user.FirstName,
+			&user.LastName,
+			&user.Password,
+			&user.IsAdmin,
+			&user.EmailVerifiedAt,
+			&user.TOTPEnabled,
+			&user.CreatedAt,
+			&user.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+
+		page.Users = append(page.Users, &user)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if len(page.Users) > q.Limit {
+		page.Users = page.Users[:q.Limit]
+		page.NextCursor = encodeUserCursor(q, page.Users[q.Limit-1])
+	}
+
+	return &page, nil
+}
+
+// likePattern turns a search term into an ilike pattern that matches it as a
+// substring, escaping the characters that ilike treats as wildcards.
+func likePattern(term string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+	return "%" + replacer.Replace(term) + "%"
+}
+
 // GetUser returns one user by id
-func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	query := `
 		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at, coalesce(ui.file_name, '')
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.email_verified_at, u.totp_enabled_at is not null, u.created_at, u.updated_at,
+			coalesce(ui.file_name, ''), coalesce(ui.mime_type, ''), coalesce(ui.width, 0), coalesce(ui.height, 0), coalesce(ui.size_bytes, 0)
 		from 
 			users u
-			left join user_images ui on (u.id = ui.user_id)
+			left join user_images ui on (u.id = ui.user_id and ui.is_active)
 		where 
 		    u.id = $1`
 
@@ -83,10 +241,17 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.TOTPEnabled,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.ProfilePic.FileName,
+		&user.ProfilePic.MIMEType,
+		&user.ProfilePic.Width,
+		&user.ProfilePic.Height,
+		&user.ProfilePic.Size,
 	)
+	user.ProfilePic.IsActive = user.ProfilePic.FileName != ""
 
 	if err != nil {
 		return nil, err
@@ -95,19 +260,20 @@ func (m *PostgresDBRepo) GetUser(id int) (*data.User, error) {
 	return &user, nil
 }
 
-// GetUserByEmail returns one user by email address
-func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// GetUserByEmail returns one user by email address, ignoring case
+func (m *PostgresDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	query := `
 		select 
-			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.created_at, u.updated_at, coalesce(ui.file_name, '')
+			u.id, u.email, u.first_name, u.last_name, u.password, u.is_admin, u.email_verified_at, u.totp_enabled_at is not null, u.created_at, u.updated_at,
+			coalesce(ui.file_name, ''), coalesce(ui.mime_type, ''), coalesce(ui.width, 0), coalesce(ui.height, 0), coalesce(ui.size_bytes, 0)
 		from 
 			users u
-			left join user_images ui on (u.id = ui.user_id)
+			left join user_images ui on (u.id = ui.user_id and ui.is_active)
 		where 
-		    u.email = $1`
+		    lower(u.email) = lower($1)`
 
 	var user data.User
 	row := m.DB.QueryRowContext(ctx, query, email)
@@ -119,10 +285,17 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 		&user.LastName,
 		&user.Password,
 		&user.IsAdmin,
+		&user.EmailVerifiedAt,
+		&user.TOTPEnabled,
 		&user.CreatedAt,
 		&user.UpdatedAt,
 		&user.ProfilePic.FileName,
+		&user.ProfilePic.MIMEType,
+		&user.ProfilePic.Width,
+		&user.ProfilePic.Height,
+		&user.ProfilePic.Size,
 	)
+	user.ProfilePic.IsActive = user.ProfilePic.FileName != ""
 
 	if err != nil {
 		return nil, err
@@ -132,8 +305,8 @@ func (m *PostgresDBRepo) GetUserByEmail(email string) (*data.User, error) {
 }
 
 // UpdateUser updates one user in the database
-func (m *PostgresDBRepo) UpdateUser(u data.User) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `update users set
@@ -161,9 +334,34 @@ func (m *PostgresDBRepo) UpdateUser(u data.User) error {
 	return nil
 }
 
+// VerifyEmail records that a user has confirmed their email address.
+func (m *PostgresDBRepo) VerifyEmail(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update users set email_verified_at = $1, updated_at = $1 where id = $2 and email_verified_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+
+	return err
+}
+
+// UnverifyEmail records that a user's email address changed, and has yet to be
+// confirmed.
+func (m *PostgresDBRepo) UnverifyEmail(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update users set email_verified_at = null, updated_at = $1 where id = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), id)
+
+	return err
+}
+
 // DeleteUser deletes one user from the database, by id
-func (m *PostgresDBRepo) DeleteUser(id int) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+func (m *PostgresDBRepo) DeleteUser(ctx context.Context, id int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	stmt := `delete from users where id = $1`
@@ -176,9 +374,10 @@ func (m *PostgresDBRepo) DeleteUser(id int) error {
 	return nil
 }
 
-// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
-func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// InsertUser inserts a new user into the database, and returns the ID of the newly inserted row.
+// The user's email address counts as verified only if EmailVerifiedAt is set.
+func (m *PostgresDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), 12)
@@ -187,8 +386,8 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	}
 
 	var newID int
-	stmt := `insert into users (email, first_name, last_name, password, is_admin, created_at, updated_at)
-		values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	stmt := `insert into users (email, first_name, last_name, password, is_admin, email_verified_at, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, $7, $8) returning id`
 
 	err = m.DB.QueryRowContext(ctx, stmt,
 		user.Email,
@@ -196,6 +395,7 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 		user.LastName,
 		hashedPassword,
 		user.IsAdmin,
+		user.EmailVerifiedAt,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -207,9 +407,11 @@ func (m *PostgresDBRepo) InsertUser(user data.User) (int, error) {
 	return newID, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// ResetPassword is the method we will use to change a user's password. Every
+// refresh token the user holds is revoked along with the old password, and any
+// outstanding password reset links stop working.
+func (m *PostgresDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(password), 12)
@@ -217,33 +419,68 @@ func (m *PostgresDBRepo) ResetPassword(id int, password string) error {
 		return err
 	}
 
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
 	stmt := `update users set password = $1 where id = $2`
-	_, err = m.DB.ExecContext(ctx, stmt, hashedPassword, id)
+	_, err = tx.ExecContext(ctx, stmt, hashedPassword, id)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	stmt = `update refresh_tokens set revoked_at = $1 where user_id = $2 and revoked_at is null`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), id)
+	if err != nil {
+		return err
+	}
+
+	stmt = `delete from user_tokens where user_id = $1 and scope = $2`
+	_, err = tx.ExecContext(ctx, stmt, id, data.ScopePasswordReset)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), dbTimeout)
+// InsertUserImage adds an image to a user's pictures, and makes it their
+// profile picture. Their earlier pictures are kept. It waits for the removal of
+// the files of fileName to finish, if one is under way; see
+// ReleaseUserImageFile.
+func (m *PostgresDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
 	defer cancel()
 
-	stmt := `delete from user_images where user_id = $1`
-	_, err := m.DB.ExecContext(ctx, stmt, i.UserID)
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := lockImageFile(ctx, tx, i.FileName); err != nil {
+		return 0, err
+	}
+
+	stmt := `update user_images set is_active = false, updated_at = $1 where user_id = $2 and is_active`
+	_, err = tx.ExecContext(ctx, stmt, time.Now(), i.UserID)
 	if err != nil {
 		return 0, err
 	}
 
 	var newID int
-	stmt = `insert into user_images (user_id, file_name, created_at, updated_at)
-		values ($1, $2, $3, $4) returning id`
+	stmt = `insert into user_images (user_id, file_name, mime_type, width, height, size_bytes, is_active, created_at, updated_at)
+		values ($1, $2, $3, $4, $5, $6, true, $7, $8) returning id`
 
-	err = m.DB.QueryRowContext(ctx, stmt,
+	err = tx.QueryRowContext(ctx, stmt,
 		i.UserID,
 		i.FileName,
+		i.MIMEType,
+		i.Width,
+		i.Height,
+		i.Size,
 		time.Now(),
 		time.Now(),
 	).Scan(&newID)
@@ -252,5 +489,515 @@ func (m *PostgresDBRepo) InsertUserImage(i data.UserImage) (int, error) {
 		return 0, err
 	}
 
-	return newID, nil
+	return newID, tx.Commit()
+}
+
+// ListUserImages returns every picture of a user, newest first.
+func (m *PostgresDBRepo) ListUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		select
+			id, user_id, file_name, mime_type, width, height, size_bytes, is_active, created_at, updated_at
+		from
+			user_images
+		where
+			user_id = $1
+		order by
+			created_at desc, id desc`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	images := []*data.UserImage{}
+	for rows.Next() {
+		var i data.UserImage
+		err := rows.Scan(
+			&i.ID,
+			&i.UserID,
+			&i.FileName,
+			&i.MIMEType,
+			&i.Width,
+			&i.Height,
+			&i.Size,
+			&i.IsActive,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, &i)
+	}
+
+	return images, rows.Err()
+}
+
+// SetActiveUserImage makes one of a user's pictures their profile picture.
+// ErrImageNotFound is returned if the user has no such picture.
+func (m *PostgresDBRepo) SetActiveUserImage(ctx context.Context, userID, imageID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var exists bool
+	query := `select exists(select 1 from user_images where id = $1 and user_id = $2)`
+	if err := tx.QueryRowContext(ctx, query, imageID, userID).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return ErrImageNotFound
+	}
+
+	// deactivate first, so that the unique index on active pictures holds
+	stmt := `update user_images set is_active = false, updated_at = $1 where user_id = $2 and is_active and id <> $3`
+	if _, err := tx.ExecContext(ctx, stmt, time.Now(), userID, imageID); err != nil {
+		return err
+	}
+
+	stmt = `update user_images set is_active = true, updated_at = $1 where id = $2`
+	if _, err := tx.ExecContext(ctx, stmt, time.Now(), imageID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// DeleteUserImage deletes one of a user's pictures, and returns it, so that the
+// caller can remove its files once no other picture uses them; see
+// ReleaseUserImageFile. Deleting the active picture leaves the user without one.
+// ErrImageNotFound is returned if the user has no such picture.
+func (m *PostgresDBRepo) DeleteUserImage(ctx context.Context, userID, imageID int) (*data.UserImage, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `
+		delete from user_images
+		where id = $1 and user_id = $2
+		returning id, user_id, file_name, mime_type, width, height, size_bytes, is_active, created_at, updated_at`
+
+	var i data.UserImage
+	err := m.DB.QueryRowContext(ctx, stmt, imageID, userID).Scan(
+		&i.ID,
+		&i.UserID,
+		&i.FileName,
+		&i.MIMEType,
+		&i.Width,
+		&i.Height,
+		&i.Size,
+		&i.IsActive,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrImageNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &i, nil
+}
+
+// ReleaseUserImageFile calls remove to delete the files of fileName, unless a
+// picture, of any user, is still stored in them. Files are named after their
+// content, so pictures can share them. The file name stays locked until remove
+// returns, so that InsertUserImage can't add a picture of the same content in
+// the meantime.
+func (m *PostgresDBRepo) ReleaseUserImageFile(ctx context.Context, fileName string, remove func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := lockImageFile(ctx, tx, fileName); err != nil {
+		return err
+	}
+
+	var inUse bool
+	query := `select exists(select 1 from user_images where file_name = $1)`
+	if err := tx.QueryRowContext(ctx, query, fileName).Scan(&inUse); err != nil {
+		return err
+	}
+
+	if !inUse {
+		if err := remove(ctx); err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// lockImageFile takes a lock on fileName that is held until tx ends.
+func lockImageFile(ctx context.Context, tx *sql.Tx, fileName string) error {
+	_, err := tx.ExecContext(ctx, `select pg_advisory_xact_lock(hashtext($1))`, "user_images:"+fileName)
+
+	return err
+}
+
+// GetUserRoles returns the roles granted to a user, along with their permissions.
+// Users flagged with is_admin hold the admin role even without a user_roles row.
+func (m *PostgresDBRepo) GetUserRoles(ctx context.Context, userID int) ([]*data.Role, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `
+		select 
+			r.id, r.name, coalesce(p.name, '')
+		from 
+			roles r
+			left join role_permissions rp on (rp.role_id = r.id)
+			left join permissions p on (p.id = rp.permission_id)
+		where 
+		    r.id in (select role_id from user_roles where user_id = $1)
+		    or (r.name = $2 and exists (select 1 from users where id = $1 and is_admin = 1))
+		order by 
+		    r.name, p.name`
+
+	rows, err := m.DB.QueryContext(ctx, query, userID, data.RoleAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []*data.Role
+
+	for rows.Next() {
+		var id int
+		var name, permission string
+		if err := rows.Scan(&id, &name, &permission); err != nil {
+			return nil, err
+		}
+
+		if len(roles) == 0 || roles[len(roles)-1].ID != id {
+			roles = append(roles, &data.Role{ID: id, Name: name})
+		}
+
+		if permission != "" {
+			role := roles[len(roles)-1]
+			role.Permissions = append(role.Permissions, permission)
+		}
+	}
+
+	return roles, rows.Err()
+}
+
+// InsertRefreshToken records a newly issued refresh token.
+func (m *PostgresDBRepo) InsertRefreshToken(ctx context.Context, t data.RefreshToken) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into refresh_tokens (id, family_id, user_id, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		t.ID,
+		t.FamilyID,
+		t.UserID,
+		t.ExpiresAt,
+		time.Now(),
+	)
+
+	return err
+}
+
+// UseRefreshToken marks a refresh token as used, and returns it. A token can only
+// be used once: if it was already used or revoked, ErrTokenReused is returned, and
+// if it was never issued, ErrTokenNotFound.
+func (m *PostgresDBRepo) UseRefreshToken(ctx context.Context, id string) (*data.RefreshToken, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// the update only matches a token nobody has used yet, so two concurrent
+	// requests with the same token cannot both succeed
+	stmt := `update refresh_tokens set used_at = $1
+		where id = $2 and used_at is null and revoked_at is null
+		returning id, family_id, user_id, expires_at, used_at, revoked_at, created_at`
+
+	var t data.RefreshToken
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), id).Scan(
+		&t.ID,
+		&t.FamilyID,
+		&t.UserID,
+		&t.ExpiresAt,
+		&t.UsedAt,
+		&t.RevokedAt,
+		&t.CreatedAt,
+	)
+
+	if err == nil {
+		return &t, nil
+	}
+
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// find out whether the token exists at all
+	err = m.DB.QueryRowContext(ctx, `select family_id, user_id from refresh_tokens where id = $1`, id).Scan(&t.FamilyID, &t.UserID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t.ID = id
+
+	return &t, ErrTokenReused
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token in a family.
+func (m *PostgresDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where family_id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), familyID)
+
+	return err
+}
+
+// RevokeUserRefreshTokens revokes every refresh token issued to a user.
+func (m *PostgresDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update refresh_tokens set revoked_at = $1 where user_id = $2 and revoked_at is null`
+
+	_, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID)
+
+	return err
+}
+
+// InsertToken records the hash of a newly issued single-use token.
+func (m *PostgresDBRepo) InsertToken(ctx context.Context, t data.Token) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `insert into user_tokens (hash, user_id, scope, expires_at, created_at)
+		values ($1, $2, $3, $4, $5)`
+
+	_, err := m.DB.ExecContext(ctx, stmt,
+		t.Hash,
+		t.UserID,
+		t.Scope,
+		t.ExpiresAt,
+		time.Now(),
+	)
+
+	return err
+}
+
+// UseToken marks the token with the given plaintext and scope as used, and
+// returns it. ErrTokenNotFound is returned if no such token was issued, or if it
+// has expired or was already used.
+func (m *PostgresDBRepo) UseToken(ctx context.Context, scope, plaintext string) (*data.Token, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	// like UseRefreshToken, the update only matches an unused token, so a token
+	// can't be spent twice by concurrent requests
+	stmt := `update user_tokens set used_at = $1
+		where hash = $2 and scope = $3 and used_at is null and expires_at > $1
+		returning hash, user_id, scope, expires_at, used_at, created_at`
+
+	var t data.Token
+	err := m.DB.QueryRowContext(ctx, stmt, time.Now(), data.HashToken(plaintext), scope).Scan(
+		&t.Hash,
+		&t.UserID,
+		&t.Scope,
+		&t.ExpiresAt,
+		&t.UsedAt,
+		&t.CreatedAt,
+	)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrTokenNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// DeleteUserTokens deletes every token of the given scope issued to a user.
+func (m *PostgresDBRepo) DeleteUserTokens(ctx context.Context, userID int, scope string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `delete from user_tokens where user_id = $1 and scope = $2`
+
+	_, err := m.DB.ExecContext(ctx, stmt, userID, scope)
+
+	return err
+}
+
+// GetTOTP returns a user's two-factor authentication secret. The secret is empty
+// if the user never started enrolling.
+func (m *PostgresDBRepo) GetTOTP(ctx context.Context, userID int) (*data.TOTP, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select id, coalesce(totp_secret, ''), totp_enabled_at from users where id = $1`
+
+	var t data.TOTP
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.EnabledAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return &t, nil
+}
+
+// SetTOTPSecret stores the secret of a user who is enrolling in two-factor
+// authentication. It fails if two-factor authentication is already enabled, so
+// that the secret of an enrolled user can't be swapped out.
+func (m *PostgresDBRepo) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_secret = $1, updated_at = $2 where id = $3 and totp_enabled_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, secret, time.Now(), userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication for a user who has a secret, and
+// replaces their recovery codes with the ones hashed in recoveryCodeHashes. Like
+// SetTOTPSecret, it returns ErrTOTPEnabled if there is nothing to enable.
+func (m *PostgresDBRepo) EnableTOTP(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	now := time.Now()
+
+	stmt := `update users set totp_enabled_at = $1, updated_at = $1
+		where id = $2 and totp_secret is not null and totp_enabled_at is null`
+	result, err := tx.ExecContext(ctx, stmt, now, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTOTPEnabled
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, recoveryCodeHashes, now); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceRecoveryCodes deletes a user's recovery codes, and inserts new ones.
+func replaceRecoveryCodes(ctx context.Context, tx *sql.Tx, userID int, hashes []string, now time.Time) error {
+	_, err := tx.ExecContext(ctx, `delete from user_recovery_codes where user_id = $1`, userID)
+	if err != nil {
+		return err
+	}
+
+	stmt := `insert into user_recovery_codes (user_id, hash, created_at) values ($1, $2, $3)`
+	for _, hash := range hashes {
+		if _, err := tx.ExecContext(ctx, stmt, userID, hash, now); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication for a user, forgetting their
+// secret and recovery codes.
+func (m *PostgresDBRepo) DisableTOTP(ctx context.Context, userID int) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt := `update users set totp_secret = null, totp_enabled_at = null, updated_at = $1 where id = $2`
+	if _, err := tx.ExecContext(ctx, stmt, time.Now(), userID); err != nil {
+		return err
+	}
+
+	if err := replaceRecoveryCodes(ctx, tx, userID, nil, time.Now()); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// UseRecoveryCode spends one of a user's recovery codes, given its hash.
+// ErrTokenNotFound is returned if the user has no such unused code.
+func (m *PostgresDBRepo) UseRecoveryCode(ctx context.Context, userID int, hash string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update user_recovery_codes set used_at = $1 where user_id = $2 and hash = $3 and used_at is null`
+
+	result, err := m.DB.ExecContext(ctx, stmt, time.Now(), userID, hash)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTokenNotFound
+	}
+
+	return nil
+}
+
+// UseTOTPStep records that a user logged in with the TOTP code of a time step.
+// ErrTokenReused is returned if they already used the code of that step, or of
+// a later one, so that every code works only once.
+func (m *PostgresDBRepo) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	stmt := `update users set totp_last_step = $1 where id = $2 and (totp_last_step is null or totp_last_step < $1)`
+
+	result, err := m.DB.ExecContext(ctx, stmt, step, userID)
+	if err != nil {
+		return err
+	}
+
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrTokenReused
+	}
+
+	return nil
 }
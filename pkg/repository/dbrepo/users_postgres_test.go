@@ -3,124 +3,29 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"errors"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"github.com/calvarado2004/go-testing-webapp/pkg/internal/pgtest"
+	"github.com/calvarado2004/go-testing-webapp/pkg/migrations"
 	"github.com/calvarado2004/go-testing-webapp/pkg/repository"
-	_ "github.com/jackc/pgconn"
-	_ "github.com/jackc/pgx/v4"
-	_ "github.com/jackc/pgx/v4/stdlib"
-	"github.com/ory/dockertest/v3"
-	"github.com/ory/dockertest/v3/docker"
-	"log"
-	"os"
 	"testing"
 	"time"
 )
 
 //integration tests for Postgres dbrepo
 
-var (
-	host     = "localhost"
-	user     = "postgres"
-	password = "postgres"
-	dbname   = "users_test"
-	port     = "5435"
-	dsn      = "host=%s port=%s user=%s password=%s dbname=%s sslmode=disable timezone=UTC connect_timeout=5"
-)
-
-var resource *dockertest.Resource
-var pool *dockertest.Pool
 var testDB *sql.DB
 var testRepo repository.DatabaseRepo
 
 // TestMain is the entry point for all tests
 func TestMain(m *testing.M) {
 
-	// connect to docker; fail if docker is not running
-	p, err := dockertest.NewPool("")
-	if err != nil {
-		log.Fatalf("Could not connect to docker: %v", err)
-	}
-
-	pool = p
-
-	// set up docker options, specifying image, port, and env vars
-	dockerOpts := dockertest.RunOptions{
-		Repository: "postgres",
-		Tag:        "14.5",
-		Env: []string{
-			"POSTGRES_USER=" + user,
-			"POSTGRES_PASSWORD=" + password,
-			"POSTGRES_DB=" + dbname,
-		},
-		ExposedPorts: []string{"5432"},
-		PortBindings: map[docker.Port][]docker.PortBinding{
-			"5432": {
-				{
-					HostIP:   "0.0.0.0",
-					HostPort: port,
-				},
-			},
-		},
-	}
-
-	// get docker image
-	resource, err = pool.RunWithOptions(&dockerOpts)
-	if err != nil {
-		log.Fatalf("Could not start resource: %v", err)
-	}
-
-	// start the docker container and wait for it to be ready
-	if err = pool.Retry(func() error {
-		var err error
-		testDB, err = sql.Open("pgx", fmt.Sprintf(dsn, host, port, user, password, dbname))
-		if err != nil {
-			log.Println("Could not connect to postgres yet")
-			return err
-		}
-		return testDB.Ping()
-	}); err != nil {
-		_ = pool.Purge(resource)
-		log.Fatalf("Could not connect to postgres at all: %s", err)
-	}
-
-	// populate the test database
-	err = createTables()
-	if err != nil {
-		log.Fatalf("Could not create tables: %s", err)
-	}
-
-	// initialize the repository
-	testRepo = &PostgresDBRepo{DB: testDB}
-
-	// run the tests
-	code := m.Run()
-
-	// clean up after tests
-	if err = pool.Purge(resource); err != nil {
-		log.Fatalf("Could not purge resource: %v", err)
-	}
-
-	os.Exit(code)
-}
-
-// createTables creates the tables for the test database
-func createTables() error {
-
-	tableSQL, err := os.ReadFile("./testdata/users.sql")
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	_, err = testDB.Exec(string(tableSQL))
-	if err != nil {
-		fmt.Println(err)
-		return err
-	}
-
-	return nil
+	pgtest.Main(m, func(db *sql.DB) {
+		testDB = db
+		testRepo = &PostgresDBRepo{DB: db}
+	})
 }
 
 // Test_pingDB tests the pingDB function testing Connection function
@@ -148,7 +53,7 @@ func TestPostgresDBRepoInsertUser(t *testing.T) {
 		UpdatedAt: time.Now(),
 	}
 
-	id, err := testRepo.InsertUser(testUser)
+	id, err := testRepo.InsertUser(context.Background(), testUser)
 	if err != nil {
 		t.Errorf("insertUser failed: %s", err)
 	}
@@ -161,7 +66,7 @@ func TestPostgresDBRepoInsertUser(t *testing.T) {
 
 // TestPostgresDBRepoAllUsers tests the allUsers function
 func TestPostgresDBRepoAllUsers(t *testing.T) {
-	users, err := testRepo.AllUsers()
+	users, err := testRepo.AllUsers(context.Background())
 	if err != nil {
 		t.Errorf("allUsers failed: %s", err)
 	}
@@ -180,9 +85,9 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 		UpdatedAt: time.Now(),
 	}
 
-	_, _ = testRepo.InsertUser(testUser2)
+	_, _ = testRepo.InsertUser(context.Background(), testUser2)
 
-	users, err = testRepo.AllUsers()
+	users, err = testRepo.AllUsers(context.Background())
 
 	if err != nil {
 		t.Errorf("allUsers failed: %s", err)
@@ -194,9 +99,56 @@ func TestPostgresDBRepoAllUsers(t *testing.T) {
 
 }
 
+// TestPostgresDBRepoListUsers tests the listUsers function
+func TestPostgresDBRepoListUsers(t *testing.T) {
+	page, err := testRepo.ListUsers(context.Background(), data.UserQuery{Limit: 1, SortBy: "id"})
+	if err != nil {
+		t.Fatalf("listUsers failed: %s", err)
+	}
+
+	if page.Total != 2 {
+		t.Errorf("expected total to be 2, got %d", page.Total)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].ID != 1 {
+		t.Fatalf("expected first page to hold user 1, got %v", page.Users)
+	}
+
+	if page.NextCursor == "" {
+		t.Fatal("expected a next cursor, got none")
+	}
+
+	page, err = testRepo.ListUsers(context.Background(), data.UserQuery{Limit: 1, SortBy: "id", Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatalf("listUsers with cursor failed: %s", err)
+	}
+
+	if len(page.Users) != 1 || page.Users[0].ID != 2 {
+		t.Errorf("expected second page to hold user 2, got %v", page.Users)
+	}
+
+	if page.NextCursor != "" {
+		t.Errorf("expected no next cursor on the last page, got %s", page.NextCursor)
+	}
+
+	page, err = testRepo.ListUsers(context.Background(), data.UserQuery{Email: "JACK"})
+	if err != nil {
+		t.Fatalf("listUsers with email filter failed: %s", err)
+	}
+
+	if page.Total != 1 || len(page.Users) != 1 || page.Users[0].Email != "jack@example.com" {
+		t.Errorf("expected only jack@example.com, got %v", page.Users)
+	}
+
+	_, err = testRepo.ListUsers(context.Background(), data.UserQuery{SortBy: "password"})
+	if err == nil {
+		t.Error("expected error sorting by a field that is not whitelisted, got nil")
+	}
+}
+
 // TestPostgresDBRepoGetUser tests the getUser function
 func TestPostgresDBRepoGetUser(t *testing.T) {
-	user, err := testRepo.GetUser(1)
+	user, err := testRepo.GetUser(context.Background(), 1)
 	if err != nil {
 		t.Errorf("getUser failed: %s", err)
 	}
@@ -217,7 +169,7 @@ func TestPostgresDBRepoGetUser(t *testing.T) {
 		t.Errorf("expected email to be john@example.com")
 	}
 
-	user, err = testRepo.GetUser(3)
+	user, err = testRepo.GetUser(context.Background(), 3)
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
@@ -226,7 +178,7 @@ func TestPostgresDBRepoGetUser(t *testing.T) {
 
 // TestPostgresDBRepoGetUserByEmail tests the getUserByEmail function
 func TestPostgresDBRepoGetUserByEmail(t *testing.T) {
-	user, err := testRepo.GetUserByEmail("jack@example.com")
+	user, err := testRepo.GetUserByEmail(context.Background(), "jack@example.com")
 	if err != nil {
 		t.Errorf("getUserByEmail failed: %s", err)
 	}
@@ -240,17 +192,17 @@ func TestPostgresDBRepoGetUserByEmail(t *testing.T) {
 // TestPostgresDBRepoUpdateUser tests the updateUser function
 func TestPostgresDBRepoUpdateUser(t *testing.T) {
 
-	user, _ := testRepo.GetUser(2)
+	user, _ := testRepo.GetUser(context.Background(), 2)
 	user.FirstName = "Jackie"
 	user.LastName = "Smithy"
 	user.Email = "jackie@smithy.com"
 
-	err := testRepo.UpdateUser(*user)
+	err := testRepo.UpdateUser(context.Background(), *user)
 	if err != nil {
 		t.Errorf("updateUser failed: %s", err)
 	}
 
-	user, _ = testRepo.GetUser(2)
+	user, _ = testRepo.GetUser(context.Background(), 2)
 
 	if user.FirstName != "Jackie" {
 		t.Errorf("expected first name to be Jackie, got %s", user.FirstName)
@@ -268,12 +220,12 @@ func TestPostgresDBRepoUpdateUser(t *testing.T) {
 
 // TestPostgresDBRepoDeleteUser tests the deleteUser function
 func TestPostgresDBRepoDeleteUser(t *testing.T) {
-	err := testRepo.DeleteUser(1)
+	err := testRepo.DeleteUser(context.Background(), 1)
 	if err != nil {
 		t.Errorf("deleteUser failed: %s", err)
 	}
 
-	_, err = testRepo.GetUser(1)
+	_, err = testRepo.GetUser(context.Background(), 1)
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
@@ -283,12 +235,12 @@ func TestPostgresDBRepoDeleteUser(t *testing.T) {
 // TestPostgresDBRepoResetPassword tests the resetPassword function
 func TestPostgresDBRepoResetPassword(t *testing.T) {
 
-	err := testRepo.ResetPassword(2, "newpassword")
+	err := testRepo.ResetPassword(context.Background(), 2, "newpassword")
 	if err != nil {
 		t.Errorf("resetPassword failed: %s", err)
 	}
 
-	user, _ := testRepo.GetUser(2)
+	user, _ := testRepo.GetUser(context.Background(), 2)
 
 	matches, err := user.PasswordMatches("newpassword")
 	if err != nil {
@@ -307,11 +259,15 @@ func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 	testUserImage := data.UserImage{
 		UserID:    2,
 		FileName:  "test.jpg",
+		MIMEType:  "image/jpeg",
+		Width:     640,
+		Height:    480,
+		Size:      12345,
 		CreatedAt: time.Now(),
 		UpdatedAt: time.Now(),
 	}
 
-	id, err := testRepo.InsertUserImage(testUserImage)
+	id, err := testRepo.InsertUserImage(context.Background(), testUserImage)
 	if err != nil {
 		t.Errorf("insertUserImage failed: %v", err)
 	}
@@ -320,11 +276,350 @@ func TestPostgresDBRepoInsertUserImage(t *testing.T) {
 		t.Errorf("expected id to be 1, got %d", id)
 	}
 
+	user, err := testRepo.GetUser(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("getUser failed: %v", err)
+	}
+
+	if pic := user.ProfilePic; pic.FileName != "test.jpg" || pic.MIMEType != "image/jpeg" || pic.Width != 640 || pic.Height != 480 || pic.Size != 12345 {
+		t.Errorf("expected the image metadata to be stored, got %+v", pic)
+	}
+
 	testUserImage.UserID = 100
 
-	_, err = testRepo.InsertUserImage(testUserImage)
+	_, err = testRepo.InsertUserImage(context.Background(), testUserImage)
 	if err == nil {
 		t.Errorf("expected error, got nil")
 	}
 
 }
+
+// TestPostgresDBRepoUserImageGallery tests keeping, switching between and
+// deleting a user's pictures
+func TestPostgresDBRepoUserImageGallery(t *testing.T) {
+	ctx := context.Background()
+
+	second, err := testRepo.InsertUserImage(ctx, data.UserImage{UserID: 2, FileName: "second.png"})
+	if err != nil {
+		t.Fatalf("insertUserImage failed: %v", err)
+	}
+
+	list, err := testRepo.ListUserImages(ctx, 2)
+	if err != nil {
+		t.Fatalf("listUserImages failed: %v", err)
+	}
+
+	if len(list) != 2 || list[0].ID != second || !list[0].IsActive || list[1].IsActive {
+		t.Fatalf("expected the new picture first and active, got %+v %+v", list[0], list[1])
+	}
+
+	first := list[1].ID
+
+	if err := testRepo.SetActiveUserImage(ctx, 2, first); err != nil {
+		t.Fatalf("setActiveUserImage failed: %v", err)
+	}
+
+	user, _ := testRepo.GetUser(ctx, 2)
+	if user.ProfilePic.ID != first || !user.ProfilePic.IsActive {
+		t.Errorf("expected picture %d to be the profile picture, got %+v", first, user.ProfilePic)
+	}
+
+	if err := testRepo.SetActiveUserImage(ctx, 1, first); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected ErrImageNotFound for another user's picture, got %v", err)
+	}
+
+	if _, err := testRepo.DeleteUserImage(ctx, 1, second); !errors.Is(err, ErrImageNotFound) {
+		t.Errorf("expected ErrImageNotFound for another user's picture, got %v", err)
+	}
+
+	deleted, err := testRepo.DeleteUserImage(ctx, 2, second)
+	if err != nil {
+		t.Fatalf("deleteUserImage failed: %v", err)
+	}
+
+	if deleted.FileName != "second.png" {
+		t.Errorf("expected the deleted picture to be returned, got %+v", deleted)
+	}
+
+	removed := map[string]bool{}
+	for _, name := range []string{"second.png", "test.jpg"} {
+		err := testRepo.ReleaseUserImageFile(ctx, name, func(ctx context.Context) error {
+			removed[name] = true
+			return nil
+		})
+		if err != nil {
+			t.Errorf("releaseUserImageFile %s failed: %v", name, err)
+		}
+	}
+
+	if !removed["second.png"] {
+		t.Error("expected the files of second.png to be removed")
+	}
+
+	if removed["test.jpg"] {
+		t.Error("expected test.jpg, which is in use, to be kept")
+	}
+}
+
+// TestPostgresDBRepoRefreshTokens tests the refresh token functions
+func TestPostgresDBRepoRefreshTokens(t *testing.T) {
+	ctx := context.Background()
+
+	for _, id := range []string{"jti-1", "jti-2"} {
+		err := testRepo.InsertRefreshToken(ctx, data.RefreshToken{
+			ID:        id,
+			FamilyID:  "family-1",
+			UserID:    2,
+			ExpiresAt: time.Now().Add(time.Hour),
+		})
+		if err != nil {
+			t.Fatalf("insertRefreshToken failed: %s", err)
+		}
+	}
+
+	token, err := testRepo.UseRefreshToken(ctx, "jti-1")
+	if err != nil {
+		t.Fatalf("useRefreshToken failed: %s", err)
+	}
+
+	if token.FamilyID != "family-1" || token.UserID != 2 {
+		t.Errorf("unexpected token returned: %+v", token)
+	}
+
+	_, err = testRepo.UseRefreshToken(ctx, "jti-1")
+	if !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected ErrTokenReused, got %v", err)
+	}
+
+	_, err = testRepo.UseRefreshToken(ctx, "no-such-token")
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound, got %v", err)
+	}
+
+	err = testRepo.RevokeRefreshTokenFamily(ctx, "family-1")
+	if err != nil {
+		t.Fatalf("revokeRefreshTokenFamily failed: %s", err)
+	}
+
+	_, err = testRepo.UseRefreshToken(ctx, "jti-2")
+	if !errors.Is(err, ErrTokenReused) {
+		t.Errorf("expected revoked token to be rejected, got %v", err)
+	}
+}
+
+// TestPostgresDBRepoGetUserRoles tests the getUserRoles function
+func TestPostgresDBRepoGetUserRoles(t *testing.T) {
+	// user 2 was inserted with is_admin set, which implies the admin role
+	roles, err := testRepo.GetUserRoles(context.Background(), 2)
+	if err != nil {
+		t.Fatalf("getUserRoles failed: %s", err)
+	}
+
+	if len(roles) != 1 || roles[0].Name != data.RoleAdmin {
+		t.Fatalf("expected the admin role, got %v", data.RoleNames(roles))
+	}
+
+	if len(roles[0].Permissions) != 5 {
+		t.Errorf("expected the admin role to hold 5 permissions, got %v", roles[0].Permissions)
+	}
+
+	roles, err = testRepo.GetUserRoles(context.Background(), 100)
+	if err != nil {
+		t.Fatalf("getUserRoles failed: %s", err)
+	}
+
+	if len(roles) != 0 {
+		t.Errorf("expected no roles for an unknown user, got %v", data.RoleNames(roles))
+	}
+}
+
+// TestPostgresDBRepoTokens tests issuing and spending single-use tokens
+func TestPostgresDBRepoTokens(t *testing.T) {
+	ctx := context.Background()
+
+	reset, _ := data.NewToken(2, time.Hour, data.ScopePasswordReset)
+	expired, _ := data.NewToken(2, -time.Minute, data.ScopePasswordReset)
+
+	for _, token := range []*data.Token{reset, expired} {
+		if err := testRepo.InsertToken(ctx, *token); err != nil {
+			t.Fatalf("insertToken failed: %s", err)
+		}
+	}
+
+	_, err := testRepo.UseToken(ctx, data.ScopeEmailVerification, reset.Plaintext)
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for the wrong scope, got %v", err)
+	}
+
+	token, err := testRepo.UseToken(ctx, data.ScopePasswordReset, reset.Plaintext)
+	if err != nil {
+		t.Fatalf("useToken failed: %s", err)
+	}
+
+	if token.UserID != 2 || token.UsedAt == nil {
+		t.Errorf("unexpected token returned: %+v", token)
+	}
+
+	_, err = testRepo.UseToken(ctx, data.ScopePasswordReset, reset.Plaintext)
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for a used token, got %v", err)
+	}
+
+	_, err = testRepo.UseToken(ctx, data.ScopePasswordReset, expired.Plaintext)
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for an expired token, got %v", err)
+	}
+
+	other, _ := data.NewToken(2, time.Hour, data.ScopePasswordReset)
+	_ = testRepo.InsertToken(ctx, *other)
+
+	if err := testRepo.ResetPassword(ctx, 2, "new password"); err != nil {
+		t.Fatalf("resetPassword failed: %s", err)
+	}
+
+	_, err = testRepo.UseToken(ctx, data.ScopePasswordReset, other.Plaintext)
+	if !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected the password reset to delete outstanding reset tokens, got %v", err)
+	}
+}
+
+// TestPostgresDBRepoVerifyEmail tests that new users start unverified, and that
+// email addresses are unique regardless of case
+func TestPostgresDBRepoVerifyEmail(t *testing.T) {
+	ctx := context.Background()
+
+	id, err := testRepo.InsertUser(ctx, data.User{FirstName: "Una", LastName: "Verified", Email: "una@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insertUser failed: %s", err)
+	}
+
+	user, err := testRepo.GetUserByEmail(ctx, "UNA@example.com")
+	if err != nil {
+		t.Fatalf("getUserByEmail ignoring case failed: %s", err)
+	}
+
+	if user.ID != id || user.EmailVerified() {
+		t.Errorf("expected user %d to be unverified, got %+v", id, user)
+	}
+
+	if err := testRepo.VerifyEmail(ctx, id); err != nil {
+		t.Fatalf("verifyEmail failed: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(ctx, id)
+	if !user.EmailVerified() {
+		t.Error("expected the user to be verified")
+	}
+
+	if err := testRepo.UnverifyEmail(ctx, id); err != nil {
+		t.Fatalf("unverifyEmail failed: %s", err)
+	}
+
+	user, _ = testRepo.GetUser(ctx, id)
+	if user.EmailVerified() {
+		t.Error("expected the user to be unverified again")
+	}
+
+	_, err = testRepo.InsertUser(ctx, data.User{FirstName: "Una", LastName: "Again", Email: "Una@Example.com", Password: "secret"})
+	if err == nil {
+		t.Error("expected an error inserting a duplicate email address, got nil")
+	}
+}
+
+func TestPostgresDBRepoTOTP(t *testing.T) {
+	ctx := context.Background()
+
+	id, err := testRepo.InsertUser(ctx, data.User{FirstName: "Otto", LastName: "Factor", Email: "otto@example.com", Password: "secret"})
+	if err != nil {
+		t.Fatalf("insertUser failed: %s", err)
+	}
+
+	state, err := testRepo.GetTOTP(ctx, id)
+	if err != nil || state.Secret != "" || state.Enabled() {
+		t.Fatalf("expected no two-factor state, got %+v, %v", state, err)
+	}
+
+	if err := testRepo.EnableTOTP(ctx, id, []string{data.HashToken("a")}); err == nil {
+		t.Error("expected an error enabling without a secret, got nil")
+	}
+
+	if err := testRepo.SetTOTPSecret(ctx, id, "JBSWY3DPEHPK3PXP"); err != nil {
+		t.Fatalf("setTOTPSecret failed: %s", err)
+	}
+
+	if err := testRepo.EnableTOTP(ctx, id, []string{data.HashToken("a"), data.HashToken("b")}); err != nil {
+		t.Fatalf("enableTOTP failed: %s", err)
+	}
+
+	user, _ := testRepo.GetUser(ctx, id)
+	if !user.TOTPEnabled {
+		t.Error("expected the user to have two-factor authentication on")
+	}
+
+	if err := testRepo.SetTOTPSecret(ctx, id, "KRSXG5CTMVRXEZLU"); !errors.Is(err, ErrTOTPEnabled) {
+		t.Errorf("expected ErrTOTPEnabled replacing the secret, got %v", err)
+	}
+
+	if err := testRepo.UseRecoveryCode(ctx, id, data.HashToken("a")); err != nil {
+		t.Errorf("useRecoveryCode failed: %s", err)
+	}
+
+	if err := testRepo.UseRecoveryCode(ctx, id, data.HashToken("a")); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected ErrTokenNotFound for a spent code, got %v", err)
+	}
+
+	if err := testRepo.UseTOTPStep(ctx, id, 100); err != nil {
+		t.Errorf("useTOTPStep failed: %s", err)
+	}
+
+	for _, step := range []int64{100, 99} {
+		if err := testRepo.UseTOTPStep(ctx, id, step); !errors.Is(err, ErrTokenReused) {
+			t.Errorf("expected ErrTokenReused for step %d, got %v", step, err)
+		}
+	}
+
+	if err := testRepo.UseTOTPStep(ctx, id, 101); err != nil {
+		t.Errorf("expected a later step to be accepted, got %v", err)
+	}
+
+	if err := testRepo.DisableTOTP(ctx, id); err != nil {
+		t.Fatalf("disableTOTP failed: %s", err)
+	}
+
+	state, _ = testRepo.GetTOTP(ctx, id)
+	if state.Secret != "" || state.Enabled() {
+		t.Errorf("expected two-factor state to be cleared, got %+v", state)
+	}
+
+	if err := testRepo.UseRecoveryCode(ctx, id, data.HashToken("b")); !errors.Is(err, ErrTokenNotFound) {
+		t.Errorf("expected the recovery codes to be deleted, got %v", err)
+	}
+}
+
+// TestMigrationsStatus checks that TestMain left every migration applied
+func TestMigrationsStatus(t *testing.T) {
+	m, err := migrations.New(testDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	statuses, err := m.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, s := range statuses {
+		if s.AppliedAt == nil {
+			t.Errorf("expected migration %d_%s to be applied", s.Version, s.Name)
+		}
+	}
+
+	applied, err := m.Up(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(applied) != 0 {
+		t.Errorf("expected nothing to apply, got %d migrations", len(applied))
+	}
+}
@@ -1,64 +1,224 @@
 package dbrepo
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
-type TestDBRepo struct{}
+// TestDBRepo is an in-memory stand-in for PostgresDBRepo, used by the handler
+// tests. Like the real repository, it gives up as soon as the context is done.
+type TestDBRepo struct {
+	mu            sync.Mutex
+	refreshTokens map[string]*data.RefreshToken
+	tokens        map[string]*data.Token
+	totp          map[int]*data.TOTP
+	recoveryCodes map[int]map[string]bool
+	totpSteps     map[int]int64
+	images        []*data.UserImage
+	nextImageID   int
+}
+
+// TestTOTPSecret is the two-factor secret of mfa@example.com, so that tests can
+// generate codes for it.
+const TestTOTPSecret = "JBSWY3DPEHPK3PXPJBSWY3DPEHPK3PXP"
+
+// TestRecoveryCode is the one recovery code of mfa@example.com.
+const TestRecoveryCode = "abcde-fghij"
 
 func (m *TestDBRepo) Connection() *sql.DB {
 	return nil
 }
 
 // AllUsers returns all users as a slice of *data.User
-func (m *TestDBRepo) AllUsers() ([]*data.User, error) {
+func (m *TestDBRepo) AllUsers(ctx context.Context) ([]*data.User, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
 	var users []*data.User
 
 	return users, nil
 }
 
-// GetUser returns one user by id
-func (m *TestDBRepo) GetUser(id int) (*data.User, error) {
+// testUsers is the fixture that ListUsers pages through.
+var testUsers = []data.User{
+	{ID: 1, FirstName: "Admin", LastName: "User", Email: "admin@example.com", IsAdmin: 1, CreatedAt: time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC)},
+	{ID: 2, FirstName: "Jack", LastName: "Smith", Email: "jack@example.com", CreatedAt: time.Date(2022, 9, 1, 0, 0, 0, 0, time.UTC)},
+	{ID: 3, FirstName: "Jill", LastName: "Smith", Email: "jill@example.com", CreatedAt: time.Date(2022, 9, 2, 0, 0, 0, 0, time.UTC)},
+	{ID: 4, FirstName: "John", LastName: "Doe", Email: "john@example.com", CreatedAt: time.Date(2023, 1, 15, 0, 0, 0, 0, time.UTC)},
+}
+
+// ListUsers returns one page of the fixture users, applying the same filters,
+// sorting and pagination rules as PostgresDBRepo.ListUsers.
+func (m *TestDBRepo) ListUsers(ctx context.Context, q data.UserQuery) (*data.UserPage, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if err := q.Normalize(); err != nil {
+		return nil, err
+	}
 
-	var user data.User
+	var matched []*data.User
+	for i := range testUsers {
+		u := testUsers[i]
 
-	if id == 1 {
-		user = data.User{
-			ID:        1,
-			FirstName: "Admin",
-			LastName:  "User",
-			Email:     "admin@example.com",
+		if q.Email != "" && !strings.Contains(strings.ToLower(u.Email), strings.ToLower(q.Email)) {
+			continue
 		}
 
-		return &user, nil
+		if q.Name != "" && !strings.Contains(strings.ToLower(u.FirstName+" "+u.LastName), strings.ToLower(q.Name)) {
+			continue
+		}
+
+		if q.IsAdmin != nil && u.IsAdmin != *q.IsAdmin {
+			continue
+		}
+
+		if !q.CreatedAfter.IsZero() && u.CreatedAt.Before(q.CreatedAfter) {
+			continue
+		}
+
+		if !q.CreatedBefore.IsZero() && !u.CreatedAt.Before(q.CreatedBefore) {
+			continue
+		}
+
+		matched = append(matched, &u)
+	}
+
+	// less reports whether a sorts before b, by the sort field and then by id
+	less := func(a, b *data.User) bool {
+		var cmp int
+		switch q.SortBy {
+		case "id":
+			cmp = a.ID - b.ID
+		case "created_at":
+			cmp = a.CreatedAt.Compare(b.CreatedAt)
+		default:
+			cmp = strings.Compare(userSortValue(q.SortBy, a), userSortValue(q.SortBy, b))
+		}
+		if cmp == 0 {
+			cmp = a.ID - b.ID
+		}
+		if q.SortDesc {
+			return cmp > 0
+		}
+		return cmp < 0
+	}
+
+	sort.Slice(matched, func(i, j int) bool { return less(matched[i], matched[j]) })
+
+	page := data.UserPage{Users: []*data.User{}, Total: len(matched)}
+
+	start := q.Offset
+	if q.Cursor != "" {
+		c, err := decodeUserCursor(q)
+		if err != nil {
+			return nil, err
+		}
+
+		// resume right after the row the cursor points at
+		start = len(matched)
+		for i, u := range matched {
+			if u.ID == c.ID {
+				start = i + 1
+				break
+			}
+		}
+	}
+
+	if start > len(matched) {
+		start = len(matched)
+	}
+
+	end := start + q.Limit
+	if end < len(matched) {
+		page.NextCursor = encodeUserCursor(q, matched[end-1])
+	} else {
+		end = len(matched)
+	}
+
+	page.Users = append(page.Users, matched[start:end]...)
+
+	return &page, nil
+}
+
+// testPassword is the bcrypt hash of "secret", the password of every test account.
+const testPassword = "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK"
+
+// testVerifiedAt is when the verified test accounts confirmed their email address.
+var testVerifiedAt = time.Date(2022, 8, 19, 0, 0, 0, 0, time.UTC)
+
+// testAccounts are users in particular states, that GetUser and GetUserByEmail
+// know about but ListUsers leaves out, so that the paging fixture stays the same:
+// one who hasn't verified their email address, and one who logs in with a second
+// factor.
+var testAccounts = []data.User{
+	{ID: 5, FirstName: "Una", LastName: "Verified", Email: "unverified@example.com", Password: testPassword},
+	{ID: 6, FirstName: "Mia", LastName: "Factor", Email: "mfa@example.com", Password: testPassword, EmailVerifiedAt: &testVerifiedAt},
+}
+
+// GetUser returns one user by id
+func (m *TestDBRepo) GetUser(ctx context.Context, id int) (*data.User, error) {
 
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	for _, users := range [][]data.User{testUsers, testAccounts} {
+		for _, u := range users {
+			if u.ID == id {
+				user := u
+				user.TOTPEnabled = m.totpFor(id).Enabled()
+				user.ProfilePic = m.activeImage(id)
+				return &user, nil
+			}
+		}
 	}
 
 	return nil, errors.New("user not found")
 
 }
 
-// GetUserByEmail returns one user by email address
-func (m *TestDBRepo) GetUserByEmail(email string) (*data.User, error) {
+// GetUserByEmail returns one user by email address: the admin, or one of the
+// testAccounts. They all use the password "secret".
+func (m *TestDBRepo) GetUserByEmail(ctx context.Context, email string) (*data.User, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
 
-	if email == "admin@example.com" {
+	if strings.EqualFold(email, "admin@example.com") {
 		user := data.User{
-			ID:        1,
-			Email:     "admin@example.com",
-			FirstName: "admin",
-			LastName:  "admin",
-			Password:  "$2a$14$ajq8Q7fbtFRQvXpdCq7Jcuy.Rx1h/L4J60Otx.gyNLbAYctGMJ9tK",
-			IsAdmin:   1,
-			CreatedAt: time.Now(),
-			UpdatedAt: time.Now(),
+			ID:              1,
+			Email:           "admin@example.com",
+			FirstName:       "admin",
+			LastName:        "admin",
+			Password:        testPassword,
+			IsAdmin:         1,
+			EmailVerifiedAt: &testVerifiedAt,
+			TOTPEnabled:     m.totpFor(1).Enabled(),
+			CreatedAt:       time.Now(),
+			UpdatedAt:       time.Now(),
 		}
 
 		return &user, nil
+	}
 
+	for _, u := range testAccounts {
+		if strings.EqualFold(email, u.Email) {
+			user := u
+			user.TOTPEnabled = m.totpFor(u.ID).Enabled()
+			return &user, nil
+		}
 	}
 
 	return nil, errors.New("user not found")
@@ -66,36 +226,525 @@ func (m *TestDBRepo) GetUserByEmail(email string) (*data.User, error) {
 }
 
 // UpdateUser updates one user in the database
-func (m *TestDBRepo) UpdateUser(u data.User) error {
+func (m *TestDBRepo) UpdateUser(ctx context.Context, u data.User) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
-	if u.ID == 1 {
+	if _, err := m.GetUser(ctx, u.ID); err == nil {
 		return nil
 	}
 
-	return errors.New("update failed, user found")
+	return errors.New("update failed, user not found")
+
+}
 
+// VerifyEmail records that a user has confirmed their email address.
+func (m *TestDBRepo) VerifyEmail(ctx context.Context, id int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// UnverifyEmail records that a user's email address changed, and has yet to be
+// confirmed.
+func (m *TestDBRepo) UnverifyEmail(ctx context.Context, id int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // DeleteUser deletes one user from the database, by id
-func (m *TestDBRepo) DeleteUser(id int) error {
+func (m *TestDBRepo) DeleteUser(ctx context.Context, id int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 
 	return nil
 }
 
 // InsertUser inserts a new user into the database, and returns the ID of the newly inserted row
-func (m *TestDBRepo) InsertUser(user data.User) (int, error) {
+func (m *TestDBRepo) InsertUser(ctx context.Context, user data.User) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
 
 	return 2, nil
 }
 
-// ResetPassword is the method we will use to change a user's password.
-func (m *TestDBRepo) ResetPassword(id int, password string) error {
+// ResetPassword is the method we will use to change a user's password. Every
+// refresh token the user holds is revoked along with the old password, and any
+// outstanding password reset links stop working.
+func (m *TestDBRepo) ResetPassword(ctx context.Context, id int, password string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := m.RevokeUserRefreshTokens(ctx, id); err != nil {
+		return err
+	}
+
+	return m.DeleteUserTokens(ctx, id, data.ScopePasswordReset)
+}
+
+// InsertUserImage adds an image to a user's pictures, and makes it active.
+func (m *TestDBRepo) InsertUserImage(ctx context.Context, i data.UserImage) (int, error) {
+
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, img := range m.images {
+		if img.UserID == i.UserID {
+			img.IsActive = false
+		}
+	}
+
+	m.nextImageID++
+	i.ID = m.nextImageID
+	i.IsActive = true
+	i.CreatedAt = time.Now()
+	i.UpdatedAt = i.CreatedAt
+	m.images = append(m.images, &i)
+
+	return i.ID, nil
+}
+
+// ListUserImages returns every picture of a user, newest first.
+func (m *TestDBRepo) ListUserImages(ctx context.Context, userID int) ([]*data.UserImage, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	images := []*data.UserImage{}
+	for j := len(m.images) - 1; j >= 0; j-- {
+		if m.images[j].UserID == userID {
+			img := *m.images[j]
+			images = append(images, &img)
+		}
+	}
+
+	return images, nil
+}
+
+// SetActiveUserImage makes one of a user's pictures their profile picture.
+func (m *TestDBRepo) SetActiveUserImage(ctx context.Context, userID, imageID int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.findImage(userID, imageID) < 0 {
+		return ErrImageNotFound
+	}
+
+	for _, img := range m.images {
+		if img.UserID == userID {
+			img.IsActive = img.ID == imageID
+		}
+	}
+
+	return nil
+}
+
+// DeleteUserImage deletes one of a user's pictures, and returns it.
+func (m *TestDBRepo) DeleteUserImage(ctx context.Context, userID, imageID int) (*data.UserImage, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	j := m.findImage(userID, imageID)
+	if j < 0 {
+		return nil, ErrImageNotFound
+	}
+
+	img := m.images[j]
+	m.images = append(m.images[:j], m.images[j+1:]...)
+
+	return img, nil
+}
+
+// ReleaseUserImageFile calls remove to delete the files of fileName, unless a
+// picture is still stored in them.
+func (m *TestDBRepo) ReleaseUserImageFile(ctx context.Context, fileName string, remove func(ctx context.Context) error) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, img := range m.images {
+		if img.FileName == fileName {
+			return nil
+		}
+	}
+
+	return remove(ctx)
+}
+
+// findImage returns the index of a user's picture in m.images, or -1. The
+// caller holds m.mu.
+func (m *TestDBRepo) findImage(userID, imageID int) int {
+	for j, img := range m.images {
+		if img.ID == imageID && img.UserID == userID {
+			return j
+		}
+	}
+
+	return -1
+}
+
+// activeImage returns a user's profile picture, if they have one.
+func (m *TestDBRepo) activeImage(userID int) data.UserImage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, img := range m.images {
+		if img.UserID == userID && img.IsActive {
+			return *img
+		}
+	}
+
+	return data.UserImage{}
+}
+
+// GetUserRoles returns the roles granted to a user: user 1 is an admin, user 2
+// a plain user, and everybody else holds no role at all.
+func (m *TestDBRepo) GetUserRoles(ctx context.Context, userID int) ([]*data.Role, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	switch userID {
+	case 1:
+		return []*data.Role{{
+			ID:          1,
+			Name:        data.RoleAdmin,
+			Permissions: data.AllPermissions,
+		}}, nil
+	case 2:
+		return []*data.Role{{ID: 2, Name: data.RoleUser}}, nil
+	}
+
+	return nil, nil
+}
+
+// InsertRefreshToken records a newly issued refresh token.
+func (m *TestDBRepo) InsertRefreshToken(ctx context.Context, t data.RefreshToken) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.refreshTokens == nil {
+		m.refreshTokens = make(map[string]*data.RefreshToken)
+	}
+
+	t.CreatedAt = time.Now()
+	m.refreshTokens[t.ID] = &t
+
+	return nil
+}
+
+// UseRefreshToken marks a refresh token as used, and returns it.
+func (m *TestDBRepo) UseRefreshToken(ctx context.Context, id string) (*data.RefreshToken, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	t, ok := m.refreshTokens[id]
+	if !ok {
+		return nil, ErrTokenNotFound
+	}
+
+	found := *t
+	if t.UsedAt != nil || t.RevokedAt != nil {
+		return &found, ErrTokenReused
+	}
+
+	now := time.Now()
+	t.UsedAt = &now
+	found.UsedAt = &now
+
+	return &found, nil
+}
+
+// RevokeRefreshTokenFamily revokes every refresh token in a family.
+func (m *TestDBRepo) RevokeRefreshTokenFamily(ctx context.Context, familyID string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.revokeRefreshTokens(func(t *data.RefreshToken) bool { return t.FamilyID == familyID })
+
+	return nil
+}
+
+// RevokeUserRefreshTokens revokes every refresh token issued to a user.
+func (m *TestDBRepo) RevokeUserRefreshTokens(ctx context.Context, userID int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.revokeRefreshTokens(func(t *data.RefreshToken) bool { return t.UserID == userID })
+
+	return nil
+}
+
+// revokeRefreshTokens revokes every refresh token for which match returns true.
+func (m *TestDBRepo) revokeRefreshTokens(match func(t *data.RefreshToken) bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	for _, t := range m.refreshTokens {
+		if t.RevokedAt == nil && match(t) {
+			t.RevokedAt = &now
+		}
+	}
+}
+
+// InsertToken records a newly issued single-use token.
+func (m *TestDBRepo) InsertToken(ctx context.Context, t data.Token) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.tokens == nil {
+		m.tokens = make(map[string]*data.Token)
+	}
+
+	t.Plaintext = ""
+	t.CreatedAt = time.Now()
+	m.tokens[t.Hash] = &t
+
+	return nil
+}
+
+// UseToken marks an unused, unexpired token as used, and returns it.
+func (m *TestDBRepo) UseToken(ctx context.Context, scope, plaintext string) (*data.Token, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+
+	t, ok := m.tokens[data.HashToken(plaintext)]
+	if !ok || t.Scope != scope || t.UsedAt != nil || !t.ExpiresAt.After(now) {
+		return nil, ErrTokenNotFound
+	}
+
+	t.UsedAt = &now
+	found := *t
+
+	return &found, nil
+}
+
+// DeleteUserTokens deletes every token of the given scope issued to a user.
+func (m *TestDBRepo) DeleteUserTokens(ctx context.Context, userID int, scope string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for hash, t := range m.tokens {
+		if t.UserID == userID && t.Scope == scope {
+			delete(m.tokens, hash)
+		}
+	}
+
+	return nil
+}
+
+// totpFor returns the two-factor state of a user, or nil if they never enrolled.
+// mfa@example.com starts out enrolled, with TestTOTPSecret and TestRecoveryCode.
+func (m *TestDBRepo) totpFor(userID int) *data.TOTP {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totp == nil {
+		m.totp = map[int]*data.TOTP{
+			6: {UserID: 6, Secret: TestTOTPSecret, EnabledAt: &testVerifiedAt},
+		}
+		m.recoveryCodes = map[int]map[string]bool{
+			6: {data.HashToken("abcdefghij"): true},
+		}
+	}
+
+	return m.totp[userID]
+}
+
+// GetTOTP returns a user's two-factor authentication secret.
+func (m *TestDBRepo) GetTOTP(ctx context.Context, userID int) (*data.TOTP, error) {
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	if _, err := m.GetUser(ctx, userID); err != nil {
+		return nil, err
+	}
+
+	t := m.totpFor(userID)
+	if t == nil {
+		return &data.TOTP{UserID: userID}, nil
+	}
+
+	found := *t
+
+	return &found, nil
+}
+
+// SetTOTPSecret stores the secret of a user who is enrolling.
+func (m *TestDBRepo) SetTOTPSecret(ctx context.Context, userID int, secret string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if m.totpFor(userID).Enabled() {
+		return ErrTOTPEnabled
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.totp[userID] = &data.TOTP{UserID: userID, Secret: secret}
+
+	return nil
+}
+
+// EnableTOTP turns on two-factor authentication, with new recovery codes.
+func (m *TestDBRepo) EnableTOTP(ctx context.Context, userID int, recoveryCodeHashes []string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	t := m.totpFor(userID)
+	if t == nil || t.Secret == "" || t.EnabledAt != nil {
+		return ErrTOTPEnabled
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	t.EnabledAt = &now
+
+	m.recoveryCodes[userID] = make(map[string]bool)
+	for _, hash := range recoveryCodeHashes {
+		m.recoveryCodes[userID][hash] = true
+	}
+
+	return nil
+}
+
+// DisableTOTP turns off two-factor authentication.
+func (m *TestDBRepo) DisableTOTP(ctx context.Context, userID int) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.totpFor(userID)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.totp, userID)
+	delete(m.recoveryCodes, userID)
 
 	return nil
 }
 
-// InsertUserImage inserts a user profile image into the database.
-func (m *TestDBRepo) InsertUserImage(i data.UserImage) (int, error) {
+// UseRecoveryCode spends one of a user's recovery codes, given its hash.
+func (m *TestDBRepo) UseRecoveryCode(ctx context.Context, userID int, hash string) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.totpFor(userID)
 
-	return 3, nil
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.recoveryCodes[userID][hash] {
+		return ErrTokenNotFound
+	}
+
+	delete(m.recoveryCodes[userID], hash)
+
+	return nil
+}
+
+// UseTOTPStep records that a user logged in with the TOTP code of a time step.
+func (m *TestDBRepo) UseTOTPStep(ctx context.Context, userID int, step int64) error {
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.totpSteps == nil {
+		m.totpSteps = make(map[int]int64)
+	}
+
+	if last, ok := m.totpSteps[userID]; ok && step <= last {
+		return ErrTokenReused
+	}
+
+	m.totpSteps[userID] = step
+
+	return nil
 }
@@ -1,19 +1,42 @@
 package repository
 
 import (
+	"context"
 	"database/sql"
 	"github.com/calvarado2004/go-testing-webapp/pkg/data"
 )
 
-// DatabaseRepo is the interface for the database repository
+// DatabaseRepo is the interface for the database repository. Every method
+// takes the caller's context, so that a cancelled request also cancels the query.
 type DatabaseRepo interface {
 	Connection() *sql.DB
-	AllUsers() ([]*data.User, error)
-	GetUser(id int) (*data.User, error)
-	GetUserByEmail(email string) (*data.User, error)
-	UpdateUser(u data.User) error
-	DeleteUser(id int) error
-	InsertUser(user data.User) (int, error)
-	ResetPassword(id int, password string) error
-	InsertUserImage(i data.UserImage) (int, error)
+	AllUsers(ctx context.Context) ([]*data.User, error)
+	ListUsers(ctx context.Context, q data.UserQuery) (*data.UserPage, error)
+	GetUser(ctx context.Context, id int) (*data.User, error)
+	GetUserByEmail(ctx context.Context, email string) (*data.User, error)
+	UpdateUser(ctx context.Context, u data.User) error
+	VerifyEmail(ctx context.Context, id int) error
+	UnverifyEmail(ctx context.Context, id int) error
+	DeleteUser(ctx context.Context, id int) error
+	InsertUser(ctx context.Context, user data.User) (int, error)
+	ResetPassword(ctx context.Context, id int, password string) error
+	InsertUserImage(ctx context.Context, i data.UserImage) (int, error)
+	ListUserImages(ctx context.Context, userID int) ([]*data.UserImage, error)
+	SetActiveUserImage(ctx context.Context, userID, imageID int) error
+	DeleteUserImage(ctx context.Context, userID, imageID int) (*data.UserImage, error)
+	ReleaseUserImageFile(ctx context.Context, fileName string, remove func(ctx context.Context) error) error
+	GetUserRoles(ctx context.Context, userID int) ([]*data.Role, error)
+	InsertRefreshToken(ctx context.Context, t data.RefreshToken) error
+	UseRefreshToken(ctx context.Context, id string) (*data.RefreshToken, error)
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string) error
+	RevokeUserRefreshTokens(ctx context.Context, userID int) error
+	InsertToken(ctx context.Context, t data.Token) error
+	UseToken(ctx context.Context, scope, plaintext string) (*data.Token, error)
+	DeleteUserTokens(ctx context.Context, userID int, scope string) error
+	GetTOTP(ctx context.Context, userID int) (*data.TOTP, error)
+	SetTOTPSecret(ctx context.Context, userID int, secret string) error
+	EnableTOTP(ctx context.Context, userID int, recoveryCodeHashes []string) error
+	DisableTOTP(ctx context.Context, userID int) error
+	UseRecoveryCode(ctx context.Context, userID int, hash string) error
+	UseTOTPStep(ctx context.Context, userID int, step int64) error
 }
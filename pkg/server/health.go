@@ -0,0 +1,57 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// pingTimeout bounds the dependency checks of a readiness probe.
+const pingTimeout = 2 * time.Second
+
+// Health serves the liveness and readiness probes of a server.
+type Health struct {
+	// Ping checks the dependencies the server can't serve requests without,
+	// typically the database. Nil means there are none.
+	Ping func(ctx context.Context) error
+
+	draining atomic.Bool
+}
+
+// Drain makes readiness probes fail from now on, so that load balancers stop
+// sending requests while the server shuts down.
+func (h *Health) Drain() {
+	h.draining.Store(true)
+}
+
+// Live answers liveness probes: the process is up and serving.
+func (h *Health) Live(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.Write([]byte("ok\n"))
+}
+
+// Ready answers readiness probes: the server isn't shutting down, and its
+// dependencies answer.
+func (h *Health) Ready(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+
+	if h.draining.Load() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte("shutting down\n"))
+		return
+	}
+
+	if h.Ping != nil {
+		ctx, cancel := context.WithTimeout(r.Context(), pingTimeout)
+		defer cancel()
+
+		if err := h.Ping(ctx); err != nil {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			_, _ = w.Write([]byte("not ready\n"))
+			return
+		}
+	}
+
+	_, _ = w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,88 @@
+// Package server runs the HTTP servers of the web app and the API: with
+// timeouts, liveness and readiness probes, and a graceful shutdown that
+// drains in-flight requests.
+package server
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+)
+
+// readHeaderTimeout bounds how long a client may take to send its headers,
+// whatever the other timeouts are.
+const readHeaderTimeout = 5 * time.Second
+
+// Config holds the timeouts of a server.
+type Config struct {
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+}
+
+// RegisterFlags defines a flag for each timeout in fs, with defaults suited to
+// uploads of a few megabytes.
+func (c *Config) RegisterFlags(fs *flag.FlagSet) {
+	fs.DurationVar(&c.ReadTimeout, "read-timeout", 30*time.Second, "longest time to read a request, body included")
+	fs.DurationVar(&c.WriteTimeout, "write-timeout", 30*time.Second, "longest time to write a response")
+	fs.DurationVar(&c.IdleTimeout, "idle-timeout", 2*time.Minute, "how long idle keep-alive connections are kept open")
+	fs.DurationVar(&c.ShutdownTimeout, "shutdown-timeout", 30*time.Second, "how long to wait for in-flight requests on shutdown")
+}
+
+// Run listens on addr and serves handler until ctx is done, see Serve.
+func Run(ctx context.Context, addr string, handler http.Handler, cfg Config, health *Health, logger *slog.Logger) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return Serve(ctx, l, handler, cfg, health, logger)
+}
+
+// Serve serves handler on l until ctx is done. It then marks health as
+// draining, so that readiness probes fail, stops accepting connections, and
+// waits up to cfg.ShutdownTimeout for in-flight requests to finish.
+func Serve(ctx context.Context, l net.Listener, handler http.Handler, cfg Config, health *Health, logger *slog.Logger) error {
+	srv := &http.Server{
+		Handler:           handler,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: readHeaderTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		ErrorLog:          slog.NewLogLogger(logger.Handler(), slog.LevelError),
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(l)
+	}()
+
+	logger.Info("listening", "addr", l.Addr().String())
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("shutting down, draining in-flight requests", "timeout", cfg.ShutdownTimeout)
+	health.Drain()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		return err
+	}
+
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
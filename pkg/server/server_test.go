@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	var tests = []struct {
+		name          string
+		ping          func(ctx context.Context) error
+		drain         bool
+		expectedReady int
+	}{
+		{"no dependencies", nil, false, http.StatusOK},
+		{"database up", func(ctx context.Context) error { return nil }, false, http.StatusOK},
+		{"database down", func(ctx context.Context) error { return errors.New("connection refused") }, false, http.StatusServiceUnavailable},
+		{"draining", func(ctx context.Context) error { return nil }, true, http.StatusServiceUnavailable},
+	}
+
+	for _, e := range tests {
+		h := &Health{Ping: e.ping}
+		if e.drain {
+			h.Drain()
+		}
+
+		req, _ := http.NewRequest("GET", "/readyz", nil)
+		rr := httptest.NewRecorder()
+		h.Ready(rr, req)
+
+		if rr.Code != e.expectedReady {
+			t.Errorf("%s: expected readiness %d, got %d", e.name, e.expectedReady, rr.Code)
+		}
+
+		// the process stays live whatever its dependencies do
+		rr = httptest.NewRecorder()
+		h.Live(rr, req)
+
+		if rr.Code != http.StatusOK {
+			t.Errorf("%s: expected liveness 200, got %d", e.name, rr.Code)
+		}
+	}
+}
+
+func TestServeDrainsInFlightRequests(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		_, _ = w.Write([]byte("done"))
+	})
+
+	health := &Health{}
+	cfg := Config{ReadTimeout: time.Second, WriteTimeout: 5 * time.Second, IdleTimeout: time.Second, ShutdownTimeout: 5 * time.Second}
+	logger := slog.New(slog.NewTextHandler(io.Discard, nil))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- Serve(ctx, l, handler, cfg, health, logger)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	responses := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String())
+		if err != nil {
+			responses <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		responses <- result{string(body), err}
+	}()
+
+	<-started
+	cancel()
+
+	// shutting down, but waiting for the request in flight
+	select {
+	case err := <-served:
+		t.Fatalf("expected Serve to wait for the request in flight, it returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	req, _ := http.NewRequest("GET", "/readyz", nil)
+	rr := httptest.NewRecorder()
+	health.Ready(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected readiness to fail while draining, got %d", rr.Code)
+	}
+
+	close(release)
+
+	if r := <-responses; r.err != nil || r.body != "done" {
+		t.Errorf("expected the request in flight to complete, got %q, %v", r.body, r.err)
+	}
+
+	if err := <-served; err != nil {
+		t.Errorf("expected a clean shutdown, got %v", err)
+	}
+
+	if _, err := http.Get("http://" + l.Addr().String()); err == nil {
+		t.Error("expected new connections to be refused after shutdown")
+	}
+}
@@ -0,0 +1,174 @@
+// Package sessions keeps the sessions of the web app in Postgres, so that they
+// outlive a restart and are shared by every instance of the app.
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/alexedwards/scs/v2"
+)
+
+// dbTimeout bounds every query of PostgresStore.
+const dbTimeout = 3 * time.Second
+
+// PostgresStore is an scs session store on the sessions table.
+type PostgresStore struct {
+	DB *sql.DB
+
+	// UserID returns the id of the user the session data b is signed in as, or
+	// 0. It is stored with the session, so that the sessions of a user can be
+	// found without reading every session; see UserSessionsCtx.
+	UserID func(b []byte) int
+}
+
+var (
+	_ scs.CtxStore         = (*PostgresStore)(nil)
+	_ scs.IterableStore    = (*PostgresStore)(nil)
+	_ scs.IterableCtxStore = (*PostgresStore)(nil)
+)
+
+// FindCtx returns the data of the session token, unless it has expired.
+func (s *PostgresStore) FindCtx(ctx context.Context, token string) ([]byte, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	query := `select data from sessions where token = $1 and expiry > $2`
+
+	var b []byte
+	err := s.DB.QueryRowContext(ctx, query, token, time.Now().UTC()).Scan(&b)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return b, true, nil
+}
+
+// CommitCtx saves the data of the session token, replacing what was there.
+func (s *PostgresStore) CommitCtx(ctx context.Context, token string, b []byte, expiry time.Time) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	var userID sql.NullInt64
+	if s.UserID != nil {
+		if id := s.UserID(b); id != 0 {
+			userID = sql.NullInt64{Int64: int64(id), Valid: true}
+		}
+	}
+
+	stmt := `insert into sessions (token, data, expiry, user_id) values ($1, $2, $3, $4)
+		on conflict (token) do update set data = excluded.data, expiry = excluded.expiry, user_id = excluded.user_id`
+
+	_, err := s.DB.ExecContext(ctx, stmt, token, b, expiry.UTC(), userID)
+
+	return err
+}
+
+// DeleteCtx removes the session token, if it exists.
+func (s *PostgresStore) DeleteCtx(ctx context.Context, token string) error {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	_, err := s.DB.ExecContext(ctx, `delete from sessions where token = $1`, token)
+
+	return err
+}
+
+// AllCtx returns the data of every session that hasn't expired, by token.
+func (s *PostgresStore) AllCtx(ctx context.Context) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return s.query(ctx, `select token, data from sessions where expiry > $1`, time.Now().UTC())
+}
+
+// UserSessionsCtx returns the data of every session of userID that hasn't
+// expired, by token. Only sessions committed with a UserID function are found.
+func (s *PostgresStore) UserSessionsCtx(ctx context.Context, userID int) (map[string][]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	return s.query(ctx, `select token, data from sessions where user_id = $1 and expiry > $2`, userID, time.Now().UTC())
+}
+
+// query returns the data of the sessions query selects, by token.
+func (s *PostgresStore) query(ctx context.Context, query string, args ...any) (map[string][]byte, error) {
+	rows, err := s.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make(map[string][]byte)
+	for rows.Next() {
+		var token string
+		var b []byte
+		if err := rows.Scan(&token, &b); err != nil {
+			return nil, err
+		}
+		sessions[token] = b
+	}
+
+	return sessions, rows.Err()
+}
+
+// Find is FindCtx without a context.
+func (s *PostgresStore) Find(token string) ([]byte, bool, error) {
+	return s.FindCtx(context.Background(), token)
+}
+
+// Commit is CommitCtx without a context.
+func (s *PostgresStore) Commit(token string, b []byte, expiry time.Time) error {
+	return s.CommitCtx(context.Background(), token, b, expiry)
+}
+
+// Delete is DeleteCtx without a context.
+func (s *PostgresStore) Delete(token string) error {
+	return s.DeleteCtx(context.Background(), token)
+}
+
+// All is AllCtx without a context.
+func (s *PostgresStore) All() (map[string][]byte, error) {
+	return s.AllCtx(context.Background())
+}
+
+// DeleteExpired removes the sessions that expired before now, and returns how
+// many there were.
+func (s *PostgresStore) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	ctx, cancel := context.WithTimeout(ctx, dbTimeout)
+	defer cancel()
+
+	res, err := s.DB.ExecContext(ctx, `delete from sessions where expiry <= $1`, now.UTC())
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
+
+// Cleanup deletes expired sessions every interval until ctx is done. Expired
+// sessions are never found anyway; this only keeps the table small.
+func (s *PostgresStore) Cleanup(ctx context.Context, interval time.Duration, logger *slog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			deleted, err := s.DeleteExpired(ctx, now)
+			if err != nil {
+				logger.ErrorContext(ctx, "deleting expired sessions", "error", err)
+				continue
+			}
+			logger.DebugContext(ctx, "deleted expired sessions", "count", deleted)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+//go:build integration
+
+package sessions
+
+import (
+	"context"
+	"database/sql"
+	"github.com/calvarado2004/go-testing-webapp/pkg/internal/pgtest"
+	"strings"
+	"testing"
+	"time"
+)
+
+var testDB *sql.DB
+
+// TestMain runs the tests against Postgres in a container
+func TestMain(m *testing.M) {
+	pgtest.Main(m, func(db *sql.DB) { testDB = db })
+}
+
+// TestSessionPostgresStore checks the session store against the sessions table
+func TestSessionPostgresStore(t *testing.T) {
+	ctx := context.Background()
+	store := &PostgresStore{DB: testDB}
+	now := time.Now()
+
+	if err := store.CommitCtx(ctx, "live", []byte("first"), now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	// committing again replaces the data
+	if err := store.CommitCtx(ctx, "live", []byte("second"), now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	if err := store.CommitCtx(ctx, "expired", []byte("old"), now.Add(-time.Hour)); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	if b, found, err := store.FindCtx(ctx, "live"); err != nil || !found || string(b) != "second" {
+		t.Errorf("expected the latest data of the live session, got %q %v %v", b, found, err)
+	}
+
+	if _, found, err := store.FindCtx(ctx, "expired"); err != nil || found {
+		t.Errorf("expected the expired session not to be found, got %v %v", found, err)
+	}
+
+	if _, found, err := store.FindCtx(ctx, "missing"); err != nil || found {
+		t.Errorf("expected a missing session not to be found, got %v %v", found, err)
+	}
+
+	// another instance sees the same sessions
+	other := &PostgresStore{DB: testDB}
+	all, err := other.AllCtx(ctx)
+	if err != nil {
+		t.Fatalf("listing sessions failed: %s", err)
+	}
+
+	if len(all) != 1 || string(all["live"]) != "second" {
+		t.Errorf("expected only the live session, got %v", all)
+	}
+
+	deleted, err := store.DeleteExpired(ctx, now)
+	if err != nil || deleted != 1 {
+		t.Errorf("expected the expired session to be deleted, got %d %v", deleted, err)
+	}
+
+	if err := store.DeleteCtx(ctx, "live"); err != nil {
+		t.Fatalf("delete failed: %s", err)
+	}
+
+	if _, found, _ := store.FindCtx(ctx, "live"); found {
+		t.Error("expected the deleted session to be gone")
+	}
+
+	if err := store.DeleteCtx(ctx, "missing"); err != nil {
+		t.Errorf("expected deleting a missing session to do nothing, got %s", err)
+	}
+
+	// sessions are found by the user they are signed in as
+	users := &PostgresStore{DB: testDB, UserID: func(b []byte) int {
+		if strings.HasPrefix(string(b), "user 7") {
+			return 7
+		}
+		return 0
+	}}
+
+	for token, b := range map[string]string{"seven": "user 7", "anonymous": "nobody"} {
+		if err := users.CommitCtx(ctx, token, []byte(b), now.Add(time.Hour)); err != nil {
+			t.Fatalf("commit failed: %s", err)
+		}
+	}
+
+	found, err := users.UserSessionsCtx(ctx, 7)
+	if err != nil || len(found) != 1 || string(found["seven"]) != "user 7" {
+		t.Errorf("expected the session of user 7, got %v %v", found, err)
+	}
+
+	// signing out clears the user
+	if err := users.CommitCtx(ctx, "seven", []byte("signed out"), now.Add(time.Hour)); err != nil {
+		t.Fatalf("commit failed: %s", err)
+	}
+
+	if found, _ := users.UserSessionsCtx(ctx, 7); len(found) != 0 {
+		t.Errorf("expected no sessions of user 7, got %v", found)
+	}
+}
@@ -0,0 +1,189 @@
+package storage
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Local keeps objects as files under Dir. It suits a single instance, or
+// several that share a volume. Its Handler serves the objects at BaseURL.
+type Local struct {
+	Dir string
+	// BaseURL is where Handler is mounted, such as "/media".
+	BaseURL string
+	// Secret signs the URLs returned by SignedURL. Without one, URLs are not
+	// signed, and Handler serves every object to everybody.
+	Secret []byte
+
+	// now returns the current time; tests replace it.
+	now func() time.Time
+}
+
+func (l *Local) clock() time.Time {
+	if l.now == nil {
+		return time.Now()
+	}
+
+	return l.now()
+}
+
+// path returns the file that holds key.
+func (l *Local) path(key string) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+
+	return filepath.Join(l.Dir, filepath.FromSlash(key)), nil
+}
+
+// Put writes the object through a temporary file, so that readers never see a
+// partial one.
+func (l *Local) Put(ctx context.Context, key string, r io.Reader, contentType string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(path), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := io.Copy(f, r); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(f.Name(), 0o644); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), path)
+}
+
+// Get opens the object.
+func (l *Local) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	path, err := l.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	f, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, ErrNotFound
+	}
+
+	return f, err
+}
+
+// Delete removes the object.
+func (l *Local) Delete(ctx context.Context, key string) error {
+	path, err := l.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err = os.Remove(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// SignedURL returns the URL of the object under BaseURL, signed with Secret if
+// there is one.
+func (l *Local) SignedURL(ctx context.Context, key string, expires time.Duration) (string, error) {
+	if err := validateKey(key); err != nil {
+		return "", err
+	}
+
+	u := strings.TrimSuffix(l.BaseURL, "/") + "/" + (&url.URL{Path: key}).EscapedPath()
+	if len(l.Secret) == 0 {
+		return u, nil
+	}
+
+	exp := strconv.FormatInt(l.clock().Add(expires).Unix(), 10)
+
+	return u + "?expires=" + exp + "&signature=" + l.sign(key, exp), nil
+}
+
+// sign returns the signature of key, valid until the unix time exp.
+func (l *Local) sign(key, exp string) string {
+	mac := hmac.New(sha256.New, l.Secret)
+	mac.Write([]byte(key + "\n" + exp))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Handler serves objects, with the request path, relative to where it is
+// mounted, as the key. Requests must carry a valid signature if there is a Secret.
+func (l *Local) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/")
+
+		if len(l.Secret) > 0 {
+			exp := r.URL.Query().Get("expires")
+			unix, err := strconv.ParseInt(exp, 10, 64)
+			if err != nil || l.clock().Unix() > unix ||
+				!hmac.Equal([]byte(r.URL.Query().Get("signature")), []byte(l.sign(key, exp))) {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+		}
+
+		path, err := l.path(key)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		defer f.Close()
+
+		info, err := f.Stat()
+		if err != nil || info.IsDir() {
+			http.NotFound(w, r)
+			return
+		}
+
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		http.ServeContent(w, r, info.Name(), info.ModTime(), f)
+	})
+}
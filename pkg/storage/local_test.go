@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocal(t *testing.T) {
+	ctx := context.Background()
+	l := &Local{Dir: t.TempDir(), BaseURL: "/media"}
+
+	if err := l.Put(ctx, "avatars/a.png", strings.NewReader("picture"), "image/png"); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, err := l.Get(ctx, "avatars/a.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(rc)
+	rc.Close()
+
+	if string(data) != "picture" {
+		t.Errorf("expected picture, got %q", data)
+	}
+
+	if u, _ := l.SignedURL(ctx, "avatars/a.png", time.Minute); u != "/media/avatars/a.png" {
+		t.Errorf("expected an unsigned URL without a secret, got %s", u)
+	}
+
+	if err := l.Delete(ctx, "avatars/a.png"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l.Get(ctx, "avatars/a.png"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound, got %v", err)
+	}
+
+	if err := l.Delete(ctx, "avatars/a.png"); err != nil {
+		t.Errorf("expected deleting a missing key to succeed, got %v", err)
+	}
+
+	for _, key := range []string{"", "/etc/passwd", "../secret", "a/../../b", `a\b`} {
+		if err := l.Put(ctx, key, strings.NewReader("x"), ""); err != ErrInvalidKey {
+			t.Errorf("%q: expected ErrInvalidKey, got %v", key, err)
+		}
+	}
+}
+
+func TestLocal_Handler(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+
+	l := &Local{Dir: t.TempDir(), BaseURL: "/media", Secret: []byte("secret")}
+	l.now = func() time.Time { return now }
+
+	_ = l.Put(ctx, "a.png", strings.NewReader("picture"), "image/png")
+
+	signed, err := l.SignedURL(ctx, "a.png", time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u, _ := url.Parse(signed)
+	tampered := strings.Replace(signed, "signature=", "signature=0", 1)
+
+	var tests = []struct {
+		name           string
+		url            string
+		after          time.Duration
+		expectedStatus int
+	}{
+		{"signed", signed, 0, http.StatusOK},
+		{"unsigned", u.Path, 0, http.StatusForbidden},
+		{"tampered", tampered, 0, http.StatusForbidden},
+		{"expired", signed, 2 * time.Minute, http.StatusForbidden},
+	}
+
+	for _, e := range tests {
+		l.now = func() time.Time { return now.Add(e.after) }
+
+		req := httptest.NewRequest("GET", e.url, nil)
+		rr := httptest.NewRecorder()
+
+		http.StripPrefix("/media", l.Handler()).ServeHTTP(rr, req)
+
+		if rr.Code != e.expectedStatus {
+			t.Errorf("%s: expected status %d, got %d", e.name, e.expectedStatus, rr.Code)
+		}
+	}
+}
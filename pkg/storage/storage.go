@@ -0,0 +1,49 @@
+// Package storage keeps uploaded files, such as profile pictures, in a blob
+// store, so that every replica of the web app sees the same files. Local keeps
+// them on disk, and S3 in any S3-compatible object store.
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned for keys that hold nothing.
+	ErrNotFound = errors.New("storage: object not found")
+	// ErrInvalidKey is returned for keys that are empty, absolute, or that
+	// climb out of the store with "..".
+	ErrInvalidKey = errors.New("storage: invalid key")
+)
+
+// Storage is a blob store. Keys are slash-separated relative paths, such as
+// "avatars/abc.png".
+type Storage interface {
+	// Put stores the content of r under key, replacing what was there.
+	Put(ctx context.Context, key string, r io.Reader, contentType string) error
+	// Get returns the content stored under key; the caller closes it.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete removes key. Deleting a missing key is not an error.
+	Delete(ctx context.Context, key string) error
+	// SignedURL returns a URL that serves key to anyone holding it, until
+	// expires has passed.
+	SignedURL(ctx context.Context, key string, expires time.Duration) (string, error)
+}
+
+// validateKey checks that key is a clean, relative path.
+func validateKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || strings.Contains(key, `\`) {
+		return ErrInvalidKey
+	}
+
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ErrInvalidKey
+		}
+	}
+
+	return nil
+}